@@ -0,0 +1,216 @@
+// Package audit records the changes kcd makes to KCD resources, workloads and services in
+// an append-only audit log.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// Sources of changes.
+const (
+	SourceSyncer  = "syncer"
+	SourceAPI     = "api"
+	SourceWebhook = "webhook"
+	SourceCLI     = "cli"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionPatchPodSpec           = "PatchPodSpec"
+	ActionUpdateServiceSelector  = "UpdateServiceSelector"
+	ActionPatchNumReplicas       = "PatchNumReplicas"
+	ActionShiftTraffic           = "ShiftTraffic"
+	ActionUpdateStatus           = "UpdateStatus"
+	ActionUpdateSpec             = "UpdateSpec"
+	ActionVersionPolicyException = "VersionPolicyException"
+	ActionAddTags                = "AddTags"
+	ActionRemoveTags             = "RemoveTags"
+)
+
+// ActorSyncer is the actor of changes made by the syncer.
+const ActorSyncer = "kcd-syncer"
+
+// Entry is a single change recorded in the audit log.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Source    string    `json:"source"`
+	Action    string    `json:"action"`
+	Namespace string    `json:"namespace,omitempty"`
+	KCD       string    `json:"kcd,omitempty"`
+	// Target is the name of the changed object, e.g. a workload or service.
+	Target string `json:"target,omitempty"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// String returns a human readable description of the entry.
+func (e Entry) String() string {
+	s := fmt.Sprintf("%s by %s via %s", e.Action, e.Actor, e.Source)
+	if e.Target != "" {
+		s += fmt.Sprintf(" on %s", e.Target)
+	}
+	s += fmt.Sprintf(": %q -> %q", e.Old, e.New)
+	if e.Reason != "" {
+		s += fmt.Sprintf(", reason: %s", e.Reason)
+	}
+	return s
+}
+
+// Logger records audit log entries. Failing to record an entry doesn't fail the change,
+// so implementations report their own errors.
+type Logger interface {
+	Log(entry Entry)
+}
+
+// ForKCD returns an entry for a change related to the given KCD resource.
+func ForKCD(kcd *kcd1.KCD, source, actor, action string) Entry {
+	return Entry{
+		Time:      time.Now().UTC(),
+		Actor:     actor,
+		Source:    source,
+		Action:    action,
+		Namespace: kcd.Namespace,
+		KCD:       kcd.Name,
+	}
+}
+
+type nop struct{}
+
+// Log implements the Logger interface.
+func (nop) Log(Entry) {}
+
+// Nop returns a Logger that discards all entries.
+func Nop() Logger {
+	return nop{}
+}
+
+type multi []Logger
+
+// Log implements the Logger interface.
+func (m multi) Log(entry Entry) {
+	for _, l := range m {
+		l.Log(entry)
+	}
+}
+
+// Multi returns a Logger that records entries with all the given loggers.
+func Multi(loggers ...Logger) Logger {
+	return multi(loggers)
+}
+
+// JSONLogger implements the Logger interface by writing entries as JSON lines.
+type JSONLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONLogger returns a JSONLogger instance writing to w.
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{w: w}
+}
+
+// NewFileLogger returns a JSONLogger instance appending to the file at path, which is
+// created if it doesn't exist.
+func NewFileLogger(path string) (*JSONLogger, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log %s", path)
+	}
+	return NewJSONLogger(f), nil
+}
+
+// Log implements the Logger interface.
+func (jl *JSONLogger) Log(entry Entry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		glog.Errorf("Failed to encode audit log entry %+v: %v", entry, err)
+		return
+	}
+
+	jl.mu.Lock()
+	defer jl.mu.Unlock()
+	if _, err := jl.w.Write(append(data, '\n')); err != nil {
+		glog.Errorf("Failed to write audit log entry %s: %v", data, err)
+	}
+}
+
+// EventLogger implements the Logger interface by recording entries as events of the KCD
+// resource they relate to. Entries without a KCD resource are not recorded.
+type EventLogger struct {
+	recorder record.EventRecorder
+}
+
+// NewEventLogger returns an EventLogger instance.
+func NewEventLogger(cs kubernetes.Interface) *EventLogger {
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+
+	return newEventLogger(eventBroadcaster.NewRecorder(k8sscheme.Scheme, corev1.EventSource{Component: "kcd-audit"}))
+}
+
+func newEventLogger(recorder record.EventRecorder) *EventLogger {
+	return &EventLogger{recorder: recorder}
+}
+
+// Log implements the Logger interface.
+func (el *EventLogger) Log(entry Entry) {
+	if entry.KCD == "" {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		Kind:       "KCD",
+		APIVersion: kcd1.SchemeGroupVersion.String(),
+		Namespace:  entry.Namespace,
+		Name:       entry.KCD,
+	}
+	el.recorder.Event(ref, corev1.EventTypeNormal, "Audit"+entry.Action, entry.String())
+}
+
+// New returns a Logger for the given destination, which is either "stdout" or the path of
+// a file. If events is true, entries are also recorded as events using cs. Returns a no-op
+// Logger if neither is configured.
+func New(dest string, events bool, cs kubernetes.Interface) (Logger, error) {
+	var loggers []Logger
+	switch dest {
+	case "":
+	case "stdout", "-":
+		loggers = append(loggers, NewJSONLogger(os.Stdout))
+	default:
+		fl, err := NewFileLogger(dest)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		loggers = append(loggers, fl)
+	}
+	if events {
+		if cs == nil {
+			return nil, errors.New("a kubernetes client is required to record audit events")
+		}
+		loggers = append(loggers, NewEventLogger(cs))
+	}
+
+	switch len(loggers) {
+	case 0:
+		return Nop(), nil
+	case 1:
+		return loggers[0], nil
+	default:
+		return Multi(loggers...), nil
+	}
+}
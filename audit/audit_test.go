@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func testEntry() Entry {
+	kcd := &kcd1.KCD{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app"}}
+	entry := ForKCD(kcd, SourceSyncer, ActorSyncer, ActionPatchPodSpec)
+	entry.Target = "app-deployment"
+	entry.Old = "nginx:v1"
+	entry.New = "nginx:v2"
+	entry.Reason = "rollout"
+	return entry
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+
+	entry := testEntry()
+	logger.Log(entry)
+	logger.Log(entry)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %d: %s", len(lines), buf.String())
+	}
+	var decoded Entry
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatalf("failed to decode entry: %v", err)
+	}
+	if !decoded.Time.Equal(entry.Time) {
+		t.Errorf("expected time %v, got %v", entry.Time, decoded.Time)
+	}
+	decoded.Time = entry.Time
+	if decoded != entry {
+		t.Errorf("expected entry %+v, got %+v", entry, decoded)
+	}
+}
+
+func TestFileLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcd-audit")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// entries are appended across loggers, e.g. after restarts
+	for i := 0; i < 2; i++ {
+		logger, err := New(path, false, nil)
+		if err != nil {
+			t.Fatalf("failed to create logger: %v", err)
+		}
+		logger.Log(testEntry())
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	var n int
+	for scanner := bufio.NewScanner(f); scanner.Scan(); n++ {
+		if !strings.Contains(scanner.Text(), `"action":"PatchPodSpec"`) {
+			t.Errorf("unexpected audit log line: %s", scanner.Text())
+		}
+	}
+	if n != 2 {
+		t.Errorf("expected 2 entries, got %d", n)
+	}
+
+	if _, err := New(filepath.Join(dir, "missing", "audit.log"), false, nil); err == nil {
+		t.Errorf("expected error for an audit log in a missing directory")
+	}
+	if _, err := New("", true, nil); err == nil {
+		t.Errorf("expected error for audit events without a client")
+	}
+}
+
+func TestEventLogger(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	logger := newEventLogger(recorder)
+
+	logger.Log(testEntry())
+	logger.Log(Entry{Action: ActionAddTags, Source: SourceCLI})
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "AuditPatchPodSpec") || !strings.Contains(event, `"nginx:v1" -> "nginx:v2"`) {
+			t.Errorf("unexpected event %q", event)
+		}
+	default:
+		t.Fatalf("expected audit event")
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("expected no event for entries without a KCD resource, got %q", event)
+	default:
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	// a missing logger doesn't need to be checked by callers
+	FromContext(context.Background()).Log(testEntry())
+
+	var buf bytes.Buffer
+	FromContext(NewContext(context.Background(), NewJSONLogger(&buf))).Log(testEntry())
+	if buf.Len() == 0 {
+		t.Errorf("expected entry to be logged to the logger in context")
+	}
+}
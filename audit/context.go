@@ -0,0 +1,22 @@
+package audit
+
+import "context"
+
+type ctxKey int
+
+const (
+	loggerKey ctxKey = iota
+)
+
+// NewContext returns a context populated with the given logger instance.
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// FromContext returns the Logger instance stored in context, or a no-op Logger if not exists.
+func FromContext(ctx context.Context) Logger {
+	if l, has := ctx.Value(loggerKey).(Logger); has && l != nil {
+		return l
+	}
+	return Nop()
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"github.com/wish/kcd/audit"
 	"github.com/wish/kcd/events"
 	"github.com/wish/kcd/stats"
 )
@@ -9,6 +10,7 @@ import (
 type Options struct {
 	Stats    stats.Stats
 	Recorder events.Recorder
+	Audit    audit.Logger
 }
 
 // WithStats applies the stats instance as configuration.
@@ -25,11 +27,19 @@ func WithRecorder(recorder events.Recorder) func(*Options) {
 	}
 }
 
+// WithAudit applies the given audit logger as configuration.
+func WithAudit(logger audit.Logger) func(*Options) {
+	return func(opts *Options) {
+		opts.Audit = logger
+	}
+}
+
 // NewOptions returns an Options intance with defaults.
 func NewOptions() *Options {
 	return &Options{
 		Stats:    stats.NewFake(),
 		Recorder: events.NewFakeRecorder(100),
+		Audit:    audit.Nop(),
 	}
 }
 
@@ -38,5 +48,6 @@ func WithOptions(options *Options) func(*Options) {
 	return func(opts *Options) {
 		opts.Stats = options.Stats
 		opts.Recorder = options.Recorder
+		opts.Audit = options.Audit
 	}
 }
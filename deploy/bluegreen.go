@@ -3,10 +3,14 @@ package deploy
 import (
 	"context"
 	"fmt"
+	"math"
+	"sort"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/wish/kcd/audit"
+	"github.com/wish/kcd/deploy/traffic"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/registry"
@@ -15,6 +19,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 )
@@ -23,6 +28,13 @@ const (
 	// KindServieBlueGreen defines a deployment type that performs a blue-green rollout
 	// at the service level.
 	KindServieBlueGreen = "ServiceBlueGreen"
+
+	// AnnotationPreviousColour is set on the live service to the label values of the
+	// workload that was live before the most recent rollout, if it is being kept.
+	AnnotationPreviousColour = "kcd.wish.com/previous-colour"
+	// AnnotationPreviousUntil is set on the live service to the time until which the
+	// previous workload is kept.
+	AnnotationPreviousUntil = "kcd.wish.com/previous-until"
 )
 
 // InvalidTargetError indicates that a blue green deployment failed because the target workloads
@@ -48,10 +60,29 @@ type BlueGreenDeployer struct {
 	blueGreen *kcd1.BlueGreenSpec
 	version   string
 
+	// rolloutTime is the time the rollout of the version started.
+	rolloutTime time.Time
+
 	// primary is the current live workload (before the rollout) and secondary is the
 	// workload that will be updated and made live.
 	primary   TemplateRolloutTarget
 	secondary TemplateRolloutTarget
+
+	// targets contains all the blue-green workloads, of which there are at least two.
+	targets []TemplateRolloutTarget
+
+	// liveServices and verificationServices contain the names of the services that are
+	// switched to the secondary workload. The first live service determines the primary.
+	liveServices         []string
+	verificationServices []string
+
+	// router shifts traffic from the live to the verification services in steps, if
+	// defined by the blue-green spec, and weight is the percentage last shifted.
+	router traffic.Router
+	weight int
+
+	// pods contains the most recently observed pod counts of the secondary workload.
+	pods kcd1.PodsStatus
 }
 
 // NewBlueGreenDeployer returns a Deployer for performing blue-green rollouts.
@@ -64,32 +95,37 @@ func NewBlueGreenDeployer(workloadProvider workload.Provider, registryProvider r
 	if kcd.Spec.Strategy.BlueGreen == nil {
 		return nil, errors.Errorf("no blue-green spec provided for kcd resource %s", kcd.Name)
 	}
-	if kcd.Spec.Strategy.BlueGreen.ServiceName == "" {
+	liveServices := LiveServices(kcd.Spec.Strategy.BlueGreen)
+	if len(liveServices) == 0 {
 		return nil, errors.Errorf("no service defined for blue-green strategy in kcd resource %s", kcd.Name)
 	}
 	if len(kcd.Spec.Strategy.BlueGreen.LabelNames) == 0 {
 		return nil, errors.Errorf("no label names defined for blue-green strategy in kcd resource %s", kcd.Name)
 	}
 
-	targets, err := workloadProvider.Workloads(kcd, workload.TypeDeployment)
+	// any workload with a pod template and replicas can be a colour, other selected
+	// workloads such as the pods of the colours are ignored
+	targets, err := workloadProvider.Workloads(kcd)
 	if err != nil {
 		return nil, errors.Wrapf(err, "blue-green deployer failed to obtain workloads for kcd=%s", kcd.Name)
 	}
-	if len(targets) != 2 {
-		return nil, errors.Errorf("blue-green deployer for %s requires exactly 2 rollout targets, found %d", kcd.Name, len(targets))
-	}
-
 	var tTargets []TemplateRolloutTarget
 	for _, target := range targets {
 		tTarget, ok := target.(TemplateRolloutTarget)
 		if !ok {
-			glog.Errorf("BlueGreen deployer for %s requires targets of type TemplateRolloutTarget", kcd.Name)
-			return nil, &InvalidTargetError{
-				message: fmt.Sprintf("blue-green deployer for %s requires targets of type TemplateRolloutTarget", kcd.Name),
-			}
+			glog.V(4).Infof("Ignoring %s %s without pod template for blue-green rollout of kcd=%s",
+				target.Type(), target.Name(), kcd.Name)
+			continue
 		}
 		tTargets = append(tTargets, tTarget)
 	}
+	if len(tTargets) < 2 {
+		glog.Errorf("BlueGreen deployer for %s requires at least 2 targets of type TemplateRolloutTarget", kcd.Name)
+		return nil, &InvalidTargetError{
+			message: fmt.Sprintf("blue-green deployer for %s requires at least 2 rollout targets with pod templates, found %d",
+				kcd.Name, len(tTargets)),
+		}
+	}
 
 	bgd := &BlueGreenDeployer{
 		cs:               workloadProvider.Client(),
@@ -98,9 +134,24 @@ func NewBlueGreenDeployer(workloadProvider workload.Provider, registryProvider r
 		kcd:              kcd,
 		blueGreen:        kcd.Spec.Strategy.BlueGreen,
 		version:          version,
+		targets:          tTargets,
+
+		liveServices:         liveServices,
+		verificationServices: VerificationServices(kcd.Spec.Strategy.BlueGreen),
 	}
 
-	service, err := bgd.getService(kcd.Spec.Strategy.BlueGreen.ServiceName)
+	if spec := kcd.Spec.Strategy.BlueGreen.Traffic; spec != nil {
+		var dc dynamic.Interface
+		if dp, ok := workloadProvider.(workload.DynamicProvider); ok {
+			dc = dp.DynamicClient()
+		}
+		bgd.router, err = traffic.NewRouter(dc, bgd.namespace, *spec, bgd.liveServices, bgd.verificationServices)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create traffic router for kcd spec %s", kcd.Name)
+		}
+	}
+
+	service, err := bgd.getService(liveServices[0])
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to find service for kcd spec %s", kcd.Name)
 	}
@@ -113,6 +164,28 @@ func NewBlueGreenDeployer(workloadProvider workload.Provider, registryProvider r
 	return bgd, nil
 }
 
+// LiveServices returns the names of the live services of the blue-green spec.
+func LiveServices(bg *kcd1.BlueGreenSpec) []string {
+	return serviceNames(bg.ServiceName, bg.ServiceNames)
+}
+
+// VerificationServices returns the names of the verification services of the blue-green spec.
+func VerificationServices(bg *kcd1.BlueGreenSpec) []string {
+	return serviceNames(bg.VerificationServiceName, bg.VerificationServiceNames)
+}
+
+func serviceNames(name string, names []string) []string {
+	var result []string
+	seen := map[string]bool{"": true}
+	for _, n := range append([]string{name}, names...) {
+		if !seen[n] {
+			seen[n] = true
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
 // Workloads implements the Deployer interface.
 func (bgd *BlueGreenDeployer) Workloads() []workload.Workload {
 	return []workload.Workload{bgd.primary}
@@ -123,18 +196,90 @@ func (bgd *BlueGreenDeployer) AsState(next state.State) state.State {
 	return state.StateFunc(func(ctx context.Context) (state.States, error) {
 		glog.V(2).Infof("Beginning blue-green deployment for kcd=%s, version=%s, namespace=%s",
 			bgd.kcd.Name, bgd.version, bgd.namespace)
+		bgd.rolloutTime = time.Now().UTC()
+
+		soak := Soak(bgd.cs, bgd.namespace, bgd.kcd, bgd.version, []RolloutTarget{bgd.secondary}, bgd.rolloutTime,
+			bgd.retirePrevious(bgd.primary, bgd.secondary, next))
+
+		var switchLive state.State = bgd.updateServiceSelectors(bgd.liveServices, bgd.secondary, soak)
+		if bgd.router != nil {
+			switchLive = state.WithFailure(bgd.shiftTraffic(traffic.Steps(*bgd.blueGreen.Traffic), soak), bgd.resetTraffic())
+		}
 
 		return state.Single(
 			bgd.updateVersion(bgd.secondary,
 				bgd.updateVerificationServiceSelector(bgd.secondary,
 					bgd.ensureHasPods(bgd.secondary,
 						verify.NewVerifiers(bgd.cs, bgd.registryProvider, bgd.namespace, bgd.version, bgd.kcd.Spec.Strategy.Verify,
-							bgd.scaleUpSecondary(bgd.primary, bgd.secondary,
-								bgd.updateServiceSelector(bgd.blueGreen.ServiceName, bgd.secondary,
-									bgd.scaleDown(bgd.primary, next))))))))
+							bgd.scaleUpSecondary(bgd.primary, bgd.secondary, switchLive))))))
 	})
 }
 
+// VerifyStepDuration is the duration allowed for each verification of the new workload
+// while traffic is shifted to it.
+const VerifyStepDuration = 5 * time.Minute
+
+// TrafficDuration returns the duration of shifting traffic to the new workload of a
+// blue-green rollout of the KCD resource, which is watched and verified at every step
+// but the last.
+func TrafficDuration(kcd *kcd1.KCD) time.Duration {
+	bg := kcd.Spec.Strategy.BlueGreen
+	if kcd.Spec.Strategy.Kind != KindServieBlueGreen || bg == nil || bg.Traffic == nil {
+		return 0
+	}
+	step := time.Duration(bg.Traffic.StepSeconds)*time.Second +
+		time.Duration(len(kcd.Spec.Strategy.Verify))*VerifyStepDuration
+	return time.Duration(len(traffic.Steps(*bg.Traffic))-1) * step
+}
+
+// shiftTraffic shifts traffic to the verification services, which select the secondary,
+// in the given steps. The secondary is verified and its health watched after each step.
+// Instead of shifting all traffic, the final step switches the live services to the
+// secondary and stops sending traffic to the verification services.
+func (bgd *BlueGreenDeployer) shiftTraffic(steps []int, next state.State) state.State {
+	if len(steps) == 0 || steps[0] >= 100 {
+		return bgd.updateServiceSelectors(bgd.liveServices, bgd.secondary, bgd.setTrafficWeight(0, next))
+	}
+
+	stepDuration := time.Duration(bgd.blueGreen.Traffic.StepSeconds) * time.Second
+	return bgd.setTrafficWeight(steps[0],
+		verify.NewVerifiers(bgd.cs, bgd.registryProvider, bgd.namespace, bgd.version, bgd.kcd.Spec.Strategy.Verify,
+			soakFor(bgd.cs, bgd.namespace, bgd.kcd, bgd.version, []RolloutTarget{bgd.secondary}, bgd.rolloutTime, stepDuration,
+				bgd.shiftTraffic(steps[1:], next))))
+}
+
+// setTrafficWeight sends the given percentage of traffic to the verification services.
+func (bgd *BlueGreenDeployer) setTrafficWeight(percent int, next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		glog.V(1).Infof("Shifting %d%% of traffic of kcd=%s to %s", percent, bgd.kcd.Name, bgd.secondary.Name())
+
+		if err := bgd.router.SetWeight(ctx, percent); err != nil {
+			return state.Error(err)
+		}
+		auditChange(ctx, bgd.kcd, audit.ActionShiftTraffic, bgd.router.String(), fmt.Sprintf("%d%%", bgd.weight),
+			fmt.Sprintf("%d%%", percent), fmt.Sprintf("shift traffic to %s", bgd.secondary.Name()))
+		bgd.weight = percent
+
+		return state.Single(next)
+	}
+}
+
+// resetTraffic stops sending traffic to the verification services if the rollout fails.
+func (bgd *BlueGreenDeployer) resetTraffic() state.OnFailureFunc {
+	return func(ctx context.Context, err error) state.States {
+		glog.V(1).Infof("Shifting traffic of kcd=%s back from %s after failure: %v", bgd.kcd.Name, bgd.secondary.Name(), err)
+		// the context of the failed operation may have expired already
+		if err := bgd.router.SetWeight(context.TODO(), 0); err != nil {
+			glog.Errorf("Failed to shift traffic of kcd=%s back from %s: %v", bgd.kcd.Name, bgd.secondary.Name(), err)
+			return state.NewStates()
+		}
+		auditChange(ctx, bgd.kcd, audit.ActionShiftTraffic, bgd.router.String(), fmt.Sprintf("%d%%", bgd.weight),
+			"0%", "rollout failed")
+		bgd.weight = 0
+		return state.NewStates()
+	}
+}
+
 // getService returns the service with the given name.
 func (bgd *BlueGreenDeployer) getService(serviceName string) (*corev1.Service, error) {
 	service, err := bgd.cs.CoreV1().Services(bgd.namespace).Get(context.TODO(), serviceName, metav1.GetOptions{})
@@ -145,28 +290,112 @@ func (bgd *BlueGreenDeployer) getService(serviceName string) (*corev1.Service, e
 	return service, nil
 }
 
-// getBlueGreenTargets returns the primary and secondary rollout targets based on whether
-// the live service (as specified) is currently selecting them.
+// getBlueGreenTargets returns the primary and secondary rollout targets. The primary is
+// the target the live service is currently selecting, either by its whole selector or
+// by the values of the label names. The secondary is chosen from the remaining targets,
+// preferring one that already runs the version, then one that isn't the previous target
+// kept for rollbacks, then the one with the fewest replicas.
 func (bgd *BlueGreenDeployer) getBlueGreenTargets(service *corev1.Service,
 	targets []TemplateRolloutTarget) (primary, secondary TemplateRolloutTarget, err error) {
 
+	primary, err = bgd.livePrimary(service, targets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous := service.Annotations[AnnotationPreviousColour]
+
+	type candidate struct {
+		target   TemplateRolloutTarget
+		current  bool
+		previous bool
+		replicas int32
+	}
+	var candidates []candidate
+	for _, target := range targets {
+		if target == primary {
+			continue
+		}
+		// the version is only a preference, the patch of the pod spec fails later if invalid
+		current, err := workload.CheckPodSpecVersion(target.PodSpec(), bgd.kcd, bgd.version)
+		if err != nil {
+			glog.V(2).Infof("Failed to check version of blue-green target %s: %v", target.Name(), err)
+		}
+		numReplicas, err := target.NumReplicas()
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get num replicas for target %s", target.Name())
+		}
+		candidates = append(candidates, candidate{
+			target:   target,
+			current:  current,
+			previous: previous != "" && bgd.colour(target).String() == previous,
+			replicas: numReplicas,
+		})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch {
+		case a.current != b.current:
+			return a.current
+		case a.previous != b.previous:
+			return b.previous
+		case a.replicas != b.replicas:
+			return a.replicas < b.replicas
+		}
+		return a.target.Name() < b.target.Name()
+	})
+
+	return primary, candidates[0].target, nil
+}
+
+// livePrimary returns the target that is selected by the live service.
+func (bgd *BlueGreenDeployer) livePrimary(service *corev1.Service, targets []TemplateRolloutTarget) (TemplateRolloutTarget, error) {
+	var matches []TemplateRolloutTarget
 	selector := labels.Set(service.Spec.Selector).AsSelector()
 	for _, target := range targets {
-		ptLabels := labels.Set(target.PodTemplateSpec().Labels)
-		if selector.Matches(ptLabels) {
-			if primary != nil {
-				return nil, nil, errors.Errorf("unexpected state: found 2 primary blue-green workloads for kcd spec %s", bgd.kcd.Name)
-			}
-			primary = target
-		} else {
-			if secondary != nil {
-				return nil, nil, errors.Errorf("unexpected state: found 2 secondary blue-green workloads for kcd spec %s", bgd.kcd.Name)
-			}
-			secondary = target
+		if selector.Matches(labels.Set(target.PodTemplateSpec().Labels)) {
+			matches = append(matches, target)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+
+	// fall back to the values of the label names, in case the service selects on other
+	// labels the pod templates don't define, or matches several targets
+	serviceColour := labels.Set{}
+	for _, labelName := range bgd.blueGreen.LabelNames {
+		value, has := service.Spec.Selector[labelName]
+		if !has {
+			return nil, errors.Errorf("unexpected state: found %d primary blue-green workloads for kcd spec %s",
+				len(matches), bgd.kcd.Name)
+		}
+		serviceColour[labelName] = value
+	}
+	matches = nil
+	for _, target := range targets {
+		if labels.Equals(bgd.colour(target), serviceColour) {
+			matches = append(matches, target)
 		}
 	}
+	if len(matches) != 1 {
+		return nil, errors.Errorf("unexpected state: found %d primary blue-green workloads with labels %s for kcd spec %s",
+			len(matches), serviceColour, bgd.kcd.Name)
+	}
+	return matches[0], nil
+}
 
-	return primary, secondary, nil
+// colour returns the values of the label names of the target's pod template.
+func (bgd *BlueGreenDeployer) colour(target TemplateRolloutTarget) labels.Set {
+	podLabels := target.PodTemplateSpec().Labels
+	colour := labels.Set{}
+	for _, labelName := range bgd.blueGreen.LabelNames {
+		if value, has := podLabels[labelName]; has {
+			colour[labelName] = value
+		}
+	}
+	return colour
 }
 
 // updateVersion patches the container version of the given rollout target.
@@ -184,6 +413,8 @@ func (bgd *BlueGreenDeployer) updateVersion(target TemplateRolloutTarget, next s
 							bgd.version, target.Name(), updateErr)
 						return updateErr
 					}
+					auditChange(ctx, bgd.kcd, audit.ActionPatchPodSpec, target.Name(), c.Image,
+						bgd.kcd.Spec.ImageRepo+":"+bgd.version, "blue-green rollout")
 				}
 			}
 			return nil
@@ -198,51 +429,93 @@ func (bgd *BlueGreenDeployer) updateVersion(target TemplateRolloutTarget, next s
 	}
 }
 
-// updateVerificationServiceSelector updates the verification service defined in the KCD
+// updateVerificationServiceSelector updates the verification services defined in the KCD
 // to point to the given rollout target.
 func (bgd *BlueGreenDeployer) updateVerificationServiceSelector(target TemplateRolloutTarget, next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
-		if bgd.kcd.Spec.Strategy.BlueGreen.VerificationServiceName == "" {
+		if len(bgd.verificationServices) == 0 {
 			glog.V(1).Infof("No test service defined for kcd spec %s", bgd.kcd.Name)
 			return state.Single(next)
 		}
 
-		return state.Single(bgd.updateServiceSelector(bgd.blueGreen.VerificationServiceName, target, next))
+		return state.Single(bgd.updateServiceSelectors(bgd.verificationServices, target, next))
 	}
 }
 
-// updateServiceSelector updates the selector of the service with the given name to point to
-// the current rollout target, based on the label names defined in the KCD.
-func (bgd *BlueGreenDeployer) updateServiceSelector(serviceName string, target TemplateRolloutTarget,
+// updateServiceSelectors updates the selectors of the services with the given names to point
+// to the current rollout target, based on the label names defined in the KCD.
+func (bgd *BlueGreenDeployer) updateServiceSelectors(serviceNames []string, target TemplateRolloutTarget,
 	next state.State) state.StateFunc {
 
 	return func(ctx context.Context) (state.States, error) {
-		labelNames := bgd.kcd.Spec.Strategy.BlueGreen.LabelNames
+		if err := bgd.switchServices(ctx, serviceNames, target, fmt.Sprintf("switch to %s", target.Name())); err != nil {
+			return state.Error(err)
+		}
+		return state.Single(next)
+	}
+}
 
+// switchServices updates the selectors of the services with the given names to point to
+// the target, based on the label names defined in the KCD. The services are switched
+// together: all of them are checked before any is updated, and the services already
+// switched are switched back if updating one fails.
+func (bgd *BlueGreenDeployer) switchServices(ctx context.Context, serviceNames []string, target TemplateRolloutTarget,
+	reason string) error {
+
+	selector := labels.Set{}
+	for _, labelName := range bgd.blueGreen.LabelNames {
+		targetLabel, has := target.PodTemplateSpec().Labels[labelName]
+		if !has {
+			return errors.Errorf("pod template spec for target %s is missing label name %s in kcd spec %s",
+				target.Name(), labelName, bgd.kcd.Name)
+		}
+		selector[labelName] = targetLabel
+	}
+
+	var services []*corev1.Service
+	for _, serviceName := range serviceNames {
 		service, err := bgd.getService(serviceName)
 		if err != nil {
-			return state.Error(errors.Wrapf(err, "failed to find test service for kcd spec %s", bgd.kcd.Name))
+			return errors.Wrapf(err, "failed to find test service for kcd spec %s", bgd.kcd.Name)
 		}
+		services = append(services, service)
+	}
 
-		for _, labelName := range labelNames {
-			targetLabel, has := target.PodTemplateSpec().Labels[labelName]
-			if !has {
-				return state.Error(errors.Errorf("pod template spec for target %s is missing label name %s in kcd spec %s",
-					target.Name(), labelName, bgd.kcd.Name))
-			}
+	var switched []*corev1.Service
+	for _, service := range services {
+		oldSelector := labels.Set(service.Spec.Selector)
+		updated := service.DeepCopy()
+		updated.Spec.Selector = labels.Merge(oldSelector, selector)
+
+		glog.V(2).Infof("Updating service %s with selectors %v", service.Name, updated.Spec.Selector)
 
-			service.Spec.Selector[labelName] = targetLabel
+		// TODO: is update appropriate?
+		result, err := bgd.cs.CoreV1().Services(bgd.namespace).Update(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			bgd.revertServices(ctx, switched, services)
+			return errors.Wrapf(err, "failed to update test service %s while processing blue-green deployment for %s",
+				service.Name, bgd.kcd.Name)
 		}
+		auditChange(ctx, bgd.kcd, audit.ActionUpdateServiceSelector, service.Name, oldSelector.String(),
+			labels.Set(updated.Spec.Selector).String(), reason)
+		switched = append(switched, result)
+	}
 
-		glog.V(2).Infof("Updating service %s with selectors %v", serviceName, service.Spec.Selector)
+	return nil
+}
 
-		// TODO: is update appropriate?
+// revertServices restores the selectors of the switched services to those of the original
+// services with the same names, after switching a group of services failed.
+func (bgd *BlueGreenDeployer) revertServices(ctx context.Context, switched, original []*corev1.Service) {
+	for i, service := range switched {
+		oldSelector := labels.Set(service.Spec.Selector).String()
+		service.Spec.Selector = original[i].Spec.Selector
 		if _, err := bgd.cs.CoreV1().Services(bgd.namespace).Update(context.TODO(), service, metav1.UpdateOptions{}); err != nil {
-			return state.Error(errors.Wrapf(err, "failed to update test service %s while processing blue-green deployment for %s",
-				service.Name, bgd.kcd.Name))
+			glog.Errorf("Failed to revert selector of service %s for kcd=%s: %v", service.Name, bgd.kcd.Name, err)
+			continue
 		}
-
-		return state.Single(next)
+		auditChange(ctx, bgd.kcd, audit.ActionUpdateServiceSelector, service.Name, oldSelector,
+			labels.Set(service.Spec.Selector).String(), "revert failed switch")
 	}
 }
 
@@ -265,6 +538,7 @@ func (bgd *BlueGreenDeployer) ensureHasPods(target TemplateRolloutTarget, next s
 			if err != nil {
 				return state.Error(errors.Wrapf(err, "failed to patch number of replicas for target %s", target.Name()))
 			}
+			auditChange(ctx, bgd.kcd, audit.ActionPatchNumReplicas, target.Name(), "0", "1", "ensure pods for verification")
 		}
 
 		return state.Single(bgd.waitForAllPods(target, next))
@@ -275,7 +549,7 @@ func (bgd *BlueGreenDeployer) ensureHasPods(target TemplateRolloutTarget, next s
 // version, and starts polling if not the case.
 func (bgd *BlueGreenDeployer) waitForAllPods(target TemplateRolloutTarget, next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
-		ok, err := bgd.checkPods(target, 1)
+		ok, err := bgd.checkPods(ctx, target, 1, bgd.version)
 		if err != nil {
 			return state.Error(errors.Wrapf(err, "failed to check pods in waitForAllPods for %s", target.Name()))
 		}
@@ -287,10 +561,23 @@ func (bgd *BlueGreenDeployer) waitForAllPods(target TemplateRolloutTarget, next
 }
 
 // checkPods checks whether the target has at least num pods and that every pod
-// is the current version (as defined by this deployer) and that every container
-// within each pod is in a ready state.
-func (bgd *BlueGreenDeployer) checkPods(target TemplateRolloutTarget, num int32) (bool, error) {
-	return CheckPods(bgd.cs, bgd.namespace, target, num, bgd.kcd, bgd.version)
+// is the given version and that enough pods are ready according to the readiness
+// policy of the kcd resource.
+func (bgd *BlueGreenDeployer) checkPods(ctx context.Context, target TemplateRolloutTarget, num int32,
+	version string) (bool, error) {
+
+	counts, ok, err := CheckPods(bgd.cs, bgd.namespace, target, num, bgd.kcd, version)
+	if err != nil {
+		return false, err
+	}
+	reportPods(ctx, bgd.kcd, target, bgd.pods, counts)
+	bgd.pods = counts
+	return ok, nil
+}
+
+// Pods implements the ReportsPods interface.
+func (bgd *BlueGreenDeployer) Pods() kcd1.PodsStatus {
+	return bgd.pods
 }
 
 // scaleUpSecondary scales up the secondary deployment to be the same as the primary.
@@ -313,9 +600,11 @@ func (bgd *BlueGreenDeployer) scaleUpSecondary(primary, secondary TemplateRollou
 			if err := secondary.PatchNumReplicas(primaryNum); err != nil {
 				return state.Error(errors.Wrapf(err, "failed to patch number of replicas for secondary spec %s", secondary.Name()))
 			}
+			auditChange(ctx, bgd.kcd, audit.ActionPatchNumReplicas, secondary.Name(), fmt.Sprint(secondaryNum),
+				fmt.Sprint(primaryNum), fmt.Sprintf("match replicas of %s", primary.Name()))
 		}
 
-		ok, err := bgd.checkPods(secondary, primaryNum)
+		ok, err := bgd.checkPods(ctx, secondary, primaryNum, bgd.version)
 		if err != nil {
 			return state.Error(errors.Wrapf(err, "failed to check pods while scaling up sceondary %s", secondary.Name()))
 		}
@@ -334,9 +623,223 @@ func (bgd *BlueGreenDeployer) scaleDown(target TemplateRolloutTarget, next state
 			return state.Single(next)
 		}
 
+		numReplicas, err := target.NumReplicas()
+		if err != nil {
+			return state.Error(errors.Wrapf(err, "failed to get num replicas for target %s", target.Name()))
+		}
 		if err := target.PatchNumReplicas(0); err != nil {
 			return state.Error(errors.WithStack(err))
 		}
+		auditChange(ctx, bgd.kcd, audit.ActionPatchNumReplicas, target.Name(), fmt.Sprint(numReplicas), "0", "scale down")
+		return state.Single(next)
+	}
+}
+
+// retirePrevious retires the previously live target after a successful rollout. By default
+// it is scaled down if the blue-green spec requires it. If the previous target is kept, it
+// keeps running with the configured share of its replicas and is recorded on the live
+// service, so that a rollback only needs to switch the service selectors. A target kept
+// from an earlier rollout is scaled down instead.
+func (bgd *BlueGreenDeployer) retirePrevious(previous, live TemplateRolloutTarget, next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		keep := bgd.blueGreen.KeepPrevious
+		if keep == nil {
+			return state.Single(bgd.scaleDown(previous, next))
+		}
+
+		service, err := bgd.getService(bgd.liveServices[0])
+		if err != nil {
+			return state.Error(err)
+		}
+
+		if older := bgd.targetForColour(service.Annotations[AnnotationPreviousColour]); older != nil &&
+			older != previous && older != live && bgd.blueGreen.ScaleDown {
+			glog.V(1).Infof("Scaling down %s which was kept from an earlier rollout", older.Name())
+			if err := bgd.patchNumReplicas(ctx, older, 0, "scale down earlier previous"); err != nil {
+				return state.Error(err)
+			}
+		}
+
+		numReplicas, err := previous.NumReplicas()
+		if err != nil {
+			return state.Error(errors.Wrapf(err, "failed to get num replicas for target %s", previous.Name()))
+		}
+		percent := keep.ReplicasPercent
+		if percent <= 0 || percent > 100 {
+			percent = 100
+		}
+		keepReplicas := int32(math.Ceil(float64(numReplicas) * float64(percent) / 100))
+		if keepReplicas < 1 {
+			keepReplicas = 1
+		}
+		if keepReplicas < numReplicas {
+			glog.V(1).Infof("Keeping %d of %d replicas of previous target %s", keepReplicas, numReplicas, previous.Name())
+			if err := previous.PatchNumReplicas(keepReplicas); err != nil {
+				return state.Error(errors.Wrapf(err, "failed to patch number of replicas for target %s", previous.Name()))
+			}
+			auditChange(ctx, bgd.kcd, audit.ActionPatchNumReplicas, previous.Name(), fmt.Sprint(numReplicas),
+				fmt.Sprint(keepReplicas), "keep previous")
+		}
+
+		annotations := map[string]string{
+			AnnotationPreviousColour: bgd.colour(previous).String(),
+		}
+		if keep.Seconds > 0 {
+			annotations[AnnotationPreviousUntil] = time.Now().UTC().Add(time.Duration(keep.Seconds) * time.Second).Format(time.RFC3339)
+		}
+		if err := bgd.annotatePrevious(annotations); err != nil {
+			return state.Error(err)
+		}
+		return state.Single(next)
+	}
+}
+
+// targetForColour returns the target whose label values are the given colour, or nil if
+// there isn't one.
+func (bgd *BlueGreenDeployer) targetForColour(colour string) TemplateRolloutTarget {
+	if colour == "" {
+		return nil
+	}
+	for _, target := range bgd.targets {
+		if bgd.colour(target).String() == colour {
+			return target
+		}
+	}
+	return nil
+}
+
+// annotatePrevious replaces the annotations of the live service that record the previous
+// target with the given ones.
+func (bgd *BlueGreenDeployer) annotatePrevious(annotations map[string]string) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		service, err := bgd.getService(bgd.liveServices[0])
+		if err != nil {
+			return err
+		}
+		if service.Annotations == nil {
+			service.Annotations = map[string]string{}
+		}
+		delete(service.Annotations, AnnotationPreviousColour)
+		delete(service.Annotations, AnnotationPreviousUntil)
+		for k, v := range annotations {
+			service.Annotations[k] = v
+		}
+		_, err = bgd.cs.CoreV1().Services(bgd.namespace).Update(context.TODO(), service, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to annotate service %s with previous target", bgd.liveServices[0])
+	}
+	return nil
+}
+
+// patchNumReplicas sets the number of replicas of the target.
+func (bgd *BlueGreenDeployer) patchNumReplicas(ctx context.Context, target TemplateRolloutTarget, num int32,
+	reason string) error {
+
+	numReplicas, err := target.NumReplicas()
+	if err != nil {
+		return errors.Wrapf(err, "failed to get num replicas for target %s", target.Name())
+	}
+	if err := target.PatchNumReplicas(num); err != nil {
+		return errors.Wrapf(err, "failed to patch number of replicas for target %s", target.Name())
+	}
+	auditChange(ctx, bgd.kcd, audit.ActionPatchNumReplicas, target.Name(), fmt.Sprint(numReplicas), fmt.Sprint(num), reason)
+	return nil
+}
+
+// Housekeeping implements the Housekeeper interface. It stops keeping the previous target
+// once its keep window has passed, scaling it down if the blue-green spec requires it.
+func (bgd *BlueGreenDeployer) Housekeeping(ctx context.Context) error {
+	service, err := bgd.getService(bgd.liveServices[0])
+	if err != nil {
+		return err
+	}
+	until, has := service.Annotations[AnnotationPreviousUntil]
+	if !has {
+		return nil
+	}
+	untilTime, err := time.Parse(time.RFC3339, until)
+	if err != nil {
+		glog.Warningf("Ignoring invalid %s annotation %q of service %s", AnnotationPreviousUntil, until, service.Name)
+	} else if time.Now().Before(untilTime) {
+		return nil
+	}
+
+	if previous := bgd.targetForColour(service.Annotations[AnnotationPreviousColour]); previous != nil &&
+		previous != bgd.primary && bgd.blueGreen.ScaleDown {
+		glog.V(1).Infof("Scaling down previous target %s of kcd=%s since it was kept until %s", previous.Name(), bgd.kcd.Name, until)
+		if err := bgd.patchNumReplicas(ctx, previous, 0, "previous expired"); err != nil {
+			return err
+		}
+	}
+	return bgd.annotatePrevious(nil)
+}
+
+// Rollback implements the SupportsRollback interface. Since the previously live target is
+// still running the previous version, rolling back scales it up again if required and
+// switches the services back to it.
+func (bgd *BlueGreenDeployer) Rollback(prevVersion string, next state.State, onFailure state.OnFailure) state.State {
+	return state.StateFunc(func(ctx context.Context) (state.States, error) {
+		ok, err := workload.CheckPodSpecVersion(bgd.primary.PodSpec(), bgd.kcd, prevVersion)
+		if err != nil {
+			return onFailure.Fail(ctx, errors.Wrapf(err, "failed to check version of %s", bgd.primary.Name())), nil
+		}
+		if !ok {
+			return onFailure.Fail(ctx, errors.Errorf("previously live target %s doesn't run version %s",
+				bgd.primary.Name(), prevVersion)), nil
+		}
+
+		primaryNum, err := bgd.primary.NumReplicas()
+		if err != nil {
+			return onFailure.Fail(ctx, errors.Wrapf(err, "failed to get num replicas for target %s", bgd.primary.Name())), nil
+		}
+		secondaryNum, err := bgd.secondary.NumReplicas()
+		if err != nil {
+			return onFailure.Fail(ctx, errors.Wrapf(err, "failed to get num replicas for target %s", bgd.secondary.Name())), nil
+		}
+		if primaryNum < secondaryNum {
+			glog.V(1).Infof("Scaling up %s to %d replicas for rollback", bgd.primary.Name(), secondaryNum)
+			if err := bgd.patchNumReplicas(ctx, bgd.primary, secondaryNum, "rollback"); err != nil {
+				return onFailure.Fail(ctx, err), nil
+			}
+			primaryNum = secondaryNum
+		}
+
+		return state.Single(bgd.checkRollbackState(prevVersion, primaryNum, next, onFailure))
+	})
+}
+
+// checkRollbackState waits until the previously live target has enough pods running the
+// previous version and then switches the services back to it.
+func (bgd *BlueGreenDeployer) checkRollbackState(prevVersion string, num int32, next state.State,
+	onFailure state.OnFailure) state.StateFunc {
+
+	return func(ctx context.Context) (state.States, error) {
+		ok, err := bgd.checkPods(ctx, bgd.primary, num, prevVersion)
+		if err != nil {
+			// failures are already being handled, so retry errors here rather than failing
+			glog.Errorf("Failed to check rollback state of target=%s, version=%s (will retry): %v", bgd.primary.Name(), prevVersion, err)
+		}
+		if !ok {
+			if deadline, hasDeadline := ctx.Deadline(); hasDeadline && time.Until(deadline) < 2*rolloutCheckInterval {
+				return onFailure.Fail(ctx, errors.Errorf("timed out waiting for rollback of target=%s to version %s",
+					bgd.primary.Name(), prevVersion)), nil
+			}
+			return state.After(rolloutCheckInterval, bgd.checkRollbackState(prevVersion, num, next, onFailure))
+		}
+
+		reason := fmt.Sprintf("rollback to %s", bgd.primary.Name())
+		if err := bgd.switchServices(ctx, bgd.liveServices, bgd.primary, reason); err != nil {
+			return onFailure.Fail(ctx, err), nil
+		}
+		if len(bgd.verificationServices) > 0 {
+			if err := bgd.switchServices(ctx, bgd.verificationServices, bgd.primary, reason); err != nil {
+				return onFailure.Fail(ctx, err), nil
+			}
+		}
+
+		glog.V(1).Infof("Rollback succeeded for kcd=%s, version=%s", bgd.kcd.Name, prevVersion)
 		return state.Single(next)
 	}
 }
@@ -1,16 +1,28 @@
 package deploy_test
 
 import (
+	"context"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/wish/kcd/deploy"
 	"github.com/wish/kcd/deploy/fake"
+	"github.com/wish/kcd/deploy/traffic"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/state"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	gofake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func TestBlueGreenDeployErrorCases(t *testing.T) {
@@ -54,7 +66,7 @@ func TestBlueGreenDeployErrorCases(t *testing.T) {
 	}
 
 	cs := gofake.NewSimpleClientset()
-	_, err := cs.CoreV1().Services(namespace).Create(&corev1.Service{
+	_, err := cs.CoreV1().Services(namespace).Create(context.TODO(), &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: serviceName,
 		},
@@ -63,7 +75,7 @@ func TestBlueGreenDeployErrorCases(t *testing.T) {
 				"service-selector": "primary",
 			},
 		},
-	})
+	}, metav1.CreateOptions{})
 	if err != nil {
 		t.Errorf("unexpected error when creating service: %v", err)
 	}
@@ -84,3 +96,436 @@ func TestBlueGreenDeployErrorCases(t *testing.T) {
 	}
 
 }
+
+func newColourTarget(name, version string, replicas int32) *fake.TemplateRolloutTarget {
+	target := fake.NewTemplateRolloutTarget()
+	target.FakeName = name
+	target.FakePodSelector = "colour=" + name
+	target.FakeNumReplicas = replicas
+	target.FakePodSpec = corev1.PodSpec{
+		Containers: []corev1.Container{{Name: containerName, Image: "repo/app:" + version}},
+	}
+	target.FakePodTemplateSpec = corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"app": "app", "colour": name},
+		},
+		Spec: target.FakePodSpec,
+	}
+	return target
+}
+
+func createColourPods(t *testing.T, cs *gofake.Clientset, namespace, colour, version string, num int) {
+	for i := 0; i < num; i++ {
+		pod := newVersionPod(namespace, i, version, true, time.Now().Add(-time.Hour))
+		pod.Name = fmt.Sprintf("%s-%s", colour, pod.Name)
+		pod.Labels["colour"] = colour
+		if _, err := cs.CoreV1().Pods(namespace).Create(context.TODO(), pod, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create pod: %v", err)
+		}
+	}
+}
+
+func patchNumReplicasInvocation(target *fake.TemplateRolloutTarget) *fake.ReceivedPatchNumReplicas {
+	inv := &fake.InvocationPatchNumReplicas{Received: &fake.ReceivedPatchNumReplicas{}}
+	target.Invocations <- inv
+	return inv.Received
+}
+
+func TestBlueGreenKeepPrevious(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Container: kcd1.ContainerSpec{Name: containerName},
+			Strategy: kcd1.StrategySpec{
+				Kind: deploy.KindServieBlueGreen,
+				BlueGreen: &kcd1.BlueGreenSpec{
+					ServiceName:  "app",
+					LabelNames:   []string{"colour"},
+					ScaleDown:    true,
+					KeepPrevious: &kcd1.KeepPreviousSpec{Seconds: 3600, ReplicasPercent: 50},
+				},
+			},
+		},
+	}
+
+	// blue is live, green was kept from the previous rollout and red is idle
+	blue := newColourTarget("blue", "v1", 4)
+	green := newColourTarget("green", "v0", 2)
+	red := newColourTarget("red", "v0", 0)
+
+	cs := gofake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   namespace,
+			Annotations: map[string]string{deploy.AnnotationPreviousColour: "colour=green"},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "app", "colour": "blue"},
+		},
+	})
+	createColourPods(t, cs, namespace, "red", "v2", 4)
+	createColourPods(t, cs, namespace, "blue", "v1", 4)
+
+	workloadProvider := workload.NewFakeProvider(cs, namespace, []workload.Workload{green, blue, red})
+	deployer, err := deploy.NewBlueGreenDeployer(workloadProvider, nil, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating deployer: %v", err)
+	}
+	if name := deployer.Workloads()[0].Name(); name != "blue" {
+		t.Errorf("expected blue to be the primary, got %s", name)
+	}
+
+	patchPodSpec := fake.NewInvocationPatchPodSpec()
+	red.Invocations <- patchPodSpec
+	ensurePods := patchNumReplicasInvocation(red)
+	scaleUp := patchNumReplicasInvocation(red)
+	scaleDownGreen := patchNumReplicasInvocation(green)
+	keepBlue := patchNumReplicasInvocation(blue)
+
+	if err := runStates(deployer.AsState(nil)); err != nil {
+		t.Fatalf("unexpected error running rollout: %v", err)
+	}
+
+	if patchPodSpec.Received.Version != "v2" {
+		t.Errorf("expected red to be updated to v2, got %q", patchPodSpec.Received.Version)
+	}
+	if ensurePods.Num != 1 || scaleUp.Num != 4 {
+		t.Errorf("expected red to be scaled to 1 and then 4 replicas, got %d and %d", ensurePods.Num, scaleUp.Num)
+	}
+	if scaleDownGreen.Num != 0 {
+		t.Errorf("expected green to be scaled down, got %d replicas", scaleDownGreen.Num)
+	}
+	if keepBlue.Num != 2 {
+		t.Errorf("expected blue to keep 2 replicas, got %d", keepBlue.Num)
+	}
+
+	service, err := cs.CoreV1().Services(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if colour := service.Spec.Selector["colour"]; colour != "red" {
+		t.Errorf("expected service to select red, got %s", colour)
+	}
+	if previous := service.Annotations[deploy.AnnotationPreviousColour]; previous != "colour=blue" {
+		t.Errorf("expected blue to be recorded as previous, got %q", previous)
+	}
+	until, err := time.Parse(time.RFC3339, service.Annotations[deploy.AnnotationPreviousUntil])
+	if err != nil || until.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expected previous to be kept for an hour, got %v: %v", until, err)
+	}
+
+	// rolling back only scales blue up again and switches the service back
+	blue.FakeNumReplicas = 2
+	red.FakeNumReplicas = 4
+	scaleUpBlue := patchNumReplicasInvocation(blue)
+	rolledBack := false
+	rollback := deployer.Rollback("v1",
+		state.StateFunc(func(ctx context.Context) (state.States, error) {
+			rolledBack = true
+			return state.None()
+		}),
+		state.OnFailureFunc(func(ctx context.Context, err error) state.States {
+			t.Errorf("unexpected rollback failure: %v", err)
+			return state.NewStates()
+		}))
+	if err := runStates(rollback); err != nil {
+		t.Fatalf("unexpected error running rollback: %v", err)
+	}
+	if !rolledBack || scaleUpBlue.Num != 4 {
+		t.Errorf("expected blue to be scaled to 4 replicas and rollback to complete, got %d replicas (done=%t)",
+			scaleUpBlue.Num, rolledBack)
+	}
+	service, err = cs.CoreV1().Services(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if colour := service.Spec.Selector["colour"]; colour != "blue" {
+		t.Errorf("expected service to select blue after rollback, got %s", colour)
+	}
+}
+
+func TestBlueGreenHousekeeping(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Container: kcd1.ContainerSpec{Name: containerName},
+			Strategy: kcd1.StrategySpec{
+				BlueGreen: &kcd1.BlueGreenSpec{
+					ServiceName:  "app",
+					LabelNames:   []string{"colour"},
+					ScaleDown:    true,
+					KeepPrevious: &kcd1.KeepPreviousSpec{Seconds: 60},
+				},
+			},
+		},
+	}
+	blue := newColourTarget("blue", "v1", 4)
+	green := newColourTarget("green", "v2", 4)
+
+	// the service selects on a label the pod templates don't define, so the primary is
+	// found by the values of the label names
+	cs := gofake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: namespace,
+			Annotations: map[string]string{
+				deploy.AnnotationPreviousColour: "colour=blue",
+				deploy.AnnotationPreviousUntil:  time.Now().Add(time.Minute).UTC().Format(time.RFC3339),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"tier": "web", "colour": "green"},
+		},
+	})
+	workloadProvider := workload.NewFakeProvider(cs, namespace, []workload.Workload{blue, green})
+	deployer, err := deploy.NewBlueGreenDeployer(workloadProvider, nil, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating deployer: %v", err)
+	}
+	if name := deployer.Workloads()[0].Name(); name != "green" {
+		t.Errorf("expected green to be the primary, got %s", name)
+	}
+
+	// nothing to do while the previous colour is still kept
+	if err := deployer.Housekeeping(context.Background()); err != nil {
+		t.Fatalf("unexpected housekeeping error: %v", err)
+	}
+
+	service, err := cs.CoreV1().Services(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	service.Annotations[deploy.AnnotationPreviousUntil] = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	if _, err := cs.CoreV1().Services(namespace).Update(context.TODO(), service, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update service: %v", err)
+	}
+
+	scaleDown := patchNumReplicasInvocation(blue)
+	scaleDown.Num = -1
+	if err := deployer.Housekeeping(context.Background()); err != nil {
+		t.Fatalf("unexpected housekeeping error: %v", err)
+	}
+	if scaleDown.Num != 0 {
+		t.Errorf("expected blue to be scaled down, got %d replicas", scaleDown.Num)
+	}
+	service, err = cs.CoreV1().Services(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get service: %v", err)
+	}
+	if len(service.Annotations) != 0 {
+		t.Errorf("expected previous annotations to be removed, got %v", service.Annotations)
+	}
+}
+
+func newColourStatefulSet(namespace, colour, version string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-" + colour,
+			Namespace: namespace,
+			Labels:    map[string]string{"kcdapp": "app"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "app", "colour": colour},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: containerName, Image: "repo/app:" + version}},
+				},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{Replicas: 2},
+	}
+}
+
+func TestBlueGreenMultipleServices(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Container: kcd1.ContainerSpec{Name: containerName},
+			Strategy: kcd1.StrategySpec{
+				Kind: deploy.KindServieBlueGreen,
+				BlueGreen: &kcd1.BlueGreenSpec{
+					ServiceName:              "app",
+					ServiceNames:             []string{"app-internal", "app-headless"},
+					VerificationServiceNames: []string{"app-verify", "app-verify-internal"},
+					LabelNames:               []string{"colour"},
+				},
+			},
+		},
+	}
+	liveServices := []string{"app", "app-internal", "app-headless"}
+	verificationServices := []string{"app-verify", "app-verify-internal"}
+
+	newClientset := func() *gofake.Clientset {
+		blue := newColourStatefulSet(namespace, "blue", "v1")
+		green := newColourStatefulSet(namespace, "green", "v1")
+		cs := gofake.NewSimpleClientset(blue, green)
+		for _, name := range append(liveServices, verificationServices...) {
+			_, err := cs.CoreV1().Services(namespace).Create(context.TODO(), &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+				Spec: corev1.ServiceSpec{
+					Selector: map[string]string{"app": "app", "colour": "blue"},
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				t.Fatalf("failed to create service: %v", err)
+			}
+		}
+		createColourPods(t, cs, namespace, "green", "v2", 2)
+		return cs
+	}
+	newDeployer := func(cs *gofake.Clientset) *deploy.BlueGreenDeployer {
+		statefulSets, err := cs.AppsV1().StatefulSets(namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			t.Fatalf("failed to list statefulsets: %v", err)
+		}
+		var workloads []workload.Workload
+		for i := range statefulSets.Items {
+			workloads = append(workloads, workload.NewStatefulSet(cs, namespace, &statefulSets.Items[i]))
+		}
+		// pods are selected as well but aren't blue-green targets
+		workloads = append(workloads, workload.NewPod(cs, namespace, newVersionPod(namespace, 0, "v1", true, time.Now())))
+		deployer, err := deploy.NewBlueGreenDeployer(workload.NewFakeProvider(cs, namespace, workloads), nil, kcd, "v2")
+		if err != nil {
+			t.Fatalf("unexpected error creating deployer: %v", err)
+		}
+		return deployer
+	}
+	selectedColours := func(cs *gofake.Clientset, names []string) []string {
+		var colours []string
+		for _, name := range names {
+			service, err := cs.CoreV1().Services(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get service: %v", err)
+			}
+			colours = append(colours, service.Spec.Selector["colour"])
+		}
+		return colours
+	}
+
+	cs := newClientset()
+	if err := runStates(newDeployer(cs).AsState(nil)); err != nil {
+		t.Fatalf("unexpected error running rollout: %v", err)
+	}
+	if colours := selectedColours(cs, append(liveServices, verificationServices...)); !reflect.DeepEqual(colours,
+		[]string{"green", "green", "green", "green", "green"}) {
+		t.Errorf("expected all services to select green, got %v", colours)
+	}
+	green, err := cs.AppsV1().StatefulSets(namespace).Get(context.TODO(), "app-green", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get statefulset: %v", err)
+	}
+	if image := green.Spec.Template.Spec.Containers[0].Image; image != "repo/app:v2" {
+		t.Errorf("expected green to be updated to v2, got %s", image)
+	}
+
+	// live services are switched back if one of them fails to switch
+	cs = newClientset()
+	cs.PrependReactor("update", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		service := action.(k8stesting.UpdateAction).GetObject().(*corev1.Service)
+		if service.Name == "app-headless" {
+			return true, nil, errors.New("update failed")
+		}
+		return false, nil, nil
+	})
+	if err := runStates(newDeployer(cs).AsState(nil)); err == nil {
+		t.Errorf("expected rollout to fail")
+	}
+	if colours := selectedColours(cs, liveServices); !reflect.DeepEqual(colours, []string{"blue", "blue", "blue"}) {
+		t.Errorf("expected live services to select blue, got %v", colours)
+	}
+}
+
+func TestBlueGreenTrafficSteps(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Container: kcd1.ContainerSpec{Name: containerName},
+			Strategy: kcd1.StrategySpec{
+				Kind: deploy.KindServieBlueGreen,
+				BlueGreen: &kcd1.BlueGreenSpec{
+					ServiceName:             "app",
+					VerificationServiceName: "app-verify",
+					LabelNames:              []string{"colour"},
+					Traffic:                 &kcd1.TrafficSpec{Kind: traffic.KindHTTPRoute, Name: "app", Steps: []int{5, 25}},
+				},
+			},
+		},
+	}
+
+	cs := gofake.NewSimpleClientset(newColourStatefulSet(namespace, "blue", "v1"), newColourStatefulSet(namespace, "green", "v1"))
+	for _, name := range []string{"app", "app-verify"} {
+		_, err := cs.CoreV1().Services(namespace).Create(context.TODO(), &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "app", "colour": "blue"}},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("failed to create service: %v", err)
+		}
+	}
+	createColourPods(t, cs, namespace, "green", "v2", 2)
+
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": namespace},
+		"spec": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{"backendRefs": []interface{}{
+					map[string]interface{}{"name": "app", "port": int64(80), "weight": int64(100)},
+					map[string]interface{}{"name": "app-verify", "port": int64(80), "weight": int64(0)},
+				}},
+			},
+		},
+	}})
+
+	// record the canary weights along with the colour selected by the live service
+	var steps []string
+	dc.PrependReactor("update", "httproutes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		route := action.(k8stesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+		rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+		canary := rules[0].(map[string]interface{})["backendRefs"].([]interface{})[1].(map[string]interface{})
+		service, err := cs.CoreV1().Services(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+		if err != nil {
+			return true, nil, err
+		}
+		steps = append(steps, fmt.Sprintf("%s:%d", service.Spec.Selector["colour"], canary["weight"]))
+		return false, nil, nil
+	})
+
+	statefulSets, err := cs.AppsV1().StatefulSets(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list statefulsets: %v", err)
+	}
+	var workloads []workload.Workload
+	for i := range statefulSets.Items {
+		workloads = append(workloads, workload.NewStatefulSet(cs, namespace, &statefulSets.Items[i]))
+	}
+	workloadProvider := workload.NewFakeProvider(cs, namespace, workloads).WithDynamicClient(dc)
+	deployer, err := deploy.NewBlueGreenDeployer(workloadProvider, nil, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating deployer: %v", err)
+	}
+	if err := runStates(deployer.AsState(nil)); err != nil {
+		t.Fatalf("unexpected error running rollout: %v", err)
+	}
+
+	// the live service is switched once all steps have been verified, after which the
+	// verification service no longer receives traffic
+	if expected := []string{"blue:5", "blue:25", "green:0"}; !reflect.DeepEqual(steps, expected) {
+		t.Errorf("expected traffic steps %v, got %v", expected, steps)
+	}
+
+	// traffic routing requires a dynamic client
+	if _, err := deploy.NewBlueGreenDeployer(workload.NewFakeProvider(cs, namespace, workloads), nil, kcd, "v2"); err == nil {
+		t.Errorf("expected error without dynamic client")
+	}
+}
@@ -2,19 +2,41 @@ package deploy
 
 import (
 	"context"
+	"math"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/wish/kcd/audit"
+	"github.com/wish/kcd/events"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	"github.com/wish/kcd/gok8s/workload"
 	k8s "github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/registry"
 	"github.com/wish/kcd/state"
+	"github.com/wish/kcd/stats"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+// DefaultTimeout is the duration allowed for rolling out and verifying a version if the
+// KCD resource doesn't define a timeout.
+const DefaultTimeout = 15 * time.Minute
+
+// MaxTimeout is the maximum duration of a rollout, including the soak and traffic steps.
+const MaxTimeout = 24 * time.Hour
+
+// Timeout returns the duration allowed for a rollout of the KCD resource: its timeout for
+// rolling out and verifying the version, plus the post-rollout soak and the traffic steps.
+func Timeout(kcd *kcd1.KCD) time.Duration {
+	timeout := DefaultTimeout
+	if kcd.Spec.TimeoutSeconds > 0 {
+		timeout = time.Second * time.Duration(kcd.Spec.TimeoutSeconds)
+	}
+	return timeout + SoakDuration(kcd) + TrafficDuration(kcd)
+}
+
 // RolloutTarget defines an interface for something deployable, such as a Deployment, DaemonSet, Pod, etc.
 type RolloutTarget = k8s.Workload
 
@@ -34,10 +56,41 @@ type Deployer interface {
 
 // SupportsRollback is implemented by deployers that support a Rollback mechanism.
 type SupportsRollback interface {
-	// Rollback performs a rollback of the deployment to the given previous version.
-	// Rollback always calls next, even on failure since it is assumed we are already
-	// in a failure date.
-	Rollback(prevVersion string, next state.State) state.State
+	// Rollback performs a rollback of the deployment to the given previous version and
+	// waits for the workloads to run it. Rollback calls next once the rollback succeeded
+	// or invokes onFailure if the rollback itself failed. Since it is assumed we are
+	// already in a failure state, failures are never returned as errors.
+	Rollback(prevVersion string, next state.State, onFailure state.OnFailure) state.State
+}
+
+// ReportsPods is implemented by deployers that keep track of the pods observed while
+// checking the state of a rollout.
+type ReportsPods interface {
+	// Pods returns the pod counts of the workloads most recently observed by the deployer.
+	Pods() kcd1.PodsStatus
+}
+
+// MultiCluster is implemented by deployers that roll out to more than one cluster.
+type MultiCluster interface {
+	// Clusters returns the rollout of each cluster in rollout order.
+	Clusters() []ClusterRollout
+}
+
+// ClusterRollout describes the workloads rolled out in a single cluster.
+type ClusterRollout struct {
+	// Name is the name of the cluster.
+	Name string
+	// WorkloadProvider operates on the workloads of the cluster.
+	WorkloadProvider workload.Provider
+	// Workloads are the workloads rolled out in the cluster.
+	Workloads []workload.Workload
+}
+
+// Housekeeper is implemented by deployers that tidy up after earlier rollouts while no
+// rollout is in progress.
+type Housekeeper interface {
+	// Housekeeping performs the deployer's housekeeping tasks.
+	Housekeeping(ctx context.Context) error
 }
 
 // New returns a Deployer instance based on the "kind" of the kcd resource.
@@ -76,54 +129,166 @@ func ActivePodsForTarget(cs kubernetes.Interface, namespace string, target Rollo
 	return pods, nil
 }
 
-// CheckPods checks whether the target has at least num pods and that every pod has the
-// specified version and that every kcd managed container (defined by the kcd resource)
-// within each pod is in a ready state.
-func CheckPods(cs kubernetes.Interface, namespace string, target RolloutTarget, num int32, kcd *kcd1.KCD, version string) (bool, error) {
+// CheckPods checks whether the target has at least num pods, that every pod has the specified
+// version and that enough pods are ready according to the readiness policy defined by the
+// kcd resource. By default all pods must be ready. A target with replicas but without pods
+// isn't rolled out yet, other targets without active pods are. Returns the pod counts that
+// were observed.
+func CheckPods(cs kubernetes.Interface, namespace string, target RolloutTarget, num int32, kcd *kcd1.KCD,
+	version string) (kcd1.PodsStatus, bool, error) {
+
+	var counts kcd1.PodsStatus
+
 	pods, err := ActivePodsForTarget(cs, namespace, target)
 	if err != nil {
-		return false, errors.Wrapf(err, "failed to get pods for target %s", target.Name())
+		return counts, false, errors.Wrapf(err, "failed to get pods for target %s", target.Name())
 	}
 
-	if len(pods) == 0 {
-		glog.V(4).Infof("%s has %d replicaset, thus deployment succeeded", target.Name(), len(pods))
-		return true, nil
+	counts, err = CountPods(pods, kcd, version, time.Now().UTC())
+	if err != nil {
+		return counts, false, errors.Wrapf(err, "failed to count pods for target %s", target.Name())
+	}
+
+	if counts.Total < num {
+		glog.V(2).Infof("insufficient pods found for target %s: found %d but need %d", target.Name(), counts.Total, num)
+		return counts, false, nil
 	}
 
-	if len(pods) < int(num) {
-		glog.V(2).Infof("insufficient pods found for target %s: found %d but need %d", target.Name(), len(pods), num)
-		return false, nil
+	if counts.Total == 0 {
+		tTarget, ok := target.(TemplateRolloutTarget)
+		if !ok {
+			// jobs, cron jobs and daemon sets may have no active pods once rolled out
+			glog.V(4).Infof("%s has no active pods, thus deployment succeeded", target.Name())
+			return counts, true, nil
+		}
+		replicas, err := tTarget.NumReplicas()
+		if err != nil {
+			return counts, false, errors.Wrapf(err, "failed to get num replicas for target %s", target.Name())
+		}
+		if replicas > 0 {
+			glog.V(2).Infof("Still waiting for rollout: target %s has %d replicas but no pods", target.Name(), replicas)
+			return counts, false, nil
+		}
+		glog.V(4).Infof("%s has no replicas, thus deployment succeeded", target.Name())
+		return counts, true, nil
 	}
 
 	// firstly, check if there are old pods left
-	for _, pod := range pods {
-		//if pod.Status.Phase != corev1.PodRunning {
-		//	glog.V(2).Infof("Still waiting for rollout: pod %s phase is %v", pod.Name, pod.Status.Phase)
-		//	return false, nil
-		//}
-		glog.V(4).Infof("Check pod spec version %v, %v", pod.Name, pod.Namespace)
+	if counts.Updated < counts.Total {
+		glog.V(2).Infof("Still waiting for rollout: %d of %d pods of %s are the wrong version",
+			counts.Total-counts.Updated, counts.Total, target.Name())
+		return counts, false, nil
+	}
+
+	// secondly, check if enough new pods are up and running
+	required := RequiredReadyPods(kcd, counts.Total)
+	if counts.Ready < required {
+		glog.V(2).Infof("Still waiting for rollout, %d of %d pods of %s are ready but need %d",
+			counts.Ready, counts.Total, target.Name(), required)
+		return counts, false, nil
+	}
+
+	glog.V(4).Infof("%d of %d pods of %s in latest version are ready", counts.Ready, counts.Total, target.Name())
+	return counts, true, nil
+}
 
+// CountPods returns the total number of pods, the number of pods that have the specified
+// version and the number of pods with the specified version that are ready according
+// to the readiness policy of the kcd resource at the given time.
+func CountPods(pods []corev1.Pod, kcd *kcd1.KCD, version string, now time.Time) (kcd1.PodsStatus, error) {
+	var minReady time.Duration
+	if kcd.Spec.Strategy.Readiness != nil {
+		minReady = time.Duration(kcd.Spec.Strategy.Readiness.MinReadySeconds) * time.Second
+	}
+
+	counts := kcd1.PodsStatus{
+		Total: int32(len(pods)),
+	}
+	for _, pod := range pods {
 		ok, err := workload.CheckPodSpecVersion(pod.Spec, kcd, version)
 		if err != nil {
-			return false, errors.Wrapf(err, "failed to check container version for target %s", target.Name())
+			return counts, errors.Wrapf(err, "failed to check container version of pod %s", pod.Name)
 		}
 		if !ok {
-			glog.V(2).Infof("Still waiting for rollout: pod %s is wrong version", pod.Name)
-			return false, nil
+			glog.V(4).Infof("Pod %s is wrong version", pod.Name)
+			continue
+		}
+		counts.Updated++
+
+		if !CheckPodRunningState(pod) {
+			continue
+		}
+		if minReady > 0 && !podReadySince(pod, now.Add(-minReady)) {
+			glog.V(4).Infof("Pod %s has not been ready for %v", pod.Name, minReady)
+			continue
 		}
+		counts.Ready++
 	}
 
-	// secondly, check if new pods are up and running
-	for _, pod := range pods {
-		if CheckPodRunningState(pod) {
-			glog.V(4).Infof("Pod %s in latest version is ready", pod.Name)
-			return true, nil
+	return counts, nil
+}
+
+// RequiredReadyPods returns the number of pods of a workload with the given total number
+// of pods that must be ready for a rollout to succeed.
+func RequiredReadyPods(kcd *kcd1.KCD, total int32) int32 {
+	percent := 100
+	if kcd.Spec.Strategy.Readiness != nil && kcd.Spec.Strategy.Readiness.MinReadyPercent > 0 {
+		percent = kcd.Spec.Strategy.Readiness.MinReadyPercent
+	}
+	if percent > 100 {
+		percent = 100
+	}
+
+	required := int32(math.Ceil(float64(total) * float64(percent) / 100))
+	if required == 0 && total > 0 {
+		required = 1
+	}
+	return required
+}
+
+// podReadySince returns whether the pod has been ready since at least the given time.
+func podReadySince(pod corev1.Pod, t time.Time) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady {
+			return cond.Status == corev1.ConditionTrue && !cond.LastTransitionTime.Time.After(t)
 		}
 	}
+	return false
+}
+
+// reportPods emits stats for the pod counts observed for the target and records an event
+// if the counts changed since they were last observed.
+func reportPods(ctx context.Context, kcd *kcd1.KCD, target RolloutTarget, prev, counts kcd1.PodsStatus) {
+	if st := stats.FromContext(ctx); st != nil {
+		st.Gauge("kcdsync.pods.total", int64(counts.Total), kcd.Name, target.Name())
+		st.Gauge("kcdsync.pods.updated", int64(counts.Updated), kcd.Name, target.Name())
+		st.Gauge("kcdsync.pods.ready", int64(counts.Ready), kcd.Name, target.Name())
+	}
+
+	if rec := events.FromContext(ctx); rec != nil && counts != prev {
+		rec.Eventf(events.Normal, "RolloutPods", "%s: %d/%d pods ready, %d updated",
+			target.Name(), counts.Ready, counts.Total, counts.Updated)
+	}
+}
 
-	//glog.V(2).Info("All pods and containers are ready")
-	glog.V(2).Info("Still waiting for rollout, new pods are not ready yet")
-	return false, nil
+// auditChange records a change made by the syncer to the target of the KCD resource in the
+// audit log.
+func auditChange(ctx context.Context, kcd *kcd1.KCD, action, target, old, new, reason string) {
+	entry := audit.ForKCD(kcd, audit.SourceSyncer, audit.ActorSyncer, action)
+	entry.Target = target
+	entry.Old = old
+	entry.New = new
+	entry.Reason = reason
+	audit.FromContext(ctx).Log(entry)
+}
+
+// addPods returns the sum of the given pod counts.
+func addPods(a, b kcd1.PodsStatus) kcd1.PodsStatus {
+	return kcd1.PodsStatus{
+		Total:   a.Total + b.Total,
+		Updated: a.Updated + b.Updated,
+		Ready:   a.Ready + b.Ready,
+	}
 }
 
 // CheckPodRunningState checks whether a pod is running and all of its container is in ready state.
@@ -0,0 +1,188 @@
+package deploy_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wish/kcd/deploy"
+	"github.com/wish/kcd/deploy/fake"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newVersionPod(namespace string, idx int, version string, ready bool, readySince time.Time) *corev1.Pod {
+	readyStatus := corev1.ConditionFalse
+	if ready {
+		readyStatus = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("app-pod-%d", idx),
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "app"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: containerName, Image: "repo/app:" + version},
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: containerName, Ready: ready},
+			},
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: readyStatus, LastTransitionTime: metav1.NewTime(readySince)},
+			},
+		},
+	}
+}
+
+// newCompletedPod returns a pod that ran to completion, e.g. of a job.
+func newCompletedPod(namespace string, idx int, version string) *corev1.Pod {
+	pod := newVersionPod(namespace, idx, version, false, time.Time{})
+	pod.Status.Phase = corev1.PodSucceeded
+	return pod
+}
+
+func TestCheckPods(t *testing.T) {
+	namespace := "test-namespace"
+	now := time.Now().UTC()
+
+	kcd := &kcd1.KCD{
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+		},
+	}
+	target := fake.NewTemplateRolloutTarget()
+	target.FakePodSelector = "app=app"
+	nonTemplateTarget := fake.NewRolloutTarget()
+	nonTemplateTarget.FakePodSelector = "app=app"
+
+	testCases := []struct {
+		name        string
+		readiness   *kcd1.ReadinessSpec
+		replicas    int32
+		nonTemplate bool
+		pods      []runtime.Object
+		expected  bool
+		counts    kcd1.PodsStatus
+	}{
+		{
+			name:     "no pods and no replicas",
+			expected: true,
+		},
+		{
+			name:     "no pods while replicas are starting",
+			replicas: 2,
+			expected: false,
+		},
+		{
+			// e.g. a cron job without running jobs
+			name:        "no active pods of a target without replicas",
+			nonTemplate: true,
+			pods: []runtime.Object{
+				newCompletedPod(namespace, 0, "v2"),
+			},
+			expected: true,
+		},
+		{
+			name: "all pods ready",
+			pods: []runtime.Object{
+				newVersionPod(namespace, 0, "v2", true, now),
+				newVersionPod(namespace, 1, "v2", true, now),
+			},
+			expected: true,
+			counts:   kcd1.PodsStatus{Total: 2, Updated: 2, Ready: 2},
+		},
+		{
+			name: "single pod ready",
+			pods: []runtime.Object{
+				newVersionPod(namespace, 0, "v2", true, now),
+				newVersionPod(namespace, 1, "v2", false, now),
+			},
+			expected: false,
+			counts:   kcd1.PodsStatus{Total: 2, Updated: 2, Ready: 1},
+		},
+		{
+			name: "old pods remaining",
+			pods: []runtime.Object{
+				newVersionPod(namespace, 0, "v2", true, now),
+				newVersionPod(namespace, 1, "v1", true, now),
+			},
+			expected: false,
+			counts:   kcd1.PodsStatus{Total: 2, Updated: 1, Ready: 1},
+		},
+		{
+			name:      "minimum percentage ready",
+			readiness: &kcd1.ReadinessSpec{MinReadyPercent: 50},
+			pods: []runtime.Object{
+				newVersionPod(namespace, 0, "v2", true, now),
+				newVersionPod(namespace, 1, "v2", false, now),
+			},
+			expected: true,
+			counts:   kcd1.PodsStatus{Total: 2, Updated: 2, Ready: 1},
+		},
+		{
+			name:      "not ready for long enough",
+			readiness: &kcd1.ReadinessSpec{MinReadySeconds: 60},
+			pods: []runtime.Object{
+				newVersionPod(namespace, 0, "v2", true, now.Add(-2*time.Minute)),
+				newVersionPod(namespace, 1, "v2", true, now),
+			},
+			expected: false,
+			counts:   kcd1.PodsStatus{Total: 2, Updated: 2, Ready: 1},
+		},
+	}
+
+	for _, tc := range testCases {
+		kcd.Spec.Strategy.Readiness = tc.readiness
+		target.FakeNumReplicas = tc.replicas
+		cs := gofake.NewSimpleClientset(tc.pods...)
+
+		var rt deploy.RolloutTarget = target
+		if tc.nonTemplate {
+			rt = nonTemplateTarget
+		}
+		counts, ok, err := deploy.CheckPods(cs, namespace, rt, 0, kcd, "v2")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if ok != tc.expected {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.expected, ok)
+		}
+		if counts != tc.counts {
+			t.Errorf("%s: expected counts %+v but got %+v", tc.name, tc.counts, counts)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	kcd := &kcd1.KCD{}
+	if timeout := deploy.Timeout(kcd); timeout != deploy.DefaultTimeout {
+		t.Errorf("expected default timeout, got %s", timeout)
+	}
+
+	kcd.Spec.TimeoutSeconds = 600
+	kcd.Spec.Strategy = kcd1.StrategySpec{
+		Kind:        deploy.KindServieBlueGreen,
+		SoakSeconds: 120,
+		Verify:      []kcd1.VerifySpec{{Kind: "image"}},
+		BlueGreen: &kcd1.BlueGreenSpec{
+			Traffic: &kcd1.TrafficSpec{Kind: "HTTPRoute", Name: "app", Steps: []int{5, 25}, StepSeconds: 60},
+		},
+	}
+	// 2 steps before all traffic is shifted, each watched for a minute and verified
+	expected := 10*time.Minute + 2*time.Minute + 2*(time.Minute+deploy.VerifyStepDuration)
+	if timeout := deploy.Timeout(kcd); timeout != expected {
+		t.Errorf("expected timeout %s including soak and traffic steps, got %s", expected, timeout)
+	}
+}
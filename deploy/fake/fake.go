@@ -19,6 +19,9 @@ type RolloutTarget struct {
 	FakeRolloutFailed bool
 	FakePodSelector   string
 
+	// RolloutTime is the rollout time RolloutFailed was last called with.
+	RolloutTime time.Time
+
 	Invocations chan interface{}
 }
 
@@ -106,6 +109,7 @@ func (rt *RolloutTarget) PatchPodSpec(kcd *kcd1.KCD, container corev1.Container,
 
 // RolloutFailed implements the RolloutTarget interface.
 func (rt *RolloutTarget) RolloutFailed(rolloutTime time.Time) (bool, error) {
+	rt.RolloutTime = rolloutTime
 	return rt.FakeRolloutFailed, nil
 }
 
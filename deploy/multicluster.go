@@ -0,0 +1,259 @@
+package deploy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/cluster"
+	"github.com/wish/kcd/gok8s/workload"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/state"
+)
+
+// clusterDeployer is the deployer for a single cluster of a multi-cluster rollout.
+type clusterDeployer struct {
+	name             string
+	workloadProvider workload.Provider
+	deployer         Deployer
+}
+
+// MultiClusterDeployer is a Deployer that rolls a version out to each of the clusters
+// defined in the KCD resource, using the KCD's strategy within each cluster.
+// Clusters are rolled out in waves and the rollout halts on the first failure.
+type MultiClusterDeployer struct {
+	kcd     *kcd1.KCD
+	version string
+
+	waves [][]clusterDeployer
+
+	mu      sync.Mutex
+	started int
+	halted  bool
+}
+
+// haltableState is a state of a cluster rollout that is dropped, along with all of its
+// following states, once the multi-cluster rollout has been halted.
+type haltableState struct {
+	mcd   *MultiClusterDeployer
+	state state.State
+}
+
+// Do implements the State interface.
+func (hs haltableState) Do(ctx context.Context) (state.States, error) {
+	if hs.mcd.isHalted() {
+		glog.V(2).Infof("Multi-cluster rollout halted, dropping state: kcd=%s, version=%s", hs.mcd.kcd.Name, hs.mcd.version)
+		return state.None()
+	}
+
+	states, err := hs.state.Do(ctx)
+	for i, st := range states.States {
+		states.States[i] = hs.mcd.haltable(st)
+	}
+	return states, err
+}
+
+// After implements the HasAfter interface by retaining the delay of the wrapped state.
+func (hs haltableState) After() time.Time {
+	if aft, ok := hs.state.(state.HasAfter); ok {
+		return aft.After()
+	}
+	return time.Time{}
+}
+
+// NewMultiClusterDeployer returns a Deployer that performs rollouts across the clusters
+// defined by the KCD resource.
+func NewMultiClusterDeployer(clusterProvider cluster.Provider, registryProvider registry.Provider,
+	kcd *kcd1.KCD, version string) (*MultiClusterDeployer, error) {
+
+	glog.V(2).Infof("Creating MultiClusterDeployer: kcd=%s, version=%s, clusters=%d", kcd.Name, version, len(kcd.Spec.Clusters))
+
+	if len(kcd.Spec.Clusters) == 0 {
+		return nil, errors.Errorf("no clusters defined in kcd resource %s", kcd.Name)
+	}
+
+	mcd := &MultiClusterDeployer{
+		kcd:     kcd,
+		version: version,
+	}
+
+	for _, wave := range cluster.Waves(kcd) {
+		var cds []clusterDeployer
+		for _, cl := range wave {
+			workloadProvider, err := clusterProvider.WorkloadProvider(kcd, cl)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to obtain workload provider for cluster %s", cl.Name)
+			}
+			deployer, err := New(workloadProvider, registryProvider, kcd, version)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create deployer for cluster %s", cl.Name)
+			}
+			cds = append(cds, clusterDeployer{name: cl.Name, workloadProvider: workloadProvider, deployer: deployer})
+		}
+		mcd.waves = append(mcd.waves, cds)
+	}
+
+	return mcd, nil
+}
+
+// Workloads implements the Deployer interface.
+func (mcd *MultiClusterDeployer) Workloads() []workload.Workload {
+	var result []workload.Workload
+	for _, wave := range mcd.waves {
+		for _, cd := range wave {
+			result = append(result, cd.deployer.Workloads()...)
+		}
+	}
+	return result
+}
+
+// Clusters implements the MultiCluster interface.
+func (mcd *MultiClusterDeployer) Clusters() []ClusterRollout {
+	var result []ClusterRollout
+	for _, wave := range mcd.waves {
+		for _, cd := range wave {
+			result = append(result, ClusterRollout{
+				Name:             cd.name,
+				WorkloadProvider: cd.workloadProvider,
+				Workloads:        cd.deployer.Workloads(),
+			})
+		}
+	}
+	return result
+}
+
+// AsState implements the Deployer interface.
+func (mcd *MultiClusterDeployer) AsState(next state.State) state.State {
+	return mcd.rolloutWave(0, next)
+}
+
+// haltable returns the given state such that it's dropped once the rollout was halted.
+func (mcd *MultiClusterDeployer) haltable(st state.State) state.State {
+	if _, ok := st.(haltableState); ok {
+		return st
+	}
+	return haltableState{mcd: mcd, state: st}
+}
+
+// halt stops the clusters that are still rolling out from executing any further states.
+func (mcd *MultiClusterDeployer) halt() {
+	mcd.mu.Lock()
+	defer mcd.mu.Unlock()
+	mcd.halted = true
+}
+
+func (mcd *MultiClusterDeployer) isHalted() bool {
+	mcd.mu.Lock()
+	defer mcd.mu.Unlock()
+	return mcd.halted
+}
+
+// startedWaves returns the waves whose rollout has been started.
+func (mcd *MultiClusterDeployer) startedWaves() [][]clusterDeployer {
+	mcd.mu.Lock()
+	defer mcd.mu.Unlock()
+	return mcd.waves[:mcd.started]
+}
+
+// rolloutWave rolls out all clusters of the wave at the given index concurrently and
+// proceeds to the following wave once every cluster has succeeded. If any cluster
+// fails then the rollout of the other clusters is halted.
+func (mcd *MultiClusterDeployer) rolloutWave(idx int, next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		if idx >= len(mcd.waves) {
+			glog.V(1).Infof("All clusters rolled out for kcd=%s, version=%s", mcd.kcd.Name, mcd.version)
+			return state.Single(next)
+		}
+
+		mcd.mu.Lock()
+		if mcd.halted {
+			mcd.mu.Unlock()
+			return state.None()
+		}
+		if idx >= mcd.started {
+			mcd.started = idx + 1
+		}
+		mcd.mu.Unlock()
+
+		var branches []func(done state.State) state.State
+		for _, cd := range mcd.waves[idx] {
+			cd := cd
+			glog.V(1).Infof("Rolling out cluster=%s, wave=%d for kcd=%s, version=%s", cd.name, idx, mcd.kcd.Name, mcd.version)
+			branches = append(branches, func(done state.State) state.State {
+				return mcd.haltable(cd.deployer.AsState(done))
+			})
+		}
+
+		return state.Single(state.WithFailure(state.Join(mcd.rolloutWave(idx+1, next), branches...),
+			state.OnFailureFunc(func(ctx context.Context, err error) state.States {
+				glog.V(1).Infof("Halting multi-cluster rollout after failure: kcd=%s, version=%s, error=%v", mcd.kcd.Name, mcd.version, err)
+				mcd.halt()
+				return state.NewStates()
+			})))
+	}
+}
+
+// Pods implements the ReportsPods interface by summing the pods of all clusters.
+func (mcd *MultiClusterDeployer) Pods() kcd1.PodsStatus {
+	var result kcd1.PodsStatus
+	for _, wave := range mcd.waves {
+		for _, cd := range wave {
+			if reporter, ok := cd.deployer.(ReportsPods); ok {
+				result = addPods(result, reporter.Pods())
+			}
+		}
+	}
+	return result
+}
+
+// Rollback implements the SupportsRollback interface by halting the rollout and rolling
+// back all clusters of the waves that were started concurrently. Clusters of later
+// waves never received the version and are left untouched. The rollback fails if it
+// fails in any cluster, once all clusters have completed.
+func (mcd *MultiClusterDeployer) Rollback(prevVersion string, next state.State, onFailure state.OnFailure) state.State {
+	return state.StateFunc(func(ctx context.Context) (state.States, error) {
+		mcd.halt()
+		return state.Single(mcd.rollbackWaves(prevVersion, next, onFailure))
+	})
+}
+
+// rollbackWaves rolls back the clusters of the started waves.
+func (mcd *MultiClusterDeployer) rollbackWaves(prevVersion string, next state.State, onFailure state.OnFailure) state.State {
+	var mu sync.Mutex
+	var failures []string
+
+	var branches []func(done state.State) state.State
+	for _, wave := range mcd.startedWaves() {
+		for _, cd := range wave {
+			name := cd.name
+			rollbacker, ok := cd.deployer.(SupportsRollback)
+			if !ok {
+				glog.Errorf("Deployer for cluster %s does not support rollback: kcd=%v", name, mcd.kcd.Name)
+				continue
+			}
+			branches = append(branches, func(done state.State) state.State {
+				return rollbacker.Rollback(prevVersion, done, state.OnFailureFunc(func(ctx context.Context, err error) state.States {
+					glog.Errorf("Rollback failed in cluster %s: kcd=%v, error=%v", name, mcd.kcd.Name, err)
+					mu.Lock()
+					failures = append(failures, fmt.Sprintf("cluster %s: %v", name, err))
+					mu.Unlock()
+					return state.NewStates(done)
+				}))
+			})
+		}
+	}
+
+	return state.Join(state.StateFunc(func(ctx context.Context) (state.States, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(failures) > 0 {
+			return onFailure.Fail(ctx, errors.Errorf("rollback failed in %s", strings.Join(failures, "; "))), nil
+		}
+		return state.Single(next)
+	}), branches...)
+}
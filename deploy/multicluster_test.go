@@ -0,0 +1,303 @@
+package deploy_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wish/kcd/deploy"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/cluster"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/state"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+// runStates executes the given state and all subsequent states until completion,
+// ignoring any delays. Returns the first error encountered.
+func runStates(st state.State) error {
+	queue := []state.State{st}
+	for len(queue) > 0 {
+		curr := queue[0]
+		queue = queue[1:]
+
+		states, err := curr.Do(context.Background())
+		if err != nil {
+			return err
+		}
+		queue = append(queue, states.States...)
+	}
+	return nil
+}
+
+func newMultiClusterDeployment(namespace, version string, conditions ...appsv1.DeploymentCondition) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: namespace,
+			Labels:    map[string]string{"kcdapp": "app"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": "app"},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: containerName, Image: "repo/app:" + version},
+					},
+				},
+			},
+		},
+		Status: appsv1.DeploymentStatus{
+			Conditions: conditions,
+		},
+	}
+}
+
+func deploymentImage(t *testing.T, cs kubernetes.Interface, namespace string) string {
+	dep, err := cs.AppsV1().Deployments(namespace).Get(context.TODO(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error getting deployment: %v", err)
+	}
+	return dep.Spec.Template.Spec.Containers[0].Image
+}
+
+func TestMultiClusterDeploy(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-kcd",
+			Namespace: namespace,
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Selector:  map[string]string{"kcdapp": "app"},
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+			Clusters: []kcd1.ClusterSpec{
+				{Name: "a"},
+				{Name: "b", Wave: 2},
+				{Name: "c", Namespace: "other", Wave: 2},
+			},
+		},
+	}
+	var registryProvider registry.Provider
+
+	clients := map[string]kubernetes.Interface{
+		"a": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1")),
+		"b": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1")),
+		"c": gofake.NewSimpleClientset(newMultiClusterDeployment("other", "v1")),
+	}
+
+	deployer, err := deploy.NewMultiClusterDeployer(cluster.NewFakeProvider(clients), registryProvider, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating multi-cluster deployer: %v", err)
+	}
+	if len(deployer.Workloads()) != 3 {
+		t.Errorf("expected 3 workloads, got %d", len(deployer.Workloads()))
+	}
+
+	completed := false
+	next := state.StateFunc(func(ctx context.Context) (state.States, error) {
+		completed = true
+		return state.None()
+	})
+
+	if err := runStates(deployer.AsState(next)); err != nil {
+		t.Fatalf("unexpected error during multi-cluster rollout: %v", err)
+	}
+	if !completed {
+		t.Errorf("expected next state to be invoked once all clusters were rolled out")
+	}
+	for name, cs := range clients {
+		ns := namespace
+		if name == "c" {
+			ns = "other"
+		}
+		if img := deploymentImage(t, cs, ns); img != "repo/app:v2" {
+			t.Errorf("expected cluster %s to be rolled out to v2, got %s", name, img)
+		}
+	}
+}
+
+func TestMultiClusterDeployHaltsOnFailure(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-kcd",
+			Namespace: namespace,
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Selector:  map[string]string{"kcdapp": "app"},
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+			Clusters: []kcd1.ClusterSpec{
+				{Name: "a"},
+				{Name: "b"},
+			},
+		},
+	}
+	var registryProvider registry.Provider
+
+	// the rollout fails after it started
+	failed := appsv1.DeploymentCondition{
+		Type:           appsv1.DeploymentProgressing,
+		Status:         corev1.ConditionFalse,
+		Reason:         "ProgressDeadlineExceeded",
+		LastUpdateTime: metav1.NewTime(time.Now().Add(time.Hour)),
+	}
+	clients := map[string]kubernetes.Interface{
+		"a": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1", failed)),
+		"b": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1")),
+	}
+
+	deployer, err := deploy.NewMultiClusterDeployer(cluster.NewFakeProvider(clients), registryProvider, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating multi-cluster deployer: %v", err)
+	}
+
+	err = runStates(deployer.AsState(nil))
+	if !state.IsPermanent(err) {
+		t.Errorf("expected permanent failure when the first cluster fails, got %v", err)
+	}
+	if img := deploymentImage(t, clients["b"], namespace); img != "repo/app:v1" {
+		t.Errorf("expected cluster b not to be rolled out after cluster a failed, got %s", img)
+	}
+
+	/////
+
+	kcd.Spec.Clusters = append(kcd.Spec.Clusters, kcd1.ClusterSpec{Name: "unknown"})
+	if _, err := deploy.NewMultiClusterDeployer(cluster.NewFakeProvider(clients), registryProvider, kcd, "v2"); err == nil {
+		t.Errorf("expected error when a cluster cannot be resolved")
+	}
+}
+
+func TestMultiClusterRollbackHaltsSlowCluster(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-kcd",
+			Namespace: namespace,
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Selector:  map[string]string{"kcdapp": "app"},
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+			Clusters: []kcd1.ClusterSpec{
+				{Name: "a", Wave: 1},
+				{Name: "b", Wave: 1},
+				{Name: "c", Wave: 2},
+			},
+		},
+	}
+	var registryProvider registry.Provider
+
+	failed := appsv1.DeploymentCondition{
+		Type:           appsv1.DeploymentProgressing,
+		Status:         corev1.ConditionFalse,
+		Reason:         "ProgressDeadlineExceeded",
+		LastUpdateTime: metav1.NewTime(time.Now().Add(time.Hour)),
+	}
+	clients := map[string]*gofake.Clientset{
+		"a": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1", failed)),
+		"b": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1")),
+		"c": gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v1")),
+	}
+	interfaces := make(map[string]kubernetes.Interface)
+	for name, cs := range clients {
+		interfaces[name] = cs
+	}
+
+	deployer, err := deploy.NewMultiClusterDeployer(cluster.NewFakeProvider(interfaces), registryProvider, kcd, "v2")
+	if err != nil {
+		t.Fatalf("unexpected error creating multi-cluster deployer: %v", err)
+	}
+
+	// start the first wave, whose failure handler halts the rollout
+	ctx := context.Background()
+	states, err := deployer.AsState(nil).Do(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error starting the rollout: %v", err)
+	}
+	states, err = states.States[0].Do(ctx)
+	if err != nil || states.OnFailure == nil {
+		t.Fatalf("expected the wave to handle failures, got %+v, %v", states, err)
+	}
+	onFailure := states.OnFailure
+	states, err = states.States[0].Do(ctx)
+	if err != nil || len(states.States) != 2 {
+		t.Fatalf("expected a state per cluster of the first wave, got %+v, %v", states, err)
+	}
+	clusterA, slowClusterB := states.States[0], states.States[1]
+
+	// cluster a fails while cluster b hasn't been rolled out yet
+	err = runStates(clusterA)
+	if !state.IsPermanent(err) {
+		t.Fatalf("expected permanent failure of cluster a, got %v", err)
+	}
+	onFailure.Fail(ctx, err)
+
+	var rollbackErr error
+	rollback := deployer.Rollback("v1", nil, state.OnFailureFunc(func(ctx context.Context, err error) state.States {
+		rollbackErr = err
+		return state.NewStates()
+	}))
+	if err := runStates(rollback); err != nil {
+		t.Fatalf("unexpected error during rollback: %v", err)
+	}
+	if rollbackErr == nil {
+		t.Errorf("expected the rollback of the failed cluster a to fail")
+	}
+
+	// the slow cluster continues after the rollback but must not roll out the version
+	if err := runStates(slowClusterB); err != nil {
+		t.Fatalf("unexpected error for halted cluster b: %v", err)
+	}
+	if img := deploymentImage(t, clients["b"], namespace); img != "repo/app:v1" {
+		t.Errorf("expected halted cluster b to remain on v1, got %s", img)
+	}
+	for _, action := range clients["c"].Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("expected cluster c of a later wave not to be rolled back, got %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestClusterWaves(t *testing.T) {
+	kcd := &kcd1.KCD{
+		Spec: kcd1.KCDSpec{
+			Clusters: []kcd1.ClusterSpec{
+				{Name: "a"},
+				{Name: "b"},
+				{Name: "c", Wave: 1},
+				{Name: "d", Wave: 1},
+				{Name: "e", Wave: 2},
+			},
+		},
+	}
+
+	var names [][]string
+	for _, wave := range cluster.Waves(kcd) {
+		var wn []string
+		for _, cl := range wave {
+			wn = append(wn, cl.Name)
+		}
+		names = append(names, wn)
+	}
+
+	expected := [][]string{{"a"}, {"b"}, {"c", "d"}, {"e"}}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected waves %v, got %v", expected, names)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/wish/kcd/audit"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/registry"
@@ -16,6 +17,9 @@ import (
 	"k8s.io/client-go/util/retry"
 )
 
+// rolloutCheckInterval is the interval at which the state of rollouts is checked.
+const rolloutCheckInterval = 15 * time.Second
+
 // SimpleDeployer implements a rollout strategy by patching the target's pod spec with a new version.
 type SimpleDeployer struct {
 	cs        kubernetes.Interface
@@ -26,6 +30,12 @@ type SimpleDeployer struct {
 	kcd     *kcd1.KCD
 	version string
 	targets []RolloutTarget
+
+	// rolloutTime is the time the rollout of the version started.
+	rolloutTime time.Time
+
+	// pods contains the most recently observed pod counts for each target.
+	pods map[string]kcd1.PodsStatus
 }
 
 // NewSimpleDeployer returns a new SimpleDeployer instance, which triggers rollouts
@@ -53,6 +63,7 @@ func NewSimpleDeployer(workloadProvider workload.Provider, registryProvider regi
 		kcd:              kcd,
 		version:          version,
 		targets:          workloads,
+		pods:             make(map[string]kcd1.PodsStatus),
 	}, nil
 }
 
@@ -64,10 +75,11 @@ func (sd *SimpleDeployer) Workloads() []workload.Workload {
 // AsState implements the Deployer interface.
 func (sd *SimpleDeployer) AsState(next state.State) state.State {
 	return state.StateFunc(func(ctx context.Context) (state.States, error) {
+		sd.rolloutTime = time.Now().UTC()
 		for _, target := range sd.targets {
 			glog.V(2).Infof("Performing simple deployment: target=%s, version=%s", target.Name(), sd.version)
 
-			err := sd.patchPodSpec(target, sd.version)
+			err := sd.patchPodSpec(ctx, target, sd.version, "rollout")
 			if err != nil {
 				return state.Error(errors.WithStack(err))
 			}
@@ -76,12 +88,13 @@ func (sd *SimpleDeployer) AsState(next state.State) state.State {
 		return state.Single(
 			sd.checkRolloutState(
 				verify.NewVerifiers(sd.cs, sd.registryProvider, sd.namespace, sd.version, sd.kcd.Spec.Strategy.Verify,
-					next)))
+					Soak(sd.cs, sd.namespace, sd.kcd, sd.version, sd.targets, sd.rolloutTime, next))))
 	})
 }
 
 // patchPodSpec patches the rollout target's pod spec with the given version.
-func (sd *SimpleDeployer) patchPodSpec(target RolloutTarget, version string) error {
+// The reason for the change is recorded in the audit log.
+func (sd *SimpleDeployer) patchPodSpec(ctx context.Context, target RolloutTarget, version, reason string) error {
 	var container *v1.Container
 	podSpec := target.PodSpec()
 
@@ -93,6 +106,8 @@ func (sd *SimpleDeployer) patchPodSpec(target RolloutTarget, version string) err
 						version, target.Name(), updateErr)
 					return updateErr
 				}
+				auditChange(ctx, sd.kcd, audit.ActionPatchPodSpec, target.Name(), c.Image,
+					sd.kcd.Spec.ImageRepo+":"+version, reason)
 				container = &c
 			}
 		}
@@ -119,12 +134,12 @@ func (sd *SimpleDeployer) checkRolloutState(next state.State) state.StateFunc {
 				glog.V(2).Infof("Checking rollout state: target=%s, version=%s", target.Name(), sd.version)
 			}
 
-			ok, err := sd.checkRollout(target)
+			ok, err := sd.checkRollout(ctx, target, sd.version, sd.rolloutTime)
 			if err != nil {
 				return state.Error(errors.WithStack(err))
 			}
 			if !ok {
-				return state.After(time.Second*15, sd.checkRolloutState(next))
+				return state.After(rolloutCheckInterval, sd.checkRolloutState(next))
 			}
 		}
 
@@ -133,24 +148,29 @@ func (sd *SimpleDeployer) checkRolloutState(next state.State) state.StateFunc {
 	}
 }
 
-// checkRollout determines whether the rollout of the target has completed successfully.
+// checkRollout determines whether the rollout of the target to the version, started at
+// the given time, has completed successfully.
 // Returns true if the rollout was successful and all pods have been updated.
 // Returns false if the rollout is still progressing.
 // Returns a permanent failure if the rollout failed.
-func (sd *SimpleDeployer) checkRollout(target RolloutTarget) (complete bool, err error) {
-	failed, err := target.RolloutFailed(sd.kcd.Status.CurrStatusTime.Time)
+func (sd *SimpleDeployer) checkRollout(ctx context.Context, target RolloutTarget, version string,
+	rolloutTime time.Time) (complete bool, err error) {
+
+	failed, err := target.RolloutFailed(rolloutTime)
 	if err != nil {
 		return false, errors.Wrapf(err, "failed to check whether rollout failed for %s", target.Name())
 	}
 	if failed {
 		glog.V(1).Infof("Rollout failed for target=%s", target.Name())
-		return false, state.NewFailed("rollout failed for target=%s, version=%s", target.Name(), sd.version)
+		return false, state.NewFailed("rollout failed for target=%s, version=%s", target.Name(), version)
 	}
 
-	success, err := CheckPods(sd.cs, sd.namespace, target, 0, sd.kcd, sd.version)
+	counts, success, err := CheckPods(sd.cs, sd.namespace, target, 0, sd.kcd, version)
 	if err != nil {
 		return false, errors.Wrapf(err, "failed to check pods during rollout for %s", target.Name())
 	}
+	reportPods(ctx, sd.kcd, target, sd.pods[target.Name()], counts)
+	sd.pods[target.Name()] = counts
 	if success {
 		glog.V(1).Infof("Successfully rolled out all pods for target=%s", target.Name())
 		return true, nil
@@ -160,28 +180,70 @@ func (sd *SimpleDeployer) checkRollout(target RolloutTarget) (complete bool, err
 	return false, nil
 }
 
-// Rollback rolls the version of the workload back to its previous state.
-func (sd *SimpleDeployer) Rollback(prevVersion string, next state.State) state.State {
+// Pods implements the ReportsPods interface.
+func (sd *SimpleDeployer) Pods() kcd1.PodsStatus {
+	var result kcd1.PodsStatus
+	for _, counts := range sd.pods {
+		result = addPods(result, counts)
+	}
+	return result
+}
+
+// Rollback implements the SupportsRollback interface by patching the targets with the
+// previous version and waiting for the pods of the previous version like a rollout.
+func (sd *SimpleDeployer) Rollback(prevVersion string, next state.State, onFailure state.OnFailure) state.State {
 	return state.StateFunc(func(ctx context.Context) (state.States, error) {
-		var firstErr error
+		if prevVersion == "" {
+			return onFailure.Fail(ctx, errors.Errorf("no previous version to roll back kcd=%s to", sd.kcd.Name)), nil
+		}
+
+		rollbackTime := time.Now().UTC()
 		for _, target := range sd.targets {
 			glog.V(2).Infof("Performing rollback: target=%s, version=%s", target.Name(), prevVersion)
 
-			err := sd.patchPodSpec(target, prevVersion)
+			err := sd.patchPodSpec(ctx, target, prevVersion, "rollback")
 			if err != nil {
 				err = errors.Wrapf(err, "failed to patch podspec while rolling back target=%s, version=%s", target.Name(), prevVersion)
-				glog.Errorf("failed to patch pod spec during rollback: %v", err)
-				if firstErr == nil {
-					firstErr = err
-				}
+				glog.Errorf("Failed to rollback at least one workload: %v", err)
+				return onFailure.Fail(ctx, err), nil
 			}
 		}
 
-		if firstErr != nil {
-			glog.Errorf("Failed to rollback at least one workload: %v", firstErr)
-			return state.Error(firstErr)
+		return state.Single(sd.checkRollbackState(prevVersion, rollbackTime, next, onFailure))
+	})
+}
+
+// checkRollbackState waits until the pods of each target run the previous version. The
+// rollback fails if a target fails to roll out or if the rollback can't complete before
+// the deadline of the operation.
+func (sd *SimpleDeployer) checkRollbackState(prevVersion string, rollbackTime time.Time, next state.State,
+	onFailure state.OnFailure) state.StateFunc {
+
+	return func(ctx context.Context) (state.States, error) {
+		for _, target := range sd.targets {
+			glog.V(2).Infof("Checking rollback state: target=%s, version=%s", target.Name(), prevVersion)
+
+			ok, err := sd.checkRollout(ctx, target, prevVersion, rollbackTime)
+			if err != nil && state.IsPermanent(err) {
+				return onFailure.Fail(ctx, errors.Wrapf(err, "rollback to version %s failed", prevVersion)), nil
+			}
+			if err != nil {
+				// failures are already being handled, so retry transient errors here rather than
+				// failing the operation
+				glog.Errorf("Failed to check rollback state of target=%s, version=%s (will retry): %v", target.Name(), prevVersion, err)
+			}
+			if ok {
+				continue
+			}
+
+			if deadline, hasDeadline := ctx.Deadline(); hasDeadline && time.Until(deadline) < 2*rolloutCheckInterval {
+				return onFailure.Fail(ctx, errors.Errorf("timed out waiting for rollback of target=%s to version %s",
+					target.Name(), prevVersion)), nil
+			}
+			return state.After(rolloutCheckInterval, sd.checkRollbackState(prevVersion, rollbackTime, next, onFailure))
 		}
 
+		glog.V(1).Infof("Rollback succeeded for kcd=%s, version=%s", sd.kcd.Name, prevVersion)
 		return state.Single(next)
-	})
+	}
 }
@@ -4,16 +4,22 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/wish/kcd/deploy"
 	"github.com/wish/kcd/deploy/fake"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdfake "github.com/wish/kcd/gok8s/client/clientset/versioned/fake"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/state"
 	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	apimacherrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
 	gofake "k8s.io/client-go/kubernetes/fake"
 )
 
@@ -161,3 +167,72 @@ func TestSimpleDeploy(t *testing.T) {
 		t.Errorf("Expected no error when PatchPodSpec returns an error that IS conflict")
 	}
 }
+
+func TestSimpleRollback(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-kcd",
+			Namespace: namespace,
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "repo/app",
+			Selector:  map[string]string{"kcdapp": "app"},
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+		},
+	}
+	var registryProvider registry.Provider
+
+	rollback := func(cs kubernetes.Interface, prevVersion string) (rolledBack bool, failure error) {
+		workloadProvider := workload.NewProvider(cs, kcdfake.NewSimpleClientset(), namespace)
+		sd, err := deploy.NewSimpleDeployer(workloadProvider, registryProvider, kcd, "v2")
+		if err != nil {
+			t.Fatalf("unexpected error creating simple deployer: %v", err)
+		}
+		next := state.StateFunc(func(ctx context.Context) (state.States, error) {
+			rolledBack = true
+			return state.None()
+		})
+		onFailure := state.OnFailureFunc(func(ctx context.Context, err error) state.States {
+			failure = err
+			return state.NewStates()
+		})
+		if err := runStates(sd.Rollback(prevVersion, next, onFailure)); err != nil {
+			t.Fatalf("expected rollback failures to be handled, got error %v", err)
+		}
+		return rolledBack, failure
+	}
+
+	cs := gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v2"))
+	if rolledBack, failure := rollback(cs, "v1"); !rolledBack || failure != nil {
+		t.Errorf("expected rollback to succeed, got rolledBack=%v, failure=%v", rolledBack, failure)
+	}
+	if img := deploymentImage(t, cs, namespace); img != "repo/app:v1" {
+		t.Errorf("expected deployment to be rolled back to v1, got %s", img)
+	}
+
+	/////
+
+	cs = gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v2"))
+	if rolledBack, failure := rollback(cs, ""); rolledBack || failure == nil {
+		t.Errorf("expected rollback without a previous version to fail, got rolledBack=%v", rolledBack)
+	}
+	if img := deploymentImage(t, cs, namespace); img != "repo/app:v2" {
+		t.Errorf("expected deployment not to be changed without a previous version, got %s", img)
+	}
+
+	/////
+
+	failed := appsv1.DeploymentCondition{
+		Type:           appsv1.DeploymentProgressing,
+		Status:         corev1.ConditionFalse,
+		Reason:         "ProgressDeadlineExceeded",
+		LastUpdateTime: metav1.NewTime(time.Now().Add(time.Hour)),
+	}
+	cs = gofake.NewSimpleClientset(newMultiClusterDeployment(namespace, "v2", failed))
+	if rolledBack, failure := rollback(cs, "v1"); rolledBack || failure == nil {
+		t.Errorf("expected failed rollback to be escalated, got rolledBack=%v", rolledBack)
+	}
+}
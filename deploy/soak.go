@@ -0,0 +1,167 @@
+package deploy
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/state"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// soakCheckInterval is the interval at which the health of workloads is checked
+	// while soaking a rollout.
+	soakCheckInterval = 15 * time.Second
+
+	reasonCrashLoopBackOff = "CrashLoopBackOff"
+)
+
+// SoakDuration returns the duration for which a successful rollout of the KCD resource
+// is watched before being considered a success.
+func SoakDuration(kcd *kcd1.KCD) time.Duration {
+	return time.Duration(kcd.Spec.Strategy.SoakSeconds) * time.Second
+}
+
+// podHealth records the observed health of a pod's kcd managed container.
+type podHealth struct {
+	restarts int32
+	ready    bool
+}
+
+// healthWatch watches the pods of rollout targets for signs of degradation after
+// a rollout has completed.
+type healthWatch struct {
+	cs        kubernetes.Interface
+	namespace string
+
+	kcd         *kcd1.KCD
+	version     string
+	targets     []RolloutTarget
+	rolloutTime time.Time
+
+	deadline time.Time
+	pods     map[string]podHealth
+}
+
+// Soak returns a state that watches the health of the given targets for the soak duration
+// defined by the KCD resource before moving on to the next state. The rollout is
+// permanently failed if, during that window, a target's rollout started at rolloutTime
+// fails or the kcd managed container of one of its pods restarts, enters CrashLoopBackOff
+// or stops being ready.
+func Soak(cs kubernetes.Interface, namespace string, kcd *kcd1.KCD, version string, targets []RolloutTarget,
+	rolloutTime time.Time, next state.State) state.State {
+
+	return soakFor(cs, namespace, kcd, version, targets, rolloutTime, SoakDuration(kcd), next)
+}
+
+// soakFor returns a state that watches the health of the given targets for the given
+// duration, like Soak.
+func soakFor(cs kubernetes.Interface, namespace string, kcd *kcd1.KCD, version string, targets []RolloutTarget,
+	rolloutTime time.Time, soak time.Duration, next state.State) state.State {
+
+	return state.StateFunc(func(ctx context.Context) (state.States, error) {
+		if soak <= 0 {
+			return state.Single(next)
+		}
+
+		glog.V(1).Infof("Soaking rollout of kcd=%s, version=%s for %v", kcd.Name, version, soak)
+
+		hw := &healthWatch{
+			cs:          cs,
+			namespace:   namespace,
+			kcd:         kcd,
+			version:     version,
+			targets:     targets,
+			rolloutTime: rolloutTime,
+			deadline:    time.Now().UTC().Add(soak),
+			pods:        make(map[string]podHealth),
+		}
+		return state.Single(hw.check(next))
+	})
+}
+
+// check inspects the health of all targets and either fails the rollout, continues
+// watching or moves on to the next state once the soak duration has elapsed.
+func (hw *healthWatch) check(next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		for _, target := range hw.targets {
+			if err := hw.checkTarget(target); err != nil {
+				return state.Error(err)
+			}
+		}
+
+		if !time.Now().UTC().Before(hw.deadline) {
+			glog.V(1).Infof("Soak completed for kcd=%s, version=%s", hw.kcd.Name, hw.version)
+			return state.Single(next)
+		}
+
+		glog.V(4).Infof("Soaking kcd=%s, version=%s until %v", hw.kcd.Name, hw.version, hw.deadline)
+		return state.After(soakCheckInterval, hw.check(next))
+	}
+}
+
+// checkTarget returns a permanent failure if the target shows signs of degradation.
+func (hw *healthWatch) checkTarget(target RolloutTarget) error {
+	failed, err := target.RolloutFailed(hw.rolloutTime)
+	if err != nil {
+		return errors.Wrapf(err, "failed to check whether rollout failed for %s", target.Name())
+	}
+	if failed {
+		glog.V(1).Infof("Rollout failed during soak for target=%s", target.Name())
+		return state.NewFailed("rollout failed during soak for target=%s, version=%s", target.Name(), hw.version)
+	}
+
+	pods, err := ActivePodsForTarget(hw.cs, hw.namespace, target)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get pods during soak for target %s", target.Name())
+	}
+
+	for _, pod := range pods {
+		cs := hw.containerStatus(pod)
+		if cs == nil {
+			continue
+		}
+
+		if cs.State.Waiting != nil && cs.State.Waiting.Reason == reasonCrashLoopBackOff {
+			glog.V(1).Infof("Pod %s is in %s during soak for target=%s", pod.Name, reasonCrashLoopBackOff, target.Name())
+			return state.NewFailed("pod %s of target %s is in %s", pod.Name, target.Name(), reasonCrashLoopBackOff)
+		}
+
+		curr := podHealth{
+			restarts: cs.RestartCount,
+			ready:    CheckPodRunningState(pod),
+		}
+		prev, seen := hw.pods[pod.Name]
+		hw.pods[pod.Name] = curr
+
+		if !seen {
+			continue
+		}
+		if curr.restarts > prev.restarts {
+			glog.V(1).Infof("Pod %s restarted during soak for target=%s: restarts=%d", pod.Name, target.Name(), curr.restarts)
+			return state.NewFailed("container %s of pod %s restarted %d times during soak", cs.Name, pod.Name,
+				curr.restarts-prev.restarts)
+		}
+		if prev.ready && !curr.ready {
+			glog.V(1).Infof("Pod %s stopped being ready during soak for target=%s", pod.Name, target.Name())
+			return state.NewFailed("pod %s of target %s stopped being ready during soak", pod.Name, target.Name())
+		}
+	}
+
+	return nil
+}
+
+// containerStatus returns the status of the kcd managed container of the pod, or nil if
+// the container has no status.
+func (hw *healthWatch) containerStatus(pod corev1.Pod) *corev1.ContainerStatus {
+	for i, cs := range pod.Status.ContainerStatuses {
+		if cs.Name == hw.kcd.Spec.Container.Name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package deploy_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wish/kcd/deploy"
+	"github.com/wish/kcd/deploy/fake"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/state"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newSoakPod(namespace string, restarts int32, ready bool) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-pod",
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "app"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: containerName, Ready: ready, RestartCount: restarts},
+			},
+		},
+	}
+}
+
+func updatePod(t *testing.T, cs kubernetes.Interface, pod *corev1.Pod) {
+	if _, err := cs.CoreV1().Pods(pod.Namespace).UpdateStatus(context.TODO(), pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unexpected error updating pod: %v", err)
+	}
+}
+
+// soakStep runs the given state and returns the single state that follows it.
+func soakStep(t *testing.T, st state.State) (state.State, error) {
+	states, err := st.Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if len(states.States) != 1 {
+		t.Fatalf("expected a single following state, got %d", len(states.States))
+	}
+	return states.States[0], nil
+}
+
+func TestSoak(t *testing.T) {
+	namespace := "test-namespace"
+	kcd := &kcd1.KCD{
+		Spec: kcd1.KCDSpec{
+			Container: kcd1.ContainerSpec{
+				Name: containerName,
+			},
+		},
+	}
+	target := fake.NewRolloutTarget()
+	target.FakePodSelector = "app=app"
+	targets := []deploy.RolloutTarget{target}
+
+	next := state.StateFunc(func(ctx context.Context) (state.States, error) {
+		return state.None()
+	})
+	rolloutTime := time.Now().UTC().Add(-time.Minute)
+
+	// no soak configured
+	cs := gofake.NewSimpleClientset(newSoakPod(namespace, 0, true))
+	st, err := soakStep(t, deploy.Soak(cs, namespace, kcd, "v2", targets, rolloutTime, next))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := st.(*state.AfterState); ok {
+		t.Errorf("expected soak to be skipped when no soak time is defined")
+	}
+
+	/////
+
+	kcd.Spec.Strategy.SoakSeconds = 3600
+
+	st, err = soakStep(t, deploy.Soak(cs, namespace, kcd, "v2", targets, rolloutTime, next))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	st, err = soakStep(t, st)
+	if err != nil {
+		t.Fatalf("unexpected error for healthy pods: %v", err)
+	}
+	if _, ok := st.(*state.AfterState); !ok {
+		t.Fatalf("expected soak to keep watching healthy pods")
+	}
+
+	updatePod(t, cs, newSoakPod(namespace, 1, true))
+	if _, err = soakStep(t, st); !state.IsPermanent(err) {
+		t.Errorf("expected permanent failure after a container restart, got %v", err)
+	}
+
+	/////
+
+	cs = gofake.NewSimpleClientset(newSoakPod(namespace, 0, true))
+	st, _ = soakStep(t, deploy.Soak(cs, namespace, kcd, "v2", targets, rolloutTime, next))
+	st, _ = soakStep(t, st)
+
+	updatePod(t, cs, newSoakPod(namespace, 0, false))
+	if _, err = soakStep(t, st); !state.IsPermanent(err) {
+		t.Errorf("expected permanent failure after a pod stopped being ready, got %v", err)
+	}
+
+	/////
+
+	crashing := newSoakPod(namespace, 0, false)
+	crashing.Status.ContainerStatuses[0].State.Waiting = &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+	cs = gofake.NewSimpleClientset(crashing)
+	st, _ = soakStep(t, deploy.Soak(cs, namespace, kcd, "v2", targets, rolloutTime, next))
+	if _, err = soakStep(t, st); !state.IsPermanent(err) {
+		t.Errorf("expected permanent failure for a crash looping pod, got %v", err)
+	}
+
+	/////
+
+	target.FakeRolloutFailed = true
+	cs = gofake.NewSimpleClientset(newSoakPod(namespace, 0, true))
+	st, _ = soakStep(t, deploy.Soak(cs, namespace, kcd, "v2", targets, rolloutTime, next))
+	if _, err = soakStep(t, st); !state.IsPermanent(err) {
+		t.Errorf("expected permanent failure when the rollout failed, got %v", err)
+	}
+	if !target.RolloutTime.Equal(rolloutTime) {
+		t.Errorf("expected rollout failure to be checked since the rollout time %v, got %v", rolloutTime, target.RolloutTime)
+	}
+}
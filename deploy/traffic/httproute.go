@@ -0,0 +1,98 @@
+package traffic
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// HTTPRouteResource is the resource of Gateway API HTTPRoutes.
+var HTTPRouteResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1",
+	Resource: "httproutes",
+}
+
+// httpRoute is a Router that sets the weights of the service backendRefs of the rules
+// of a Gateway API HTTPRoute.
+type httpRoute struct {
+	client dynamic.ResourceInterface
+	name   string
+
+	stable map[string]bool
+	canary map[string]bool
+}
+
+// String implements the Router interface.
+func (r *httpRoute) String() string {
+	return fmt.Sprintf("%s %s", KindHTTPRoute, r.name)
+}
+
+// SetWeight implements the Router interface. Backends that are neither stable nor canary
+// services are left as they are.
+func (r *httpRoute) SetWeight(ctx context.Context, percent int) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		route, err := r.client.Get(ctx, r.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		rules, _, err := unstructured.NestedSlice(route.Object, "spec", "rules")
+		if err != nil {
+			return errors.Wrapf(err, "invalid rules")
+		}
+		var hasStable, hasCanary bool
+		for _, rule := range rules {
+			ruleMap, ok := rule.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			refs, _ := ruleMap["backendRefs"].([]interface{})
+			for _, ref := range refs {
+				refMap, ok := ref.(map[string]interface{})
+				if !ok || !isServiceRef(refMap, route.GetNamespace()) {
+					continue
+				}
+				name, _ := refMap["name"].(string)
+				switch {
+				case r.stable[name]:
+					refMap["weight"] = int64(100 - percent)
+					hasStable = true
+				case r.canary[name]:
+					refMap["weight"] = int64(percent)
+					hasCanary = true
+				}
+			}
+		}
+		if !hasStable || !hasCanary {
+			return errors.Errorf("found no backendRefs for both the stable services %v and the canary services %v",
+				keys(r.stable), keys(r.canary))
+		}
+		if err := unstructured.SetNestedSlice(route.Object, rules, "spec", "rules"); err != nil {
+			return errors.WithStack(err)
+		}
+
+		glog.V(2).Infof("Setting canary weight of %s to %d%%", r, percent)
+		_, err = r.client.Update(ctx, route, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set weights of %s", r)
+	}
+	return nil
+}
+
+// isServiceRef returns whether the backendRef refers to a service in the namespace.
+func isServiceRef(ref map[string]interface{}, namespace string) bool {
+	group, _ := ref["group"].(string)
+	kind, _ := ref["kind"].(string)
+	ns, _ := ref["namespace"].(string)
+	return group == "" && (kind == "" || kind == "Service") && (ns == "" || ns == namespace)
+}
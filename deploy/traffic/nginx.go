@@ -0,0 +1,112 @@
+package traffic
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/util/retry"
+)
+
+// IngressResource is the resource of Ingresses.
+var IngressResource = schema.GroupVersionResource{
+	Group:    "networking.k8s.io",
+	Version:  "v1",
+	Resource: "ingresses",
+}
+
+// Annotations of NGINX ingress canary Ingresses.
+const (
+	AnnotationNginxCanary       = "nginx.ingress.kubernetes.io/canary"
+	AnnotationNginxCanaryWeight = "nginx.ingress.kubernetes.io/canary-weight"
+)
+
+// nginxCanary is a Router that sets the canary weight of an NGINX ingress canary Ingress.
+// The canary Ingress must route to the canary services only, the stable services are
+// routed to by the main Ingress of the same host.
+type nginxCanary struct {
+	client dynamic.ResourceInterface
+	name   string
+
+	canary map[string]bool
+}
+
+// String implements the Router interface.
+func (r *nginxCanary) String() string {
+	return fmt.Sprintf("%s %s", KindNginxIngress, r.name)
+}
+
+// SetWeight implements the Router interface.
+func (r *nginxCanary) SetWeight(ctx context.Context, percent int) error {
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ingress, err := r.client.Get(ctx, r.name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		backends, err := ingressBackends(ingress)
+		if err != nil {
+			return err
+		}
+		if len(backends) == 0 {
+			return errors.New("found no service backends")
+		}
+		for _, backend := range backends {
+			if !r.canary[backend] {
+				return errors.Errorf("backend service %s is not one of the canary services %v", backend, keys(r.canary))
+			}
+		}
+
+		annotations := ingress.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[AnnotationNginxCanary] = "true"
+		annotations[AnnotationNginxCanaryWeight] = strconv.Itoa(percent)
+		ingress.SetAnnotations(annotations)
+
+		glog.V(2).Infof("Setting canary weight of %s to %d%%", r, percent)
+		_, err = r.client.Update(ctx, ingress, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to set canary weight of %s", r)
+	}
+	return nil
+}
+
+// ingressBackends returns the names of the services the ingress routes to.
+func ingressBackends(ingress *unstructured.Unstructured) ([]string, error) {
+	var backends []string
+	if name, found, _ := unstructured.NestedString(ingress.Object, "spec", "defaultBackend", "service", "name"); found {
+		backends = append(backends, name)
+	}
+
+	rules, _, err := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rules")
+	}
+	for _, rule := range rules {
+		ruleMap, ok := rule.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		paths, _, _ := unstructured.NestedSlice(ruleMap, "http", "paths")
+		for _, path := range paths {
+			pathMap, ok := path.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if name, found, _ := unstructured.NestedString(pathMap, "backend", "service", "name"); found {
+				backends = append(backends, name)
+			}
+		}
+	}
+	return backends, nil
+}
@@ -0,0 +1,118 @@
+package traffic
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// Kinds of traffic routers.
+const (
+	// KindHTTPRoute shifts traffic by setting the weights of the backendRefs of a Gateway
+	// API HTTPRoute.
+	KindHTTPRoute = "HTTPRoute"
+	// KindNginxIngress shifts traffic by setting the canary weight of an NGINX ingress
+	// canary Ingress.
+	KindNginxIngress = "NginxIngress"
+)
+
+// DefaultSteps are the percentages of traffic shifted to the new workload if the
+// traffic spec doesn't define any.
+var DefaultSteps = []int{5, 25, 100}
+
+// Router shifts traffic between stable and canary services.
+type Router interface {
+	// SetWeight sends the given percentage of traffic to the canary services and the
+	// rest to the stable services.
+	SetWeight(ctx context.Context, percent int) error
+
+	// String returns a description of the routing resource.
+	String() string
+}
+
+// NewRouter returns a Router of the kind defined by the traffic spec, which shifts
+// traffic from the stable to the canary services in the given namespace.
+func NewRouter(dc dynamic.Interface, namespace string, spec kcd1.TrafficSpec, stable, canary []string) (Router, error) {
+	if err := Validate(spec); err != nil {
+		return nil, err
+	}
+	if dc == nil {
+		return nil, errors.Errorf("no dynamic client available for traffic router %s %s", spec.Kind, spec.Name)
+	}
+	if len(canary) == 0 {
+		return nil, errors.Errorf("traffic router %s %s requires canary services", spec.Kind, spec.Name)
+	}
+
+	switch spec.Kind {
+	case KindHTTPRoute:
+		if len(stable) == 0 {
+			return nil, errors.Errorf("traffic router %s %s requires stable services", spec.Kind, spec.Name)
+		}
+		return &httpRoute{
+			client: dc.Resource(HTTPRouteResource).Namespace(namespace),
+			name:   spec.Name,
+			stable: toSet(stable),
+			canary: toSet(canary),
+		}, nil
+	default:
+		return &nginxCanary{
+			client: dc.Resource(IngressResource).Namespace(namespace),
+			name:   spec.Name,
+			canary: toSet(canary),
+		}, nil
+	}
+}
+
+// Validate checks that the traffic spec is valid.
+func Validate(spec kcd1.TrafficSpec) error {
+	if spec.Kind != KindHTTPRoute && spec.Kind != KindNginxIngress {
+		return errors.Errorf("unknown traffic router kind %q, expected %s or %s", spec.Kind, KindHTTPRoute, KindNginxIngress)
+	}
+	if spec.Name == "" {
+		return errors.Errorf("no name defined for traffic router %s", spec.Kind)
+	}
+	prev := 0
+	for _, step := range spec.Steps {
+		if step <= prev || step > 100 {
+			return errors.Errorf("traffic steps %v must be increasing percentages of at most 100", spec.Steps)
+		}
+		prev = step
+	}
+	if spec.StepSeconds < 0 {
+		return errors.Errorf("step seconds %d must not be negative", spec.StepSeconds)
+	}
+	return nil
+}
+
+// Steps returns the percentages of traffic shifted to the new workload, which always
+// end with 100.
+func Steps(spec kcd1.TrafficSpec) []int {
+	steps := spec.Steps
+	if len(steps) == 0 {
+		steps = DefaultSteps
+	}
+	if steps[len(steps)-1] < 100 {
+		steps = append(append([]int{}, steps...), 100)
+	}
+	return steps
+}
+
+func toSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+func keys(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for k := range set {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,168 @@
+package traffic
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const namespace = "test-namespace"
+
+func newHTTPRoute(backends ...string) *unstructured.Unstructured {
+	var refs []interface{}
+	for _, backend := range backends {
+		refs = append(refs, map[string]interface{}{"name": backend, "port": int64(80)})
+	}
+	refs = append(refs, map[string]interface{}{"group": "example.com", "kind": "Bucket", "name": "app"})
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "gateway.networking.k8s.io/v1",
+		"kind":       "HTTPRoute",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": namespace},
+		"spec": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{"backendRefs": refs},
+			},
+		},
+	}}
+}
+
+func newIngress(name, backend string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.k8s.io/v1",
+		"kind":       "Ingress",
+		"metadata":   map[string]interface{}{"name": name, "namespace": namespace},
+		"spec": map[string]interface{}{
+			"rules": []interface{}{
+				map[string]interface{}{
+					"host": "app.example.com",
+					"http": map[string]interface{}{
+						"paths": []interface{}{
+							map[string]interface{}{
+								"path":     "/",
+								"pathType": "Prefix",
+								"backend": map[string]interface{}{
+									"service": map[string]interface{}{"name": backend},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func backendWeights(t *testing.T, route *unstructured.Unstructured) map[string]int64 {
+	rules, _, err := unstructured.NestedSlice(route.Object, "spec", "rules")
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	weights := map[string]int64{}
+	for _, ref := range rules[0].(map[string]interface{})["backendRefs"].([]interface{}) {
+		refMap := ref.(map[string]interface{})
+		if weight, ok := refMap["weight"]; ok {
+			weights[refMap["name"].(string)] = weight.(int64)
+		}
+	}
+	return weights
+}
+
+func TestHTTPRoute(t *testing.T) {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newHTTPRoute("app", "app-verify"), newIngress("other", "app"))
+	spec := kcd1.TrafficSpec{Kind: KindHTTPRoute, Name: "app"}
+
+	router, err := NewRouter(dc, namespace, spec, []string{"app"}, []string{"app-verify"})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	for _, percent := range []int{5, 25, 0} {
+		if err := router.SetWeight(context.Background(), percent); err != nil {
+			t.Fatalf("failed to set weight: %v", err)
+		}
+		route, err := dc.Resource(HTTPRouteResource).Namespace(namespace).Get(context.Background(), "app", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get route: %v", err)
+		}
+		expected := map[string]int64{"app": int64(100 - percent), "app-verify": int64(percent)}
+		if weights := backendWeights(t, route); !reflect.DeepEqual(weights, expected) {
+			t.Errorf("expected weights %v, got %v", expected, weights)
+		}
+	}
+
+	// the route must have a backend for both stable and canary services
+	router, err = NewRouter(dc, namespace, spec, []string{"app"}, []string{"app-canary"})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.SetWeight(context.Background(), 5); err == nil {
+		t.Errorf("expected error for missing canary backend")
+	}
+}
+
+func TestNginxCanary(t *testing.T) {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newIngress("app-canary", "app-verify"), newIngress("app-wrong", "app"))
+
+	router, err := NewRouter(dc, namespace, kcd1.TrafficSpec{Kind: KindNginxIngress, Name: "app-canary"},
+		[]string{"app"}, []string{"app-verify"})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.SetWeight(context.Background(), 25); err != nil {
+		t.Fatalf("failed to set weight: %v", err)
+	}
+	ingress, err := dc.Resource(IngressResource).Namespace(namespace).Get(context.Background(), "app-canary", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get ingress: %v", err)
+	}
+	expected := map[string]string{AnnotationNginxCanary: "true", AnnotationNginxCanaryWeight: "25"}
+	if annotations := ingress.GetAnnotations(); !reflect.DeepEqual(annotations, expected) {
+		t.Errorf("expected annotations %v, got %v", expected, annotations)
+	}
+
+	// a canary ingress routing to the stable services would shift traffic the wrong way
+	router, err = NewRouter(dc, namespace, kcd1.TrafficSpec{Kind: KindNginxIngress, Name: "app-wrong"},
+		[]string{"app"}, []string{"app-verify"})
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	if err := router.SetWeight(context.Background(), 25); err == nil {
+		t.Errorf("expected error for canary ingress routing to stable service")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, spec := range []kcd1.TrafficSpec{
+		{Kind: KindHTTPRoute, Name: "app"},
+		{Kind: KindNginxIngress, Name: "app", Steps: []int{10, 50}, StepSeconds: 60},
+	} {
+		if err := Validate(spec); err != nil {
+			t.Errorf("%v: unexpected error: %v", spec, err)
+		}
+	}
+	for _, spec := range []kcd1.TrafficSpec{
+		{Kind: "Istio", Name: "app"},
+		{Kind: KindHTTPRoute},
+		{Kind: KindHTTPRoute, Name: "app", Steps: []int{25, 5}},
+		{Kind: KindHTTPRoute, Name: "app", Steps: []int{0, 50}},
+		{Kind: KindHTTPRoute, Name: "app", Steps: []int{50, 150}},
+		{Kind: KindHTTPRoute, Name: "app", StepSeconds: -1},
+	} {
+		if err := Validate(spec); err == nil {
+			t.Errorf("%v: expected error", spec)
+		}
+	}
+
+	if steps := Steps(kcd1.TrafficSpec{}); !reflect.DeepEqual(steps, []int{5, 25, 100}) {
+		t.Errorf("unexpected default steps %v", steps)
+	}
+	if steps := Steps(kcd1.TrafficSpec{Steps: []int{10, 50}}); !reflect.DeepEqual(steps, []int{10, 50, 100}) {
+		t.Errorf("expected steps to end with 100, got %v", steps)
+	}
+}
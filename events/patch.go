@@ -3,17 +3,28 @@ package events
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/mitchellh/mapstructure"
-	"github.com/wish/kcd/gok8s/client/clientset/versioned"
-	"github.com/wish/kcd/registry/ecr"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/audit"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdlisters "github.com/wish/kcd/gok8s/client/listers/custom/v1"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/registry/pullsecret"
 	"github.com/wish/kcd/stats"
 	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
 )
 
 const (
@@ -21,9 +32,29 @@ const (
 
 	KcdAppName = "kcdapp"
 
+	// ContainerPatchPath is the path of the containers of workloads with a pod template,
+	// such as Deployments, StatefulSets, DaemonSets and Jobs.
 	ContainerPatchPath = "/spec/template/spec/containers"
+
+	// CronJobContainerPatchPath is the path of the containers of CronJobs.
+	CronJobContainerPatchPath = "/spec/jobTemplate/spec/template/spec/containers"
+
+	// PodContainerPatchPath is the path of the containers of Pods.
+	PodContainerPatchPath = "/spec/containers"
 )
 
+// containerPatchPaths maps the kinds of workloads handled by the webhook to the path of
+// their containers.
+var containerPatchPaths = map[string]string{
+	"Deployment":  ContainerPatchPath,
+	"StatefulSet": ContainerPatchPath,
+	"DaemonSet":   ContainerPatchPath,
+	"ReplicaSet":  ContainerPatchPath,
+	"Job":         ContainerPatchPath,
+	"CronJob":     CronJobContainerPatchPath,
+	"Pod":         PodContainerPatchPath,
+}
+
 // objectWithMeta allows us to unmarshal just the ObjectMeta of a k8s object
 type objectWithMeta struct {
 	metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
@@ -42,7 +73,11 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-var versionRegex, _ = regexp.Compile(ecr.VersionRegex)
+// newRegistryProvider returns the registry provider used to resolve tags for the KCD
+// resource. Replaced in tests.
+var newRegistryProvider = func(kcd *kcd1.KCD, stats stats.Stats) (registry.Provider, error) {
+	return providers.NewProvider(kcd, stats)
+}
 
 // Get the container image string value addressed by nameParts
 func (r Record) Get(nameParts []string, cName string) (string, string, bool) {
@@ -66,27 +101,31 @@ func (r Record) Get(nameParts []string, cName string) (string, string, bool) {
 		}
 	}
 
-	containers := val.([]interface{})
-	matched := false
+	containers, ok := val.([]interface{})
+	if !ok {
+		return "", "-1", false
+	}
 	for idx, container := range containers {
 		var cd containaerData
 		mapstructure.Decode(container, &cd)
 		if cd.Name == cName {
-			matched = true
 			glog.V(4).Infof("Found specified container name, start patching: %s", cName)
 			return cd.Image, strconv.Itoa(idx), true
 		}
 	}
 
-	if !matched {
-		glog.V(4).Infof("Could not find specified container name: %s", cName)
-	}
-
+	glog.V(4).Infof("Could not find specified container name: %s", cName)
 	return "", "-1", false
 }
 
-// Mutate tag applied by flux to version
-func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned.Clientset) *v1.AdmissionResponse {
+// Mutate replaces image tags applied by GitOps tools, such as flux, with the version managed
+// by the KCD resources that select the workload. Workloads are matched against the selector
+// of each KCD resource in their namespace, as listed by kcdLister. Registry lookups use the credentials of the
+// registrySecretRef of the KCD resource or of the image pull secrets of the workload, which
+// are read with cs if not nil. Patches are recorded in the audit log.
+func Mutate(req *v1.AdmissionRequest, stats stats.Stats, cs kubernetes.Interface, kcdLister kcdlisters.KCDLister,
+	auditLogger audit.Logger) *v1.AdmissionResponse {
+
 	var newManifest objectWithMeta
 
 	if err := json.Unmarshal(req.Object.Raw, &newManifest); err != nil {
@@ -98,42 +137,20 @@ func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned
 		}
 	}
 
-	// We will use existing kcdapp label to locate container name
-	var kcdName string
-	if kcdAppName, ok := newManifest.Labels[KcdAppName]; !ok {
-		glog.Infof("Can not find kcdapp label in manifest under name: %s and namespace: %s", newManifest.Name, newManifest.Namespace)
+	containerPath, ok := containerPatchPaths[req.Kind.Kind]
+	if !ok {
+		glog.V(4).Infof("Not patching unsupported kind %s: %s/%s", req.Kind.Kind, req.Namespace, newManifest.Name)
 		return &v1.AdmissionResponse{
 			UID:     req.UID,
 			Allowed: true,
 			Result: &metav1.Status{
-				Message: "Can not find kcdapp label in manifest",
+				Message: "Patching is not supported for kind " + req.Kind.Kind,
 			},
 		}
-	} else {
-		kcdName = kcdAppName + "-kcd"
 	}
-	// Retrieve kcd resource
-	kcd, err := customClient.CustomV1().KCDs(newManifest.Namespace).Get(context.TODO(), kcdName, metav1.GetOptions{})
-
-	if err != nil {
-		glog.Errorf("Failed to find KCD resource in namespace=%s, name=%s, error=%v", newManifest.Namespace, newManifest.Name, err)
-		return &v1.AdmissionResponse{
-			Allowed: true,
-			UID:     req.UID,
-			Result: &metav1.Status{
-				Message: "Can not retrieve KCD resources",
-			},
-		}
-	} else {
-		glog.Infof("Kcd resource got: %v", kcd)
-	}
-
-	glog.V(4).Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v KCD=%v",
-		req.Kind, req.Namespace, req.Name, newManifest.Name, req.UID, req.Operation, req.UserInfo, kcd)
 
 	// We only check if any labels for disabling
-	v, ok := newManifest.Labels[EnabledLabel]
-	if ok {
+	if v, ok := newManifest.Labels[EnabledLabel]; ok {
 		// if enable label is FALSE or not boolean, pass the checking
 		if b, err := strconv.ParseBool(v); err != nil {
 			glog.V(4).Infof("Label kcd-version-patcher.wish.com/enabled is not boolean: %v", v)
@@ -156,11 +173,36 @@ func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned
 		}
 	}
 
-	containerName := kcd.Spec.Container.Name
-	glog.V(4).Infof("KCD resource container name to patch %s", containerName)
+	namespace := newManifest.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	kcds, err := selectingKCDs(kcdLister, namespace, newManifest.Labels)
+	if err != nil {
+		glog.Errorf("Failed to find KCD resources in namespace=%s, name=%s, error=%v", namespace, newManifest.Name, err)
+		return &v1.AdmissionResponse{
+			Allowed: true,
+			UID:     req.UID,
+			Result: &metav1.Status{
+				Message: "Can not retrieve KCD resources",
+			},
+		}
+	}
+	if len(kcds) == 0 {
+		glog.V(4).Infof("No KCD resource selects %s %s/%s", req.Kind.Kind, namespace, newManifest.Name)
+		return &v1.AdmissionResponse{
+			UID:     req.UID,
+			Allowed: true,
+			Result: &metav1.Status{
+				Message: "No KCD resource selects the workload",
+			},
+		}
+	}
 
-	var currentMap map[string]interface{}
+	glog.V(4).Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v KCDs=%d",
+		req.Kind, req.Namespace, req.Name, newManifest.Name, req.UID, req.Operation, req.UserInfo, len(kcds))
 
+	var currentMap map[string]interface{}
 	if req.OldObject.Raw != nil {
 		if err := json.Unmarshal(req.OldObject.Raw, &currentMap); err != nil {
 			return &v1.AdmissionResponse{
@@ -180,17 +222,54 @@ func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned
 		}
 	}
 
-	patches, ok := patchForContainer(containerName, Record(currentMap), Record(newMap), stats)
+	podSpecs := []corev1.PodSpec{podSpecOf(Record(newMap), containerPath)}
+	credentials := func(kcd *kcd1.KCD) (context.Context, error) {
+		if cs == nil {
+			return context.Background(), nil
+		}
+		return pullsecret.WithCredentials(context.Background(), cs, kcd.Namespace, providers.Source(kcd),
+			kcd.Spec.RegistrySecretRef, podSpecs)
+	}
 
-	// if we tried to patch the container name specified in path, but not successful.
-	if !ok {
-		glog.Errorf("Patching service container %v is failed", Record(currentMap))
-		return &v1.AdmissionResponse{
-			Allowed: true,
-			UID:     req.UID,
-			Result: &metav1.Status{
-				Message: "Patching is not successful",
-			},
+	var patches []patchOperation
+	patched := map[string]patchOperation{}
+	var auditEntries []audit.Entry
+	for _, kcd := range kcds {
+		glog.V(4).Infof("KCD resource %s container name to patch %s", kcd.Name, kcd.Spec.Container.Name)
+
+		kcdPatches, ok := patchForContainer(kcd, containerPath, Record(currentMap), Record(newMap), stats, credentials)
+		// if we tried to patch the container name specified in path, but not successful.
+		if !ok {
+			glog.Errorf("Patching service container %s for kcd %s is failed", kcd.Spec.Container.Name, kcd.Name)
+			return &v1.AdmissionResponse{
+				Allowed: true,
+				UID:     req.UID,
+				Result: &metav1.Status{
+					Message: "Patching is not successful",
+				},
+			}
+		}
+		for _, patch := range kcdPatches {
+			// KCD resources that select the workload and manage the same container patch
+			// the same path, which may only be patched once
+			if prev, ok := patched[patch.Path]; ok {
+				if prev.Value != patch.Value {
+					glog.Warningf("Not patching %s of %s %s/%s with %v of kcd %s, already patched with %v",
+						patch.Path, req.Kind.Kind, namespace, newManifest.Name, patch.Value, kcd.Name, prev.Value)
+				}
+				continue
+			}
+			patched[patch.Path] = patch
+			patches = append(patches, patch)
+
+			entry := audit.ForKCD(kcd, audit.SourceWebhook, req.UserInfo.Username, audit.ActionPatchPodSpec)
+			entry.Target = fmt.Sprintf("%s/%s", req.Kind.Kind, newManifest.Name)
+			if image, _, ok := Record(newMap).Get(strings.Split(strings.Trim(containerPath, "/"), "/"), kcd.Spec.Container.Name); ok {
+				entry.Old = image
+			}
+			entry.New = fmt.Sprint(patch.Value)
+			entry.Reason = "keep version managed by kcd"
+			auditEntries = append(auditEntries, entry)
 		}
 	}
 
@@ -214,6 +293,9 @@ func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned
 	}
 
 	glog.V(4).Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	for _, entry := range auditEntries {
+		auditLogger.Log(entry)
+	}
 	return &v1.AdmissionResponse{
 		Allowed: true,
 		UID:     req.UID,
@@ -225,67 +307,151 @@ func Mutate(req *v1.AdmissionRequest, stats stats.Stats, customClient *versioned
 	}
 }
 
-// patchForPath returns any patches required to get the value at path to match
-// in replacement if already set in current
-func patchForContainer(cName string, current, replacement Record, stats stats.Stats) ([]patchOperation, bool) {
+// selectingKCDs returns the KCD resources in the namespace whose selector matches the
+// given workload labels. The returned resources are shared with the lister's cache and
+// must not be modified.
+func selectingKCDs(kcdLister kcdlisters.KCDLister, namespace string, workloadLabels map[string]string) ([]*kcd1.KCD, error) {
+	if kcdLister == nil {
+		return nil, errors.New("no KCD lister configured")
+	}
 
-	// We use constant path to retrieve the specified container
-	pathParts := strings.Split(strings.Trim(ContainerPatchPath, "/"), "/")
+	list, err := kcdLister.KCDs(namespace).List(labels.Everything())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list KCD resources in namespace %s", namespace)
+	}
 
-	// If the current one doesn't have the value, we're okay to let this pass
-	imageRepo, _, ok := current.Get(pathParts, cName)
-	if !ok {
-		glog.V(4).Infof("Error getting current image repo container name: %v", cName)
-		return nil, false
+	var result []*kcd1.KCD
+	for _, kcd := range list {
+		if len(kcd.Spec.Selector) == 0 {
+			continue
+		}
+		if labels.SelectorFromSet(kcd.Spec.Selector).Matches(labels.Set(workloadLabels)) {
+			result = append(result, kcd)
+		}
 	}
+	return result, nil
+}
+
+// splitImage returns the repository and tag of an image.
+func splitImage(image string) (repo, tag string) {
+	idx := strings.LastIndex(image, ":")
+	if idx < 0 || idx < strings.LastIndex(image, "/") {
+		return image, ""
+	}
+	return image[:idx], image[idx+1:]
+}
+
+// credentialsFunc returns a context with the registry credentials of the KCD resource.
+type credentialsFunc func(kcd *kcd1.KCD) (context.Context, error)
+
+// podSpecOf returns the pod spec of the workload whose containers are at containerPath.
+func podSpecOf(obj Record, containerPath string) corev1.PodSpec {
+	var podSpec corev1.PodSpec
+	pathParts := strings.Split(strings.Trim(containerPath, "/"), "/")
+	spec, found, err := unstructured.NestedMap(obj, pathParts[:len(pathParts)-1]...)
+	if err == nil && found {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(spec, &podSpec)
+	}
+	if err != nil {
+		glog.V(4).Infof("Could not decode pod spec at %s: %v", containerPath, err)
+	}
+	return podSpec
+}
 
-	// Retrieve current tag from k8s config
-	imageData := strings.Split(imageRepo, ":")
-	curTag := imageData[1]
-	glog.V(4).Infof("Current tag: %v for running container: %v", curTag, cName)
+// patchForContainer returns any patches required to replace the tag of the KCD managed
+// container in replacement with a version. Tags that already are versions, as defined by
+// the version syntax of the KCD resource, are left untouched. Otherwise the version of the
+// container in current is kept, falling back to the version most recently rolled out by
+// the KCD resource and finally to the version of the tag in the registry, which is looked
+// up with the credentials of the KCD resource.
+func patchForContainer(kcd *kcd1.KCD, containerPath string, current, replacement Record, stats stats.Stats,
+	credentials credentialsFunc) ([]patchOperation, bool) {
+
+	cName := kcd.Spec.Container.Name
+	pathParts := strings.Split(strings.Trim(containerPath, "/"), "/")
+
+	versionRegex, err := regexp.Compile(providers.VersionSyntax(kcd))
+	if err != nil {
+		glog.Errorf("Invalid version syntax of kcd %s: %v", kcd.Name, err)
+		return nil, false
+	}
 
 	//We retrieve the image repo and index from replacement map
 	imageRepoFlux, idxFlux, ok := replacement.Get(pathParts, cName)
 	if !ok {
-		glog.Errorf("Error getting new image repo container name applied by flux: %v", cName)
-		return nil, false
+		glog.V(4).Infof("Workload has no container %s managed by kcd %s", cName, kcd.Name)
+		return nil, true
 	}
 	// Retrieve new tag applied by flux
-	imageDataFlux := strings.Split(imageRepoFlux, ":")
-	fluxTag := imageDataFlux[1]
-	// If current tag is already a SHA, no need to patch
+	fluxRepo, fluxTag := splitImage(imageRepoFlux)
+	// If the new tag is already a version, no need to patch
 	if versionRegex.MatchString(fluxTag) {
-		glog.V(4).Infof("Already SHA tag of flux applied, no need to patch for container %v at version: %v for request version %v", cName, curTag, fluxTag)
+		glog.V(4).Infof("Already a version applied, no need to patch container %v for request version %v", cName, fluxTag)
 		return nil, true
 	}
 
-	pathToPatch := strings.Join([]string{ContainerPatchPath, idxFlux, "image"}, "/")
-
-	patchOp := patchOperation{
-		Path: pathToPatch,
+	version := ""
+	if imageRepo, _, ok := current.Get(pathParts, cName); ok {
+		if _, curTag := splitImage(imageRepo); versionRegex.MatchString(curTag) {
+			glog.V(4).Infof("Current tag: %v for running container: %v", curTag, cName)
+			version = curTag
+		}
 	}
-
-	p, e := ecr.NewECR(imageRepoFlux, ecr.VersionRegex, stats)
-	if e != nil {
-		glog.Errorf("Unable to create ECR for iamge repo %v at version: %v", imageRepo, curTag)
-		return nil, false
+	if version == "" {
+		version = rolledOutVersion(kcd)
 	}
-	if registry, e := p.RegistryFor(imageRepoFlux); e != nil {
-		glog.Errorf("Failed to build registry for image repo: %v", imageRepo)
-		return nil, false
-	} else {
-		versions, err := registry.Versions(context.Background(), fluxTag)
+	if version == "" {
+		ctx, err := credentials(kcd)
+		if err == nil {
+			version, err = registryVersion(ctx, kcd, fluxTag, stats)
+		}
 		if err != nil {
-			glog.Errorf("Syncer failed to get version from registry using tag=%s", fluxTag)
+			glog.Errorf("Failed to get version of tag %s for container %s: %v", fluxTag, cName, err)
 			return nil, false
 		}
-		version := versions[0]
-		glog.Infof("Got registry versions for container=%s, tag=%s, rolloutVersion=%s", cName, fluxTag, version)
+	}
+
+	pathToPatch := strings.Join([]string{containerPath, idxFlux, "image"}, "/")
+	glog.Infof("Replacing path=%v old tag=%v to patched version=%v", pathToPatch, fluxTag, version)
+	return []patchOperation{{
+		Op:    "replace",
+		Path:  pathToPatch,
+		Value: fluxRepo + ":" + version,
+	}}, true
+}
+
+// rolledOutVersion returns the version the workloads of the KCD resource are expected to
+// run. That is the current version while it is rolled out or once it succeeded. Otherwise,
+// e.g. if it failed, was rolled back or is held back, the workloads still run the last
+// successful version, if any.
+func rolledOutVersion(kcd *kcd1.KCD) string {
+	switch kcd.Status.CurrStatus {
+	case kcd1.StatusSuccess, kcd1.StatusProgressing, kcd1.StatusResync:
+		return kcd.Status.CurrVersion
+	}
+	if kcd.Status.SuccessVersion != "" {
+		return kcd.Status.SuccessVersion
+	}
+	return kcd.Status.CurrVersion
+}
 
-		patchOp.Value = imageDataFlux[0] + ":" + version
-		glog.Infof("Replacing path=%v old tag=%v to patched version=%v", pathToPatch, fluxTag, version)
-		patchOp.Op = "replace"
-		patches := []patchOperation{patchOp}
-		return patches, true
+// registryVersion returns the version of the tag in the registry of the KCD resource.
+func registryVersion(ctx context.Context, kcd *kcd1.KCD, tag string, stats stats.Stats) (string, error) {
+	p, err := newRegistryProvider(kcd, stats)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create registry provider for %s", providers.Source(kcd))
+	}
+	reg, err := p.RegistryFor(providers.Source(kcd))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to build registry for %s", providers.Source(kcd))
+	}
+	versions, err := reg.Versions(ctx, tag)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get versions of tag %s", tag)
+	}
+	if len(versions) == 0 {
+		return "", errors.Errorf("no versions found for tag %s", tag)
 	}
+	glog.Infof("Got registry versions for kcd=%s, tag=%s, rolloutVersion=%s", kcd.Name, tag, versions[0])
+	return versions[0], nil
 }
@@ -1,12 +1,21 @@
 package events
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
+	"github.com/wish/kcd/audit"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdlisters "github.com/wish/kcd/gok8s/client/listers/custom/v1"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
 	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	gofake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
 )
 
 type admissionResponse struct {
@@ -44,479 +53,266 @@ func (a *admissionResponse) Validate(ar *v1.AdmissionResponse) error {
 	return nil
 }
 
+// credentialsRegistry returns the version of any tag if it is looked up with the
+// credentials.
+type credentialsRegistry struct {
+	creds   registry.Credentials
+	version string
+}
+
+func (r credentialsRegistry) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return r, nil
+}
+
+func (r credentialsRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	if creds, ok := registry.CredentialsFromContext(ctx); !ok || creds != r.creds {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	return []string{r.version}, nil
+}
+
+// newKCDLister returns a lister of the given KCD resources.
+func newKCDLister(t *testing.T, kcds ...*kcd1.KCD) kcdlisters.KCDLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, kcd := range kcds {
+		if err := indexer.Add(kcd); err != nil {
+			t.Fatalf("failed to add kcd %s: %v", kcd.Name, err)
+		}
+	}
+	return kcdlisters.NewKCDLister(indexer)
+}
+
+// fakeRegistry returns the versions of tags from a map.
+type fakeRegistry map[string][]string
+
+func (f fakeRegistry) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return f, nil
+}
+
+func (f fakeRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	versions, ok := f[tag]
+	if !ok {
+		return nil, fmt.Errorf("tag %s not found", tag)
+	}
+	return versions, nil
+}
+
+func newTestKCD(name string, selector map[string]string, container, versionSyntax, currVersion string) *kcd1.KCD {
+	return &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns",
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo:     "nginx",
+			VersionSyntax: versionSyntax,
+			Selector:      selector,
+			Container: kcd1.ContainerSpec{
+				Name: container,
+			},
+		},
+		Status: kcd1.KCDStatus{
+			CurrVersion: currVersion,
+		},
+	}
+}
+
+func newRequest(kind, object, oldObject string) *v1.AdmissionRequest {
+	req := &v1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Kind: kind},
+		Namespace: "ns",
+		Object:    runtime.RawExtension{Raw: []byte(object)},
+	}
+	if oldObject != "" {
+		req.OldObject = runtime.RawExtension{Raw: []byte(oldObject)}
+	}
+	return req
+}
+
+const (
+	sha1 = "1111111111111111111111111111111111111111"
+	sha2 = "2222222222222222222222222222222222222222"
+)
+
+func deployment(labels, image string) string {
+	return fmt.Sprintf(`{"metadata":{"name":"app","labels":%s},
+		"spec":{"template":{"spec":{"containers":[{"name":"sidecar","image":"envoy:v1"},{"name":"app","image":"%s"}]}}}}`,
+		labels, image)
+}
+
 func TestMutate(t *testing.T) {
+	origProvider := newRegistryProvider
+	defer func() { newRegistryProvider = origProvider }()
+	newRegistryProvider = func(kcd *kcd1.KCD, stats stats.Stats) (registry.Provider, error) {
+		return fakeRegistry{"latest": {sha2}}, nil
+	}
+
+	appKCD := newTestKCD("app-kcd", map[string]string{"app": "app"}, "app", "", sha1)
+	semverKCD := newTestKCD("semver-kcd", map[string]string{"app": "semver"}, "app", `^v\d+\.\d+\.\d+$`, "v1.2.3")
+	newKCD := newTestKCD("new-kcd", map[string]string{"app": "new"}, "app", "", "")
+	failedKCD := newTestKCD("failed-kcd", map[string]string{"app": "failed"}, "app", "", sha2)
+	failedKCD.Status.CurrStatus = kcd1.StatusFailed
+	failedKCD.Status.SuccessVersion = sha1
+	sharedKCD := newTestKCD("shared-kcd", map[string]string{"app": "shared"}, "app", "", sha1)
+	otherSharedKCD := newTestKCD("other-shared-kcd", map[string]string{"app": "shared"}, "app", "", sha1)
+	lister := newKCDLister(t, appKCD, semverKCD, newKCD, failedKCD, sharedKCD, otherSharedKCD)
+
 	tests := []struct {
-		in  *v1.AdmissionRequest
-		out *admissionResponse
+		name string
+		in   *v1.AdmissionRequest
+		out  *admissionResponse
 	}{
-		// disabled, no path
-		// admissionResponse:
-		// Allowed: true,
-		// StatusMessage: "Patching does not have defined boolean value enable: true or false",
 		{
-			in: &v1.AdmissionRequest{
-				Object: runtime.RawExtension{
-					Raw: []byte(`{}`),
-				},
-			},
+			name: "unsupported kind",
+			in:   newRequest("Service", `{"metadata":{"name":"app","labels":{"app":"app"}}}`, ""),
 			out: &admissionResponse{
 				Allowed:       true,
-				StatusMessage: "Patching does not have defined boolean value enable: true or false",
+				StatusMessage: "Patching is not supported for kind Service",
 			},
 		},
-		// enabled, correct path
-		// running container with SHA version, flux applied with SHA version
-		// admissionResponse:
-		// Allowed: true,
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:a792cca8"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-			},
+			name: "disabled",
+			in:   newRequest("Deployment", deployment(`{"app":"app","kcd-version-patcher.wish.com/enabled":"false"}`, "nginx:latest"), ""),
 			out: &admissionResponse{
-				Allowed: true,
+				Allowed:       true,
+				StatusMessage: "Patching is disabled",
 			},
 		},
-		// enabled, no path
-		// Action: No patch
-		// admissionResponse:
-		// Allowed: true,
-		// StatusMessage: "Patching does not have defined path",
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {},
-							"labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {},
-							"labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-			},
+			name: "not selected",
+			in:   newRequest("Deployment", deployment(`{"app":"other"}`, "nginx:latest"), ""),
 			out: &admissionResponse{
 				Allowed:       true,
-				StatusMessage: "Patching does not have defined path",
+				StatusMessage: "No KCD resource selects the workload",
 			},
 		},
-		// enabled is not bool value, correct path
-		// Action: No patch
-		// admissionResponse:
-		// Allowed: true,
-		// StatusMessage: "Patching enabled is not boolean value",
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "xxxx"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-			},
+			name: "version applied",
+			in:   newRequest("Deployment", deployment(`{"app":"app"}`, "nginx:"+sha2), deployment(`{"app":"app"}`, "nginx:"+sha1)),
 			out: &admissionResponse{
 				Allowed:       true,
-				StatusMessage: "Patching enabled is not boolean value",
+				StatusMessage: "No patching needed",
 			},
 		},
-		// disabled, correct path
-		// Action: No patch
-		// admissionResponse:
-		// Allowed: true,
-		// StatusMessage: "Patching is disabled",
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "false"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "false"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
+			name: "deployment keeps running version",
+			in:   newRequest("Deployment", deployment(`{"app":"app"}`, "nginx:latest"), deployment(`{"app":"app"}`, "nginx:"+sha2)),
+			out: &admissionResponse{
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:` + sha2 + `"}]`,
 			},
+		},
+		{
+			name: "statefulset uses current version",
+			in:   newRequest("StatefulSet", deployment(`{"app":"app"}`, "nginx:latest"), ""),
 			out: &admissionResponse{
-				Allowed:       true,
-				StatusMessage: "Patching is disabled",
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:` + sha1 + `"}]`,
 			},
 		},
-		// enabled, incorrect path
-		// Action: No patch
-		// admissionResponse:
-		// Allowed: true,
-		// StatusMessage: "Patching is not successful",
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-serv"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
+			name: "failed version uses successful version",
+			in:   newRequest("Deployment", deployment(`{"app":"failed"}`, "nginx:latest"), ""),
+			out: &admissionResponse{
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:` + sha1 + `"}]`,
 			},
+		},
+		{
+			name: "container of several kcds patched once",
+			in:   newRequest("Deployment", deployment(`{"app":"shared"}`, "nginx:latest"), ""),
 			out: &admissionResponse{
-				Allowed:       true,
-				StatusMessage: "Patching is not successful",
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:` + sha1 + `"}]`,
+			},
+		},
+		{
+			name: "cronjob",
+			in: newRequest("CronJob", `{"metadata":{"name":"job","labels":{"app":"app"}},
+				"spec":{"jobTemplate":{"spec":{"template":{"spec":{"containers":[{"name":"app","image":"nginx:latest"}]}}}}}}`, ""),
+			out: &admissionResponse{
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/jobTemplate/spec/template/spec/containers/0/image","value":"nginx:` + sha1 + `"}]`,
 			},
 		},
-		// enabled, correct path
-		// running container with SHA version, flux applied with tag version
-		// admissionResponse:
-		// [{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"}]
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
+			name: "pod",
+			in: newRequest("Pod", `{"metadata":{"name":"pod","labels":{"app":"app","pod-template-hash":"abc"}},
+				"spec":{"containers":[{"name":"app","image":"nginx:latest"}]}}`, ""),
+			out: &admissionResponse{
+				Allowed: true,
+				Patch:   `[{"op":"replace","path":"/spec/containers/0/image","value":"nginx:` + sha1 + `"}]`,
 			},
+		},
+		{
+			name: "version syntax of kcd",
+			in:   newRequest("Deployment", deployment(`{"app":"semver"}`, "nginx:"+sha2), deployment(`{"app":"semver"}`, "nginx:v1.2.4")),
 			out: &admissionResponse{
 				Allowed: true,
-				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"}]`,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:v1.2.4"}]`,
 			},
 		},
-		// enabled, correct path
-		// multiple containers include sidecar, running container with SHA version, flux applied with tag version
-		// admissionResponse:
-		// [{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"}]
 		{
-			in: &v1.AdmissionRequest{
-				Kind: metav1.GroupVersionKind{
-					Group:   "apps",
-					Version: "v1",
-					Kind:    "Deployment",
-				},
-				Object: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "test-sidecar-1",
-											"image": "test-sidecar-1-image"
-										},
-										{
-											"name": "test-sidecar-2",
-											"image": "test-sidecar-2-image"
-										},
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:dev"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
-				OldObject: runtime.RawExtension{
-					Raw: []byte(`{
-					    "metadata": {
-					        "annotations": {"kcd-version-patcher.wish.com/container": "hello-service"},
-					        "labels": {"kcd-version-patcher.wish.com/enabled": "true"},
-					        "namespace": "hello-service",
-					        "name": "hello-service"
-				        },
-				        "spec": {
-							"template": {
-								"spec": {
-									"containers": [
-										{
-											"name": "test-sidecar-1",
-											"image": "test-sidecar-1-image"
-										},
-										{
-											"name": "test-sidecar-2",
-											"image": "test-sidecar-2-image"
-										},
-										{
-											"name": "hello-service",
-											"image": "951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"
-										}
-									]
-								}
-							}
-						}
-				    }`),
-				},
+			name: "version syntax of kcd applied",
+			in:   newRequest("Deployment", deployment(`{"app":"semver"}`, "nginx:v1.3.0"), deployment(`{"app":"semver"}`, "nginx:v1.2.4")),
+			out: &admissionResponse{
+				Allowed:       true,
+				StatusMessage: "No patching needed",
 			},
+		},
+		{
+			name: "registry version",
+			in:   newRequest("Deployment", deployment(`{"app":"new"}`, "nginx:latest"), ""),
 			out: &admissionResponse{
 				Allowed: true,
-				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/2/image","value":"951896542015.dkr.ecr.us-west-1.amazonaws.com/contextlogic/hello-service:93ebd365"}]`,
+				Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/1/image","value":"nginx:` + sha2 + `"}]`,
+			},
+		},
+		{
+			name: "registry version not found",
+			in:   newRequest("Deployment", deployment(`{"app":"new"}`, "nginx:unknown"), ""),
+			out: &admissionResponse{
+				Allowed:       true,
+				StatusMessage: "Patching is not successful",
 			},
 		},
 	}
 
-	for idx, test := range tests {
-		out := Mutate(test.in, nil, nil)
-		if err := test.out.Validate(out); err != nil {
-			fmt.Println(idx)
-			t.Fatalf("Error: %v\n%v", err, out)
+	for _, test := range tests {
+		if err := test.out.Validate(Mutate(test.in, stats.NewFake(), nil, lister, audit.Nop())); err != nil {
+			t.Errorf("%s: %v", test.name, err)
 		}
 	}
 }
+
+func TestMutateCredentials(t *testing.T) {
+	origProvider := newRegistryProvider
+	defer func() { newRegistryProvider = origProvider }()
+	newRegistryProvider = func(kcd *kcd1.KCD, stats stats.Stats) (registry.Provider, error) {
+		return credentialsRegistry{creds: registry.Credentials{Username: "user", Password: "pass"}, version: sha2}, nil
+	}
+
+	lister := newKCDLister(t, newTestKCD("app-kcd", map[string]string{"app": "app"}, "app", "", ""))
+	cs := gofake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "regcred", Namespace: "ns"},
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{"docker.io":{"username":"user","password":"pass"}}}`),
+		},
+	})
+	object := `{"metadata":{"name":"app","labels":{"app":"app"}},
+		"spec":{"template":{"spec":{"imagePullSecrets":[{"name":"regcred"}],"containers":[{"name":"app","image":"nginx:latest"}]}}}}`
+
+	// the registry version is looked up with the credentials of the image pull secret
+	out := &admissionResponse{
+		Allowed: true,
+		Patch:   `[{"op":"replace","path":"/spec/template/spec/containers/0/image","value":"nginx:` + sha2 + `"}]`,
+	}
+	if err := out.Validate(Mutate(newRequest("Deployment", object, ""), stats.NewFake(), cs, lister, audit.Nop())); err != nil {
+		t.Errorf("image pull secret: %v", err)
+	}
+
+	out = &admissionResponse{Allowed: true, StatusMessage: "Patching is not successful"}
+	if err := out.Validate(Mutate(newRequest("Deployment", object, ""), stats.NewFake(), gofake.NewSimpleClientset(), lister, audit.Nop())); err != nil {
+		t.Errorf("missing image pull secret: %v", err)
+	}
+}
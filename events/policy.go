@@ -0,0 +1,228 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/wish/kcd/audit"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdlisters "github.com/wish/kcd/gok8s/client/listers/custom/v1"
+	"github.com/wish/kcd/gok8s/client/clientset/versioned/scheme"
+	"github.com/wish/kcd/stats"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// PolicyExceptionAnnotation allows a workload to use versions that are not managed by kcd.
+// Its value is the reason for the exception, which is audited.
+const PolicyExceptionAnnotation = "kcd.wish.com/version-policy-exception"
+
+// VersionPolicy rejects workloads managed by KCD resources whose container image version
+// is neither the current nor the last successful version of the KCD resource, e.g. when
+// an image is changed with kubectl and would bypass the verification of kcd.
+type VersionPolicy struct {
+	kcdLister   kcdlisters.KCDLister
+	recorder    record.EventRecorder
+	stats       stats.Stats
+	auditLogger audit.Logger
+}
+
+// NewVersionPolicy returns a VersionPolicy instance, which finds the KCD resources of
+// workloads with kcdLister. Violations and exceptions are recorded as events of the KCD
+// resource and exceptions in the audit log.
+func NewVersionPolicy(cs kubernetes.Interface, kcdLister kcdlisters.KCDLister, stats stats.Stats,
+	auditLogger audit.Logger) *VersionPolicy {
+
+	scheme.AddToScheme(k8sscheme.Scheme)
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cs.CoreV1().Events("")})
+
+	return &VersionPolicy{
+		kcdLister:   kcdLister,
+		recorder:    eventBroadcaster.NewRecorder(k8sscheme.Scheme, corev1.EventSource{Component: "kcd-version-policy"}),
+		stats:       stats,
+		auditLogger: auditLogger,
+	}
+}
+
+// violation describes a container whose version is not managed by a KCD resource.
+type violation struct {
+	kcd     *kcd1.KCD
+	current string // the image of the container before the change, if any
+	image   string
+	message string
+}
+
+// Review returns the admission response for the create or update of a workload.
+func (p *VersionPolicy) Review(req *v1.AdmissionRequest) *v1.AdmissionResponse {
+	containerPath, ok := containerPatchPaths[req.Kind.Kind]
+	if !ok || (req.Operation != v1.Create && req.Operation != v1.Update) {
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	var newManifest objectWithMeta
+	var newMap, currentMap map[string]interface{}
+	err := json.Unmarshal(req.Object.Raw, &newManifest)
+	if err == nil {
+		err = json.Unmarshal(req.Object.Raw, &newMap)
+	}
+	if err != nil {
+		glog.Errorf("Could not unmarshal %s %s/%s: %v", req.Kind.Kind, req.Namespace, req.Name, err)
+		return &v1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonBadRequest,
+				Code:    http.StatusBadRequest,
+				Message: fmt.Sprintf("could not decode %s: %v", req.Kind.Kind, err),
+			},
+		}
+	}
+	if req.OldObject.Raw != nil {
+		if err := json.Unmarshal(req.OldObject.Raw, &currentMap); err != nil {
+			glog.V(2).Infof("Could not unmarshal old object of %s %s/%s: %v", req.Kind.Kind, req.Namespace, req.Name, err)
+		}
+	}
+
+	namespace := newManifest.Namespace
+	if namespace == "" {
+		namespace = req.Namespace
+	}
+	name := newManifest.Name
+	if name == "" {
+		name = req.Name
+	}
+
+	// objects created by controllers, such as the ReplicaSets of Deployments and the Pods of
+	// ReplicaSets, are reviewed when their owner is written
+	if owner := metav1.GetControllerOf(&newManifest); owner != nil {
+		glog.V(4).Infof("Not reviewing %s %s/%s controlled by %s %s", req.Kind.Kind, namespace, name, owner.Kind, owner.Name)
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	kcds, err := selectingKCDs(p.kcdLister, namespace, newManifest.Labels)
+	if err != nil {
+		// don't block workloads because kcd is unavailable
+		glog.Errorf("Failed to find KCD resources for %s %s/%s, not enforcing version policy: %v", req.Kind.Kind, namespace, name, err)
+		p.auditLogger.Log(audit.Entry{
+			Time:      time.Now().UTC(),
+			Actor:     req.UserInfo.Username,
+			Source:    audit.SourceWebhook,
+			Action:    audit.ActionVersionPolicyException,
+			Namespace: namespace,
+			Target:    fmt.Sprintf("%s/%s", req.Kind.Kind, name),
+			Reason:    fmt.Sprintf("version policy not enforced: %v", err),
+		})
+		p.stats.IncCount("kcd.versionpolicy.unenforced", namespace)
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	pathParts := strings.Split(strings.Trim(containerPath, "/"), "/")
+	var violations []violation
+	for _, kcd := range kcds {
+		if v := checkVersion(kcd, pathParts, Record(currentMap), Record(newMap)); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+	if len(violations) == 0 {
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	reason := strings.TrimSpace(newManifest.Annotations[PolicyExceptionAnnotation])
+	for _, v := range violations {
+		if reason != "" {
+			glog.V(1).Infof("Allowing version policy exception for %s %s/%s by user=%s: %s, reason=%q",
+				req.Kind.Kind, namespace, name, req.UserInfo.Username, v.message, reason)
+			entry := audit.ForKCD(v.kcd, audit.SourceWebhook, req.UserInfo.Username, audit.ActionVersionPolicyException)
+			entry.Target = fmt.Sprintf("%s/%s", req.Kind.Kind, name)
+			entry.Old = v.current
+			entry.New = v.image
+			entry.Reason = reason
+			p.auditLogger.Log(entry)
+			p.recordEvent(v.kcd, corev1.EventTypeWarning, "VersionPolicyException", "%s %s by %s: %s, reason: %s",
+				req.Kind.Kind, name, req.UserInfo.Username, v.message, reason)
+			p.stats.IncCount("kcd.versionpolicy.exception", v.kcd.Name)
+		} else {
+			glog.V(1).Infof("Rejecting %s %s/%s by user=%s: %s", req.Kind.Kind, namespace, name, req.UserInfo.Username, v.message)
+			p.recordEvent(v.kcd, corev1.EventTypeWarning, "VersionPolicyViolation", "Rejected %s %s by %s: %s",
+				req.Kind.Kind, name, req.UserInfo.Username, v.message)
+			p.stats.IncCount("kcd.versionpolicy.violation", v.kcd.Name)
+		}
+	}
+	if reason != "" {
+		return &v1.AdmissionResponse{Allowed: true}
+	}
+
+	messages := make([]string, len(violations))
+	for i, v := range violations {
+		messages[i] = v.message
+	}
+	return &v1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status: metav1.StatusFailure,
+			Reason: metav1.StatusReasonForbidden,
+			Code:   http.StatusForbidden,
+			Message: fmt.Sprintf("%s; versions are rolled out by kcd, set the %s annotation with a reason to override",
+				strings.Join(messages, "; "), PolicyExceptionAnnotation),
+		},
+	}
+}
+
+// recordEvent records an event of the KCD resource, if a recorder is configured.
+func (p *VersionPolicy) recordEvent(kcd *kcd1.KCD, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.recorder == nil {
+		return
+	}
+	p.recorder.Eventf(kcd, eventType, reason, messageFmt, args...)
+}
+
+// checkVersion returns the violation if the image of the container managed by the KCD
+// resource in replacement isn't allowed, or nil if it is. Only the current and last
+// successful versions of the KCD's image repo are allowed. Containers whose image is
+// unchanged from current are allowed, so that workloads can still be scaled or otherwise
+// updated.
+func checkVersion(kcd *kcd1.KCD, pathParts []string, current, replacement Record) *violation {
+	allowed := map[string]bool{}
+	for _, version := range []string{kcd.Status.CurrVersion, kcd.Status.SuccessVersion} {
+		if version != "" {
+			allowed[version] = true
+		}
+	}
+	// nothing has been rolled out by the KCD resource yet
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	cName := kcd.Spec.Container.Name
+	image, _, ok := replacement.Get(pathParts, cName)
+	if !ok {
+		return nil
+	}
+	currImage, _, _ := current.Get(pathParts, cName)
+	if currImage == image {
+		return nil
+	}
+
+	if repo, tag := splitImage(image); repo == kcd.Spec.ImageRepo && allowed[tag] {
+		return nil
+	}
+	return &violation{
+		kcd:     kcd,
+		current: currImage,
+		image:   image,
+		message: fmt.Sprintf("image %s of container %s is not the current (%s) or last successful (%s) version of %s of kcd %s",
+			image, cName, kcd.Status.CurrVersion, kcd.Status.SuccessVersion, kcd.Spec.ImageRepo, kcd.Name),
+	}
+}
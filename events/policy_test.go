@@ -0,0 +1,108 @@
+package events
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/wish/kcd/audit"
+	"github.com/wish/kcd/stats"
+	v1 "k8s.io/api/admission/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestVersionPolicy(t *testing.T) {
+	kcd := newTestKCD("app-kcd", map[string]string{"app": "app"}, "app", "", sha2)
+	kcd.Status.SuccessVersion = sha1
+	newKCD := newTestKCD("new-kcd", map[string]string{"app": "new"}, "app", "", "")
+
+	recorder := record.NewFakeRecorder(10)
+	var auditLog bytes.Buffer
+	policy := &VersionPolicy{
+		kcdLister:   newKCDLister(t, kcd, newKCD),
+		recorder:    recorder,
+		stats:       stats.NewFake(),
+		auditLogger: audit.NewJSONLogger(&auditLog),
+	}
+
+	const sha3 = "3333333333333333333333333333333333333333"
+	exception := `{"app":"app"},"annotations":{"` + PolicyExceptionAnnotation + `":"hotfix for incident"}`
+	controlled := `{"app":"app"},"ownerReferences":[{"apiVersion":"apps/v1","kind":"Deployment","name":"app","uid":"1","controller":true}]`
+	owned := `{"app":"app"},"ownerReferences":[{"apiVersion":"v1","kind":"ConfigMap","name":"app","uid":"1"}]`
+
+	tests := []struct {
+		name      string
+		operation v1.Operation
+		object    string
+		oldObject string
+		allowed   bool
+		event     string
+	}{
+		{"current version", v1.Create, deployment(`{"app":"app"}`, "nginx:"+sha2), "", true, ""},
+		{"successful version", v1.Update, deployment(`{"app":"app"}`, "nginx:"+sha1), deployment(`{"app":"app"}`, "nginx:"+sha2), true, ""},
+		{"unmanaged version", v1.Update, deployment(`{"app":"app"}`, "nginx:"+sha3), deployment(`{"app":"app"}`, "nginx:"+sha2), false, "VersionPolicyViolation"},
+		{"other repository", v1.Update, deployment(`{"app":"app"}`, "evil.io/other:"+sha2), deployment(`{"app":"app"}`, "nginx:"+sha2), false, "VersionPolicyViolation"},
+		{"unchanged image", v1.Update, deployment(`{"app":"app"}`, "nginx:"+sha3), deployment(`{"app":"app"}`, "nginx:"+sha3), true, ""},
+		{"not selected", v1.Create, deployment(`{"app":"other"}`, "nginx:"+sha3), "", true, ""},
+		{"nothing rolled out", v1.Create, deployment(`{"app":"new"}`, "nginx:"+sha3), "", true, ""},
+		{"exception", v1.Create, deployment(exception, "nginx:"+sha3), "", true, "VersionPolicyException"},
+		{"delete", v1.Delete, deployment(`{"app":"app"}`, "nginx:"+sha3), "", true, ""},
+		{"controlled", v1.Create, deployment(controlled, "nginx:"+sha3), "", true, ""},
+		{"owned", v1.Create, deployment(owned, "nginx:"+sha3), "", false, "VersionPolicyViolation"},
+	}
+
+	for _, test := range tests {
+		req := newRequest("Deployment", test.object, test.oldObject)
+		req.Operation = test.operation
+
+		resp := policy.Review(req)
+		if resp.Allowed != test.allowed {
+			t.Errorf("%s: expected allowed=%v, got %+v", test.name, test.allowed, resp.Result)
+		}
+		if !test.allowed && !strings.Contains(resp.Result.Message, PolicyExceptionAnnotation) {
+			t.Errorf("%s: expected rejection to mention the exception annotation: %s", test.name, resp.Result.Message)
+		}
+
+		entry := strings.TrimSpace(auditLog.String())
+		auditLog.Reset()
+		if test.event == "VersionPolicyException" {
+			if !strings.Contains(entry, `"action":"VersionPolicyException"`) || !strings.Contains(entry, `"reason":"hotfix for incident"`) {
+				t.Errorf("%s: expected exception to be audited, got %s", test.name, entry)
+			}
+		} else if entry != "" {
+			t.Errorf("%s: unexpected audit log entry %s", test.name, entry)
+		}
+
+		select {
+		case event := <-recorder.Events:
+			if test.event == "" || !strings.Contains(event, test.event) {
+				t.Errorf("%s: unexpected event %q", test.name, event)
+			}
+			if test.event == "VersionPolicyException" && !strings.Contains(event, "hotfix for incident") {
+				t.Errorf("%s: expected event to contain the reason: %q", test.name, event)
+			}
+		default:
+			if test.event != "" {
+				t.Errorf("%s: expected %s event", test.name, test.event)
+			}
+		}
+	}
+}
+
+func TestVersionPolicyUnavailable(t *testing.T) {
+	var auditLog bytes.Buffer
+	policy := &VersionPolicy{
+		stats:       stats.NewFake(),
+		auditLogger: audit.NewJSONLogger(&auditLog),
+	}
+
+	req := newRequest("Deployment", deployment(`{"app":"app"}`, "nginx:"+sha1), "")
+	req.Operation = v1.Create
+	if resp := policy.Review(req); !resp.Allowed {
+		t.Errorf("expected workload to be allowed when KCD resources are unavailable, got %+v", resp.Result)
+	}
+	entry := auditLog.String()
+	if !strings.Contains(entry, `"action":"VersionPolicyException"`) || !strings.Contains(entry, "no KCD lister configured") {
+		t.Errorf("expected unenforced policy to be audited, got %s", entry)
+	}
+}
@@ -6,7 +6,7 @@ require (
 	github.com/DataDog/datadog-go v2.2.0+incompatible
 	github.com/aws/aws-sdk-go v1.21.8
 	github.com/coreos/go-systemd v0.0.0-20190719114852-fd7a80b32e1f // indirect
-	github.com/docker/distribution v2.7.1+incompatible // indirect
+	github.com/docker/distribution v2.7.1+incompatible
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7 // indirect
 	github.com/golang/glog v1.0.0
 	github.com/heroku/docker-registry-client v0.0.0-20181004091502-47ecf50fd8d4
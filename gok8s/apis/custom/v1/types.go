@@ -1,6 +1,7 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -37,6 +38,46 @@ type KCDSpec struct {
 	Rollback RollbackSpec `json:"rollback"`
 
 	Config *ConfigSpec `json:"config"`
+
+	Clusters []ClusterSpec `json:"clusters,omitempty"`
+
+	PromoteFrom *PromoteFromSpec `json:"promoteFrom,omitempty"`
+
+	// Paused stops new versions from being rolled out.
+	Paused bool `json:"paused,omitempty"`
+	// VersionOverride pins the workloads to the given version instead of the version
+	// obtained from the registry.
+	VersionOverride string `json:"versionOverride,omitempty"`
+	// ApprovedVersion is the most recent version approved for rollout when the
+	// strategy requires approval.
+	ApprovedVersion string `json:"approvedVersion,omitempty"`
+
+	// RegistrySource is where the versions of the image repository are looked up, if not
+	// in the registry of ImageRepo, e.g. a file:// or oci-layout:// local registry. The
+	// workloads are still updated to images of ImageRepo.
+	RegistrySource string `json:"registrySource,omitempty"`
+
+	// RegistrySecretRef is a docker config secret in the namespace of the KCD resource
+	// with the credentials of the image repository. If not set, the image pull secrets
+	// of the workloads are used.
+	RegistrySecretRef *corev1.LocalObjectReference `json:"registrySecretRef,omitempty"`
+
+	// VersionOrder defines how versions are ordered, so that rollouts of versions older
+	// than the last successful version are detected. Versions are not ordered if not set.
+	VersionOrder *VersionOrderSpec `json:"versionOrder,omitempty"`
+	// AllowDowngrade allows rollouts of versions older than the last successful version.
+	// Otherwise such rollouts are blocked until the version is approved or pinned via
+	// the version override.
+	AllowDowngrade bool `json:"allowDowngrade,omitempty"`
+}
+
+// VersionOrderSpec defines how versions are compared.
+type VersionOrderSpec struct {
+	// Kind is semver, buildNumber or pushTime.
+	Kind string `json:"kind"`
+	// Pattern is a regular expression whose first capture group is the build number of
+	// a version, for the buildNumber kind.
+	Pattern string `json:"pattern,omitempty"`
 }
 
 // ContainerSpec defines a name of container and option container level verification step
@@ -50,6 +91,26 @@ type StrategySpec struct {
 	Kind      string         `json:"kind"`
 	BlueGreen *BlueGreenSpec `json:"blueGreen"`
 	Verify    []VerifySpec   `json:"verify"`
+
+	// SoakSeconds is the duration for which the health of workloads is watched after
+	// a rollout before the rollout is considered successful.
+	SoakSeconds int `json:"soakSeconds,omitempty"`
+
+	Readiness *ReadinessSpec `json:"readiness,omitempty"`
+
+	// RequireApproval holds back new versions until they are approved by setting
+	// the ApprovedVersion of the KCD spec.
+	RequireApproval bool `json:"requireApproval,omitempty"`
+}
+
+// ReadinessSpec defines when enough pods of a workload are ready for a rollout to succeed.
+// By default all pods must be ready.
+type ReadinessSpec struct {
+	// MinReadyPercent is the minimum percentage of pods that must be ready.
+	MinReadyPercent int `json:"minReadyPercent,omitempty"`
+	// MinReadySeconds is the minimum duration for which a pod must have been ready
+	// to be considered ready.
+	MinReadySeconds int `json:"minReadySeconds,omitempty"`
 }
 
 // BlueGreenSpec defines a strategy for rolling out a workload via a blue-green deployment.
@@ -58,6 +119,45 @@ type BlueGreenSpec struct {
 	VerificationServiceName string   `json:"verificationServiceName"`
 	LabelNames              []string `json:"labelNames"`
 	ScaleDown               bool     `json:"scaleDown"`
+
+	// ServiceNames are live services in addition to ServiceName, which are switched
+	// together with it.
+	ServiceNames []string `json:"serviceNames,omitempty"`
+	// VerificationServiceNames are verification services in addition to
+	// VerificationServiceName, which are switched together with it.
+	VerificationServiceNames []string `json:"verificationServiceNames,omitempty"`
+
+	// KeepPrevious keeps the previously live workload running after a rollout so that
+	// a rollback only needs to switch the service selectors back.
+	KeepPrevious *KeepPreviousSpec `json:"keepPrevious,omitempty"`
+
+	// Traffic shifts traffic to the new workload in steps via a traffic router before the
+	// live services are switched to it.
+	Traffic *TrafficSpec `json:"traffic,omitempty"`
+}
+
+// TrafficSpec defines how traffic is shifted from the live services to the verification
+// services, which select the new workload, during a blue-green rollout.
+type TrafficSpec struct {
+	// Kind is the kind of traffic router, HTTPRoute or NginxIngress.
+	Kind string `json:"kind"`
+	// Name is the name of the HTTPRoute, or of the canary Ingress for NginxIngress.
+	Name string `json:"name"`
+	// Steps are the percentages of traffic sent to the new workload, e.g. 5, 25 and 100.
+	Steps []int `json:"steps,omitempty"`
+	// StepSeconds is the duration for which the health of the new workload is watched
+	// at each step before more traffic is shifted to it.
+	StepSeconds int `json:"stepSeconds,omitempty"`
+}
+
+// KeepPreviousSpec defines how the previously live workload of a blue-green rollout is kept.
+type KeepPreviousSpec struct {
+	// Seconds is the duration for which the previous workload is kept after a rollout.
+	// If zero, it is kept until the next rollout.
+	Seconds int `json:"seconds,omitempty"`
+	// ReplicasPercent is the percentage of its replicas the previous workload is kept
+	// running with. Defaults to 100.
+	ReplicasPercent int `json:"replicasPercent,omitempty"`
 }
 
 // VerifySpec defines various verification types performed during a rollout.
@@ -84,6 +184,62 @@ type ConfigSpec struct {
 	Key  string `json:"key"`
 }
 
+// ClusterSpec defines a cluster that the selected workloads are rolled out to.
+// Clusters are rolled out one after another in the order listed, and consecutive
+// clusters that share the same non-zero wave are rolled out together.
+type ClusterSpec struct {
+	Name string `json:"name"`
+
+	// KubeConfigSecret is the name of a secret in the KCD namespace containing the
+	// kubeconfig for the cluster. The local cluster is used if empty.
+	KubeConfigSecret string `json:"kubeConfigSecret"`
+	// KubeConfigKey is the key of the kubeconfig within the secret (default "kubeconfig").
+	KubeConfigKey string `json:"kubeConfigKey"`
+	// Namespace is the namespace of the workloads in the cluster (default is the KCD namespace).
+	Namespace string `json:"namespace"`
+
+	Wave int `json:"wave"`
+}
+
+// PromoteFromSpec defines another KCD resource, such as a staging environment, whose
+// successfully deployed versions are promoted to this KCD once they have soaked.
+type PromoteFromSpec struct {
+	Name string `json:"name"`
+	// Namespace of the source KCD resource (default is the KCD namespace).
+	Namespace string `json:"namespace"`
+
+	// SoakSeconds is the minimum time the version must have been successfully deployed
+	// by the source KCD before it is promoted.
+	SoakSeconds int `json:"soakSeconds"`
+
+	// UpdateTag indicates whether the promoted image should be tagged with this KCD's tag
+	// in the registry once it has been rolled out.
+	UpdateTag bool `json:"updateTag"`
+}
+
+// Values of KCDStatus.CurrStatus.
+const (
+	StatusFailed      = "Failed"
+	StatusSuccess     = "Success"
+	StatusProgressing = "Progressing"
+
+	// StatusAwaitingApproval is the status of a version that is held back until it
+	// is approved.
+	StatusAwaitingApproval = "AwaitingApproval"
+
+	// StatusRolledBack is the status of a failed version whose workloads were rolled
+	// back to the last successful version.
+	StatusRolledBack = "RolledBack"
+
+	// StatusDowngradeBlocked is the status of a version older than the last successful
+	// version that is held back until it is approved.
+	StatusDowngradeBlocked = "DowngradeBlocked"
+
+	// StatusResync is the status of a version whose rollout is retried on request,
+	// including its verification.
+	StatusResync = "Resync"
+)
+
 // KCDStatus is status  for Deployment resources
 type KCDStatus struct {
 	Created bool `json:"deployed"`
@@ -96,6 +252,21 @@ type KCDStatus struct {
 
 	// SuccessVersion is the last version that was successfully deployed.
 	SuccessVersion string `json:"successVersion"`
+
+	// SuccessTime is the time that the SuccessVersion was first successfully deployed.
+	// It is kept when the same version succeeds again, so that promotions soak the
+	// version from its first success.
+	SuccessTime metav1.Time `json:"successTime"`
+
+	// Pods contains the pod counts observed during the most recent rollout.
+	Pods PodsStatus `json:"pods"`
+}
+
+// PodsStatus contains the number of pods of the workloads observed during a rollout.
+type PodsStatus struct {
+	Total   int32 `json:"total"`
+	Updated int32 `json:"updated"`
+	Ready   int32 `json:"ready"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -6,6 +6,7 @@
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -17,6 +18,26 @@ func (in *BlueGreenSpec) DeepCopyInto(out *BlueGreenSpec) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.ServiceNames != nil {
+		in, out := &in.ServiceNames, &out.ServiceNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.VerificationServiceNames != nil {
+		in, out := &in.VerificationServiceNames, &out.VerificationServiceNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.KeepPrevious != nil {
+		in, out := &in.KeepPrevious, &out.KeepPrevious
+		*out = new(KeepPreviousSpec)
+		**out = **in
+	}
+	if in.Traffic != nil {
+		in, out := &in.Traffic, &out.Traffic
+		*out = new(TrafficSpec)
+		(*in).DeepCopyInto(*out)
+	}
 	return
 }
 
@@ -30,6 +51,22 @@ func (in *BlueGreenSpec) DeepCopy() *BlueGreenSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSpec) DeepCopyInto(out *ClusterSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSpec.
+func (in *ClusterSpec) DeepCopy() *ClusterSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConfigSpec) DeepCopyInto(out *ConfigSpec) {
 	*out = *in
@@ -163,6 +200,26 @@ func (in *KCDSpec) DeepCopyInto(out *KCDSpec) {
 		*out = new(ConfigSpec)
 		**out = **in
 	}
+	if in.Clusters != nil {
+		in, out := &in.Clusters, &out.Clusters
+		*out = make([]ClusterSpec, len(*in))
+		copy(*out, *in)
+	}
+	if in.PromoteFrom != nil {
+		in, out := &in.PromoteFrom, &out.PromoteFrom
+		*out = new(PromoteFromSpec)
+		**out = **in
+	}
+	if in.RegistrySecretRef != nil {
+		in, out := &in.RegistrySecretRef, &out.RegistrySecretRef
+		*out = new(corev1.LocalObjectReference)
+		**out = **in
+	}
+	if in.VersionOrder != nil {
+		in, out := &in.VersionOrder, &out.VersionOrder
+		*out = new(VersionOrderSpec)
+		**out = **in
+	}
 	return
 }
 
@@ -180,6 +237,7 @@ func (in *KCDSpec) DeepCopy() *KCDSpec {
 func (in *KCDStatus) DeepCopyInto(out *KCDStatus) {
 	*out = *in
 	in.CurrStatusTime.DeepCopyInto(&out.CurrStatusTime)
+	in.SuccessTime.DeepCopyInto(&out.SuccessTime)
 	return
 }
 
@@ -193,6 +251,70 @@ func (in *KCDStatus) DeepCopy() *KCDStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *KeepPreviousSpec) DeepCopyInto(out *KeepPreviousSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KeepPreviousSpec.
+func (in *KeepPreviousSpec) DeepCopy() *KeepPreviousSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(KeepPreviousSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PodsStatus) DeepCopyInto(out *PodsStatus) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PodsStatus.
+func (in *PodsStatus) DeepCopy() *PodsStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(PodsStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PromoteFromSpec) DeepCopyInto(out *PromoteFromSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PromoteFromSpec.
+func (in *PromoteFromSpec) DeepCopy() *PromoteFromSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(PromoteFromSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ReadinessSpec) DeepCopyInto(out *ReadinessSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ReadinessSpec.
+func (in *ReadinessSpec) DeepCopy() *ReadinessSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ReadinessSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RollbackSpec) DeepCopyInto(out *RollbackSpec) {
 	*out = *in
@@ -222,6 +344,11 @@ func (in *StrategySpec) DeepCopyInto(out *StrategySpec) {
 		*out = make([]VerifySpec, len(*in))
 		copy(*out, *in)
 	}
+	if in.Readiness != nil {
+		in, out := &in.Readiness, &out.Readiness
+		*out = new(ReadinessSpec)
+		**out = **in
+	}
 	return
 }
 
@@ -235,6 +362,27 @@ func (in *StrategySpec) DeepCopy() *StrategySpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TrafficSpec) DeepCopyInto(out *TrafficSpec) {
+	*out = *in
+	if in.Steps != nil {
+		in, out := &in.Steps, &out.Steps
+		*out = make([]int, len(*in))
+		copy(*out, *in)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TrafficSpec.
+func (in *TrafficSpec) DeepCopy() *TrafficSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(TrafficSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VerifySpec) DeepCopyInto(out *VerifySpec) {
 	*out = *in
@@ -250,3 +398,19 @@ func (in *VerifySpec) DeepCopy() *VerifySpec {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VersionOrderSpec) DeepCopyInto(out *VersionOrderSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VersionOrderSpec.
+func (in *VersionOrderSpec) DeepCopy() *VersionOrderSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VersionOrderSpec)
+	in.DeepCopyInto(out)
+	return out
+}
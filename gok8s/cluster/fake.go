@@ -0,0 +1,30 @@
+package cluster
+
+import (
+	"github.com/pkg/errors"
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/workload"
+	"k8s.io/client-go/kubernetes"
+)
+
+// FakeProvider is a Provider that returns workload providers for a fixed set of
+// clients, keyed by cluster name. For use in testing.
+type FakeProvider struct {
+	Clients map[string]kubernetes.Interface
+}
+
+// NewFakeProvider returns a FakeProvider for the given clients.
+func NewFakeProvider(clients map[string]kubernetes.Interface) *FakeProvider {
+	return &FakeProvider{
+		Clients: clients,
+	}
+}
+
+// WorkloadProvider implements the Provider interface.
+func (fp *FakeProvider) WorkloadProvider(kcd *kcdv1.KCD, cluster kcdv1.ClusterSpec) (workload.Provider, error) {
+	cs, ok := fp.Clients[cluster.Name]
+	if !ok {
+		return nil, errors.Errorf("unknown cluster %s", cluster.Name)
+	}
+	return workload.NewProvider(cs, nil, Namespace(kcd, cluster)), nil
+}
@@ -0,0 +1,140 @@
+// Package cluster provides access to the clusters that a KCD resource rolls out to.
+package cluster
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/config"
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	clientset "github.com/wish/kcd/gok8s/client/clientset/versioned"
+	"github.com/wish/kcd/gok8s/workload"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// DefaultKubeConfigKey is the secret key used for kubeconfigs if none is specified.
+	DefaultKubeConfigKey = "kubeconfig"
+)
+
+// Provider defines methods for obtaining workload providers for the clusters
+// defined by a KCD resource.
+type Provider interface {
+	// WorkloadProvider returns a workload provider operating in the given cluster.
+	WorkloadProvider(kcd *kcdv1.KCD, cluster kcdv1.ClusterSpec) (workload.Provider, error)
+}
+
+// SecretProvider is a Provider that builds clients for remote clusters from kubeconfigs
+// stored in secrets alongside the KCD resource.
+type SecretProvider struct {
+	cs    kubernetes.Interface
+	kcdcs clientset.Interface
+	local *workload.K8sProvider
+
+	options []func(*config.Options)
+
+	// clients caches the clientsets built from kubeconfig secrets.
+	mu      sync.Mutex
+	clients map[string]cachedClient
+}
+
+// cachedClient is a clientset built from a given revision of a kubeconfig secret.
+type cachedClient struct {
+	resourceVersion string
+	cs              kubernetes.Interface
+}
+
+// NewSecretProvider returns a SecretProvider. The local workload provider is used for
+// clusters that do not reference a kubeconfig secret.
+func NewSecretProvider(cs kubernetes.Interface, kcdcs clientset.Interface, local *workload.K8sProvider,
+	options ...func(*config.Options)) *SecretProvider {
+
+	return &SecretProvider{
+		cs:      cs,
+		kcdcs:   kcdcs,
+		local:   local,
+		options: options,
+		clients: make(map[string]cachedClient),
+	}
+}
+
+// WorkloadProvider implements the Provider interface.
+func (sp *SecretProvider) WorkloadProvider(kcd *kcdv1.KCD, cluster kcdv1.ClusterSpec) (workload.Provider, error) {
+	if cluster.KubeConfigSecret == "" {
+		return sp.local.ForNamespace(Namespace(kcd, cluster)), nil
+	}
+
+	cs, err := sp.client(kcd, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return workload.NewProvider(cs, sp.kcdcs, Namespace(kcd, cluster), sp.options...), nil
+}
+
+// client returns the clientset for the cluster's kubeconfig secret. Clientsets are reused
+// until the secret changes.
+func (sp *SecretProvider) client(kcd *kcdv1.KCD, cluster kcdv1.ClusterSpec) (kubernetes.Interface, error) {
+	key := cluster.KubeConfigKey
+	if key == "" {
+		key = DefaultKubeConfigKey
+	}
+
+	secret, err := sp.cs.CoreV1().Secrets(kcd.Namespace).Get(context.TODO(), cluster.KubeConfigSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get kubeconfig secret %s for cluster %s", cluster.KubeConfigSecret, cluster.Name)
+	}
+
+	cacheKey := kcd.Namespace + "/" + cluster.KubeConfigSecret + "/" + key
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if cached, ok := sp.clients[cacheKey]; ok && cached.resourceVersion == secret.ResourceVersion {
+		return cached.cs, nil
+	}
+
+	glog.V(4).Infof("Loading kubeconfig for cluster=%s from secret=%s/%s, key=%s",
+		cluster.Name, kcd.Namespace, cluster.KubeConfigSecret, key)
+
+	data, ok := secret.Data[key]
+	if !ok {
+		return nil, errors.Errorf("kubeconfig secret %s for cluster %s has no key %s", cluster.KubeConfigSecret, cluster.Name, key)
+	}
+
+	cfg, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load kubeconfig for cluster %s", cluster.Name)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build clientset for cluster %s", cluster.Name)
+	}
+
+	sp.clients[cacheKey] = cachedClient{resourceVersion: secret.ResourceVersion, cs: cs}
+	return cs, nil
+}
+
+// Namespace returns the namespace of the workloads in the given cluster.
+func Namespace(kcd *kcdv1.KCD, cluster kcdv1.ClusterSpec) string {
+	if cluster.Namespace != "" {
+		return cluster.Namespace
+	}
+	return kcd.Namespace
+}
+
+// Waves groups the clusters of the KCD resource into the order in which they should be
+// rolled out. Consecutive clusters that share the same non-zero wave are grouped together,
+// otherwise each cluster is rolled out on its own.
+func Waves(kcd *kcdv1.KCD) [][]kcdv1.ClusterSpec {
+	var waves [][]kcdv1.ClusterSpec
+	for i, cluster := range kcd.Spec.Clusters {
+		if i > 0 && cluster.Wave != 0 && cluster.Wave == kcd.Spec.Clusters[i-1].Wave {
+			waves[len(waves)-1] = append(waves[len(waves)-1], cluster)
+			continue
+		}
+		waves = append(waves, []kcdv1.ClusterSpec{cluster})
+	}
+	return waves
+}
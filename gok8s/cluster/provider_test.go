@@ -0,0 +1,119 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/workload"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+const namespace = "test-namespace"
+
+const kubeConfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: https://remote.example.com
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: remote
+current-context: remote
+users:
+- name: remote
+  user:
+    token: secret-token
+`
+
+func newKubeConfigSecret(name, key string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, ResourceVersion: "1"},
+		Data:       map[string][]byte{key: []byte(kubeConfig)},
+	}
+}
+
+func TestSecretProviderLocal(t *testing.T) {
+	cs := gofake.NewSimpleClientset()
+	sp := NewSecretProvider(cs, nil, workload.NewProvider(cs, nil, namespace))
+	kcd := &kcdv1.KCD{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace}}
+
+	for _, tc := range []struct {
+		cluster   kcdv1.ClusterSpec
+		namespace string
+	}{
+		{kcdv1.ClusterSpec{Name: "local"}, namespace},
+		{kcdv1.ClusterSpec{Name: "local", Namespace: "other"}, "other"},
+	} {
+		wp, err := sp.WorkloadProvider(kcd, tc.cluster)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tc.cluster, err)
+		}
+		if wp.Client() != kubernetes.Interface(cs) {
+			t.Errorf("%+v: expected the local client", tc.cluster)
+		}
+		if wp.Namespace() != tc.namespace {
+			t.Errorf("%+v: expected namespace %s, got %s", tc.cluster, tc.namespace, wp.Namespace())
+		}
+	}
+}
+
+func TestSecretProviderRemote(t *testing.T) {
+	cs := gofake.NewSimpleClientset(newKubeConfigSecret("remote", DefaultKubeConfigKey), newKubeConfigSecret("custom", "config"))
+	sp := NewSecretProvider(cs, nil, workload.NewProvider(cs, nil, namespace))
+	kcd := &kcdv1.KCD{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace}}
+
+	cluster := kcdv1.ClusterSpec{Name: "remote", KubeConfigSecret: "remote", Namespace: "other"}
+	wp, err := sp.WorkloadProvider(kcd, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wp.Client() == kubernetes.Interface(cs) {
+		t.Errorf("expected a client for the remote cluster")
+	}
+	if wp.Namespace() != "other" {
+		t.Errorf("expected namespace other, got %s", wp.Namespace())
+	}
+
+	// clients are reused until the secret changes
+	cached, err := sp.WorkloadProvider(kcd, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cached.Client() != wp.Client() {
+		t.Errorf("expected the cached client to be reused")
+	}
+	secret := newKubeConfigSecret("remote", DefaultKubeConfigKey)
+	secret.ResourceVersion = "2"
+	if _, err := cs.CoreV1().Secrets(namespace).Update(context.Background(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update secret: %v", err)
+	}
+	updated, err := sp.WorkloadProvider(kcd, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updated.Client() == wp.Client() {
+		t.Errorf("expected a new client after the secret changed")
+	}
+
+	if _, err := sp.WorkloadProvider(kcd, kcdv1.ClusterSpec{Name: "custom", KubeConfigSecret: "custom", KubeConfigKey: "config"}); err != nil {
+		t.Errorf("unexpected error for custom kubeconfig key: %v", err)
+	}
+
+	for _, cluster := range []kcdv1.ClusterSpec{
+		{Name: "missing", KubeConfigSecret: "missing"},
+		{Name: "custom", KubeConfigSecret: "custom"},
+		{Name: "remote", KubeConfigSecret: "remote", KubeConfigKey: "config"},
+	} {
+		if _, err := sp.WorkloadProvider(kcd, cluster); err == nil {
+			t.Errorf("%+v: expected error", cluster)
+		}
+	}
+}
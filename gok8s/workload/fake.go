@@ -2,6 +2,7 @@ package workload
 
 import (
 	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -9,6 +10,7 @@ type FakeProvider struct {
 	namespace string
 	client    kubernetes.Interface
 	workloads []Workload
+	dc        dynamic.Interface
 }
 
 func NewFakeProvider(client kubernetes.Interface, namespace string, workloads []Workload) *FakeProvider {
@@ -30,3 +32,12 @@ func (fp *FakeProvider) Client() kubernetes.Interface {
 func (fp *FakeProvider) Workloads(kcd *kcdv1.KCD, types ...string) ([]Workload, error) {
 	return fp.workloads, nil
 }
+
+func (fp *FakeProvider) WithDynamicClient(dc dynamic.Interface) *FakeProvider {
+	fp.dc = dc
+	return fp
+}
+
+func (fp *FakeProvider) DynamicClient() dynamic.Interface {
+	return fp.dc
+}
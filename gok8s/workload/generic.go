@@ -0,0 +1,281 @@
+package workload
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+// GenericResource describes a custom workload kind (such as an Argo Rollout or an
+// OpenKruise CloneSet) that manages its pods through a pod template.
+type GenericResource struct {
+	// Resource identifies the API resource, e.g. rollouts.v1alpha1.argoproj.io.
+	Resource schema.GroupVersionResource
+
+	// Kind is the kind of the resource, e.g. Rollout. It is used as the workload type.
+	Kind string
+
+	// PodTemplatePath is the path to the pod template within the resource,
+	// e.g. {.spec.template}.
+	PodTemplatePath string
+}
+
+// ParseGenericResource parses a generic resource definition of the form
+// <resource>.<version>.<group>/<Kind>=<podTemplatePath>, for example
+// rollouts.v1alpha1.argoproj.io/Rollout={.spec.template}.
+func ParseGenericResource(def string) (GenericResource, error) {
+	parts := strings.SplitN(def, "=", 2)
+	if len(parts) != 2 {
+		return GenericResource{}, errors.Errorf("generic resource %s is missing a pod template path", def)
+	}
+	resKind := strings.SplitN(parts[0], "/", 2)
+	if len(resKind) != 2 || resKind[1] == "" {
+		return GenericResource{}, errors.Errorf("generic resource %s is missing a kind", def)
+	}
+
+	gvr, _ := schema.ParseResourceArg(resKind[0])
+	if gvr == nil {
+		return GenericResource{}, errors.Errorf("generic resource %s must be of the form <resource>.<version>.<group>", resKind[0])
+	}
+
+	if _, err := fieldPath(parts[1]); err != nil {
+		return GenericResource{}, errors.Wrapf(err, "invalid pod template path for generic resource %s", def)
+	}
+
+	return GenericResource{
+		Resource:        *gvr,
+		Kind:            resKind[1],
+		PodTemplatePath: parts[1],
+	}, nil
+}
+
+// fieldPath converts a simple JSONPath expression such as {.spec.template} into
+// its field names. Only plain field references are supported.
+func fieldPath(path string) ([]string, error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(p, "{")
+	p = strings.TrimSuffix(p, "}")
+	p = strings.TrimPrefix(p, ".")
+	if p == "" {
+		return nil, errors.Errorf("empty path %s", path)
+	}
+	if strings.ContainsAny(p, "[]*?@$()") {
+		return nil, errors.Errorf("path %s must only contain field references", path)
+	}
+
+	fields := strings.Split(p, ".")
+	for _, f := range fields {
+		if f == "" {
+			return nil, errors.Errorf("path %s contains an empty field", path)
+		}
+	}
+	return fields, nil
+}
+
+// Generic defines a workload for managing custom resources that contain a pod template,
+// using the dynamic client.
+type Generic struct {
+	obj      *unstructured.Unstructured
+	resource GenericResource
+	fields   []string
+
+	client dynamic.ResourceInterface
+}
+
+// NewGeneric returns an instance for managing a custom workload described by the given
+// generic resource definition.
+func NewGeneric(dc dynamic.Interface, namespace string, resource GenericResource, obj *unstructured.Unstructured) (*Generic, error) {
+	client := dc.Resource(resource.Resource).Namespace(namespace)
+	return newGeneric(obj, resource, client)
+}
+
+func newGeneric(obj *unstructured.Unstructured, resource GenericResource, client dynamic.ResourceInterface) (*Generic, error) {
+	fields, err := fieldPath(resource.PodTemplatePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return &Generic{
+		obj:      obj,
+		resource: resource,
+		fields:   fields,
+		client:   client,
+	}, nil
+}
+
+func (g *Generic) String() string {
+	return fmt.Sprintf("%+v", g.obj)
+}
+
+// curr returns the current state of the resource.
+func (g *Generic) curr() (*unstructured.Unstructured, error) {
+	obj, err := g.client.Get(context.TODO(), g.obj.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s state", g.resource.Kind)
+	}
+	return obj, nil
+}
+
+// Name implements the Workload interface.
+func (g *Generic) Name() string {
+	return g.obj.GetName()
+}
+
+// Namespace implements the Workload interface.
+func (g *Generic) Namespace() string {
+	return g.obj.GetNamespace()
+}
+
+// Type implements the Workload interface.
+func (g *Generic) Type() string {
+	return g.resource.Kind
+}
+
+// PodSpec implements the Workload interface.
+func (g *Generic) PodSpec() corev1.PodSpec {
+	return g.PodTemplateSpec().Spec
+}
+
+// PodTemplateSpec implements the TemplateWorkload interface.
+func (g *Generic) PodTemplateSpec() corev1.PodTemplateSpec {
+	var pts corev1.PodTemplateSpec
+
+	tmpl, found, err := unstructured.NestedMap(g.obj.Object, g.fields...)
+	if err != nil || !found {
+		glog.Errorf("Failed to find pod template at %s in %s %s: %v", g.resource.PodTemplatePath, g.resource.Kind, g.Name(), err)
+		return pts
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(tmpl, &pts); err != nil {
+		glog.Errorf("Failed to convert pod template of %s %s: %v", g.resource.Kind, g.Name(), err)
+	}
+	return pts
+}
+
+// RolloutFailed implements the Workload interface. Custom resources are expected to
+// follow the Deployment convention of reporting a Progressing condition with reason
+// ProgressDeadlineExceeded when a rollout fails.
+func (g *Generic) RolloutFailed(rolloutTime time.Time) (bool, error) {
+	glog.V(4).Infof("checking rollout failure for %s %v at time %v", g.resource.Kind, g.Name(), rolloutTime)
+
+	obj, err := g.curr()
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to obtain current %s while checking rollout failure", g.resource.Kind)
+	}
+
+	conditions, _, err := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read conditions of %s %s", g.resource.Kind, g.Name())
+	}
+
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if cond["type"] != "Progressing" || cond["status"] != string(corev1.ConditionFalse) ||
+			cond["reason"] != "ProgressDeadlineExceeded" {
+			continue
+		}
+		if updated, ok := cond["lastUpdateTime"].(string); ok {
+			t, err := time.Parse(time.RFC3339, updated)
+			if err == nil && t.Before(rolloutTime) {
+				continue
+			}
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// PodSelector implements the Workload interface.
+func (g *Generic) PodSelector() string {
+	set := labels.Set(g.PodTemplateSpec().Labels)
+	return set.AsSelector().String()
+}
+
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// PatchPodSpec implements the Workload interface. Custom resources do not support
+// strategic merge patches, so the container image is replaced via a JSON patch
+// that is guarded by a test of the container name.
+func (g *Generic) PatchPodSpec(kcd *kcd1.KCD, container corev1.Container, version string) error {
+	idx := -1
+	for i, c := range g.PodSpec().Containers {
+		if c.Name == container.Name {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return errors.Errorf("container %s not found in %s %s", container.Name, g.resource.Kind, g.Name())
+	}
+
+	containerPath := fmt.Sprintf("/%s/spec/containers/%d", strings.Join(g.fields, "/"), idx)
+	patch, err := json.Marshal([]jsonPatchOperation{
+		{Op: "test", Path: containerPath + "/name", Value: container.Name},
+		{Op: "replace", Path: containerPath + "/image", Value: fmt.Sprintf("%s:%s", kcd.Spec.ImageRepo, version)},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	_, err = g.client.Patch(context.TODO(), g.Name(), types.JSONPatchType, patch, metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch pod template spec container for %s %s", g.resource.Kind, g.Name())
+	}
+	return nil
+}
+
+// NumReplicas implements the TemplateWorkload interface. The desired replicas of the spec
+// are returned, or the replicas of the status if the spec doesn't define them.
+func (g *Generic) NumReplicas() (int32, error) {
+	obj, err := g.curr()
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get current %s for %s", g.resource.Kind, g.Name())
+	}
+
+	num, found, err := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if err != nil || !found {
+		num, _, err = unstructured.NestedInt64(obj.Object, "status", "replicas")
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to read replicas of %s %s", g.resource.Kind, g.Name())
+		}
+	}
+	return int32(num), nil
+}
+
+const genericReplicasPatchJSON = `
+	{
+		"spec": {
+			"replicas": %d
+		}
+	}`
+
+// PatchNumReplicas implements the TemplateWorkload interface.
+func (g *Generic) PatchNumReplicas(num int32) error {
+	_, err := g.client.Patch(context.TODO(), g.Name(), types.MergePatchType,
+		[]byte(fmt.Sprintf(genericReplicasPatchJSON, num)), metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch replicas for %s %s", g.resource.Kind, g.Name())
+	}
+	return nil
+}
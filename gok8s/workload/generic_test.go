@@ -0,0 +1,233 @@
+package workload
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+const testNamespace = "test-namespace"
+
+var rolloutResource = GenericResource{
+	Resource:        schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+	Kind:            "Rollout",
+	PodTemplatePath: "{.spec.template}",
+}
+
+func TestParseGenericResource(t *testing.T) {
+	for _, tc := range []struct {
+		def      string
+		expected GenericResource
+	}{
+		{"rollouts.v1alpha1.argoproj.io/Rollout={.spec.template}", rolloutResource},
+		{
+			"clonesets.v1alpha1.apps.kruise.io/CloneSet=.spec.template",
+			GenericResource{
+				Resource:        schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"},
+				Kind:            "CloneSet",
+				PodTemplatePath: ".spec.template",
+			},
+		},
+	} {
+		gr, err := ParseGenericResource(tc.def)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.def, err)
+			continue
+		}
+		if !reflect.DeepEqual(gr, tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.def, tc.expected, gr)
+		}
+	}
+
+	for _, def := range []string{
+		"rollouts.v1alpha1.argoproj.io/Rollout",
+		"rollouts.v1alpha1.argoproj.io={.spec.template}",
+		"rollouts.v1alpha1.argoproj.io/={.spec.template}",
+		"rollouts/Rollout={.spec.template}",
+		"rollouts.v1alpha1.argoproj.io/Rollout={}",
+		"rollouts.v1alpha1.argoproj.io/Rollout={.spec.templates[0]}",
+	} {
+		if _, err := ParseGenericResource(def); err == nil {
+			t.Errorf("%s: expected error", def)
+		}
+	}
+}
+
+func TestFieldPath(t *testing.T) {
+	for _, tc := range []struct {
+		path     string
+		expected []string
+		err      bool
+	}{
+		{path: "{.spec.template}", expected: []string{"spec", "template"}},
+		{path: " {.spec.template} ", expected: []string{"spec", "template"}},
+		{path: ".spec.template", expected: []string{"spec", "template"}},
+		{path: "spec", expected: []string{"spec"}},
+		{path: "{}", err: true},
+		{path: "", err: true},
+		{path: "{.spec..template}", err: true},
+		{path: "{.spec.template.}", err: true},
+		{path: "{.spec.containers[*]}", err: true},
+		{path: "{$.spec}", err: true},
+	} {
+		fields, err := fieldPath(tc.path)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", tc.path, fields)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(fields, tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.path, tc.expected, fields)
+		}
+	}
+}
+
+func newRollout(spec, status map[string]interface{}) *unstructured.Unstructured {
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+	spec["template"] = map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{"app": "app"},
+		},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "sidecar", "image": "registry.example.com/sidecar:1"},
+				map[string]interface{}{"name": "app", "image": "registry.example.com/app:v1"},
+			},
+		},
+	}
+	obj := map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]interface{}{"name": "app", "namespace": testNamespace},
+		"spec":       spec,
+	}
+	if status != nil {
+		obj["status"] = status
+	}
+	return &unstructured.Unstructured{Object: obj}
+}
+
+func newTestGeneric(t *testing.T, obj *unstructured.Unstructured) (*Generic, *dynamicfake.FakeDynamicClient) {
+	dc := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), obj)
+	g, err := NewGeneric(dc, testNamespace, rolloutResource, obj)
+	if err != nil {
+		t.Fatalf("failed to create generic workload: %v", err)
+	}
+	return g, dc
+}
+
+func TestGenericPatchPodSpec(t *testing.T) {
+	g, dc := newTestGeneric(t, newRollout(nil, nil))
+	kcd := &kcd1.KCD{Spec: kcd1.KCDSpec{ImageRepo: "registry.example.com/app"}}
+
+	if selector := g.PodSelector(); selector != "app=app" {
+		t.Errorf("expected pod selector app=app, got %s", selector)
+	}
+
+	if err := g.PatchPodSpec(kcd, corev1.Container{Name: "app"}, "v2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	obj, err := dc.Resource(rolloutResource.Resource).Namespace(testNamespace).Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get rollout: %v", err)
+	}
+	containers, _, _ := unstructured.NestedSlice(obj.Object, "spec", "template", "spec", "containers")
+	images := []string{
+		containers[0].(map[string]interface{})["image"].(string),
+		containers[1].(map[string]interface{})["image"].(string),
+	}
+	if expected := []string{"registry.example.com/sidecar:1", "registry.example.com/app:v2"}; !reflect.DeepEqual(images, expected) {
+		t.Errorf("expected images %v, got %v", expected, images)
+	}
+
+	if err := g.PatchPodSpec(kcd, corev1.Container{Name: "missing"}, "v2"); err == nil {
+		t.Errorf("expected error for unknown container")
+	}
+}
+
+func TestGenericNumReplicas(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		spec     map[string]interface{}
+		status   map[string]interface{}
+		expected int32
+	}{
+		{"spec preferred over status", map[string]interface{}{"replicas": int64(3)}, map[string]interface{}{"replicas": int64(2)}, 3},
+		{"spec without status", map[string]interface{}{"replicas": int64(3)}, nil, 3},
+		{"status without spec", nil, map[string]interface{}{"replicas": int64(2)}, 2},
+		{"no replicas", nil, nil, 0},
+	} {
+		g, _ := newTestGeneric(t, newRollout(tc.spec, tc.status))
+		num, err := g.NumReplicas()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if num != tc.expected {
+			t.Errorf("%s: expected %d replicas, got %d", tc.name, tc.expected, num)
+		}
+	}
+
+	g, dc := newTestGeneric(t, newRollout(nil, nil))
+	if err := g.PatchNumReplicas(4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	obj, err := dc.Resource(rolloutResource.Resource).Namespace(testNamespace).Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get rollout: %v", err)
+	}
+	if num, _, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas"); num != 4 {
+		t.Errorf("expected patched replicas 4, got %d", num)
+	}
+}
+
+func TestGenericRolloutFailed(t *testing.T) {
+	rolloutTime := time.Now().UTC().Truncate(time.Second)
+	condition := func(status, reason string, updated time.Time) map[string]interface{} {
+		return map[string]interface{}{"conditions": []interface{}{
+			map[string]interface{}{
+				"type":           "Progressing",
+				"status":         status,
+				"reason":         reason,
+				"lastUpdateTime": updated.Format(time.RFC3339),
+			},
+		}}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		status   map[string]interface{}
+		expected bool
+	}{
+		{"no status", nil, false},
+		{"progressing", condition("True", "ReplicaSetUpdated", rolloutTime.Add(time.Minute)), false},
+		{"deadline exceeded", condition("False", "ProgressDeadlineExceeded", rolloutTime.Add(time.Minute)), true},
+		{"deadline exceeded before rollout", condition("False", "ProgressDeadlineExceeded", rolloutTime.Add(-time.Minute)), false},
+	} {
+		g, _ := newTestGeneric(t, newRollout(nil, tc.status))
+		failed, err := g.RolloutFailed(rolloutTime)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if failed != tc.expected {
+			t.Errorf("%s: expected rollout failed %t, got %t", tc.name, tc.expected, failed)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	clientset "github.com/wish/kcd/gok8s/client/clientset/versioned"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -26,12 +27,23 @@ type Provider interface {
 	Workloads(kcd *kcdv1.KCD, types ...string) ([]Workload, error)
 }
 
+// DynamicProvider is implemented by workload providers that provide a dynamic client for
+// working with resources that have no typed client, e.g. HTTPRoutes.
+type DynamicProvider interface {
+	// DynamicClient returns the dynamic client, or nil if there is none.
+	DynamicClient() dynamic.Interface
+}
+
 // K8sProvider is a Kubernetes implementation of a workload provider.
 type K8sProvider struct {
 	cs        kubernetes.Interface
 	kcdcs     clientset.Interface
 	namespace string
 
+	// dc and generic define custom workload kinds that are managed via the dynamic client.
+	dc      dynamic.Interface
+	generic []GenericResource
+
 	options *config.Options
 }
 
@@ -51,6 +63,21 @@ func NewProvider(cs kubernetes.Interface, kcdcs clientset.Interface, ns string,
 	}
 }
 
+// AddGenericResources registers custom workload kinds, such as Argo Rollouts, that
+// are selected alongside the built-in workload types.
+func (k *K8sProvider) AddGenericResources(dc dynamic.Interface, resources ...GenericResource) *K8sProvider {
+	k.dc = dc
+	k.generic = append(k.generic, resources...)
+	return k
+}
+
+// ForNamespace returns a copy of the provider that operates within the given namespace.
+func (k *K8sProvider) ForNamespace(namespace string) *K8sProvider {
+	kCopy := *k
+	kCopy.namespace = namespace
+	return &kCopy
+}
+
 // Namespace returns the namespace that this K8sProvider is operating within.
 func (k *K8sProvider) Namespace() string {
 	return k.namespace
@@ -62,6 +89,11 @@ func (k *K8sProvider) Client() kubernetes.Interface {
 	return k.cs
 }
 
+// DynamicClient implements the DynamicProvider interface.
+func (k *K8sProvider) DynamicClient() dynamic.Interface {
+	return k.dc
+}
+
 // Workloads returns the workload instances that match the given container version resource.
 func (k *K8sProvider) Workloads(kcd *kcdv1.KCD, types ...string) ([]Workload, error) {
 	var result []Workload
@@ -149,6 +181,24 @@ func (k *K8sProvider) Workloads(kcd *kcdv1.KCD, types ...string) ([]Workload, er
 		}
 	}
 
+	for _, gr := range k.generic {
+		if !contains(types, gr.Kind) {
+			continue
+		}
+		list, err := k.dc.Resource(gr.Resource).Namespace(k.namespace).List(context.TODO(), listOpts)
+		if err != nil {
+			return nil, k.handleError(err, gr.Resource.Resource)
+		}
+		for _, item := range list.Items {
+			obj := item
+			wl, err := NewGeneric(k.dc, k.namespace, gr, &obj)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to create workload for %s %s", gr.Kind, obj.GetName())
+			}
+			result = append(result, wl)
+		}
+	}
+
 	glog.V(2).Infof("Retrieved %d workloads", len(result))
 
 	return result, nil
@@ -98,3 +98,36 @@ func (ss *StatefulSet) PatchPodSpec(kcd *kcd1.KCD, container corev1.Container, v
 	}
 	return nil
 }
+
+// NumReplicas implements the TemplateWorkload interface. StatefulSets create their pods
+// one at a time, so the replicas of the spec are returned rather than those of the status,
+// which lag behind while scaling up.
+func (ss *StatefulSet) NumReplicas() (int32, error) {
+	statefulSet, err := ss.client.Get(context.TODO(), ss.statefulSet.Name, metav1.GetOptions{})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to get current StatefulSet for %s", ss.statefulSet.Name)
+	}
+
+	if statefulSet.Spec.Replicas == nil {
+		// defaulted by the api server
+		return 1, nil
+	}
+	return *statefulSet.Spec.Replicas, nil
+}
+
+const statefulSetReplicasPatchJSON = `
+	{
+		"spec": {
+			"replicas": %d
+		}
+	}`
+
+// PatchNumReplicas implements the TemplateWorkload interface.
+func (ss *StatefulSet) PatchNumReplicas(num int32) error {
+	_, err := ss.client.Patch(context.TODO(), ss.statefulSet.ObjectMeta.Name, types.StrategicMergePatchType,
+		[]byte(fmt.Sprintf(statefulSetReplicasPatchJSON, num)), metav1.PatchOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to patch replicas for StatefulSet %s", ss.statefulSet.Name)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package workload
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStatefulSetNumReplicas(t *testing.T) {
+	three := int32(3)
+	for _, tc := range []struct {
+		name     string
+		spec     *int32
+		status   int32
+		expected int32
+	}{
+		{"spec preferred over status while scaling up", &three, 1, 3},
+		{"default replicas", nil, 0, 1},
+	} {
+		statefulSet := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: testNamespace},
+			Spec:       appsv1.StatefulSetSpec{Replicas: tc.spec},
+			Status:     appsv1.StatefulSetStatus{Replicas: tc.status},
+		}
+		ss := NewStatefulSet(gofake.NewSimpleClientset(statefulSet), testNamespace, statefulSet)
+
+		num, err := ss.NumReplicas()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if num != tc.expected {
+			t.Errorf("%s: expected %d replicas, got %d", tc.name, tc.expected, num)
+		}
+	}
+}
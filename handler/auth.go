@@ -0,0 +1,286 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/gok8s/apis/custom"
+	"goji.io/pattern"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
+	"k8s.io/apiserver/pkg/authentication/token/tokenfile"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/authorization/authorizer"
+	"k8s.io/apiserver/pkg/authorization/authorizerfactory"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// AuthModeKubernetes authenticates requests via TokenReviews and authorizes them
+	// via SubjectAccessReviews against the KCD resource.
+	AuthModeKubernetes = "kubernetes"
+
+	// AuthModeStatic authenticates requests against a static token file and allows
+	// all authenticated requests. Intended for local use.
+	AuthModeStatic = "static"
+
+	// AuthModeNone disables authentication and authorization.
+	AuthModeNone = "none"
+
+	kcdResource   = "kcds"
+	kcdAPIVersion = "v1"
+)
+
+// Auth authenticates and authorizes requests to the kcd API.
+type Auth struct {
+	Authenticator authenticator.Request
+	Authorizer    authorizer.Authorizer
+}
+
+// NewAuth returns an Auth instance for the given mode. Returns nil if authentication
+// is disabled. The token file is only used by the static mode and has the same format
+// as the Kubernetes static token file: token,user,uid,"group1,group2".
+func NewAuth(mode, tokenFile string, cs kubernetes.Interface) (*Auth, error) {
+	switch mode {
+	case AuthModeKubernetes:
+		return &Auth{
+			Authenticator: NewTokenReviewAuthenticator(cs),
+			Authorizer:    NewSubjectAccessReviewAuthorizer(cs),
+		}, nil
+	case AuthModeStatic:
+		if tokenFile == "" {
+			return nil, errors.New("a token file is required for static authentication")
+		}
+		tokens, err := tokenfile.NewCSV(tokenFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load token file %s", tokenFile)
+		}
+		return &Auth{
+			Authenticator: bearertoken.New(tokens),
+			Authorizer:    authorizerfactory.NewAlwaysAllowAuthorizer(),
+		}, nil
+	case AuthModeNone:
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unknown auth mode %s", mode)
+	}
+}
+
+// tokenReviewAuthenticator authenticates bearer tokens using the TokenReview API.
+type tokenReviewAuthenticator struct {
+	cs kubernetes.Interface
+}
+
+// NewTokenReviewAuthenticator returns an authenticator that authenticates requests by
+// submitting their bearer token to the Kubernetes TokenReview API.
+func NewTokenReviewAuthenticator(cs kubernetes.Interface) authenticator.Request {
+	return bearertoken.New(&tokenReviewAuthenticator{cs: cs})
+}
+
+// AuthenticateToken implements the authenticator.Token interface.
+func (tra *tokenReviewAuthenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	}
+
+	result, err := tra.cs.AuthenticationV1().TokenReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to create token review")
+	}
+	if !result.Status.Authenticated {
+		if result.Status.Error != "" {
+			glog.V(2).Infof("Token review failed: %s", result.Status.Error)
+		}
+		return nil, false, nil
+	}
+
+	extra := make(map[string][]string, len(result.Status.User.Extra))
+	for k, v := range result.Status.User.Extra {
+		extra[k] = v
+	}
+
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   result.Status.User.Username,
+			UID:    result.Status.User.UID,
+			Groups: result.Status.User.Groups,
+			Extra:  extra,
+		},
+	}, true, nil
+}
+
+// subjectAccessReviewAuthorizer authorizes requests using the SubjectAccessReview API.
+type subjectAccessReviewAuthorizer struct {
+	cs kubernetes.Interface
+}
+
+// NewSubjectAccessReviewAuthorizer returns an authorizer that checks whether a user may
+// perform an action by submitting a SubjectAccessReview to the Kubernetes API.
+func NewSubjectAccessReviewAuthorizer(cs kubernetes.Interface) authorizer.Authorizer {
+	return &subjectAccessReviewAuthorizer{cs: cs}
+}
+
+// Authorize implements the authorizer.Authorizer interface.
+func (sar *subjectAccessReviewAuthorizer) Authorize(ctx context.Context, attrs authorizer.Attributes) (authorizer.Decision, string, error) {
+	u := attrs.GetUser()
+
+	extra := make(map[string]authorizationv1.ExtraValue, len(u.GetExtra()))
+	for k, v := range u.GetExtra() {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   u.GetName(),
+			UID:    u.GetUID(),
+			Groups: u.GetGroups(),
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: attrs.GetNamespace(),
+				Verb:      attrs.GetVerb(),
+				Group:     attrs.GetAPIGroup(),
+				Version:   attrs.GetAPIVersion(),
+				Resource:  attrs.GetResource(),
+				Name:      attrs.GetName(),
+			},
+		},
+	}
+
+	result, err := sar.cs.AuthorizationV1().SubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return authorizer.DecisionNoOpinion, "", errors.Wrap(err, "failed to create subject access review")
+	}
+
+	switch {
+	case result.Status.Allowed:
+		return authorizer.DecisionAllow, result.Status.Reason, nil
+	case result.Status.Denied:
+		return authorizer.DecisionDeny, result.Status.Reason, nil
+	default:
+		return authorizer.DecisionNoOpinion, result.Status.Reason, nil
+	}
+}
+
+// Middleware returns middleware that authenticates each request and authorizes it
+// against the KCD resource it refers to.
+func (a *Auth) Middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok, err := a.Authenticator.AuthenticateRequest(r)
+		if err != nil {
+			glog.Errorf("Authentication failed (type=%T): %+v", err, err)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if ok && isAnonymous(resp.User) {
+			ok = false
+		}
+		if !ok {
+			glog.V(2).Info("Failed to authenticate user")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		if glog.V(4) {
+			glog.V(4).Infof("Authentication was successful for user %+v", resp.User)
+		}
+
+		attrs := requestAttributes(r, resp.User)
+		decision, reason, err := a.Authorizer.Authorize(r.Context(), attrs)
+		if err != nil {
+			glog.Errorf("Authorization failed: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if decision != authorizer.DecisionAllow {
+			glog.V(1).Infof("Authorization failed (%v) for user %s, verb=%s, namespace=%s, name=%s: %s",
+				decision, resp.User.GetName(), attrs.Verb, attrs.Namespace, attrs.Name, reason)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(request.WithUser(r.Context(), resp.User)))
+	})
+}
+
+// Allowed returns whether the authenticated user of the request may perform the verb on
+// the KCD resource the request refers to. Implements the AccessChecker interface of the
+// kcd API.
+func (a *Auth) Allowed(r *http.Request, verb string) bool {
+	u, ok := request.UserFrom(r.Context())
+	if !ok {
+		return false
+	}
+
+	attrs := requestAttributes(r, u)
+	attrs.Verb = verb
+	decision, _, err := a.Authorizer.Authorize(r.Context(), attrs)
+	if err != nil {
+		glog.Errorf("Authorization failed: %v", err)
+		return false
+	}
+	return decision == authorizer.DecisionAllow
+}
+
+// isAnonymous returns whether the user is the anonymous or an unauthenticated user.
+func isAnonymous(u user.Info) bool {
+	if u.GetName() == user.Anonymous {
+		return true
+	}
+	for _, group := range u.GetGroups() {
+		if group == user.AllUnauthenticated {
+			return true
+		}
+	}
+	return false
+}
+
+// requestAttributes returns the authorization attributes of a request to the kcd API.
+// Requests are authorized against the KCD resource identified by the namespace and name
+// path parameters, using the verb that corresponds to the request method.
+func requestAttributes(r *http.Request, u user.Info) authorizer.AttributesRecord {
+	namespace := pathParam(r, "namespace")
+	name := pathParam(r, "name")
+
+	return authorizer.AttributesRecord{
+		User:            u,
+		Verb:            requestVerb(r.Method, name),
+		Namespace:       namespace,
+		APIGroup:        custom.GroupName,
+		APIVersion:      kcdAPIVersion,
+		Resource:        kcdResource,
+		Name:            name,
+		ResourceRequest: true,
+		Path:            r.URL.Path,
+	}
+}
+
+// requestVerb returns the Kubernetes verb that corresponds to the HTTP method. The API
+// never deletes KCD resources, so all modifying requests are updates of the resource.
+func requestVerb(method, name string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		if name == "" {
+			return "list"
+		}
+		return "get"
+	default:
+		return "update"
+	}
+}
+
+// pathParam returns the value of the path parameter with the given name, or an empty
+// string if the matched route has no such parameter.
+func pathParam(r *http.Request, name string) string {
+	if v, ok := r.Context().Value(pattern.Variable(name)).(string); ok {
+		return v
+	}
+	return ""
+}
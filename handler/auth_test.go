@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	goji "goji.io"
+	"goji.io/pat"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	gofake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newAuthClientset returns a fake clientset that authenticates the given token as the
+// given user and allows that user to perform the given verb on KCD resources.
+func newAuthClientset(token, username, verb string, reviews *[]*authorizationv1.SubjectAccessReview) *gofake.Clientset {
+	cs := gofake.NewSimpleClientset()
+
+	cs.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if review.Spec.Token == token {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{
+				Username: username,
+				Groups:   []string{"system:authenticated"},
+			}
+		}
+		return true, review, nil
+	})
+
+	cs.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		*reviews = append(*reviews, review)
+		attrs := review.Spec.ResourceAttributes
+		if review.Spec.User == username && attrs.Verb == verb && attrs.Resource == "kcds" && attrs.Group == "custom.k8s.io" {
+			review.Status.Allowed = true
+		}
+		return true, review, nil
+	})
+
+	return cs
+}
+
+func newAuthMux(auth *Auth) http.Handler {
+	mux := goji.NewMux()
+	kcdmux := goji.SubMux()
+	mux.Handle(pat.New("/kcd/*"), kcdmux)
+
+	kcdmux.Use(accessTokenQueryParam)
+	kcdmux.Use(auth.Middleware)
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	kcdmux.Handle(pat.Get("/v1/namespaces/:namespace/resources"), ok)
+	kcdmux.Handle(pat.Post("/v1/namespaces/:namespace/resources/:name"), ok)
+	return mux
+}
+
+func TestKubernetesAuth(t *testing.T) {
+	var reviews []*authorizationv1.SubjectAccessReview
+	cs := newAuthClientset("good-token", "alice", "update", &reviews)
+
+	auth, err := NewAuth(AuthModeKubernetes, "", cs)
+	if err != nil {
+		t.Fatalf("unexpected error creating auth: %v", err)
+	}
+	mux := newAuthMux(auth)
+
+	testCases := []struct {
+		name     string
+		method   string
+		url      string
+		token    string
+		expected int
+	}{
+		{"no token", http.MethodPost, "/kcd/v1/namespaces/ns/resources/app", "", http.StatusUnauthorized},
+		{"bad token", http.MethodPost, "/kcd/v1/namespaces/ns/resources/app", "bad-token", http.StatusUnauthorized},
+		{"allowed", http.MethodPost, "/kcd/v1/namespaces/ns/resources/app", "good-token", http.StatusOK},
+		{"query param token", http.MethodPost, "/kcd/v1/namespaces/ns/resources/app?access_token=good-token", "", http.StatusOK},
+		{"forbidden verb", http.MethodGet, "/kcd/v1/namespaces/ns/resources", "good-token", http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		reviews = nil
+
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != tc.expected {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.expected, rec.Code)
+		}
+	}
+
+	/////
+
+	reviews = nil
+	req := httptest.NewRequest(http.MethodPost, "/kcd/v1/namespaces/ns/resources/app", nil)
+	req.Header.Set("Authorization", "Bearer good-token")
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(reviews) != 1 {
+		t.Fatalf("expected a single subject access review, got %d", len(reviews))
+	}
+	attrs := reviews[0].Spec.ResourceAttributes
+	if attrs.Namespace != "ns" || attrs.Name != "app" || attrs.Version != "v1" {
+		t.Errorf("unexpected resource attributes in subject access review: %+v", attrs)
+	}
+}
+
+func TestStaticAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcd-auth")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	if err := ioutil.WriteFile(tokenFile, []byte("static-token,bob,1001,\"dev\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write token file: %v", err)
+	}
+
+	if _, err := NewAuth(AuthModeStatic, "", nil); err == nil {
+		t.Errorf("expected error when no token file is provided")
+	}
+
+	auth, err := NewAuth(AuthModeStatic, tokenFile, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating auth: %v", err)
+	}
+	mux := newAuthMux(auth)
+
+	for token, expected := range map[string]int{
+		"static-token": http.StatusOK,
+		"other-token":  http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/kcd/v1/namespaces/ns/resources/app", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Code != expected {
+			t.Errorf("token %s: expected status %d, got %d", token, expected, rec.Code)
+		}
+	}
+
+	/////
+
+	if auth, err := NewAuth(AuthModeNone, "", nil); err != nil || auth != nil {
+		t.Errorf("expected no auth for mode none, got auth=%v, err=%v", auth, err)
+	}
+	if _, err := NewAuth("unknown", "", nil); err == nil {
+		t.Errorf("expected error for an unknown auth mode")
+	}
+}
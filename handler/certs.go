@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// certCheckInterval is the minimum interval between checks for updated certificate files.
+const certCheckInterval = 10 * time.Second
+
+// certReloader provides the TLS configuration of the server and reloads the certificate,
+// key and client CA files when they change, e.g. when a mounted secret is rotated.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu        sync.RWMutex
+	config    *tls.Config
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader returns a certReloader instance for the given files. The client CA
+// file is optional; if given, clients are required to present a certificate signed by
+// one of its CAs.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("a certificate and key file are required for TLS")
+	}
+
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := cr.load(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return cr, nil
+}
+
+// files returns the files that the TLS configuration is loaded from.
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != "" {
+		files = append(files, cr.caFile)
+	}
+	return files
+}
+
+// load reads the certificate files and replaces the current TLS configuration.
+func (cr *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range cr.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to stat %s", file)
+		}
+		modTimes[file] = fi.ModTime()
+	}
+
+	pair, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load key pair")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cr.caFile != "" {
+		data, err := ioutil.ReadFile(cr.caFile)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read client CA file %s", cr.caFile)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificates found in client CA file %s", cr.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.config = config
+	cr.modTimes = modTimes
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// changed returns whether any of the files changed since they were loaded.
+func (cr *certReloader) changed() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return false
+	}
+	cr.lastCheck = time.Now()
+
+	for _, file := range cr.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			// files may briefly disappear while a mounted secret is updated
+			glog.V(2).Infof("Failed to stat %s: %v", file, err)
+			return false
+		}
+		if !fi.ModTime().Equal(cr.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigForClient returns the current TLS configuration, reloading it first if the
+// files have changed. The previous configuration is kept if the files can't be loaded.
+func (cr *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if cr.changed() {
+		if err := cr.load(); err != nil {
+			glog.Errorf("Failed to reload certificates, using previous certificates: %v", err)
+		} else {
+			glog.V(1).Info("Reloaded certificates")
+		}
+	}
+
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.config, nil
+}
+
+// getCertificate returns the current server certificate.
+func (cr *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	config, err := cr.getConfigForClient(hello)
+	if err != nil {
+		return nil, err
+	}
+	return &config.Certificates[0], nil
+}
+
+// TLSConfig returns a TLS configuration that always uses the current certificates.
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: cr.getConfigForClient,
+		GetCertificate:     cr.getCertificate,
+		MinVersion:         tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate with the given common name and its key
+// to the given files, with the given modification time.
+func writeCert(t *testing.T, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	files := map[string][]byte{
+		certFile: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyFile:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", file, err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatalf("failed to set modification time of %s: %v", file, err)
+		}
+	}
+}
+
+// commonName returns the common name of the certificate served by the TLS configuration.
+func commonName(t *testing.T, config *tls.Config) string {
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcd-certs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := newCertReloader(certFile, keyFile, ""); err == nil {
+		t.Errorf("expected error for missing certificate files")
+	}
+
+	now := time.Now()
+	writeCert(t, certFile, keyFile, "first", now.Add(-time.Minute))
+
+	cr, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("unexpected error creating cert reloader: %v", err)
+	}
+	config := cr.TLSConfig()
+	if cn := commonName(t, config); cn != "first" {
+		t.Errorf("expected first certificate, got %s", cn)
+	}
+
+	/////
+
+	writeCert(t, certFile, keyFile, "second", now)
+	if cn := commonName(t, config); cn != "first" {
+		t.Errorf("expected certificate not to be reloaded within the check interval, got %s", cn)
+	}
+
+	cr.lastCheck = now.Add(-certCheckInterval)
+	if cn := commonName(t, config); cn != "second" {
+		t.Errorf("expected second certificate after reload, got %s", cn)
+	}
+
+	/////
+
+	if err := ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	cr.lastCheck = now.Add(-certCheckInterval)
+	if cn := commonName(t, config); cn != "second" {
+		t.Errorf("expected previous certificate to be kept when reload fails, got %s", cn)
+	}
+}
+
+func TestCertReloaderClientCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kcd-certs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caFile, caKeyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	writeCert(t, certFile, keyFile, "server", time.Now())
+	writeCert(t, caFile, caKeyFile, "ca", time.Now())
+
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("unexpected error creating cert reloader: %v", err)
+	}
+	config, err := cr.TLSConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("failed to get tls config: %v", err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Errorf("expected client certificates to be required and verified")
+	}
+
+	if _, err := newCertReloader(certFile, keyFile, keyFile); err == nil {
+		t.Errorf("expected error for a client CA file without certificates")
+	}
+}
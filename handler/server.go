@@ -2,22 +2,28 @@ package handler
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"reflect"
+	"sync"
 	"time"
 
+	"github.com/wish/kcd/audit"
 	"github.com/wish/kcd/events"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	"github.com/wish/kcd/stats"
 	v1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/client-go/kubernetes"
 
 	"github.com/golang/glog"
-	"github.com/wish/kcd/gok8s/client/clientset/versioned"
+	"github.com/pkg/errors"
+	kcdlisters "github.com/wish/kcd/gok8s/client/listers/custom/v1"
+	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/history"
 	"github.com/wish/kcd/resource"
 	svc "github.com/wish/kcd/service"
@@ -25,9 +31,12 @@ import (
 	"goji.io/pat"
 	_ "k8s.io/apimachinery/pkg/runtime"
 	_ "k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/apiserver/pkg/server/options"
 )
 
+// MaxStreamDuration is the duration after which event streams are closed, so that they
+// end before the write timeout of the server. Clients are expected to reconnect.
+const MaxStreamDuration = 50 * time.Second
+
 var (
 	runtimeSchema = runtime.NewScheme()
 	codecs        = serializer.NewCodecFactory(runtimeSchema)
@@ -44,10 +53,84 @@ func StaticContentHandler(content string) http.HandlerFunc {
 	}
 }
 
-// VersionPatchHandler returns a HandlerFunc that writes the given content to the response.
-func VersionPatchHandler(stats stats.Stats, customClient *versioned.Clientset) http.HandlerFunc {
+// VersionPatchHandler returns a HandlerFunc that serves the mutating admission webhook
+// which keeps the versions of workloads managed by KCD resources, as listed by kcdLister.
+// Registry credentials are read with cs. Patches are recorded in the audit log.
+func VersionPatchHandler(stats stats.Stats, cs kubernetes.Interface, kcdLister kcdlisters.KCDLister,
+	auditLogger audit.Logger) http.HandlerFunc {
+
+	return admissionHandler(func(req *v1.AdmissionRequest) *v1.AdmissionResponse {
+		return events.Mutate(req, stats, cs, kcdLister, auditLogger)
+	})
+}
+
+// ValidateHandler returns a HandlerFunc that serves the validating admission webhook for
+// KCD resources. KCD resources with invalid specs are rejected. If a version policy is
+// given, other resources are reviewed by the policy.
+func ValidateHandler(versionPolicy *events.VersionPolicy) http.HandlerFunc {
+	return admissionHandler(func(req *v1.AdmissionRequest) *v1.AdmissionResponse {
+		if req.Kind.Kind != "KCD" {
+			if versionPolicy == nil {
+				return &v1.AdmissionResponse{Allowed: true}
+			}
+			return versionPolicy.Review(req)
+		}
+		if req.Operation == v1.Delete {
+			return &v1.AdmissionResponse{Allowed: true}
+		}
+
+		var kcd kcd1.KCD
+		if err := json.Unmarshal(req.Object.Raw, &kcd); err != nil {
+			glog.Errorf("Could not unmarshal KCD resource: %v", err)
+			return &v1.AdmissionResponse{
+				Allowed: false,
+				Result: &metav1.Status{
+					Status:  metav1.StatusFailure,
+					Reason:  metav1.StatusReasonBadRequest,
+					Code:    http.StatusBadRequest,
+					Message: fmt.Sprintf("could not decode KCD resource: %v", err),
+				},
+			}
+		}
+
+		if req.Operation == v1.Update && specUnchanged(req, &kcd) {
+			// allow e.g. label and finalizer updates of KCD resources created before
+			// the spec was validated
+			return &v1.AdmissionResponse{Allowed: true}
+		}
+
+		errs := resource.ValidateSpec(&kcd.Spec)
+		if len(errs) == 0 {
+			return &v1.AdmissionResponse{Allowed: true}
+		}
+
+		glog.V(2).Infof("Rejecting invalid KCD resource %s/%s: %v", req.Namespace, kcd.Name, errs.ToAggregate())
+		return &v1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Status:  metav1.StatusFailure,
+				Reason:  metav1.StatusReasonInvalid,
+				Code:    http.StatusUnprocessableEntity,
+				Message: fmt.Sprintf("invalid KCD resource %s: %v", kcd.Name, errs.ToAggregate()),
+			},
+		}
+	})
+}
+
+// specUnchanged returns whether the update reviewed by the request leaves the spec of the
+// KCD resource unchanged.
+func specUnchanged(req *v1.AdmissionRequest, kcd *kcd1.KCD) bool {
+	var old kcd1.KCD
+	if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(old.Spec, kcd.Spec)
+}
+
+// admissionHandler returns a HandlerFunc that decodes admission reviews, passes their
+// request to the review function and encodes its response.
+func admissionHandler(review func(req *v1.AdmissionRequest) *v1.AdmissionResponse) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		glog.V(4).Info("Enter mutation......")
 		var body []byte
 		if r.Body != nil {
 			if data, err := ioutil.ReadAll(r.Body); err == nil {
@@ -55,180 +138,167 @@ func VersionPatchHandler(stats stats.Stats, customClient *versioned.Clientset) h
 			}
 		}
 
-		var admissionResponse *v1.AdmissionResponse
 		ar := v1.AdmissionReview{}
-		c := make(chan *v1.AdmissionResponse, 1)
-		if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+		if _, _, err := deserializer.Decode(body, nil, &ar); err != nil || ar.Request == nil {
 			glog.Errorf("Can't decode body: %v", err)
-			admissionResponse = &v1.AdmissionResponse{
-				Allowed: true,
-				Result: &metav1.Status{
-					Message: err.Error(),
-				},
-			}
-		} else {
-			go func() {
-				admissionResponse = events.Mutate(ar.Request, stats, customClient)
-				c <- admissionResponse
-			}()
+			http.Error(w, "could not decode admission review", http.StatusBadRequest)
+			return
 		}
-
-		admissionResponse = <-c
+		admissionResponse := review(ar.Request)
+		admissionResponse.UID = ar.Request.UID
 
 		admissionReview := v1.AdmissionReview{
 			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
-		}
-		if admissionResponse != nil {
-			admissionReview.Response = admissionResponse
-			if ar.Request != nil {
-				admissionReview.Response.UID = ar.Request.UID
-			}
+			Response: admissionResponse,
 		}
 
-		if resp, err := json.Marshal(admissionReview); err != nil {
+		resp, err := json.Marshal(admissionReview)
+		if err != nil {
 			glog.Errorf("Can't encode response: %v", err)
 			http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-		} else {
-			if _, err := w.Write(resp); err != nil {
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(resp); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 	}
 }
 
-// NewServer creates and starts an http server to serve alive and deployment status endpoints
-// if server fails to start then, stop channel is closed notifying all listeners to the channel
-func NewServer(port int, certFile string, keyFile string, version string, resourceProvider resource.Provider, historyProvider history.Provider,
-	authOptions *options.DelegatingAuthenticationOptions, stopCh chan struct{}, stats stats.Stats, customClient *versioned.Clientset) error {
-
-	//authOptions := options.NewDelegatingAuthenticationOptions()
-	// authenticatorConfig, err := authOptions.ToAuthenticationConfig()
-	// if err != nil {
-	// 	return errors.Wrap(err, "failed to create authenticator config")
-	// }
-
-	// authenticator, _, err := authenticatorConfig.New()
-	// if err != nil {
-	// 	return errors.Wrap(err, "failed to create authenticator")
-	// }
-
-	// authorizerConfig := authorizerfactory.DelegatingAuthorizerConfig{
-	// 	AllowCacheTTL: time.Minute * 5,
-	// 	DenyCacheTTL:  time.Minute * 5,
-	// }
-	// authorizer, err := authorizerConfig.New()
-	// if err != nil {
-	// 	return errors.Wrap(err, "failed to create authorizer")
-	// }
-
-	mux := goji.NewMux()
-	mux.Handle(pat.Get("/alive"), StaticContentHandler("alive"))
-	mux.Handle(pat.Get("/version"), StaticContentHandler(version))
-	mux.Handle(pat.Post("/mutate"), VersionPatchHandler(stats, customClient))
-
-	kcdmux := goji.SubMux()
-	mux.Handle(pat.New("/kcd/*"), kcdmux)
-
-	kcdmux.Use(accessTokenQueryParam)
-	//kcdmux.Use(auth(authenticator, authorizer))
-	kcdmux.Handle(pat.Get("/v1/resources"), svc.NewAllResourceHandler(resourceProvider))
-	kcdmux.Handle(pat.Get("/v1/namespaces/:namespace/resources"), svc.NewResourceHandler(resourceProvider))
-	kcdmux.Handle(pat.Post("/v1/namespaces/:namespace/resources/:name"), svc.NewResourceUpdateHandler(resourceProvider))
-	kcdmux.Handle(pat.Get("/v1/history/:name"), history.NewHandler(historyProvider))
-
-	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		glog.Errorf("Filed to load key pair: %v", err)
+// ServerConfig defines the listeners of the server.
+type ServerConfig struct {
+	// HTTPPort is the port of a plain HTTP listener serving the health, version and kcd
+	// API endpoints. The admission webhook is not served on this port. Disabled if zero.
+	HTTPPort int
+
+	// TLSPort is the port of a TLS listener serving all endpoints, including the admission
+	// webhook. Disabled if zero.
+	TLSPort int
+
+	// CertFile and KeyFile contain the x509 certificate and key of the TLS listener.
+	// Both are reloaded when they change.
+	CertFile string
+	KeyFile  string
+
+	// ClientCAFile optionally contains the CAs used to verify client certificates. If set,
+	// clients of the TLS listener must present a valid certificate (mTLS).
+	ClientCAFile string
+}
+
+// NewServer creates and starts http servers to serve alive and deployment status endpoints
+// if a server fails to start then, stop channel is closed notifying all listeners to the channel
+func NewServer(config ServerConfig, version string, resourceProvider resource.Provider, historyProvider history.Provider,
+	workloadProvider *workload.K8sProvider, eventStream *svc.EventStream, auth *Auth, stopCh chan struct{}, stats stats.Stats,
+	kcdLister kcdlisters.KCDLister, versionPolicy *events.VersionPolicy, auditLogger audit.Logger) error {
+
+	if config.HTTPPort == 0 && config.TLSPort == 0 {
+		return errors.New("at least one of the http and tls ports is required")
 	}
 
-	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", port),
-		Handler:      mux,
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{pair}},
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 1 * time.Minute,
+	newMux := func(webhook bool) *goji.Mux {
+		mux := goji.NewMux()
+		mux.Handle(pat.Get("/alive"), StaticContentHandler("alive"))
+		mux.Handle(pat.Get("/version"), StaticContentHandler(version))
+		if webhook {
+			mux.Handle(pat.Post("/mutate"), VersionPatchHandler(stats, workloadProvider.Client(), kcdLister, auditLogger))
+			mux.Handle(pat.Post("/validate"), ValidateHandler(versionPolicy))
+		}
+
+		mux.Handle(pat.Get("/kcd/v1/openapi.json"), svc.NewOpenAPIHandler())
+
+		kcdmux := goji.SubMux()
+		mux.Handle(pat.New("/kcd/*"), kcdmux)
+
+		kcdmux.Use(accessTokenQueryParam)
+		if auth != nil {
+			kcdmux.Use(auth.Middleware)
+		}
+		kcdmux.Handle(pat.Get("/v1/resources"), svc.NewAllResourceHandler(resourceProvider))
+		kcdmux.Handle(pat.Get("/v1/namespaces/:namespace/resources"), svc.NewResourceHandler(resourceProvider))
+		kcdmux.Handle(pat.Post("/v1/namespaces/:namespace/resources/:name"), svc.NewResourceUpdateHandler(resourceProvider, auditLogger))
+		kcdmux.Handle(pat.Get("/v1/history/:name"), history.NewHandler(historyProvider))
+		api := svc.NewAPI(resourceProvider, workloadProvider, historyProvider)
+		api.WithAuditLogger(auditLogger).WithStats(stats)
+		if auth != nil {
+			api.WithAccessChecker(auth)
+		}
+		api.Register(kcdmux)
+		kcdmux.Handle(pat.Get("/v1/events"), eventStream)
+		kcdmux.Handle(pat.Get("/v1/namespaces/:namespace/events"), eventStream)
+		return mux
 	}
-	go func() {
-		if err := srv.ListenAndServeTLS(certFile, keyFile); err != nil {
-			if err.Error() != "http: Server closed" {
-				glog.V(2).Infof("Server error during ListenAndServe: %v", err)
-				close(stopCh)
-			}
+
+	if auth == nil {
+		glog.Warning("Authentication is disabled for the kcd API")
+	}
+
+	// close the stop channel at most once, even if both listeners fail
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { close(stopCh) })
+	}
+
+	var servers []*http.Server
+
+	if config.TLSPort != 0 {
+		certs, err := newCertReloader(config.CertFile, config.KeyFile, config.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure tls")
 		}
-	}()
 
-	glog.V(1).Infof("Started server on %v", srv.Addr)
+		srv := newHTTPServer(config.TLSPort, newMux(true))
+		srv.TLSConfig = certs.TLSConfig()
+		servers = append(servers, srv)
+
+		go func() {
+			if err := srv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("TLS server error during ListenAndServe: %v", err)
+				stop()
+			}
+		}()
+		glog.V(1).Infof("Started TLS server on %v (client certificates required: %v)", srv.Addr, config.ClientCAFile != "")
+	}
+
+	if config.HTTPPort != 0 {
+		srv := newHTTPServer(config.HTTPPort, newMux(false))
+		servers = append(servers, srv)
+
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				glog.Errorf("HTTP server error during ListenAndServe: %v", err)
+				stop()
+			}
+		}()
+		glog.V(1).Infof("Started HTTP server on %v", srv.Addr)
+	}
 
 	<-stopCh
-	glog.V(2).Info("Shutting down http server")
+	glog.V(2).Info("Shutting down http servers")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	srv.Shutdown(ctx)
-	glog.V(1).Info("Server gracefully stopped")
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			glog.V(2).Infof("Failed to shut down server on %v: %v", srv.Addr, err)
+		}
+	}
+	glog.V(1).Info("Servers gracefully stopped")
 
 	return nil
 }
 
-// auth returns middleware that performs authentication and authorization.
-// func auth(auther authenticator.Request, authzer authorizer.Authorizer) func(http.Handler) http.Handler {
-// 	return func(h http.Handler) http.Handler {
-// 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 			userInfo, ok, err := auther.AuthenticateRequest(r)
-// 			if err != nil {
-// 				glog.Errorf("Authentication failed (type=%T): %+v", err, err)
-// 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-// 				return
-// 			}
-
-// 			if ok {
-// 				if userInfo.GetName() == user.Anonymous {
-// 					ok = false
-// 				}
-// 				groups := userInfo.GetGroups()
-// 				for _, group := range groups {
-// 					if group == user.AllUnauthenticated {
-// 						ok = false
-// 					}
-// 				}
-// 			}
-
-// 			if !ok {
-// 				glog.V(2).Info("Failed to authenticate user")
-// 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
-// 				return
-// 			}
-
-// 			if glog.V(4) {
-// 				glog.V(4).Infof("Authentication was successful for user %+v", userInfo)
-// 			}
-
-// 			/* TODO: enable authorization
-// 			atts := authorizer.AttributesRecord{
-// 				User:      user,
-// 				Namespace: "",
-// 				Verb:      "get",
-// 				Resource:  "ContainerVersion",
-// 			}
-
-// 			authorized, reason, err := authzer.Authorize(atts)
-// 			if err != nil {
-// 				glog.Errorf("Authorization failed: %v", err)
-// 				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-// 				return
-// 			}
-// 			if authorized != authorizer.DecisionAllow {
-// 				glog.V(1).Infof("Authorization failed (%v) for reason %s", authorized, reason)
-// 				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-// 				return
-// 			}
-// 			*/
-
-// 			h.ServeHTTP(w, r)
-// 		})
-// 	}
-// }
+// newHTTPServer returns an http server for the given port and handler.
+func newHTTPServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         fmt.Sprintf(":%d", port),
+		Handler:      handler,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 1 * time.Minute,
+	}
+}
 
+// accessTokenQueryParam returns middleware that allows a bearer token to be provided
+// via the access_token query parameter, e.g. by browsers.
 func accessTokenQueryParam(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
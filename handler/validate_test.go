@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestValidateHandler(t *testing.T) {
+	valid := kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: kcd1.KCDSpec{
+			ImageRepo: "nearmap/kcd",
+			Selector:  map[string]string{"kcdapp": "app"},
+			Container: kcd1.ContainerSpec{Name: "app"},
+		},
+	}
+	invalid := valid
+	invalid.Spec.Selector = nil
+
+	invalidLabeled := invalid
+	invalidLabeled.Labels = map[string]string{"team": "app"}
+
+	for _, tc := range []struct {
+		kcd     kcd1.KCD
+		old     *kcd1.KCD
+		allowed bool
+	}{
+		{kcd: valid, allowed: true},
+		{kcd: invalid, allowed: false},
+		// updates that don't change the spec of existing resources are allowed
+		{kcd: invalidLabeled, old: &invalid, allowed: true},
+		{kcd: invalid, old: &valid, allowed: false},
+	} {
+		raw, err := json.Marshal(tc.kcd)
+		if err != nil {
+			t.Fatalf("failed to encode kcd: %v", err)
+		}
+		req := &v1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Group: "custom.k8s.io", Version: "v1", Kind: "KCD"},
+			Operation: v1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}
+		if tc.old != nil {
+			oldRaw, err := json.Marshal(tc.old)
+			if err != nil {
+				t.Fatalf("failed to encode kcd: %v", err)
+			}
+			req.Operation = v1.Update
+			req.OldObject = runtime.RawExtension{Raw: oldRaw}
+		}
+		review, err := json.Marshal(v1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+			Request:  req,
+		})
+		if err != nil {
+			t.Fatalf("failed to encode admission review: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		ValidateHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(review)))
+
+		var result v1.AdmissionReview
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("failed to decode admission review: %v", err)
+		}
+		if result.Response == nil || result.Response.UID != "uid" {
+			t.Fatalf("expected response for request uid, got %+v", result.Response)
+		}
+		if result.Response.Allowed != tc.allowed {
+			t.Errorf("expected allowed=%v, got %v", tc.allowed, result.Response.Allowed)
+		}
+		if !tc.allowed && !strings.Contains(result.Response.Result.Message, "spec.selector") {
+			t.Errorf("expected rejection message to name the invalid field, got %s", result.Response.Result.Message)
+		}
+	}
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"github.com/wish/kcd/audit"
 	conf "github.com/wish/kcd/config"
 	"github.com/wish/kcd/events"
 	clientset "github.com/wish/kcd/gok8s/client/clientset/versioned"
@@ -19,6 +21,9 @@ import (
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/handler"
 	"github.com/wish/kcd/history"
+	"github.com/wish/kcd/registry/cache"
+	"github.com/wish/kcd/registry/ecr"
+	"github.com/wish/kcd/registry/providers"
 	"github.com/wish/kcd/resource"
 	svc "github.com/wish/kcd/service"
 	"github.com/wish/kcd/signals"
@@ -30,7 +35,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	serializer "k8s.io/apimachinery/pkg/runtime/serializer"
-	"k8s.io/apiserver/pkg/server/options"
+	"k8s.io/client-go/dynamic"
 	k8sinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
@@ -103,21 +108,132 @@ func (sp *statsParams) stats(namespace string, tags ...string) (stats.Stats, err
 	}
 }
 
+type auditParams struct {
+	dest   string
+	events bool
+}
+
+func (ap *auditParams) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&ap.dest, "audit-log", "",
+		"Destination of the audit log of changes made by kcd: stdout or the path of a file. Disabled if empty.")
+	cmd.PersistentFlags().BoolVar(&ap.events, "audit-events", false,
+		"Record the audit log as events of the KCD resources.")
+}
+
+func (ap *auditParams) logger(cs kubernetes.Interface) (audit.Logger, error) {
+	return audit.New(ap.dest, ap.events, cs)
+}
+
+type ecrParams struct {
+	timeout     time.Duration
+	maxRetries  int
+	assumeRoles []string
+}
+
+func (ep *ecrParams) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&ep.timeout, "ecr-timeout", 15*time.Second,
+		"Timeout of ECR registry operations, including retries.")
+	cmd.PersistentFlags().IntVar(&ep.maxRetries, "ecr-max-retries", 5,
+		"Maximum number of retries of failed or throttled ECR requests.")
+	cmd.PersistentFlags().StringArrayVar(&ep.assumeRoles, "ecr-assume-role", nil,
+		"IAM role assumed to access ECR repositories of another account, of the form <account id or repository>=<role arn>. May be repeated.")
+}
+
+func (ep *ecrParams) options() ([]func(*ecr.Options), error) {
+	opts := []func(*ecr.Options){
+		ecr.WithTimeout(ep.timeout),
+		ecr.WithMaxRetries(ep.maxRetries),
+	}
+	for _, assumeRole := range ep.assumeRoles {
+		parts := strings.SplitN(assumeRole, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("invalid ECR role %q, expected <account id or repository>=<role arn>", assumeRole)
+		}
+		opts = append(opts, ecr.WithAssumeRole(parts[0], parts[1]))
+	}
+	return opts, nil
+}
+
+type registryCacheParams struct {
+	ttl       time.Duration
+	rateLimit float64
+	rateBurst int
+}
+
+func (rp *registryCacheParams) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&rp.ttl, "registry-cache-ttl", 30*time.Second,
+		"Time the versions of a tag are cached. 0 disables caching.")
+	cmd.PersistentFlags().Float64Var(&rp.rateLimit, "registry-rate-limit", 5,
+		"Maximum number of requests per second to a registry host. Syncers divide the limit by the number of syncers of the same host. 0 disables rate limiting.")
+	cmd.PersistentFlags().IntVar(&rp.rateBurst, "registry-rate-burst", 10,
+		"Maximum burst of requests to a registry host, divided like the rate limit.")
+}
+
+// setDefault configures the registry cache shared by the registry providers of the process.
+func (rp *registryCacheParams) setDefault(stats stats.Stats) {
+	rp.setSharedDefault(stats, 1)
+}
+
+// setSharedDefault configures the registry cache of a process that shares the rate limit
+// of registry hosts with the given number of processes, e.g. the syncers of the KCD
+// resources of a registry host. Only the rate limit is divided, the cache and coalescing
+// of lookups remain per process.
+func (rp *registryCacheParams) setSharedDefault(stats stats.Stats, processes int) {
+	rate, burst := rp.rateLimit, rp.rateBurst
+	if processes > 1 {
+		rate /= float64(processes)
+		if burst /= processes; burst < 1 {
+			burst = 1
+		}
+	}
+	cache.Default = cache.New(
+		cache.WithStats(stats),
+		cache.WithTTL(rp.ttl),
+		cache.WithRateLimit(rate, burst))
+}
+
+type localRegistryParams struct {
+	root string
+}
+
+func (lp *localRegistryParams) addFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&lp.root, "local-registry-root", "",
+		"Directory that file:// and oci-layout:// registry sources must be in. Local registries are disabled if not set.")
+}
+
+// setDefault configures the local registries of the registry providers of the process.
+func (lp *localRegistryParams) setDefault() {
+	providers.DefaultOptions = append(providers.DefaultOptions, providers.WithLocalRoot(lp.root))
+}
+
 type runParams struct {
 	k8sConfig    string
 	configMapKey string
 
 	kcdImgRepo string
 
-	port int
+	port     int // port of the tls listener
+	httpPort int // port of the plain http listener
 
 	history  bool // unused
 	rollback bool // unused
 
 	stats statsParams
+	audit auditParams
+	ecr   ecrParams           // passed to syncers
+	cache registryCacheParams // passed to syncers
+	local localRegistryParams // passed to syncers
 
 	certFile string // path to the x509 certificate for https
 	keyFile  string // path to the x509 private key matching `CertFile`
+	caFile   string // path to the CAs used to verify client certificates
+
+	authMode      string // authentication mode of the kcd API
+	authTokenFile string // path to the static token file used by the static auth mode
+
+	enforceVersions bool // whether the validating webhook rejects versions not rolled out by kcd
+
+	genericWorkloads []string
 }
 
 func newRunCommand() *cobra.Command {
@@ -133,11 +249,24 @@ func newRunCommand() *cobra.Command {
 	rc.Flags().StringVar(&params.kcdImgRepo, "kcd-img-repo", "nearmap/kcd", "Name of the docker registry to used be controller. defaults to nearmap/kcd")
 	rc.Flags().BoolVar(&params.history, "history", false, "unused")
 	rc.Flags().BoolVar(&params.rollback, "rollback", false, "unused")
-	rc.Flags().IntVar(&params.port, "port", 8081, "Port to run http server on")
-	rc.Flags().StringVar(&params.certFile, "tlsCertFile", "/etc/kcd-version-patch/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
-	rc.Flags().StringVar(&params.keyFile, "tlsKeyFile", "/etc/kcd-version-patch/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	rc.Flags().IntVar(&params.port, "port", 8081, "Port to run the https server on, which also serves the admission webhook. 0 disables the https server")
+	rc.Flags().IntVar(&params.httpPort, "http-port", 0, "Port to run a plain http server for the health, version and kcd API endpoints on. 0 disables the http server")
+	rc.Flags().StringVar(&params.certFile, "tlsCertFile", "/etc/kcd-version-patch/certs/cert.pem", "File containing the x509 Certificate for HTTPS. Reloaded when changed.")
+	rc.Flags().StringVar(&params.keyFile, "tlsKeyFile", "/etc/kcd-version-patch/certs/key.pem", "File containing the x509 private key to --tlsCertFile. Reloaded when changed.")
+	rc.Flags().StringVar(&params.caFile, "tlsClientCAFile", "", "File containing the x509 CA certificates used to verify client certificates. If set, HTTPS clients must present a valid certificate.")
+	rc.Flags().BoolVar(&params.enforceVersions, "enforce-versions", false,
+		"Reject workloads managed by kcd whose version is not the current or last successful version in the validating webhook, unless annotated with "+events.PolicyExceptionAnnotation)
+	rc.Flags().StringVar(&params.authMode, "auth-mode", handler.AuthModeKubernetes,
+		"Authentication mode of the kcd API: kubernetes (TokenReview and SubjectAccessReview), static (token file) or none.")
+	rc.Flags().StringVar(&params.authTokenFile, "auth-token-file", "",
+		"Static token file used by --auth-mode=static, with lines of the form token,user,uid,\"group1,group2\".")
+	addGenericWorkloadFlag(rc, &params.genericWorkloads)
 
 	(&params.stats).addFlags(rc)
+	(&params.audit).addFlags(rc)
+	(&params.ecr).addFlags(rc)
+	(&params.cache).addFlags(rc)
+	(&params.local).addFlags(rc)
 
 	rc.RunE = func(cmd *cobra.Command, args []string) (err error) {
 		stats, err := params.stats.stats("kcd")
@@ -148,6 +277,9 @@ func newRunCommand() *cobra.Command {
 		scStatus := 0
 		defer stats.ServiceCheck("kcd.exec", "", scStatus, time.Now())
 
+		params.cache.setDefault(stats)
+		params.local.setDefault()
+
 		stopCh := signals.SetupSignalHandler()
 
 		var cfg *rest.Config
@@ -187,6 +319,10 @@ func newRunCommand() *cobra.Command {
 
 		k8sInformerFactory := k8sinformers.NewSharedInformerFactory(k8sClient, time.Second*30)
 		customInformerFactory := informer.NewSharedInformerFactory(customClient, time.Second*30)
+		// the webhooks find the KCD resources of workloads in the informer's cache
+		kcdLister := customInformerFactory.Custom().V1().KCDs().Lister()
+
+		eventStream := svc.NewEventStream(customInformerFactory.Custom().V1().KCDs(), handler.MaxStreamDuration)
 
 		// Controllers here
 		kcdc, err := svc.NewCVController(params.configMapKey, params.kcdImgRepo,
@@ -200,17 +336,25 @@ func newRunCommand() *cobra.Command {
 		k8sInformerFactory.Start(stopCh)
 		customInformerFactory.Start(stopCh)
 		glog.V(1).Info("Started informer factory")
+		for informerType, ok := range customInformerFactory.WaitForCacheSync(stopCh) {
+			if !ok {
+				return errors.Errorf("failed to sync informer cache of %v", informerType)
+			}
+		}
 
 		stats.ServiceCheck("kcd.exec", "", scStatus, time.Now())
 
 		recorder := events.PodEventRecorder(k8sClient, "")
 		workloadProvider := workload.NewProvider(k8sClient, customClient, "", conf.WithStats(stats), conf.WithRecorder(recorder))
+		if err = addGenericWorkloads(cfg, workloadProvider, params.genericWorkloads); err != nil {
+			return errors.Wrap(err, "failed to configure generic workloads")
+		}
 		historyProvider := history.NewProvider(k8sClient, stats)
 		resourceProvider := resource.NewK8sProvider("", customClient, workloadProvider)
 
-		authOptions := options.NewDelegatingAuthenticationOptions()
-		if params.k8sConfig != "" {
-			authOptions.RemoteKubeConfigFile = params.k8sConfig
+		auth, err := handler.NewAuth(params.authMode, params.authTokenFile, k8sClient)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure authentication")
 		}
 
 		go func() {
@@ -219,7 +363,24 @@ func newRunCommand() *cobra.Command {
 				//return errors.Wrap(err, "Shutting down container version controller")
 			}
 		}()
-		err = handler.NewServer(params.port, params.certFile, params.keyFile, Version, resourceProvider, historyProvider, authOptions, stopCh, stats, customClient)
+		auditLogger, err := params.audit.logger(k8sClient)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure audit log")
+		}
+
+		var versionPolicy *events.VersionPolicy
+		if params.enforceVersions {
+			versionPolicy = events.NewVersionPolicy(k8sClient, kcdLister, stats, auditLogger)
+		}
+
+		serverConfig := handler.ServerConfig{
+			HTTPPort:     params.httpPort,
+			TLSPort:      params.port,
+			CertFile:     params.certFile,
+			KeyFile:      params.keyFile,
+			ClientCAFile: params.caFile,
+		}
+		err = handler.NewServer(serverConfig, Version, resourceProvider, historyProvider, workloadProvider, eventStream, auth, stopCh, stats, kcdLister, versionPolicy, auditLogger)
 		if err != nil {
 			return errors.Wrap(err, "failed to start new server")
 		}
@@ -230,6 +391,35 @@ func newRunCommand() *cobra.Command {
 	return rc
 }
 
+// addGenericWorkloadFlag adds a flag for defining custom workload kinds that kcd
+// should manage in addition to the built-in workload types.
+func addGenericWorkloadFlag(cmd *cobra.Command, defs *[]string) {
+	cmd.Flags().StringArrayVar(defs, "generic-workload", nil,
+		"Custom workload kind to manage, as <resource>.<version>.<group>/<Kind>=<podTemplatePath>, "+
+			"e.g. rollouts.v1alpha1.argoproj.io/Rollout={.spec.template}. May be repeated.")
+}
+
+// addGenericWorkloads registers the custom workload kinds defined by flags with the
+// workload provider, along with the dynamic client that is also used by traffic routers.
+func addGenericWorkloads(cfg *rest.Config, provider *workload.K8sProvider, defs []string) error {
+	var resources []workload.GenericResource
+	for _, def := range defs {
+		gr, err := workload.ParseGenericResource(def)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		resources = append(resources, gr)
+	}
+
+	dc, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return errors.Wrap(err, "Error building k8s dynamic client")
+	}
+
+	provider.AddGenericResources(dc, resources...)
+	return nil
+}
+
 func updateCVCRDSpec(cfg *rest.Config) error {
 	apiExtCS, err := apiextCS.NewForConfig(cfg)
 	if err != nil {
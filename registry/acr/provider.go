@@ -0,0 +1,266 @@
+package acr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/distribution"
+	"github.com/wish/kcd/stats"
+)
+
+const (
+	// registryScope is the scope of Azure AD tokens exchanged for registry tokens.
+	registryScope = "https://containerregistry.azure.net/.default"
+
+	// refreshTokenUser is the username used with registry refresh tokens.
+	refreshTokenUser = "00000000-0000-0000-0000-000000000000"
+
+	defaultAuthorityHost = "https://login.microsoftonline.com/"
+)
+
+// Options contains additional (optional) configuration for the ACR provider. The
+// workload identity options default to the environment variables set by the Azure
+// workload identity webhook.
+type Options struct {
+	// Timeout bounds each operation of the provider.
+	Timeout time.Duration
+
+	// HTTPClient is used for requests to the registry and to Azure AD.
+	HTTPClient *http.Client
+
+	// ClientID and TenantID identify the Azure AD application of the workload identity.
+	ClientID, TenantID string
+
+	// FederatedTokenFile is the path of the mounted service account token exchanged
+	// for an Azure AD token.
+	FederatedTokenFile string
+
+	// AuthorityHost is the URL of Azure AD.
+	AuthorityHost string
+}
+
+// WithTimeout sets the timeout of each operation of the provider.
+func WithTimeout(timeout time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the provider.
+func WithHTTPClient(client *http.Client) func(*Options) {
+	return func(opts *Options) {
+		opts.HTTPClient = client
+	}
+}
+
+// WithWorkloadIdentity sets the application and the federated token file of the
+// workload identity used to access the registry.
+func WithWorkloadIdentity(clientID, tenantID, federatedTokenFile string) func(*Options) {
+	return func(opts *Options) {
+		opts.ClientID = clientID
+		opts.TenantID = tenantID
+		opts.FederatedTokenFile = federatedTokenFile
+	}
+}
+
+// WithAuthorityHost sets the URL of Azure AD.
+func WithAuthorityHost(authorityHost string) func(*Options) {
+	return func(opts *Options) {
+		opts.AuthorityHost = authorityHost
+	}
+}
+
+// ParseRepo returns the registry host and the repository path of an Azure Container
+// Registry image repository, or an error if the image repository doesn't belong to ACR.
+func ParseRepo(imageRepo string) (host, repo string, err error) {
+	host, repo, err = distribution.ParseRepo(imageRepo)
+	if err != nil {
+		return "", "", err
+	}
+	if registry.ProviderByRepo(imageRepo) != "acr" {
+		return "", "", errors.Errorf("%s is not an Azure Container Registry host", host)
+	}
+	return host, repo, nil
+}
+
+// NewACR returns a provider of an Azure Container Registry image repository.
+func NewACR(imageRepo, versionExp string, stats stats.Stats, options ...func(*Options)) (*distribution.Provider, error) {
+	opts := &Options{
+		Timeout:            15 * time.Second,
+		HTTPClient:         http.DefaultClient,
+		ClientID:           os.Getenv("AZURE_CLIENT_ID"),
+		TenantID:           os.Getenv("AZURE_TENANT_ID"),
+		FederatedTokenFile: os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+		AuthorityHost:      os.Getenv("AZURE_AUTHORITY_HOST"),
+	}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.AuthorityHost == "" {
+		opts.AuthorityHost = defaultAuthorityHost
+	}
+
+	return distribution.NewProvider(imageRepo, versionExp, &cloud{opts: opts, refreshTokens: map[string]refreshToken{}},
+		distribution.WithStats(stats),
+		distribution.WithTimeout(opts.Timeout),
+		distribution.WithHTTPClient(opts.HTTPClient))
+}
+
+// cloud implements distribution.Cloud for Azure Container Registry.
+type cloud struct {
+	opts *Options
+
+	mu            sync.Mutex
+	refreshTokens map[string]refreshToken
+}
+
+type refreshToken struct {
+	value  string
+	expiry time.Time
+}
+
+// Credentials implements the distribution.Cloud interface. The federated token of the
+// workload identity is exchanged for an Azure AD token, which is exchanged for a refresh
+// token of the registry.
+func (c *cloud) Credentials(ctx context.Context, host string) (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if token, ok := c.refreshTokens[host]; ok && time.Now().Before(token.expiry) {
+		return refreshTokenUser, token.value, nil
+	}
+
+	aadToken, expiresIn, err := c.aadToken(ctx)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to obtain Azure AD token")
+	}
+
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"tenant":       {c.opts.TenantID},
+		"access_token": {aadToken},
+	}
+	var exchanged struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.postForm(ctx, fmt.Sprintf("https://%s/oauth2/exchange", host), form, &exchanged); err != nil {
+		return "", "", errors.Wrapf(err, "failed to exchange Azure AD token for a refresh token of %s", host)
+	}
+
+	// refresh tokens are valid for longer than the Azure AD token they were obtained with
+	c.refreshTokens[host] = refreshToken{
+		value:  exchanged.RefreshToken,
+		expiry: time.Now().Add(expiresIn - time.Minute),
+	}
+	return refreshTokenUser, exchanged.RefreshToken, nil
+}
+
+// aadToken exchanges the federated token for an Azure AD token of the registry scope.
+func (c *cloud) aadToken(ctx context.Context) (string, time.Duration, error) {
+	if c.opts.ClientID == "" || c.opts.TenantID == "" || c.opts.FederatedTokenFile == "" {
+		return "", 0, errors.New("workload identity is not configured: client ID, tenant ID and federated token file are required")
+	}
+	// the file is read each time as the token is rotated by the kubelet
+	assertion, err := ioutil.ReadFile(c.opts.FederatedTokenFile)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to read federated token")
+	}
+
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {c.opts.ClientID},
+		"scope":                 {registryScope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	tokenURL := strings.TrimSuffix(c.opts.AuthorityHost, "/") + "/" + c.opts.TenantID + "/oauth2/v2.0/token"
+	if err := c.postForm(ctx, tokenURL, form, &token); err != nil {
+		return "", 0, err
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// postForm posts the form and decodes the JSON response into v.
+func (c *cloud) postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%s returned status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+// TagsOf implements the distribution.Cloud interface with the manifest attributes of
+// the ACR API.
+func (c *cloud) TagsOf(ctx context.Context, client *distribution.Client, repo, digest string) ([]string, error) {
+	var attrs struct {
+		Manifest struct {
+			Tags []string `json:"tags"`
+		} `json:"manifest"`
+	}
+	path := fmt.Sprintf("/acr/v1/%s/_manifests/%s", repo, digest)
+	if _, err := client.GetJSON(ctx, path, fmt.Sprintf("repository:%s:metadata_read", repo), &attrs); err != nil {
+		return nil, errors.Wrapf(err, "failed to get attributes of manifest %s of %s", digest, repo)
+	}
+	return attrs.Manifest.Tags, nil
+}
+
+// PushTime implements the distribution.PushTimer interface with the creation time of
+// the manifest attributes.
+func (c *cloud) PushTime(ctx context.Context, client *distribution.Client, repo, digest string) (time.Time, error) {
+	var attrs struct {
+		Manifest struct {
+			CreatedTime time.Time `json:"createdTime"`
+		} `json:"manifest"`
+	}
+	path := fmt.Sprintf("/acr/v1/%s/_manifests/%s", repo, digest)
+	if _, err := client.GetJSON(ctx, path, fmt.Sprintf("repository:%s:metadata_read", repo), &attrs); err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to get attributes of manifest %s of %s", digest, repo)
+	}
+	if attrs.Manifest.CreatedTime.IsZero() {
+		return time.Time{}, errors.Errorf("no creation time of manifest %s of %s", digest, repo)
+	}
+	return attrs.Manifest.CreatedTime, nil
+}
+
+// Untag implements the distribution.Cloud interface with the tag API of ACR, as deleting
+// a manifest by tag is not supported.
+func (c *cloud) Untag(ctx context.Context, client *distribution.Client, repo, tag string) error {
+	resp, err := client.Do(ctx, http.MethodDelete, fmt.Sprintf("/acr/v1/%s/_tags/%s", repo, tag),
+		fmt.Sprintf("repository:%s:delete", repo), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted:
+		return nil
+	default:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &distribution.Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+}
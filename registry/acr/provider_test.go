@@ -0,0 +1,125 @@
+package acr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wish/kcd/stats"
+)
+
+func TestProvider(t *testing.T) {
+	const (
+		digest       = "sha256:0123"
+		refreshToken = "refresh-token"
+	)
+	var exchanges int
+	var untagged []string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tenant/oauth2/v2.0/token":
+			r.ParseForm()
+			if r.Form.Get("client_assertion") != "k8s-token" || r.Form.Get("client_id") != "client" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"access_token":"aad-token","expires_in":3600}`)
+			return
+		case "/oauth2/exchange":
+			r.ParseForm()
+			if r.Form.Get("access_token") != "aad-token" || r.Form.Get("service") != r.Host {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			exchanges++
+			fmt.Fprintf(w, `{"refresh_token":%q}`, refreshToken)
+			return
+		case "/oauth2/token":
+			if user, pass, _ := r.BasicAuth(); user != refreshTokenUser || pass != refreshToken {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, `{"access_token":"token-for-%s"}`, r.URL.Query().Get("scope"))
+			return
+		}
+
+		scope := "repository:team/app:pull"
+		if strings.HasPrefix(r.URL.Path, "/acr/v1/") {
+			scope = "repository:team/app:metadata_read"
+			if r.Method == http.MethodDelete {
+				scope = "repository:team/app:delete"
+			}
+		}
+		if r.Header.Get("Authorization") != "Bearer token-for-"+scope {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/oauth2/token",service=%q,scope=%q`, r.Host, r.Host, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.URL.Path == "/v2/team/app/manifests/prod":
+			w.Header().Set("Docker-Content-Digest", digest)
+		case r.URL.Path == "/acr/v1/team/app/_manifests/"+digest:
+			fmt.Fprintf(w, `{"manifest":{"digest":%q,"tags":["prod","abcdef0","1234567"]}}`, digest)
+		case strings.HasPrefix(r.URL.Path, "/acr/v1/team/app/_tags/") && r.Method == http.MethodDelete:
+			tag := strings.TrimPrefix(r.URL.Path, "/acr/v1/team/app/_tags/")
+			if tag == "missing" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			untagged = append(untagged, tag)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kcd-acr")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("k8s-token\n"), 0600); err != nil {
+		t.Fatalf("failed to write token: %v", err)
+	}
+
+	p, err := NewACR(strings.TrimPrefix(srv.URL, "https://")+"/team/app", `^[0-9a-f]{7}$`, stats.NewFake(),
+		WithHTTPClient(srv.Client()), WithAuthorityHost(srv.URL), WithWorkloadIdentity("client", "tenant", tokenFile))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	versions, err := p.Versions(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"1234567", "abcdef0"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	if err := p.Remove("canary", "missing"); err != nil {
+		t.Fatalf("failed to remove tags: %v", err)
+	}
+	if expected := []string{"canary"}; !reflect.DeepEqual(untagged, expected) {
+		t.Errorf("expected tags %v to be removed, got %v", expected, untagged)
+	}
+
+	// the refresh token is reused for all scopes
+	if exchanges != 1 {
+		t.Errorf("expected a single token exchange, got %d", exchanges)
+	}
+
+	unconfigured, _ := NewACR(strings.TrimPrefix(srv.URL, "https://")+"/team/app", `.*`, stats.NewFake(),
+		WithHTTPClient(srv.Client()), WithWorkloadIdentity("", "", ""))
+	if _, err := unconfigured.Versions(context.Background(), "prod"); err == nil {
+		t.Errorf("expected error without workload identity")
+	}
+}
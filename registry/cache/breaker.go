@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"time"
+)
+
+// breaker is the circuit breaker of a registry host. It opens after a number of
+// consecutive throttled or failed requests, and lets a single request through once
+// the backoff has passed. The breaker closes if that request succeeds, and opens again
+// with a doubled backoff otherwise.
+type breaker struct {
+	threshold int
+	failures  int
+	backoff   time.Duration
+	openUntil time.Time
+	probing   bool
+}
+
+// allow returns whether a request may be sent to the host.
+func (b *breaker) allow(now time.Time) bool {
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	// half-open: let a single request through
+	b.probing = true
+	return true
+}
+
+// success records a request that the host handled.
+func (b *breaker) success() {
+	b.failures = 0
+	b.backoff = 0
+	b.probing = false
+}
+
+// failure records a throttled or failed request and returns whether the breaker opened.
+func (b *breaker) failure(now time.Time, opts *Options) bool {
+	b.failures++
+	b.probing = false
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+
+	if b.backoff == 0 {
+		b.backoff = opts.BreakerBackoff
+	} else {
+		b.backoff *= 2
+	}
+	if b.backoff > opts.MaxBreakerBackoff {
+		b.backoff = opts.MaxBreakerBackoff
+	}
+	b.openUntil = now.Add(b.backoff)
+	return true
+}
+
+// tokenBucket limits the rate of requests to a registry host.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+// reserve takes a token and returns the time to wait until it is available.
+func (tb *tokenBucket) reserve(now time.Time) time.Duration {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
@@ -0,0 +1,457 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
+)
+
+// ErrCircuitOpen is returned instead of sending requests to a registry host that is
+// throttling requests or failing, until the circuit breaker of the host lets a request
+// through again.
+var ErrCircuitOpen = errors.New("registry circuit breaker is open")
+
+// IsCircuitOpen returns whether the error is caused by an open circuit breaker.
+func IsCircuitOpen(err error) bool {
+	return errors.Cause(err) == ErrCircuitOpen
+}
+
+// Options contains additional (optional) configuration for the cache.
+type Options struct {
+	Stats stats.Stats
+
+	// TTL is the time versions of a tag are served from the cache. Caching is disabled
+	// if zero, but requests are still coalesced, rate limited and subject to the circuit
+	// breaker.
+	TTL time.Duration
+
+	// MaxStale is the time versions are kept after they expired, to be served while the
+	// registry host is throttling requests or failing.
+	MaxStale time.Duration
+
+	// RateLimit is the number of requests per second sent to a registry host, with bursts
+	// of up to Burst requests. Requests are not rate limited if zero.
+	RateLimit float64
+	Burst     int
+
+	// BreakerThreshold is the number of consecutive throttled or failed requests that
+	// open the circuit breaker of a registry host. The breaker is open for BreakerBackoff,
+	// doubled each time a request fails while half-open, up to MaxBreakerBackoff.
+	BreakerThreshold                  int
+	BreakerBackoff, MaxBreakerBackoff time.Duration
+}
+
+// WithStats applies the stats type to the cache.
+func WithStats(instance stats.Stats) func(*Options) {
+	return func(opts *Options) {
+		opts.Stats = instance
+	}
+}
+
+// WithTTL sets the time versions are served from the cache.
+func WithTTL(ttl time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.TTL = ttl
+	}
+}
+
+// WithRateLimit sets the number of requests per second and the burst of requests sent
+// to a registry host.
+func WithRateLimit(rate float64, burst int) func(*Options) {
+	return func(opts *Options) {
+		opts.RateLimit = rate
+		opts.Burst = burst
+	}
+}
+
+// WithBreaker sets the number of consecutive failures that open the circuit breaker of
+// a registry host and the bounds of the time it stays open.
+func WithBreaker(threshold int, backoff, maxBackoff time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.BreakerThreshold = threshold
+		opts.BreakerBackoff = backoff
+		opts.MaxBreakerBackoff = maxBackoff
+	}
+}
+
+// Cache decorates registries with a TTL cache of versions keyed by repository and tag,
+// coalescing of concurrent requests for the same tag, a rate limiter per registry host
+// and a circuit breaker per registry host that backs off when the host throttles
+// requests or fails. A cache is shared by all providers it wraps within a process, it
+// isn't shared with other processes such as the syncers of other KCD resources.
+type Cache struct {
+	opts *Options
+	now  func() time.Time
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	pushTimes map[string]*pushTimeEntry
+	calls     map[string]*call
+	limiters  map[string]*tokenBucket
+	breakers  map[string]*breaker
+}
+
+type entry struct {
+	versions []string
+	expiry   time.Time
+}
+
+type pushTimeEntry struct {
+	pushTime time.Time
+	expiry   time.Time
+}
+
+// call is a request to the registry that concurrent requests for the same tag wait for.
+type call struct {
+	done     chan struct{}
+	versions []string
+	err      error
+}
+
+// Default is the cache shared by registry providers of the process.
+var Default = New()
+
+// New returns a cache with the given options.
+func New(options ...func(*Options)) *Cache {
+	opts := &Options{
+		Stats:             stats.NewFake(),
+		TTL:               30 * time.Second,
+		MaxStale:          10 * time.Minute,
+		RateLimit:         5,
+		Burst:             10,
+		BreakerThreshold:  3,
+		BreakerBackoff:    30 * time.Second,
+		MaxBreakerBackoff: 5 * time.Minute,
+	}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	return &Cache{
+		opts:      opts,
+		now:       time.Now,
+		entries:   map[string]*entry{},
+		pushTimes: map[string]*pushTimeEntry{},
+		calls:     map[string]*call{},
+		limiters:  map[string]*tokenBucket{},
+		breakers:  map[string]*breaker{},
+	}
+}
+
+// Wrap returns a provider whose registries are decorated by the cache. Versions are
+// cached per repository and tag, and the version pattern of the provider, as the pattern
+// filters the versions returned by the provider.
+func (c *Cache) Wrap(provider registry.Provider, versionExp string) registry.Provider {
+	return &cachedProvider{cache: c, provider: provider, versionExp: versionExp}
+}
+
+type cachedProvider struct {
+	cache      *Cache
+	provider   registry.Provider
+	versionExp string
+}
+
+// RegistryFor implements the registry.Provider interface.
+func (cp *cachedProvider) RegistryFor(imageRepo string) (registry.Registry, error) {
+	reg, err := cp.provider.RegistryFor(imageRepo)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedRegistry{
+		cache:    cp.cache,
+		registry: reg,
+		key:      imageRepo + "|" + cp.versionExp,
+		host:     HostOf(imageRepo),
+	}, nil
+}
+
+type cachedRegistry struct {
+	cache    *Cache
+	registry registry.Registry
+	key      string
+	host     string
+}
+
+// Versions implements the registry.Registry interface. Versions looked up with the
+// credentials of the context are cached separately for each set of credentials, so that
+// they aren't served to lookups with other or no access to the repository.
+func (cr *cachedRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	key := cr.key + "|" + tag
+	if creds, ok := registry.CredentialsFromContext(ctx); ok {
+		key += "|" + credentialsHash(creds)
+	}
+	return cr.cache.versions(ctx, cr.registry, cr.host, key, tag)
+}
+
+// credentialsHash returns a hash of the credentials for use in cache keys, which doesn't
+// keep the password in memory.
+func credentialsHash(creds registry.Credentials) string {
+	sum := sha256.Sum256([]byte(creds.Username + "\x00" + creds.Password))
+	return hex.EncodeToString(sum[:])
+}
+
+// PushTime implements the registry.PushTimer interface if the decorated registry does.
+// Push times are cached like versions, and requests are rate limited and subject to the
+// circuit breaker of the host.
+func (cr *cachedRegistry) PushTime(ctx context.Context, version string) (time.Time, error) {
+	pt, ok := cr.registry.(registry.PushTimer)
+	if !ok {
+		return time.Time{}, errors.Errorf("registry %s does not record push times", cr.host)
+	}
+	key := cr.key + "|pushTime|" + version
+	if creds, ok := registry.CredentialsFromContext(ctx); ok {
+		key += "|" + credentialsHash(creds)
+	}
+	return cr.cache.pushTime(ctx, pt, cr.host, key, version)
+}
+
+// versions returns the versions of the tag from the cache, the result of a concurrent
+// request for the same tag, or the registry.
+func (c *Cache) versions(ctx context.Context, reg registry.Registry, host, key, tag string) ([]string, error) {
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && c.now().Before(e.expiry) {
+		c.mu.Unlock()
+		c.opts.Stats.IncCount("registry.cache.hit", host)
+		return copyVersions(e.versions), nil
+	}
+	if cl, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		c.opts.Stats.IncCount("registry.cache.coalesced", host)
+		select {
+		case <-cl.done:
+			return copyVersions(cl.versions), cl.err
+		case <-ctx.Done():
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+	// the error is returned to the waiting requests if the registry panics
+	cl := &call{
+		done: make(chan struct{}),
+		err:  errors.Errorf("request for versions of %s from %s did not complete", tag, host),
+	}
+	c.calls[key] = cl
+	c.mu.Unlock()
+	c.opts.Stats.IncCount("registry.cache.miss", host)
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(cl.done)
+	}()
+	cl.versions, cl.err = c.fetch(ctx, reg, host, key, tag)
+
+	return copyVersions(cl.versions), cl.err
+}
+
+// fetch requests the versions of the tag from the registry, subject to the rate limiter
+// and circuit breaker of the host, and caches them. Stale versions are returned while
+// the host is throttling requests or failing.
+func (c *Cache) fetch(ctx context.Context, reg registry.Registry, host, key, tag string) ([]string, error) {
+	c.mu.Lock()
+	b := c.breaker(host)
+	allowed := b.allow(c.now())
+	versions, stale := c.stale(key)
+	c.mu.Unlock()
+	if !allowed {
+		if stale {
+			c.opts.Stats.IncCount("registry.cache.stale", host)
+			return versions, nil
+		}
+		return nil, errors.Wrapf(ErrCircuitOpen, "not requesting versions of %s from %s", tag, host)
+	}
+
+	if err := c.wait(ctx, host); err != nil {
+		c.mu.Lock()
+		b.probing = false
+		c.mu.Unlock()
+		return nil, err
+	}
+	versions, err := reg.Versions(ctx, tag)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil && isOverloaded(err) {
+		c.failure(b, host, err)
+		if versions, ok := c.stale(key); ok {
+			c.opts.Stats.IncCount("registry.cache.stale", host)
+			glog.V(1).Infof("Serving stale versions of %s from %s: %v", tag, host, err)
+			return versions, nil
+		}
+		return nil, err
+	}
+	b.success()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.opts.TTL > 0 {
+		c.entries[key] = &entry{versions: versions, expiry: c.now().Add(c.opts.TTL)}
+	}
+	c.evict()
+	return versions, nil
+}
+
+// pushTime returns the push time of the version from the cache or the registry, subject
+// to the rate limiter and circuit breaker of the host. Push times are not served stale,
+// so that versions aren't compared by outdated push times of re-pushed tags.
+func (c *Cache) pushTime(ctx context.Context, pt registry.PushTimer, host, key, version string) (time.Time, error) {
+	c.mu.Lock()
+	if e, ok := c.pushTimes[key]; ok && c.now().Before(e.expiry) {
+		c.mu.Unlock()
+		c.opts.Stats.IncCount("registry.cache.hit", host)
+		return e.pushTime, nil
+	}
+	b := c.breaker(host)
+	allowed := b.allow(c.now())
+	c.mu.Unlock()
+	if !allowed {
+		return time.Time{}, errors.Wrapf(ErrCircuitOpen, "not requesting push time of %s from %s", version, host)
+	}
+	c.opts.Stats.IncCount("registry.cache.miss", host)
+
+	if err := c.wait(ctx, host); err != nil {
+		c.mu.Lock()
+		b.probing = false
+		c.mu.Unlock()
+		return time.Time{}, err
+	}
+	pushTime, err := pt.PushTime(ctx, version)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err != nil && isOverloaded(err) {
+		c.failure(b, host, err)
+		return time.Time{}, err
+	}
+	b.success()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if c.opts.TTL > 0 {
+		c.pushTimes[key] = &pushTimeEntry{pushTime: pushTime, expiry: c.now().Add(c.opts.TTL)}
+	}
+	c.evict()
+	return pushTime, nil
+}
+
+// breaker returns the circuit breaker of the host. Must be called with the lock held.
+func (c *Cache) breaker(host string) *breaker {
+	b, ok := c.breakers[host]
+	if !ok {
+		b = &breaker{threshold: c.opts.BreakerThreshold}
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// failure records a request to the host that was throttled or failed with the breaker of
+// the host. Must be called with the lock held.
+func (c *Cache) failure(b *breaker, host string, err error) {
+	if b.failure(c.now(), c.opts) {
+		glog.Warningf("Opening circuit breaker of registry %s for %s after %d failures: %v",
+			host, b.backoff, b.failures, err)
+		c.opts.Stats.IncCount("registry.breaker.open", host)
+	}
+}
+
+// stale returns the versions of the key, even if expired, while within MaxStale. Must
+// be called with the lock held.
+func (c *Cache) stale(key string) ([]string, bool) {
+	e, ok := c.entries[key]
+	if !ok || !c.now().Before(e.expiry.Add(c.opts.MaxStale)) {
+		return nil, false
+	}
+	return e.versions, true
+}
+
+// evict removes entries that can no longer be served. Must be called with the lock held.
+func (c *Cache) evict() {
+	now := c.now()
+	for key, e := range c.entries {
+		if !now.Before(e.expiry.Add(c.opts.MaxStale)) {
+			delete(c.entries, key)
+		}
+	}
+	for key, e := range c.pushTimes {
+		if !now.Before(e.expiry) {
+			delete(c.pushTimes, key)
+		}
+	}
+}
+
+// wait blocks until the rate limiter of the host allows a request.
+func (c *Cache) wait(ctx context.Context, host string) error {
+	if c.opts.RateLimit <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	tb, ok := c.limiters[host]
+	if !ok {
+		tb = newTokenBucket(c.opts.RateLimit, c.opts.Burst, c.now())
+		c.limiters[host] = tb
+	}
+	delay := tb.reserve(c.now())
+	c.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	c.opts.Stats.IncCount("registry.ratelimit.delayed", host)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "rate limit of registry %s", host)
+	}
+}
+
+// isOverloaded returns whether the error indicates that the registry is throttling
+// requests or failing, i.e. HTTP status 429 or 5xx or an AWS throttling error.
+func isOverloaded(err error) bool {
+	cause := errors.Cause(err)
+	if e, ok := cause.(interface{ StatusCode() int }); ok {
+		if code := e.StatusCode(); code == http.StatusTooManyRequests || code >= http.StatusInternalServerError {
+			return true
+		}
+	}
+	if e, ok := cause.(interface{ Code() string }); ok {
+		switch e.Code() {
+		case "ThrottlingException", "Throttling", "TooManyRequestsException", "RequestLimitExceeded":
+			return true
+		}
+	}
+	return false
+}
+
+// HostOf returns the registry host of an image repository, which requests are rate
+// limited by.
+func HostOf(imageRepo string) string {
+	parts := strings.SplitN(imageRepo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "docker.io"
+}
+
+func copyVersions(versions []string) []string {
+	if versions == nil {
+		return nil
+	}
+	return append([]string(nil), versions...)
+}
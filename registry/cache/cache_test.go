@@ -0,0 +1,345 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
+)
+
+// countingStats records the counts of stats by name.
+type countingStats struct {
+	*stats.FakeStats
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newCountingStats() *countingStats {
+	return &countingStats{FakeStats: stats.NewFake(), counts: map[string]int{}}
+}
+
+func (cs *countingStats) IncCount(name string, tags ...string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.counts[name]++
+}
+
+func (cs *countingStats) count(name string) int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.counts[name]
+}
+
+type statusError int
+
+func (e statusError) Error() string   { return "registry error" }
+func (e statusError) StatusCode() int { return int(e) }
+
+// fakeRegistry returns the versions of tags and counts requests. Requests block while
+// the gate is closed.
+type fakeRegistry struct {
+	mu       sync.Mutex
+	versions map[string][]string
+	err      error
+	calls    int
+	gate     chan struct{}
+}
+
+func (r *fakeRegistry) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return r, nil
+}
+
+func (r *fakeRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	if r.gate != nil {
+		<-r.gate
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.err != nil {
+		return nil, errors.Wrap(r.err, "failed to get versions")
+	}
+	return r.versions[tag], nil
+}
+
+func (r *fakeRegistry) PushTime(ctx context.Context, version string) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if r.err != nil {
+		return time.Time{}, errors.Wrap(r.err, "failed to get push time")
+	}
+	return time.Unix(int64(len(version)), 0), nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func newTestCache(options ...func(*Options)) (*Cache, *countingStats, *fakeClock) {
+	st := newCountingStats()
+	clock := &fakeClock{now: time.Now()}
+	c := New(append([]func(*Options){WithStats(st), WithRateLimit(0, 0)}, options...)...)
+	c.now = clock.Now
+	return c, st, clock
+}
+
+func versions(t *testing.T, p registry.Provider, repo, tag string) ([]string, error) {
+	reg, err := p.RegistryFor(repo)
+	if err != nil {
+		t.Fatalf("failed to get registry: %v", err)
+	}
+	return reg.Versions(context.Background(), tag)
+}
+
+func TestCacheTTL(t *testing.T) {
+	c, st, clock := newTestCache(WithTTL(time.Minute))
+	fake := &fakeRegistry{versions: map[string][]string{"prod": {"v1"}, "dev": {"v2"}}}
+	p := c.Wrap(fake, ".*")
+
+	for i := 0; i < 3; i++ {
+		if vs, err := versions(t, p, "gcr.io/project/app", "prod"); err != nil || vs[0] != "v1" {
+			t.Fatalf("unexpected versions %v: %v", vs, err)
+		}
+	}
+	if fake.calls != 1 || st.count("registry.cache.hit") != 2 || st.count("registry.cache.miss") != 1 {
+		t.Errorf("expected 1 call, 2 hits and 1 miss, got %d calls and %v", fake.calls, st.counts)
+	}
+
+	// entries are keyed by repository, tag and version pattern
+	versions(t, p, "gcr.io/project/app", "dev")
+	versions(t, p, "gcr.io/project/other", "prod")
+	versions(t, c.Wrap(fake, "^v"), "gcr.io/project/app", "prod")
+	if fake.calls != 4 {
+		t.Errorf("expected 4 calls, got %d", fake.calls)
+	}
+
+	clock.now = clock.now.Add(2 * time.Minute)
+	fake.versions["prod"] = []string{"v3"}
+	if vs, _ := versions(t, p, "gcr.io/project/app", "prod"); vs[0] != "v3" {
+		t.Errorf("expected expired entry to be refreshed, got %v", vs)
+	}
+}
+
+func TestCacheCredentials(t *testing.T) {
+	c, _, _ := newTestCache(WithTTL(time.Minute))
+	fake := &fakeRegistry{versions: map[string][]string{"prod": {"v1"}}}
+	reg, err := c.Wrap(fake, ".*").RegistryFor("gcr.io/project/app")
+	if err != nil {
+		t.Fatalf("failed to get registry: %v", err)
+	}
+
+	for _, creds := range []registry.Credentials{
+		{Username: "user", Password: "secret"},
+		{Username: "user", Password: "secret"},
+		// the same user with another password may not have access
+		{Username: "user", Password: "other"},
+	} {
+		if _, err := reg.Versions(registry.WithCredentials(context.Background(), creds), "prod"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	reg.Versions(context.Background(), "prod")
+	if fake.calls != 3 {
+		t.Errorf("expected entries to be keyed by the credentials, got %d calls", fake.calls)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	c, st, _ := newTestCache(WithTTL(0))
+	fake := &fakeRegistry{versions: map[string][]string{"prod": {"v1"}}, gate: make(chan struct{})}
+	p := c.Wrap(fake, ".*")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vs, err := versions(t, p, "repo", "prod"); err != nil || len(vs) != 1 {
+				t.Errorf("unexpected versions %v: %v", vs, err)
+			}
+		}()
+	}
+	// wait for the requests to be coalesced before letting the registry respond
+	for st.count("registry.cache.coalesced") < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	close(fake.gate)
+	wg.Wait()
+
+	if fake.calls != 1 {
+		t.Errorf("expected requests to be coalesced into 1 call, got %d", fake.calls)
+	}
+}
+
+// panicRegistry panics on requests once the gate is closed.
+type panicRegistry struct {
+	gate chan struct{}
+}
+
+func (r *panicRegistry) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return r, nil
+}
+
+func (r *panicRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	<-r.gate
+	panic("registry panic")
+}
+
+func TestCoalescingPanic(t *testing.T) {
+	c, st, _ := newTestCache(WithTTL(0))
+	fake := &panicRegistry{gate: make(chan struct{})}
+	p := c.Wrap(fake, ".*")
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		versions(t, p, "repo", "prod")
+	}()
+	for {
+		c.mu.Lock()
+		n := len(c.calls)
+		c.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	errs := make(chan error)
+	go func() {
+		_, err := versions(t, p, "repo", "prod")
+		errs <- err
+	}()
+	for st.count("registry.cache.coalesced") < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(fake.gate)
+
+	if r := <-panicked; r == nil {
+		t.Errorf("expected the panic to propagate to the requesting caller")
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected an error for the coalesced request")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("coalesced request did not complete after the registry panicked")
+	}
+	if len(c.calls) != 0 {
+		t.Errorf("expected the call to be removed")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	c, st, clock := newTestCache(WithTTL(time.Minute), WithBreaker(2, time.Minute, 5*time.Minute))
+	fake := &fakeRegistry{versions: map[string][]string{"prod": {"v1"}}}
+	p := c.Wrap(fake, ".*")
+	repo := "123.dkr.ecr.us-east-1.amazonaws.com/app"
+
+	versions(t, p, repo, "prod")
+	clock.now = clock.now.Add(2 * time.Minute)
+
+	// stale versions are served while the registry is throttling requests
+	fake.err = statusError(429)
+	for i := 0; i < 2; i++ {
+		if vs, err := versions(t, p, repo, "prod"); err != nil || vs[0] != "v1" {
+			t.Fatalf("expected stale versions, got %v: %v", vs, err)
+		}
+	}
+	if st.count("registry.breaker.open") != 1 {
+		t.Errorf("expected breaker to open, got %v", st.counts)
+	}
+
+	calls := fake.calls
+	if vs, err := versions(t, p, repo, "prod"); err != nil || vs[0] != "v1" {
+		t.Errorf("expected stale versions while open, got %v: %v", vs, err)
+	}
+	if _, err := versions(t, p, repo, "dev"); !IsCircuitOpen(err) {
+		t.Errorf("expected circuit open error, got %v", err)
+	}
+	if fake.calls != calls {
+		t.Errorf("expected no requests while the breaker is open, got %d", fake.calls-calls)
+	}
+
+	// a failed request while half-open doubles the backoff
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := versions(t, p, repo, "dev"); IsCircuitOpen(err) || err == nil {
+		t.Errorf("expected the request of a half-open breaker to fail, got %v", err)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, err := versions(t, p, repo, "dev"); !IsCircuitOpen(err) {
+		t.Errorf("expected breaker to be open for twice the backoff, got %v", err)
+	}
+
+	// other errors don't open the breaker and a successful request closes it
+	clock.now = clock.now.Add(time.Minute)
+	fake.err = statusError(404)
+	if _, err := versions(t, p, repo, "dev"); IsCircuitOpen(err) || err == nil {
+		t.Errorf("expected not found error, got %v", err)
+	}
+	fake.err = nil
+	if _, err := versions(t, p, repo, "dev"); err != nil {
+		t.Errorf("expected breaker to be closed, got %v", err)
+	}
+
+	// throttling of other hosts is tracked separately
+	if _, err := versions(t, p, "gcr.io/project/app", "prod"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPushTime(t *testing.T) {
+	c, _, clock := newTestCache(WithTTL(time.Minute), WithBreaker(1, time.Minute, 5*time.Minute))
+	fake := &fakeRegistry{}
+	reg, err := c.Wrap(fake, ".*").RegistryFor("123.dkr.ecr.us-east-1.amazonaws.com/app")
+	if err != nil {
+		t.Fatalf("failed to get registry: %v", err)
+	}
+	pt := reg.(registry.PushTimer)
+
+	for i := 0; i < 2; i++ {
+		if _, err := pt.PushTime(context.Background(), "v1"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if fake.calls != 1 {
+		t.Errorf("expected push time to be cached, got %d requests", fake.calls)
+	}
+
+	// push times aren't served stale and throttling opens the breaker
+	clock.now = clock.now.Add(2 * time.Minute)
+	fake.err = statusError(429)
+	if _, err := pt.PushTime(context.Background(), "v1"); err == nil || IsCircuitOpen(err) {
+		t.Errorf("expected throttling error, got %v", err)
+	}
+	calls := fake.calls
+	if _, err := pt.PushTime(context.Background(), "v1"); !IsCircuitOpen(err) {
+		t.Errorf("expected circuit open error, got %v", err)
+	}
+	if fake.calls != calls {
+		t.Errorf("expected no requests while the breaker is open, got %d", fake.calls-calls)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	tb := newTokenBucket(2, 2, now)
+
+	for i, expected := range []time.Duration{0, 0, 500 * time.Millisecond, time.Second} {
+		if delay := tb.reserve(now); delay != expected {
+			t.Errorf("request %d: expected delay %s, got %s", i, expected, delay)
+		}
+	}
+	if delay := tb.reserve(now.Add(2 * time.Second)); delay != 0 {
+		t.Errorf("expected tokens to be refilled, got delay %s", delay)
+	}
+}
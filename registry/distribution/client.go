@@ -0,0 +1,459 @@
+package distribution
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+)
+
+// manifestTypes are the media types of manifests accepted from registries.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// maxTagsPage is the number of tags requested per page when listing the tags of a repository.
+const maxTagsPage = 1000
+
+var (
+	challengeParamRule = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	nextLinkRule       = regexp.MustCompile(`<([^>]+)>;\s*rel="?next"?`)
+)
+
+// Credentials returns the username and password used to obtain tokens from the token
+// service of a registry host.
+type Credentials func(ctx context.Context, host string) (username, password string, err error)
+
+// Error is returned for unexpected responses of a registry.
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("registry returned status %d: %s", e.Status, e.Message)
+}
+
+// StatusCode returns the HTTP status of the response.
+func (e *Error) StatusCode() int {
+	return e.Status
+}
+
+// IsNotFound returns whether the error is caused by a resource that doesn't exist in
+// the registry.
+func IsNotFound(err error) bool {
+	rerr, ok := errors.Cause(err).(*Error)
+	return ok && rerr.Status == http.StatusNotFound
+}
+
+// Client is a client of the Docker Registry HTTP API V2, the Distribution API, of a
+// single registry host. Requests are authenticated with bearer tokens obtained from
+// the token service advertised by the registry, which are cached per scope.
+type Client struct {
+	host  string
+	http  *http.Client
+	creds Credentials
+
+	mu     sync.Mutex
+	tokens map[string]bearerToken
+}
+
+type bearerToken struct {
+	value  string
+	expiry time.Time
+}
+
+// NewClient returns a client of the registry host.
+func NewClient(host string, httpClient *http.Client, creds Credentials) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		host:   host,
+		http:   httpClient,
+		creds:  creds,
+		tokens: map[string]bearerToken{},
+	}
+}
+
+// Host returns the registry host of the client.
+func (c *Client) Host() string {
+	return c.host
+}
+
+// HTTPClient returns the HTTP client used for requests to the registry.
+func (c *Client) HTTPClient() *http.Client {
+	return c.http
+}
+
+// Do sends a request to the path of the registry, authenticating with a token of the
+// given scope, e.g. repository:team/app:pull. The body of the response must be closed.
+func (c *Client) Do(ctx context.Context, method, path, scope string, header http.Header, body []byte) (*http.Response, error) {
+	key := tokenKey(ctx, scope)
+	resp, err := c.send(ctx, method, path, header, body, c.cachedToken(key))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	drain(resp)
+
+	scheme, params := parseChallenge(challenge)
+	var auth string
+	switch scheme {
+	case "bearer":
+		if params["scope"] == "" {
+			params["scope"] = scope
+		}
+		token, err := c.token(ctx, params)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.tokens[key] = token
+		c.mu.Unlock()
+		auth = "Bearer " + token.value
+	case "basic":
+		username, password, ok, err := c.credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.Errorf("registry %s requires credentials", c.host)
+		}
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+	default:
+		return nil, errors.Errorf("unsupported authentication challenge %q of registry %s", challenge, c.host)
+	}
+
+	return c.send(ctx, method, path, header, body, auth)
+}
+
+// send sends a single request to the registry.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte, auth string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, c.url(path), r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create request for %s", path)
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to send %s request to %s", method, c.host)
+	}
+	return resp, nil
+}
+
+// url returns the URL of the path on the registry. Paths that are absolute URLs, e.g.
+// links to the next page, are returned as is.
+func (c *Client) url(path string) string {
+	if strings.HasPrefix(path, "https://") || strings.HasPrefix(path, "http://") {
+		return path
+	}
+	return "https://" + c.host + path
+}
+
+// credentials returns the credentials of the context, e.g. of an image pull secret, or
+// otherwise those of the client. Returns false if neither has credentials.
+func (c *Client) credentials(ctx context.Context) (username, password string, ok bool, err error) {
+	if creds, ok := registry.CredentialsFromContext(ctx); ok {
+		return creds.Username, creds.Password, true, nil
+	}
+	if c.creds == nil {
+		return "", "", false, nil
+	}
+	username, password, err = c.creds(ctx, c.host)
+	if err != nil {
+		return "", "", false, errors.Wrapf(err, "failed to obtain credentials for %s", c.host)
+	}
+	return username, password, true, nil
+}
+
+// tokenKey returns the key of tokens of the scope obtained with the credentials of the
+// context, so that tokens of different credentials are not shared.
+func tokenKey(ctx context.Context, scope string) string {
+	if creds, ok := registry.CredentialsFromContext(ctx); ok {
+		return scope + "|" + creds.Username
+	}
+	return scope
+}
+
+// cachedToken returns the authorization header of an unexpired token of the key, if any.
+func (c *Client) cachedToken(key string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	token, ok := c.tokens[key]
+	if !ok || time.Now().After(token.expiry) {
+		return ""
+	}
+	return "Bearer " + token.value
+}
+
+// token obtains a token from the token service of the registry described by the
+// parameters of a bearer challenge.
+func (c *Client) token(ctx context.Context, params map[string]string) (bearerToken, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return bearerToken{}, errors.Errorf("invalid token realm %q of registry %s", params["realm"], c.host)
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		q.Set("scope", params["scope"])
+	}
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return bearerToken{}, errors.Wrap(err, "failed to create token request")
+	}
+	req = req.WithContext(ctx)
+	username, password, ok, err := c.credentials(ctx)
+	if err != nil {
+		return bearerToken{}, err
+	}
+	if ok && (username != "" || password != "") {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return bearerToken{}, errors.Wrapf(err, "failed to request token from %s", realm.Host)
+	}
+	defer drain(resp)
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return bearerToken{}, errors.Wrapf(err, "failed to obtain token for scope %s", params["scope"])
+	}
+
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return bearerToken{}, errors.Wrap(err, "failed to decode token response")
+	}
+	token := bearerToken{value: tr.Token}
+	if token.value == "" {
+		token.value = tr.AccessToken
+	}
+	if token.value == "" {
+		return bearerToken{}, errors.Errorf("token service %s returned no token", realm.Host)
+	}
+	// tokens without an expiry are valid for at least 60 seconds
+	expiresIn := time.Duration(tr.ExpiresIn) * time.Second
+	if expiresIn < time.Minute {
+		expiresIn = time.Minute
+	}
+	token.expiry = time.Now().Add(expiresIn - 10*time.Second)
+	return token, nil
+}
+
+// Digest returns the digest of the manifest referenced by a tag or digest.
+func (c *Client) Digest(ctx context.Context, repo, ref string) (string, error) {
+	resp, err := c.Do(ctx, http.MethodHead, manifestPath(repo, ref), pullScope(repo), acceptManifests(), nil)
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return "", errors.Wrapf(err, "failed to get manifest %s of %s", ref, repo)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.Errorf("registry returned no digest for manifest %s of %s", ref, repo)
+	}
+	return digest, nil
+}
+
+// Manifest returns the media type, digest and content of the manifest referenced by a
+// tag or digest.
+func (c *Client) Manifest(ctx context.Context, repo, ref string) (mediaType, digest string, content []byte, err error) {
+	resp, err := c.Do(ctx, http.MethodGet, manifestPath(repo, ref), pullScope(repo), acceptManifests(), nil)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer drain(resp)
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return "", "", nil, errors.Wrapf(err, "failed to get manifest %s of %s", ref, repo)
+	}
+	content, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", nil, errors.Wrapf(err, "failed to read manifest %s of %s", ref, repo)
+	}
+	return resp.Header.Get("Content-Type"), resp.Header.Get("Docker-Content-Digest"), content, nil
+}
+
+// PutManifest uploads a manifest with the tag.
+func (c *Client) PutManifest(ctx context.Context, repo, tag, mediaType string, content []byte) error {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+	resp, err := c.Do(ctx, http.MethodPut, manifestPath(repo, tag), pushScope(repo), header, content)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	return errors.Wrapf(checkStatus(resp, http.StatusCreated, http.StatusOK),
+		"failed to put manifest %s of %s", tag, repo)
+}
+
+// DeleteManifest deletes the manifest referenced by a tag or digest. Registries that
+// support deleting manifests by tag only remove the tag.
+func (c *Client) DeleteManifest(ctx context.Context, repo, ref string) error {
+	resp, err := c.Do(ctx, http.MethodDelete, manifestPath(repo, ref), deleteScope(repo), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	return errors.Wrapf(checkStatus(resp, http.StatusAccepted, http.StatusOK),
+		"failed to delete manifest %s of %s", ref, repo)
+}
+
+// Tags returns all tags of the repository, following the pages of the tag list.
+func (c *Client) Tags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+	path := fmt.Sprintf("/v2/%s/tags/list?n=%d", repo, maxTagsPage)
+	for path != "" {
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		next, err := c.GetJSON(ctx, path, pullScope(repo), &page)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to list tags of %s", repo)
+		}
+		tags = append(tags, page.Tags...)
+		path = next
+	}
+	return tags, nil
+}
+
+// GetJSON decodes the JSON response of a GET request to the path into v, and returns
+// the path of the next page advertised by the response, if any.
+func (c *Client) GetJSON(ctx context.Context, path, scope string, v interface{}) (next string, err error) {
+	header := http.Header{}
+	header.Set("Accept", "application/json")
+	resp, err := c.Do(ctx, http.MethodGet, path, scope, header, nil)
+	if err != nil {
+		return "", err
+	}
+	defer drain(resp)
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return "", err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", errors.Wrapf(err, "failed to decode response of %s", path)
+	}
+	if m := nextLinkRule.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, nil
+}
+
+// TagsByDigest returns the tags of the repository that reference the manifest digest,
+// comparing the digests of all tags. It is used with registries that have no API to
+// look up the tags of a manifest.
+func TagsByDigest(ctx context.Context, c *Client, repo, digest string) ([]string, error) {
+	all, err := c.Tags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, tag := range all {
+		d, err := c.Digest(ctx, repo, tag)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if d == digest {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// parseChallenge returns the lower case scheme and the parameters of a WWW-Authenticate header.
+func parseChallenge(challenge string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	params := map[string]string{}
+	if len(parts) == 2 {
+		for _, m := range challengeParamRule.FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	return strings.ToLower(parts[0]), params
+}
+
+// checkStatus returns an *Error if the status of the response is not one of expected.
+func checkStatus(resp *http.Response, expected ...int) error {
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &Error{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
+
+// drain reads the remaining body of a response so the connection can be reused, and
+// closes it.
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
+
+func acceptManifests() http.Header {
+	header := http.Header{}
+	for _, t := range manifestTypes {
+		header.Add("Accept", t)
+	}
+	return header
+}
+
+func manifestPath(repo, ref string) string {
+	return fmt.Sprintf("/v2/%s/manifests/%s", repo, ref)
+}
+
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+func deleteScope(repo string) string {
+	return fmt.Sprintf("repository:%s:delete", repo)
+}
@@ -0,0 +1,293 @@
+package distribution
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
+)
+
+// Cloud implements the parts of a cloud registry that are not covered by the
+// Distribution API: obtaining credentials and looking up and removing tags.
+type Cloud interface {
+	// Credentials returns the username and password used to obtain registry tokens.
+	Credentials(ctx context.Context, host string) (username, password string, err error)
+
+	// TagsOf returns the tags of the manifest with the digest.
+	TagsOf(ctx context.Context, c *Client, repo, digest string) ([]string, error)
+
+	// Untag removes the tag from the repository.
+	Untag(ctx context.Context, c *Client, repo, tag string) error
+}
+
+// PushTimer is implemented by clouds whose registries record when manifests were pushed.
+type PushTimer interface {
+	// PushTime returns the time the manifest with the digest was pushed.
+	PushTime(ctx context.Context, c *Client, repo, digest string) (time.Time, error)
+}
+
+// Options contains additional (optional) configuration for the provider.
+type Options struct {
+	Stats stats.Stats
+
+	// Timeout bounds each operation of the provider.
+	Timeout time.Duration
+
+	// HTTPClient is used for all requests to the registry and its token service.
+	HTTPClient *http.Client
+}
+
+// WithStats applies the stats type to the provider.
+func WithStats(instance stats.Stats) func(*Options) {
+	return func(opts *Options) {
+		opts.Stats = instance
+	}
+}
+
+// WithTimeout sets the timeout of each operation of the provider.
+func WithTimeout(timeout time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for requests to the registry.
+func WithHTTPClient(client *http.Client) func(*Options) {
+	return func(opts *Options) {
+		if client != nil {
+			opts.HTTPClient = client
+		}
+	}
+}
+
+// Provider implements the registry.Provider, registry.Registry and registry.Tagger
+// interfaces for a repository of a registry that supports the Distribution API.
+type Provider struct {
+	client *Client
+	repo   string
+	cloud  Cloud
+
+	vRegex *regexp.Regexp
+
+	opts *Options
+}
+
+// ParseRepo returns the registry host and the repository path of an image repository,
+// e.g. gcr.io and project/app for gcr.io/project/app.
+func ParseRepo(imageRepo string) (host, repo string, err error) {
+	named, err := reference.ParseNamed(imageRepo)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid repository %s", imageRepo)
+	}
+	if !reference.IsNameOnly(named) {
+		return "", "", errors.Errorf("repository %s must not contain a tag or digest", imageRepo)
+	}
+	return reference.Domain(named), reference.Path(named), nil
+}
+
+// NewProvider returns a provider of the image repository that uses the cloud for
+// credentials and tag operations.
+func NewProvider(imageRepo, versionExp string, cloud Cloud, options ...func(*Options)) (*Provider, error) {
+	vRegex, err := regexp.Compile(versionExp)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	opts := &Options{
+		Stats:      stats.NewFake(),
+		Timeout:    15 * time.Second,
+		HTTPClient: http.DefaultClient,
+	}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	p := &Provider{
+		cloud:  cloud,
+		vRegex: vRegex,
+		opts:   opts,
+	}
+	return p.forRepo(imageRepo)
+}
+
+// forRepo returns a provider of the image repository with the same configuration.
+func (p *Provider) forRepo(imageRepo string) (*Provider, error) {
+	host, repo, err := ParseRepo(imageRepo)
+	if err != nil {
+		return nil, err
+	}
+	client := p.client
+	if client == nil || client.Host() != host {
+		client = NewClient(host, p.opts.HTTPClient, p.cloud.Credentials)
+	}
+	return &Provider{
+		client: client,
+		repo:   repo,
+		cloud:  p.cloud,
+		vRegex: p.vRegex,
+		opts:   p.opts,
+	}, nil
+}
+
+// RegistryFor implements the registry.Provider interface.
+func (p *Provider) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return p.forRepo(imageRepo)
+}
+
+func (p *Provider) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.opts.Timeout)
+}
+
+// Versions implements the registry.Registry interface. The versions are the tags of
+// the image tagged with tag that match the version pattern.
+func (p *Provider) Versions(ctx context.Context, tag string) ([]string, error) {
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	tags, err := p.tagsOf(ctx, tag)
+	if err != nil {
+		glog.Errorf("Failed to get tags of %s from %s: %v", tag, p.client.Host(), err)
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return nil, errors.Wrapf(err, "failed to get tags of %s", tag)
+	}
+
+	var versions []string
+	for _, t := range tags {
+		if p.vRegex.MatchString(t) {
+			versions = append(versions, t)
+		}
+	}
+	if len(versions) == 0 {
+		p.opts.Stats.Event(fmt.Sprintf("registry.%s.sync.failure", p.repo),
+			fmt.Sprintf("Failed to sync with %s for tag %s", p.client.Host(), tag), "", "error",
+			time.Now().UTC(), tag)
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return nil, errors.Errorf("No version found for tag %s", tag)
+	}
+
+	glog.V(2).Infof("Got currentVersions=%s from %s", strings.Join(versions, ", "), p.client.Host())
+
+	return versions, nil
+}
+
+// Add adds a list of tags to the image identified with version. Tags the image already
+// has are skipped.
+func (p *Provider) Add(version string, tags ...string) error {
+	ctx, cancel := p.withTimeout(context.Background())
+	defer cancel()
+
+	glog.V(2).Infof("Adding tags %s to version %s of repository %s", strings.Join(tags, ", "), version, p.repo)
+
+	mediaType, digest, manifest, err := p.client.Manifest(ctx, p.repo, version)
+	if err != nil {
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return errors.Wrapf(err, "failed to get image of version %s", version)
+	}
+	if digest == "" {
+		if digest, err = p.client.Digest(ctx, p.repo, version); err != nil {
+			p.opts.Stats.IncCount("registry.failure", p.repo)
+			return errors.Wrapf(err, "failed to get digest of version %s", version)
+		}
+	}
+	existing, err := p.cloud.TagsOf(ctx, p.client, p.repo, digest)
+	if err != nil {
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return errors.Wrapf(err, "failed to get tags of version %s", version)
+	}
+	has := map[string]bool{}
+	for _, tag := range existing {
+		has[tag] = true
+	}
+
+	for _, tag := range tags {
+		if has[tag] {
+			glog.V(4).Infof("Image of version %s is already tagged with %s", version, tag)
+			continue
+		}
+		if err := p.client.PutManifest(ctx, p.repo, tag, mediaType, manifest); err != nil {
+			p.opts.Stats.IncCount("registry.failure", p.repo)
+			return errors.Wrapf(err, "failed to add tag %s to image of version %s", tag, version)
+		}
+	}
+	return nil
+}
+
+// Remove removes the list of tags from the repository such that no image contains
+// these tags. Tags that don't exist are ignored.
+func (p *Provider) Remove(tags ...string) error {
+	ctx, cancel := p.withTimeout(context.Background())
+	defer cancel()
+
+	glog.V(2).Infof("Removing tags %s from repository %s", strings.Join(tags, ", "), p.repo)
+
+	for _, tag := range tags {
+		if err := p.cloud.Untag(ctx, p.client, p.repo, tag); err != nil && !IsNotFound(err) {
+			p.opts.Stats.IncCount("registry.failure", p.repo)
+			return errors.Wrapf(err, "failed to remove tag %s", tag)
+		}
+	}
+	return nil
+}
+
+// Get returns the list of tags the image identified with version has.
+func (p *Provider) Get(version string) ([]string, error) {
+	ctx, cancel := p.withTimeout(context.Background())
+	defer cancel()
+
+	tags, err := p.tagsOf(ctx, version)
+	if err != nil {
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return nil, errors.Wrapf(err, "failed to get tags of version %s", version)
+	}
+	return tags, nil
+}
+
+// PushTime implements the registry.PushTimer interface for clouds that implement
+// PushTimer.
+func (p *Provider) PushTime(ctx context.Context, version string) (time.Time, error) {
+	pt, ok := p.cloud.(PushTimer)
+	if !ok {
+		return time.Time{}, errors.Errorf("registry %s does not record push times", p.client.Host())
+	}
+
+	ctx, cancel := p.withTimeout(ctx)
+	defer cancel()
+
+	digest, err := p.client.Digest(ctx, p.repo, version)
+	if err != nil {
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return time.Time{}, errors.Wrapf(err, "failed to get digest of version %s", version)
+	}
+	pushed, err := pt.PushTime(ctx, p.client, p.repo, digest)
+	if err != nil {
+		p.opts.Stats.IncCount("registry.failure", p.repo)
+		return time.Time{}, errors.Wrapf(err, "failed to get push time of version %s", version)
+	}
+	return pushed, nil
+}
+
+// tagsOf returns the sorted tags of the image tagged with tag.
+func (p *Provider) tagsOf(ctx context.Context, tag string) ([]string, error) {
+	digest, err := p.client.Digest(ctx, p.repo, tag)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := p.cloud.TagsOf(ctx, p.client, p.repo, digest)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
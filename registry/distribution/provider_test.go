@@ -0,0 +1,297 @@
+package distribution
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
+)
+
+const testMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+
+// fakeRegistry is a registry stand-in that requires tokens from its token service and
+// pages tag lists.
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	tags        map[string]string // tag -> digest
+	manifests   map[string]string // digest -> content
+	tokenCalls  int
+	pageSize    int
+	lastScope   string
+	credentials string
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	r := &fakeRegistry{
+		tags:      map[string]string{},
+		manifests: map[string]string{},
+		pageSize:  2,
+	}
+	r.Server = httptest.NewTLSServer(http.HandlerFunc(r.serve))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *fakeRegistry) host() string {
+	return strings.TrimPrefix(r.URL, "https://")
+}
+
+func (r *fakeRegistry) push(content string, tags ...string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	r.manifests[digest] = content
+	for _, tag := range tags {
+		r.tags[tag] = digest
+	}
+	return digest
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		user, pass, _ := req.BasicAuth()
+		if user+":"+pass != r.credentials {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.tokenCalls++
+		r.lastScope = req.URL.Query().Get("scope")
+		fmt.Fprintf(w, `{"token":"token-for-%s","expires_in":300}`, r.lastScope)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/v2/"), "/", 3)
+	if len(parts) != 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repo := parts[0] + "/" + parts[1]
+	scope := "repository:" + repo + ":pull"
+	if req.Method == http.MethodPut {
+		scope = "repository:" + repo + ":pull,push"
+	} else if req.Method == http.MethodDelete {
+		scope = "repository:" + repo + ":delete"
+	}
+	if req.Header.Get("Authorization") != "Bearer token-for-"+scope {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="%s"`, r.URL, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case parts[2] == "tags/list":
+		var all []string
+		for tag := range r.tags {
+			all = append(all, tag)
+		}
+		sort.Strings(all)
+		start := 0
+		if last := req.URL.Query().Get("last"); last != "" {
+			start = sort.SearchStrings(all, last) + 1
+		}
+		end := start + r.pageSize
+		if end < len(all) {
+			w.Header().Set("Link", fmt.Sprintf(`</v2/%s/tags/list?n=%d&last=%s>; rel="next"`, repo, r.pageSize, all[end-1]))
+		} else {
+			end = len(all)
+		}
+		fmt.Fprintf(w, `{"name":%q,"tags":["%s"]}`, repo, strings.Join(all[start:end], `","`))
+	case strings.HasPrefix(parts[2], "manifests/"):
+		ref := strings.TrimPrefix(parts[2], "manifests/")
+		switch req.Method {
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(req.Body)
+			digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+			r.manifests[digest] = string(body)
+			r.tags[ref] = digest
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if _, ok := r.tags[ref]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			delete(r.tags, ref)
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			digest, ok := r.tags[ref]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", testMediaType)
+			w.Header().Set("Docker-Content-Digest", digest)
+			w.Write([]byte(r.manifests[digest]))
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// fakeCloud looks up tags by comparing digests and removes tags by deleting manifests.
+type fakeCloud struct {
+	credentials string
+}
+
+func (c *fakeCloud) Credentials(ctx context.Context, host string) (string, string, error) {
+	parts := strings.SplitN(c.credentials, ":", 2)
+	return parts[0], parts[1], nil
+}
+
+func (c *fakeCloud) TagsOf(ctx context.Context, client *Client, repo, digest string) ([]string, error) {
+	return TagsByDigest(ctx, client, repo, digest)
+}
+
+func (c *fakeCloud) Untag(ctx context.Context, client *Client, repo, tag string) error {
+	return client.DeleteManifest(ctx, repo, tag)
+}
+
+func newTestProvider(t *testing.T, r *fakeRegistry) *Provider {
+	r.credentials = "user:secret"
+	p, err := NewProvider(r.host()+"/team/app", `^[0-9a-f]{7}$`, &fakeCloud{credentials: "user:secret"},
+		WithStats(stats.NewFake()), WithHTTPClient(r.Client()))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	return p
+}
+
+func TestVersions(t *testing.T) {
+	r := newFakeRegistry(t)
+	r.push("image-1", "1111111", "prod")
+	r.push("image-2", "2222222", "abcdef0", "latest", "staging")
+	p := newTestProvider(t, r)
+
+	versions, err := p.Versions(context.Background(), "staging")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"2222222", "abcdef0"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	// tokens are cached per scope
+	calls := r.tokenCalls
+	if _, err := p.Versions(context.Background(), "prod"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.tokenCalls != calls {
+		t.Errorf("expected cached token to be used, got %d token requests", r.tokenCalls-calls)
+	}
+
+	if _, err := p.Versions(context.Background(), "missing"); err == nil {
+		t.Errorf("expected error for missing tag")
+	}
+	r.push("image-3", "dev")
+	if _, err := p.Versions(context.Background(), "dev"); err == nil || !strings.Contains(err.Error(), "No version found") {
+		t.Errorf("expected no version error, got %v", err)
+	}
+
+	bad, _ := NewProvider(r.host()+"/team/app", `.*`, &fakeCloud{credentials: "user:wrong"}, WithHTTPClient(r.Client()))
+	if _, err := bad.Versions(context.Background(), "prod"); err == nil {
+		t.Errorf("expected error for invalid credentials")
+	}
+}
+
+func TestContextCredentials(t *testing.T) {
+	r := newFakeRegistry(t)
+	r.push("image-1", "1111111", "prod")
+	p := newTestProvider(t, r)
+	if _, err := p.Versions(context.Background(), "prod"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// credentials of the context, e.g. of a pull secret, take precedence over those of
+	// the cloud and don't share its tokens
+	r.credentials = "puller:pull-secret"
+	ctx := registry.WithCredentials(context.Background(), registry.Credentials{Username: "puller", Password: "pull-secret"})
+	calls := r.tokenCalls
+	if _, err := p.Versions(ctx, "prod"); err != nil {
+		t.Fatalf("unexpected error with context credentials: %v", err)
+	}
+	if r.tokenCalls == calls {
+		t.Errorf("expected a token to be requested with the context credentials")
+	}
+
+	wrong := registry.WithCredentials(context.Background(), registry.Credentials{Username: "puller", Password: "wrong"})
+	if _, err := newTestProvider(t, r).Versions(wrong, "prod"); err == nil {
+		t.Errorf("expected error for invalid context credentials")
+	}
+}
+
+func TestTagger(t *testing.T) {
+	r := newFakeRegistry(t)
+	digest := r.push("image-1", "1111111", "prod")
+	r.push("image-2", "2222222")
+	p := newTestProvider(t, r)
+
+	if err := p.Add("1111111", "prod", "canary", "stable"); err != nil {
+		t.Fatalf("failed to add tags: %v", err)
+	}
+	if r.tags["canary"] != digest || r.tags["stable"] != digest {
+		t.Errorf("expected tags to reference %s, got %v", digest, r.tags)
+	}
+	if r.lastScope != "repository:team/app:pull,push" {
+		t.Errorf("expected push scope, got %s", r.lastScope)
+	}
+
+	tags, err := p.Get("1111111")
+	if err != nil {
+		t.Fatalf("failed to get tags: %v", err)
+	}
+	if expected := []string{"1111111", "canary", "prod", "stable"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	if err := p.Remove("canary", "stable", "missing"); err != nil {
+		t.Fatalf("failed to remove tags: %v", err)
+	}
+	if _, ok := r.tags["canary"]; ok {
+		t.Errorf("expected canary tag to be removed")
+	}
+	if _, ok := r.tags["prod"]; !ok {
+		t.Errorf("expected prod tag to be kept")
+	}
+
+	if err := p.Add("3333333", "prod"); err == nil {
+		t.Errorf("expected error for missing version")
+	}
+}
+
+func TestParseRepo(t *testing.T) {
+	tests := []struct {
+		imageRepo, host, repo string
+		valid                 bool
+	}{
+		{"gcr.io/project/app", "gcr.io", "project/app", true},
+		{"us-docker.pkg.dev/project/images/app", "us-docker.pkg.dev", "project/images/app", true},
+		{"myregistry.azurecr.io/app", "myregistry.azurecr.io", "app", true},
+		{"localhost:5000/app", "localhost:5000", "app", true},
+		{"gcr.io/project/app:latest", "", "", false},
+		{"Invalid/App", "", "", false},
+	}
+	for _, test := range tests {
+		host, repo, err := ParseRepo(test.imageRepo)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid=%v, got %v", test.imageRepo, test.valid, err)
+			continue
+		}
+		if host != test.host || repo != test.repo {
+			t.Errorf("%s: expected %s and %s, got %s and %s", test.imageRepo, test.host, test.repo, host, repo)
+		}
+	}
+}
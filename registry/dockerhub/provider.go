@@ -2,9 +2,11 @@ package dockerhub
 
 import (
 	"context"
+	"sync"
 
 	kcdregistry "github.com/wish/kcd/registry"
 	"github.com/wish/kcd/stats"
+	"github.com/docker/distribution/reference"
 	"github.com/heroku/docker-registry-client/registry"
 	"github.com/pkg/errors"
 )
@@ -39,16 +41,35 @@ func WithCreds(user, password string) func(*Options) {
 // it performs an update in deployment which then based on update strategy of deployment
 // is further rolled out.
 // In cases, where it cant resolves
-// TODO: Dockerhub syncer does not support private repositories at the moment
-// - Need to work on storing credentials in secret or similar more secure approach
-// for user/password. For now uses anonymous access
-// - Need to define auth mechanism
+// Versions of private repositories are looked up with the credentials of the context,
+// e.g. of an image pull secret, or otherwise those of the options.
 type V2Provider struct {
 	repository string
 	client     *registry.Registry
+	clients    *credsClients
 	opts       *Options
 }
 
+// credsClients are the clients of credentials of contexts, shared by the registries of
+// a provider.
+type credsClients struct {
+	mu      sync.Mutex
+	clients map[kcdregistry.Credentials]*registry.Registry
+}
+
+// ParseRepo checks that the image repository is a valid repository name without a tag
+// or digest, e.g. nearmap/kcd.
+func ParseRepo(imageRepo string) error {
+	named, err := reference.ParseNormalizedNamed(imageRepo)
+	if err != nil {
+		return errors.Wrapf(err, "invalid repository %s", imageRepo)
+	}
+	if !reference.IsNameOnly(named) {
+		return errors.Errorf("repository %s must not contain a tag or digest", imageRepo)
+	}
+	return nil
+}
+
 // NewDHV2 returns a DockerHub V2 registry provider.
 func NewDHV2(repository, versionExp string, options ...func(*Options)) (*V2Provider, error) {
 	opts := &Options{
@@ -69,6 +90,7 @@ func NewDHV2(repository, versionExp string, options ...func(*Options)) (*V2Provi
 
 	return &V2Provider{
 		client:     client,
+		clients:    &credsClients{clients: map[kcdregistry.Credentials]*registry.Registry{}},
 		repository: repository,
 		opts:       opts,
 	}, nil
@@ -78,6 +100,7 @@ func NewDHV2(repository, versionExp string, options ...func(*Options)) (*V2Provi
 func (vp *V2Provider) RegistryFor(imageRepo string) (kcdregistry.Registry, error) {
 	return &V2Provider{
 		client:     vp.client,
+		clients:    vp.clients,
 		repository: imageRepo,
 		opts:       vp.opts,
 	}, nil
@@ -86,7 +109,12 @@ func (vp *V2Provider) RegistryFor(imageRepo string) (kcdregistry.Registry, error
 // Versions implements the Registry interface.
 func (vp *V2Provider) Versions(ctx context.Context, tag string) ([]string, error) {
 	tags := make([]string, 0, 5)
-	newVersion, err := vp.getDigest(tag)
+	client, err := vp.clientFor(ctx)
+	if err != nil {
+		vp.opts.Stats.IncCount("registry.failure", vp.repository)
+		return tags, err
+	}
+	newVersion, err := vp.getDigest(client, tag)
 	if err != nil {
 		vp.opts.Stats.IncCount("registry.failure", vp.repository)
 		return tags, errors.Errorf("No version found for tag %s", tag)
@@ -109,7 +137,7 @@ func (vp *V2Provider) Remove(tags ...string) error {
 
 // Get gets the list of tags to the image identified with version
 func (vp *V2Provider) Get(version string) ([]string, error) {
-	digest, err := vp.getDigest(version)
+	digest, err := vp.getDigest(vp.client, version)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to connect to dockerhub")
 	}
@@ -135,9 +163,30 @@ func (vp *V2Provider) addTagsOnImg(version string, tags ...string) error {
 	return nil
 }
 
+// clientFor returns the client of the credentials of the context, or the client of the
+// provider if the context has none.
+func (vp *V2Provider) clientFor(ctx context.Context) (*registry.Registry, error) {
+	creds, ok := kcdregistry.CredentialsFromContext(ctx)
+	if !ok {
+		return vp.client, nil
+	}
+
+	vp.clients.mu.Lock()
+	defer vp.clients.mu.Unlock()
+	if client, ok := vp.clients.clients[creds]; ok {
+		return client, nil
+	}
+	client, err := registry.New(vp.opts.HubURL, creds.Username, creds.Password)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to dockerhub as %s", creds.Username)
+	}
+	vp.clients.clients[creds] = client
+	return client, nil
+}
+
 // getDigest fetches the digest of dockerhub image of requested repository and tag
-func (vp *V2Provider) getDigest(tag string) (string, error) {
-	digest, err := vp.client.ManifestDigest(vp.repository, tag)
+func (vp *V2Provider) getDigest(client *registry.Registry, tag string) (string, error) {
+	digest, err := client.ManifestDigest(vp.repository, tag)
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed to get tag %s on repository %s", tag, vp.repository)
 	}
@@ -3,7 +3,9 @@ package ecr
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,8 +13,12 @@ import (
 	"github.com/wish/kcd/stats"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
@@ -20,6 +26,9 @@ import (
 const VersionRegex = `^[0-9a-f]{5,40}$`
 var ecrRule, _ = regexp.Compile("([0-9]*).dkr.ecr.([a-z0-9-]*).amazonaws.com/([a-zA-Z0-9/\\_-]*)")
 
+// maxBatchImageIds is the maximum number of image ids of a single batch request.
+const maxBatchImageIds = 100
+
 // nameAccountRegionFromARN returns the name of the repo, the AWS Account ID and region
 // that the repo belongs to from a given repo ARN.
 func nameAccountRegionFromARN(arn string) (repoName, accountID, region string, err error) {
@@ -30,6 +39,77 @@ func nameAccountRegionFromARN(arn string) (repoName, accountID, region string, e
 	return rs[3], rs[1], rs[2], nil
 }
 
+// ParseRepo returns the name of the repo, the AWS Account ID and region of an ECR
+// image repository, or an error if the image repository is not a valid ECR repository.
+func ParseRepo(imageRepo string) (repoName, accountID, region string, err error) {
+	repoName, accountID, region, err = nameAccountRegionFromARN(imageRepo)
+	if err != nil {
+		return "", "", "", errors.WithStack(err)
+	}
+	if repoName == "" || accountID == "" || region == "" {
+		return "", "", "", errors.Errorf("ecr repo %s must be of the form <account>.dkr.ecr.<region>.amazonaws.com/<name>", imageRepo)
+	}
+	return repoName, accountID, region, nil
+}
+
+// Options contains additional (optional) configuration for the ECR provider.
+type Options struct {
+	// Timeout bounds each operation of the provider, including its retries.
+	Timeout time.Duration
+
+	// MaxRetries is the maximum number of retries of a failed or throttled request.
+	MaxRetries int
+
+	// MinThrottleDelay and MaxThrottleDelay bound the exponential backoff of
+	// throttled requests.
+	MinThrottleDelay, MaxThrottleDelay time.Duration
+
+	// RoleARNs contains the IAM roles assumed to access repositories of other accounts,
+	// keyed by image repository or AWS account ID.
+	RoleARNs map[string]string
+}
+
+// WithTimeout sets the timeout of each operation of the provider.
+func WithTimeout(timeout time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+// WithMaxRetries sets the maximum number of retries of a failed or throttled request.
+func WithMaxRetries(maxRetries int) func(*Options) {
+	return func(opts *Options) {
+		opts.MaxRetries = maxRetries
+	}
+}
+
+// WithThrottleDelay sets the bounds of the backoff of throttled requests.
+func WithThrottleDelay(min, max time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.MinThrottleDelay = min
+		opts.MaxThrottleDelay = max
+	}
+}
+
+// WithAssumeRole assumes the IAM role to access the image repository, or all repositories
+// of the AWS account if key is an account ID.
+func WithAssumeRole(key, roleARN string) func(*Options) {
+	return func(opts *Options) {
+		if opts.RoleARNs == nil {
+			opts.RoleARNs = make(map[string]string)
+		}
+		opts.RoleARNs[key] = roleARN
+	}
+}
+
+// roleARN returns the IAM role to assume for the image repository, if any.
+func (opts *Options) roleARN(imageRepo, accountID string) string {
+	if role, ok := opts.RoleARNs[imageRepo]; ok {
+		return role
+	}
+	return opts.RoleARNs[accountID]
+}
+
 // Provider is responsible to syncing with the ecr repository and
 // ensuring that the deployment it is monitoring is up to date. If it finds
 // the deployment outdated from what Tag is indicating the deployment version should be.
@@ -38,25 +118,32 @@ func nameAccountRegionFromARN(arn string) (repoName, accountID, region string, e
 // In cases, where it cant resolves
 type Provider struct {
 	sess      *session.Session
-	ecr       *ecr.ECR
+	ecr       ecriface.ECRAPI
 	repoName  string
 	accountID string
 
 	vRegex *regexp.Regexp
 
 	stats stats.Stats
+	opts  *Options
 }
 
 // NewECR returns an ECR provider that implements the Registry interface, and used
 // to check an AWS ECR repository and sync deployments periodically.
-func NewECR(imageRepo, versionExp string, stats stats.Stats) (*Provider, error) {
+func NewECR(imageRepo, versionExp string, stats stats.Stats, options ...func(*Options)) (*Provider, error) {
 	vRegex, err := regexp.Compile(versionExp)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	repoName, accountID, region, err := nameAccountRegionFromARN(imageRepo) //kcd.Spec.ImageRepo
-	if err != nil {
-		return nil, errors.WithStack(err)
+
+	opts := &Options{
+		Timeout:          15 * time.Second,
+		MaxRetries:       5,
+		MinThrottleDelay: 500 * time.Millisecond,
+		MaxThrottleDelay: 10 * time.Second,
+	}
+	for _, opt := range options {
+		opt(opts)
 	}
 
 	sess, err := session.NewSession()
@@ -65,16 +152,17 @@ func NewECR(imageRepo, versionExp string, stats stats.Stats) (*Provider, error)
 	}
 
 	ep := &Provider{
-		repoName:  repoName,
-		accountID: accountID,
-		sess:      sess,
-		ecr:       ecr.New(sess, aws.NewConfig().WithRegion(region)),
-
+		sess:   sess,
 		vRegex: vRegex,
 		stats:  stats,
+		opts:   opts,
+	}
+	r, err := ep.RegistryFor(imageRepo) //kcd.Spec.ImageRepo
+	if err != nil {
+		return nil, errors.WithStack(err)
 	}
 
-	return ep, nil
+	return r.(*Provider), nil
 }
 
 // RegistryFor implements the registry.Provider interface.
@@ -84,54 +172,159 @@ func (ep *Provider) RegistryFor(imageRepo string) (registry.Registry, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	cfg := aws.NewConfig().WithRegion(region)
+	cfg = request.WithRetryer(cfg, throttleRetryer{
+		DefaultRetryer:   client.DefaultRetryer{NumMaxRetries: ep.opts.MaxRetries},
+		minThrottleDelay: ep.opts.MinThrottleDelay,
+		maxThrottleDelay: ep.opts.MaxThrottleDelay,
+	})
+	if role := ep.opts.roleARN(imageRepo, accountID); role != "" {
+		glog.V(2).Infof("Assuming role %s for ECR repository %s", role, imageRepo)
+		cfg = cfg.WithCredentials(stscreds.NewCredentials(ep.sess, role))
+	}
+
 	return &Provider{
 		repoName:  repoName,
 		accountID: accountID,
 		sess:      ep.sess,
-		ecr:       ecr.New(ep.sess, aws.NewConfig().WithRegion(region)),
+		ecr:       ecr.New(ep.sess, cfg),
 
 		vRegex: ep.vRegex,
 		stats:  ep.stats,
+		opts:   ep.opts,
 	}, nil
 }
 
-// Version implements the Registry interface.
-func (ep *Provider) Versions(ctx context.Context, tag string) ([]string, error) {
-	// TODO: parameterize timeout
-	var cancel context.CancelFunc
-	ctx, cancel = context.WithTimeout(ctx, time.Second*15)
-	defer cancel()
+// throttleRetryer retries requests like the default retryer of the AWS SDK, but backs
+// off throttled requests exponentially within configurable bounds.
+type throttleRetryer struct {
+	client.DefaultRetryer
+
+	minThrottleDelay, maxThrottleDelay time.Duration
+}
 
-	if glog.V(4) {
-		glog.V(4).Infof("Making ECR DescribeImages request for repository=%s, registry=%s, tag=%s",
-			ep.repoName, ep.accountID, tag)
+// RetryRules implements the request.Retryer interface.
+func (tr throttleRetryer) RetryRules(r *request.Request) time.Duration {
+	if !request.IsErrorThrottle(r.Error) || tr.minThrottleDelay <= 0 {
+		return tr.DefaultRetryer.RetryRules(r)
 	}
 
-	req := &ecr.DescribeImagesInput{
-		ImageIds: []*ecr.ImageIdentifier{
-			{
-				ImageTag: aws.String(tag),
+	delay := tr.minThrottleDelay
+	for i := 0; i < r.RetryCount && delay < tr.maxThrottleDelay; i++ {
+		delay *= 2
+	}
+	// add jitter so that throttled syncers don't retry in lockstep
+	delay += time.Duration(rand.Int63n(int64(tr.minThrottleDelay)))
+	if tr.maxThrottleDelay > 0 && delay > tr.maxThrottleDelay {
+		delay = tr.maxThrottleDelay
+	}
+	glog.V(2).Infof("ECR request %s was throttled, retrying in %v", r.Operation.Name, delay)
+	return delay
+}
+
+// withTimeout returns a context bounded by the timeout of the provider.
+func (ep *Provider) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ep.opts.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, ep.opts.Timeout)
+}
+
+// describeImages returns the details of all images tagged with any of the given tags,
+// most recently pushed first. Tags that aren't found, e.g. because their images have
+// been expired by a lifecycle policy, are ignored.
+func (ep *Provider) describeImages(ctx context.Context, tags ...string) ([]*ecr.ImageDetail, error) {
+	var details []*ecr.ImageDetail
+	for _, tag := range tags {
+		if glog.V(4) {
+			glog.V(4).Infof("Making ECR DescribeImages request for repository=%s, registry=%s, tag=%s",
+				ep.repoName, ep.accountID, tag)
+		}
+
+		req := &ecr.DescribeImagesInput{
+			ImageIds: []*ecr.ImageIdentifier{
+				{
+					ImageTag: aws.String(tag),
+				},
 			},
-		},
+			RegistryId:     aws.String(ep.accountID),
+			RepositoryName: aws.String(ep.repoName),
+		}
+		err := ep.ecr.DescribeImagesPagesWithContext(ctx, req, func(page *ecr.DescribeImagesOutput, lastPage bool) bool {
+			details = append(details, page.ImageDetails...)
+			return true
+		})
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageNotFoundException {
+				glog.V(2).Infof("No image found in ECR repository %s for tag %s", ep.repoName, tag)
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to describe images of tag %s", tag)
+		}
+	}
+
+	sort.SliceStable(details, func(i, j int) bool {
+		return aws.TimeValue(details[i].ImagePushedAt).After(aws.TimeValue(details[j].ImagePushedAt))
+	})
+	return details, nil
+}
+
+// listImageIds returns the identifiers of all images tagged with one of the given tags.
+func (ep *Provider) listImageIds(ctx context.Context, tags ...string) ([]*ecr.ImageIdentifier, error) {
+	wanted := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		wanted[tag] = true
+	}
+
+	req := &ecr.ListImagesInput{
+		Filter:         &ecr.ListImagesFilter{TagStatus: aws.String(ecr.TagStatusTagged)},
 		RegistryId:     aws.String(ep.accountID),
 		RepositoryName: aws.String(ep.repoName),
 	}
-	result, err := ep.ecr.DescribeImagesWithContext(ctx, req)
+	var ids []*ecr.ImageIdentifier
+	err := ep.ecr.ListImagesPagesWithContext(ctx, req, func(page *ecr.ListImagesOutput, lastPage bool) bool {
+		for _, id := range page.ImageIds {
+			if wanted[aws.StringValue(id.ImageTag)] {
+				ids = append(ids, id)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list images of repository %s", ep.repoName)
+	}
+	return ids, nil
+}
+
+// Version implements the Registry interface.
+func (ep *Provider) Versions(ctx context.Context, tag string) ([]string, error) {
+	ctx, cancel := ep.withTimeout(ctx)
+	defer cancel()
+
+	details, err := ep.describeImages(ctx, tag)
 	if err != nil {
 		glog.Errorf("Failed to get ECR: %v", err)
+		ep.stats.IncCount("registry.failure", ep.repoName)
 		return nil, errors.Wrap(err, "failed to get ecr")
 	}
-	if len(result.ImageDetails) != 1 {
-		ep.stats.Event(fmt.Sprintf("registry.%s.sync.failure", ep.repoName),
-			fmt.Sprintf("Failed to sync with ECR for tag %s", tag), "", "error",
-			time.Now().UTC(), tag)
-		return nil, errors.Errorf("Bad state: More than one image was tagged with %s", tag)
+	if len(details) > 1 {
+		glog.V(1).Infof("%d images of ECR repository %s are tagged with %s, using the most recent", len(details), ep.repoName, tag)
 	}
 
-	img := result.ImageDetails[0]
-
-	versions := ep.currentVersions(img)
+	var versions []string
+	seen := map[string]bool{}
+	for _, img := range details {
+		for _, v := range ep.currentVersions(img) {
+			if !seen[v] {
+				seen[v] = true
+				versions = append(versions, v)
+			}
+		}
+	}
 	if len(versions) == 0 {
+		ep.stats.Event(fmt.Sprintf("registry.%s.sync.failure", ep.repoName),
+			fmt.Sprintf("Failed to sync with ECR for tag %s", tag), "", "error",
+			time.Now().UTC(), tag)
 		ep.stats.IncCount("registry.failure", ep.repoName)
 		return nil, errors.Errorf("No version found for tag %s", tag)
 	}
@@ -141,89 +334,102 @@ func (ep *Provider) Versions(ctx context.Context, tag string) ([]string, error)
 	return versions, nil
 }
 
-// Add a list of tags to the image identified with version
+// Add a list of tags to the image identified with version. The image manifest is
+// obtained with a single request and tags the image already has are skipped. ECR has
+// no batch put, so each remaining tag is added with its own PutImage request.
 func (ep *Provider) Add(version string, tags ...string) error {
-	for _, tag := range tags {
-		fmt.Printf("Tags are %s \n", tags)
-		getReq := &ecr.BatchGetImageInput{
-			ImageIds: []*ecr.ImageIdentifier{
-				{
-					ImageTag: aws.String(version),
-				},
+	ctx, cancel := ep.withTimeout(context.Background())
+	defer cancel()
+
+	glog.V(2).Infof("Adding tags %s to version %s of ECR repository %s", strings.Join(tags, ", "), version, ep.repoName)
+
+	getReq := &ecr.BatchGetImageInput{
+		ImageIds: []*ecr.ImageIdentifier{
+			{
+				ImageTag: aws.String(version),
 			},
+		},
+		RegistryId:     aws.String(ep.accountID),
+		RepositoryName: aws.String(ep.repoName),
+	}
+	getRes, err := ep.ecr.BatchGetImageWithContext(ctx, getReq)
+	if err != nil {
+		ep.stats.IncCount("registry.failure", ep.repoName)
+		return errors.Wrapf(err, "failed to get image of version %s", version)
+	}
+	if len(getRes.Images) == 0 {
+		ep.stats.IncCount("registry.failure", ep.repoName)
+		return errors.Errorf("no image found with version %s", version)
+	}
+	img := getRes.Images[0]
+
+	existing, err := ep.tagsOf(ctx, version)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if existing[tag] {
+			glog.V(4).Infof("Image of version %s is already tagged with %s", version, tag)
+			continue
+		}
+
+		putReq := &ecr.PutImageInput{
+			ImageManifest:  img.ImageManifest,
+			ImageTag:       aws.String(tag),
 			RegistryId:     aws.String(ep.accountID),
 			RepositoryName: aws.String(ep.repoName),
 		}
-
-		getRes, err := ep.ecr.BatchGetImage(getReq)
+		_, err = ep.ecr.PutImageWithContext(ctx, putReq)
 		if err != nil {
-			ep.stats.IncCount("registry.failure", ep.repoName)
-			return errors.Wrap(err, fmt.Sprintf("failed to get images of tag %s", tag))
-		}
-
-		for _, img := range getRes.Images {
-			putReq := &ecr.PutImageInput{
-				ImageManifest:  img.ImageManifest,
-				ImageTag:       aws.String(tag),
-				RegistryId:     aws.String(ep.accountID),
-				RepositoryName: aws.String(ep.repoName),
-			}
-
-			_, err = ep.ecr.PutImage(putReq)
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok {
-					switch aerr.Code() {
-					case ecr.ErrCodeImageAlreadyExistsException:
-						continue
-					}
-				}
-				ep.stats.IncCount("registry.failure", ep.repoName)
-				return errors.Wrap(err, fmt.Sprintf("failed to add tag %s to image manifest %s",
-					tag, aws.StringValue(img.ImageManifest)))
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == ecr.ErrCodeImageAlreadyExistsException {
+				continue
 			}
+			ep.stats.IncCount("registry.failure", ep.repoName)
+			return errors.Wrapf(err, "failed to add tag %s to image of version %s", tag, version)
 		}
 	}
 	return nil
 }
 
 // Remove the list of tags from ECR repository such that no image contains these tags.
+// All tagged images are removed with as few batch requests as possible.
 func (ep *Provider) Remove(tags ...string) error {
-	for _, tag := range tags {
-		getReq := &ecr.BatchGetImageInput{
-			ImageIds: []*ecr.ImageIdentifier{
-				{
-					ImageTag: aws.String(tag),
-				},
-			},
+	ctx, cancel := ep.withTimeout(context.Background())
+	defer cancel()
+
+	ids, err := ep.listImageIds(ctx, tags...)
+	if err != nil {
+		ep.stats.IncCount("registry.failure", ep.repoName)
+		return err
+	}
+
+	glog.V(2).Infof("Removing %d tags %s from ECR repository %s", len(ids), strings.Join(tags, ", "), ep.repoName)
+
+	for len(ids) > 0 {
+		batch := ids
+		if len(batch) > maxBatchImageIds {
+			batch = batch[:maxBatchImageIds]
+		}
+		ids = ids[len(batch):]
+
+		delReq := &ecr.BatchDeleteImageInput{
+			ImageIds:       batch,
 			RegistryId:     aws.String(ep.accountID),
 			RepositoryName: aws.String(ep.repoName),
 		}
-
-		getRes, err := ep.ecr.BatchGetImage(getReq)
+		delRes, err := ep.ecr.BatchDeleteImageWithContext(ctx, delReq)
 		if err != nil {
 			ep.stats.IncCount("registry.failure", ep.repoName)
-			return errors.Wrap(err, fmt.Sprintf("failed to get images of tag %s", tag))
+			return errors.Wrapf(err, "failed to perform batch delete of tags %s", strings.Join(tags, ", "))
 		}
-
-		for _, img := range getRes.Images {
-
-			delReq := &ecr.BatchDeleteImageInput{
-				ImageIds: []*ecr.ImageIdentifier{
-					{
-						ImageTag:    aws.String(tag),
-						ImageDigest: img.ImageId.ImageDigest,
-					},
-				},
-				RegistryId:     aws.String(ep.accountID),
-				RepositoryName: aws.String(ep.repoName),
-			}
-
-			_, err = ep.ecr.BatchDeleteImage(delReq)
-			if err != nil {
-				ep.stats.IncCount("registry.failure", ep.repoName)
-				return errors.Wrap(err, fmt.Sprintf("failed to perform batch delete image by tag %s and digest %s",
-					tag, aws.StringValue(img.ImageId.ImageDigest)))
+		for _, f := range delRes.Failures {
+			if aws.StringValue(f.FailureCode) == ecr.ImageFailureCodeImageNotFound {
+				continue
 			}
+			ep.stats.IncCount("registry.failure", ep.repoName)
+			return errors.Errorf("failed to delete tag %s of image %s: %s", aws.StringValue(f.ImageId.ImageTag),
+				aws.StringValue(f.ImageId.ImageDigest), aws.StringValue(f.FailureReason))
 		}
 	}
 	return nil
@@ -231,40 +437,56 @@ func (ep *Provider) Remove(tags ...string) error {
 
 // Get a list of tags a version is currently identified with.
 func (ep *Provider) Get(version string) ([]string, error) {
-	getReq := &ecr.DescribeImagesInput{
-		ImageIds: []*ecr.ImageIdentifier{
-			{
-				ImageTag: aws.String(version),
-			},
-		},
-		RegistryId:     aws.String(ep.accountID),
-		RepositoryName: aws.String(ep.repoName),
-	}
+	ctx, cancel := ep.withTimeout(context.Background())
+	defer cancel()
 
-	getRes, err := ep.ecr.DescribeImages(getReq)
+	existing, err := ep.tagsOf(ctx, version)
 	if err != nil {
-		ep.stats.IncCount("registry.failure", ep.repoName)
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to get images of tag %s", version))
+		return nil, err
+	}
+	if len(existing) == 0 {
+		return nil, errors.Errorf("no image found with version %s", version)
 	}
 
-	if len(getRes.ImageDetails) > 1 {
-		return nil, errors.New("more than one image with version tag was found")
+	tags := make([]string, 0, len(existing))
+	for tag := range existing {
+		tags = append(tags, tag)
 	}
+	sort.Strings(tags)
+	return tags, nil
+}
 
-	return aws.StringValueSlice(getRes.ImageDetails[0].ImageTags), nil
+// PushTime implements the registry.PushTimer interface.
+func (ep *Provider) PushTime(ctx context.Context, version string) (time.Time, error) {
+	ctx, cancel := ep.withTimeout(ctx)
+	defer cancel()
 
+	details, err := ep.describeImages(ctx, version)
+	if err != nil {
+		ep.stats.IncCount("registry.failure", ep.repoName)
+		return time.Time{}, errors.Wrapf(err, "failed to get image of version %s", version)
+	}
+	if len(details) == 0 {
+		return time.Time{}, errors.Errorf("no image found with version %s", version)
+	}
+	return aws.TimeValue(details[0].ImagePushedAt), nil
 }
 
-func (ep *Provider) currentVersion(img *ecr.ImageDetail) string {
-	var tag string
-	for _, t := range aws.StringValueSlice(img.ImageTags) {
+// tagsOf returns the tags of the images tagged with version.
+func (ep *Provider) tagsOf(ctx context.Context, version string) (map[string]bool, error) {
+	details, err := ep.describeImages(ctx, version)
+	if err != nil {
+		ep.stats.IncCount("registry.failure", ep.repoName)
+		return nil, errors.Wrapf(err, "failed to get images of version %s", version)
+	}
 
-		if ep.vRegex.MatchString(t) {
-			tag = t
-			break
+	tags := map[string]bool{}
+	for _, img := range details {
+		for _, tag := range aws.StringValueSlice(img.ImageTags) {
+			tags[tag] = true
 		}
 	}
-	return tag
+	return tags, nil
 }
 
 func (ep *Provider) currentVersions(img *ecr.ImageDetail) []string {
@@ -276,4 +498,4 @@ func (ep *Provider) currentVersions(img *ecr.ImageDetail) []string {
 		}
 	}
 	return tags
-}
\ No newline at end of file
+}
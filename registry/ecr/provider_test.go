@@ -1,7 +1,21 @@
 package ecr
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/wish/kcd/stats"
 )
 
 func TestVersionRegex(t *testing.T) {
@@ -38,3 +52,258 @@ func TestVersionRegex(t *testing.T) {
 	}
 
 }
+
+// mockECR implements the ECR API operations used by the provider from in-memory images.
+type mockECR struct {
+	ecriface.ECRAPI
+
+	// images maps image digests to their tags
+	images map[string][]string
+	// pushed maps image digests to the time they were pushed
+	pushed map[string]time.Time
+	// pageSize is the number of results in each page of paginated responses
+	pageSize int
+
+	batchGetCalls int
+	puts          []string
+	deleteBatches [][]*ecr.ImageIdentifier
+}
+
+func (m *mockECR) digestsOf(tag string) []string {
+	var digests []string
+	for digest, tags := range m.images {
+		for _, t := range tags {
+			if t == tag {
+				digests = append(digests, digest)
+			}
+		}
+	}
+	sort.Strings(digests)
+	return digests
+}
+
+func (m *mockECR) DescribeImagesPagesWithContext(ctx aws.Context, input *ecr.DescribeImagesInput,
+	fn func(*ecr.DescribeImagesOutput, bool) bool, opts ...request.Option) error {
+
+	digests := m.digestsOf(aws.StringValue(input.ImageIds[0].ImageTag))
+	if len(digests) == 0 {
+		return awserr.New(ecr.ErrCodeImageNotFoundException, "image not found", nil)
+	}
+	for i := 0; i < len(digests); i += m.pageSize {
+		page := &ecr.DescribeImagesOutput{}
+		for _, digest := range digests[i:min(i+m.pageSize, len(digests))] {
+			page.ImageDetails = append(page.ImageDetails, &ecr.ImageDetail{
+				ImageDigest:   aws.String(digest),
+				ImageTags:     aws.StringSlice(m.images[digest]),
+				ImagePushedAt: aws.Time(m.pushed[digest]),
+			})
+		}
+		if !fn(page, i+m.pageSize >= len(digests)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockECR) ListImagesPagesWithContext(ctx aws.Context, input *ecr.ListImagesInput,
+	fn func(*ecr.ListImagesOutput, bool) bool, opts ...request.Option) error {
+
+	var ids []*ecr.ImageIdentifier
+	for digest, tags := range m.images {
+		for _, tag := range tags {
+			ids = append(ids, &ecr.ImageIdentifier{ImageDigest: aws.String(digest), ImageTag: aws.String(tag)})
+		}
+	}
+	for i := 0; i < len(ids); i += m.pageSize {
+		if !fn(&ecr.ListImagesOutput{ImageIds: ids[i:min(i+m.pageSize, len(ids))]}, i+m.pageSize >= len(ids)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockECR) BatchGetImageWithContext(ctx aws.Context, input *ecr.BatchGetImageInput,
+	opts ...request.Option) (*ecr.BatchGetImageOutput, error) {
+
+	m.batchGetCalls++
+	out := &ecr.BatchGetImageOutput{}
+	for _, digest := range m.digestsOf(aws.StringValue(input.ImageIds[0].ImageTag)) {
+		out.Images = append(out.Images, &ecr.Image{
+			ImageId:       &ecr.ImageIdentifier{ImageDigest: aws.String(digest)},
+			ImageManifest: aws.String(digest),
+		})
+	}
+	return out, nil
+}
+
+func (m *mockECR) PutImageWithContext(ctx aws.Context, input *ecr.PutImageInput,
+	opts ...request.Option) (*ecr.PutImageOutput, error) {
+
+	tag := aws.StringValue(input.ImageTag)
+	m.puts = append(m.puts, tag)
+	digest := aws.StringValue(input.ImageManifest)
+	m.images[digest] = append(m.images[digest], tag)
+	return &ecr.PutImageOutput{}, nil
+}
+
+func (m *mockECR) BatchDeleteImageWithContext(ctx aws.Context, input *ecr.BatchDeleteImageInput,
+	opts ...request.Option) (*ecr.BatchDeleteImageOutput, error) {
+
+	m.deleteBatches = append(m.deleteBatches, input.ImageIds)
+	for _, id := range input.ImageIds {
+		digest := aws.StringValue(id.ImageDigest)
+		var tags []string
+		for _, tag := range m.images[digest] {
+			if tag != aws.StringValue(id.ImageTag) {
+				tags = append(tags, tag)
+			}
+		}
+		m.images[digest] = tags
+	}
+	return &ecr.BatchDeleteImageOutput{}, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func newTestProvider(m *mockECR) *Provider {
+	return &Provider{
+		ecr:       m,
+		repoName:  "app",
+		accountID: "123456789012",
+		vRegex:    regexp.MustCompile(VersionRegex),
+		stats:     stats.NewFake(),
+		opts:      &Options{Timeout: time.Second},
+	}
+}
+
+func TestVersions(t *testing.T) {
+	now := time.Now()
+	m := &mockECR{
+		images: map[string][]string{
+			"sha256:old": {"aaaaaaa", "prod"},
+			"sha256:new": {"bbbbbbb", "ccccccc", "prod", "latest"},
+			"sha256:dev": {"ddddddd", "dev"},
+		},
+		pushed: map[string]time.Time{
+			"sha256:old": now.Add(-time.Hour),
+			"sha256:new": now,
+		},
+		pageSize: 1,
+	}
+	p := newTestProvider(m)
+
+	// both images tagged with prod are returned over several pages, most recent first
+	versions, err := p.Versions(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"bbbbbbb", "ccccccc", "aaaaaaa"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	// a tag whose image was expired by a lifecycle policy
+	if _, err := p.Versions(context.Background(), "staging"); err == nil {
+		t.Errorf("expected error for a tag without images")
+	}
+}
+
+func TestTagger(t *testing.T) {
+	m := &mockECR{
+		images: map[string][]string{
+			"sha256:a": {"aaaaaaa", "prod"},
+			"sha256:b": {"bbbbbbb", "staging"},
+		},
+		pageSize: 1,
+	}
+	p := newTestProvider(m)
+
+	if err := p.Add("aaaaaaa", "prod", "canary", "stable"); err != nil {
+		t.Fatalf("unexpected error adding tags: %v", err)
+	}
+	if m.batchGetCalls != 1 {
+		t.Errorf("expected a single BatchGetImage request, got %d", m.batchGetCalls)
+	}
+	if expected := []string{"canary", "stable"}; !reflect.DeepEqual(m.puts, expected) {
+		t.Errorf("expected only missing tags %v to be added, got %v", expected, m.puts)
+	}
+
+	tags, err := p.Get("aaaaaaa")
+	if err != nil {
+		t.Fatalf("unexpected error getting tags: %v", err)
+	}
+	if expected := []string{"aaaaaaa", "canary", "prod", "stable"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	if err := p.Remove("canary", "staging"); err != nil {
+		t.Fatalf("unexpected error removing tags: %v", err)
+	}
+	if len(m.deleteBatches) != 1 || len(m.deleteBatches[0]) != 2 {
+		t.Errorf("expected tags to be removed with a single batch request, got %v", m.deleteBatches)
+	}
+	if tags := m.images["sha256:b"]; !reflect.DeepEqual(tags, []string{"bbbbbbb"}) {
+		t.Errorf("expected staging tag to be removed, got %v", tags)
+	}
+
+	if _, err := p.Get("eeeeeee"); err == nil {
+		t.Errorf("expected error getting tags of a missing version")
+	}
+}
+
+func TestRemoveBatches(t *testing.T) {
+	m := &mockECR{images: map[string][]string{}, pageSize: 30}
+	for i := 0; i < 150; i++ {
+		m.images[fmt.Sprintf("sha256:%d", i)] = []string{"old"}
+	}
+	p := newTestProvider(m)
+
+	if err := p.Remove("old"); err != nil {
+		t.Fatalf("unexpected error removing tags: %v", err)
+	}
+	if len(m.deleteBatches) != 2 || len(m.deleteBatches[0]) != maxBatchImageIds || len(m.deleteBatches[1]) != 50 {
+		t.Errorf("expected 150 images to be deleted in batches of %d, got %d batches", maxBatchImageIds, len(m.deleteBatches))
+	}
+}
+
+func TestThrottleRetryer(t *testing.T) {
+	tr := throttleRetryer{
+		DefaultRetryer:   client.DefaultRetryer{NumMaxRetries: 5},
+		minThrottleDelay: 100 * time.Millisecond,
+		maxThrottleDelay: time.Second,
+	}
+
+	for retry, max := range []time.Duration{200 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond, time.Second, time.Second} {
+		r := &request.Request{
+			Operation:  &request.Operation{Name: "DescribeImages"},
+			Error:      awserr.New("ThrottlingException", "rate exceeded", nil),
+			RetryCount: retry,
+		}
+		if delay := tr.RetryRules(r); delay < 100*time.Millisecond || delay > max {
+			t.Errorf("retry %d: expected throttled delay of at most %v, got %v", retry, max, delay)
+		}
+	}
+}
+
+func TestRoleARN(t *testing.T) {
+	opts := &Options{}
+	WithAssumeRole("123456789012", "arn:aws:iam::123456789012:role/account")(opts)
+	WithAssumeRole("123456789012.dkr.ecr.us-east-1.amazonaws.com/app", "arn:aws:iam::123456789012:role/app")(opts)
+
+	testCases := []struct {
+		imageRepo, accountID, expected string
+	}{
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/app", "123456789012", "arn:aws:iam::123456789012:role/app"},
+		{"123456789012.dkr.ecr.us-east-1.amazonaws.com/other", "123456789012", "arn:aws:iam::123456789012:role/account"},
+		{"210987654321.dkr.ecr.us-east-1.amazonaws.com/app", "210987654321", ""},
+	}
+	for _, tc := range testCases {
+		if role := opts.roleARN(tc.imageRepo, tc.accountID); role != tc.expected {
+			t.Errorf("%s: expected role %q, got %q", tc.imageRepo, tc.expected, role)
+		}
+	}
+}
@@ -3,13 +3,24 @@ package registry
 import (
 	"context"
 	"strings"
+	"time"
 )
 
 // ProviderByRepo generates Type based on image ARN
 func ProviderByRepo(repoARN string) string {
+	if strings.HasPrefix(repoARN, "file://") || strings.HasPrefix(repoARN, "oci-layout://") {
+		return "local"
+	}
 	if strings.Contains(repoARN, "amazonaws.com") {
 		return "ecr"
 	}
+	host := strings.SplitN(repoARN, "/", 2)[0]
+	switch {
+	case host == "gcr.io" || strings.HasSuffix(host, ".gcr.io") || strings.HasSuffix(host, "-docker.pkg.dev"):
+		return "gcr"
+	case strings.HasSuffix(host, ".azurecr.io"):
+		return "acr"
+	}
 	return "dockerhub"
 }
 
@@ -27,6 +38,13 @@ type Registry interface {
 	Versions(ctx context.Context, tag string) ([]string, error)
 }
 
+// PushTimer is implemented by registries that know when the image of a version was
+// pushed, which is used to order versions that have no natural order.
+type PushTimer interface {
+	// PushTime returns the time the image tagged with version was pushed.
+	PushTime(ctx context.Context, version string) (time.Time, error)
+}
+
 // Tagger provides capability of adding/removing environment tags on ECR
 // This interface is purely designed for CI/CD purposes such that the version
 // tag ex git SHA is unique on images (images can be uniquely identified by such version tags).
@@ -42,3 +60,24 @@ type Tagger interface {
 	// Get gets the list of tags to the image identified with version
 	Get(version string) ([]string, error)
 }
+
+// Credentials are the username and password used to authenticate to a registry.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+type credentialsKey struct{}
+
+// WithCredentials returns a context with the credentials used by registries for the
+// requests made with it, e.g. credentials of an image pull secret. Registries that
+// can't use them, such as ECR which authenticates with IAM, ignore them.
+func WithCredentials(ctx context.Context, creds Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// CredentialsFromContext returns the credentials of the context, if any.
+func CredentialsFromContext(ctx context.Context) (Credentials, bool) {
+	creds, ok := ctx.Value(credentialsKey{}).(Credentials)
+	return creds, ok
+}
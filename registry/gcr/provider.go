@@ -0,0 +1,324 @@
+package gcr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/distribution"
+	"github.com/wish/kcd/stats"
+)
+
+const (
+	// cloudPlatformScope is the OAuth scope of access tokens used with the registry.
+	cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	// defaultMetadataHost is the host of the metadata server of GCE and GKE.
+	defaultMetadataHost = "metadata.google.internal"
+)
+
+// Options contains additional (optional) configuration for the GCR provider.
+type Options struct {
+	// Timeout bounds each operation of the provider.
+	Timeout time.Duration
+
+	// HTTPClient is used for requests to the registry and to Google token services.
+	HTTPClient *http.Client
+
+	// CredentialsFile is the path of a service account key or a workload identity
+	// federation credential configuration. If empty, access tokens of the service
+	// account of the pod are obtained from the metadata server.
+	CredentialsFile string
+
+	// MetadataHost is the host of the metadata server.
+	MetadataHost string
+}
+
+// WithTimeout sets the timeout of each operation of the provider.
+func WithTimeout(timeout time.Duration) func(*Options) {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+// WithHTTPClient sets the HTTP client of the provider.
+func WithHTTPClient(client *http.Client) func(*Options) {
+	return func(opts *Options) {
+		opts.HTTPClient = client
+	}
+}
+
+// WithCredentialsFile sets the path of the credentials file of the provider.
+func WithCredentialsFile(path string) func(*Options) {
+	return func(opts *Options) {
+		opts.CredentialsFile = path
+	}
+}
+
+// ParseRepo returns the registry host and the repository path of a Google Container
+// Registry or Artifact Registry image repository, or an error if the image repository
+// doesn't belong to either.
+func ParseRepo(imageRepo string) (host, repo string, err error) {
+	host, repo, err = distribution.ParseRepo(imageRepo)
+	if err != nil {
+		return "", "", err
+	}
+	if registry.ProviderByRepo(imageRepo) != "gcr" {
+		return "", "", errors.Errorf("%s is not a Google Container Registry or Artifact Registry host", host)
+	}
+	if !strings.Contains(repo, "/") {
+		return "", "", errors.Errorf("gcr repo %s must be of the form <host>/<project>/<name>", imageRepo)
+	}
+	return host, repo, nil
+}
+
+// NewGCR returns a provider of a Google Container Registry or Artifact Registry image
+// repository.
+func NewGCR(imageRepo, versionExp string, stats stats.Stats, options ...func(*Options)) (*distribution.Provider, error) {
+	opts := &Options{
+		Timeout:         15 * time.Second,
+		HTTPClient:      http.DefaultClient,
+		CredentialsFile: os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"),
+		MetadataHost:    os.Getenv("GCE_METADATA_HOST"),
+	}
+	for _, opt := range options {
+		opt(opts)
+	}
+	if opts.MetadataHost == "" {
+		opts.MetadataHost = defaultMetadataHost
+	}
+
+	return distribution.NewProvider(imageRepo, versionExp, &cloud{opts: opts},
+		distribution.WithStats(stats),
+		distribution.WithTimeout(opts.Timeout),
+		distribution.WithHTTPClient(opts.HTTPClient))
+}
+
+// cloud implements distribution.Cloud for Google registries.
+type cloud struct {
+	opts *Options
+
+	mu          sync.Mutex
+	accessToken string
+	expiry      time.Time
+}
+
+// Credentials implements the distribution.Cloud interface. Service account keys are
+// used as is, while other credentials are exchanged for OAuth access tokens.
+func (c *cloud) Credentials(ctx context.Context, host string) (string, string, error) {
+	if c.opts.CredentialsFile != "" {
+		// the file is read each time as mounted credentials may be rotated
+		data, err := ioutil.ReadFile(c.opts.CredentialsFile)
+		if err != nil {
+			return "", "", errors.Wrap(err, "failed to read credentials file")
+		}
+		var creds credentialsFile
+		if err := json.Unmarshal(data, &creds); err != nil {
+			return "", "", errors.Wrapf(err, "failed to parse credentials file %s", c.opts.CredentialsFile)
+		}
+		switch creds.Type {
+		case "service_account":
+			return "_json_key", string(data), nil
+		case "external_account":
+			token, err := c.token(func() (string, time.Duration, error) {
+				return c.externalAccountToken(ctx, &creds)
+			})
+			return "oauth2accesstoken", token, err
+		default:
+			return "", "", errors.Errorf("unsupported credentials type %q in %s", creds.Type, c.opts.CredentialsFile)
+		}
+	}
+
+	token, err := c.token(func() (string, time.Duration, error) {
+		return c.metadataToken(ctx)
+	})
+	return "oauth2accesstoken", token, err
+}
+
+// token returns the cached access token, or obtains a new one if it is about to expire.
+func (c *cloud) token(obtain func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.accessToken != "" && time.Now().Before(c.expiry) {
+		return c.accessToken, nil
+	}
+	token, expiresIn, err := obtain()
+	if err != nil {
+		return "", err
+	}
+	c.accessToken = token
+	c.expiry = time.Now().Add(expiresIn - time.Minute)
+	return token, nil
+}
+
+// credentialsFile contains the fields of Google credential files used by the provider.
+type credentialsFile struct {
+	Type string `json:"type"`
+
+	// workload identity federation
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url"`
+	CredentialSource               struct {
+		File   string `json:"file"`
+		Format struct {
+			Type                  string `json:"type"`
+			SubjectTokenFieldName string `json:"subject_token_field_name"`
+		} `json:"format"`
+	} `json:"credential_source"`
+}
+
+// externalAccountToken exchanges the subject token mounted in the credential source
+// file for an access token with the security token service, and impersonates the
+// service account if configured.
+func (c *cloud) externalAccountToken(ctx context.Context, creds *credentialsFile) (string, time.Duration, error) {
+	if creds.CredentialSource.File == "" {
+		return "", 0, errors.New("only file credential sources are supported")
+	}
+	data, err := ioutil.ReadFile(creds.CredentialSource.File)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to read subject token")
+	}
+	subjectToken := strings.TrimSpace(string(data))
+	if creds.CredentialSource.Format.Type == "json" {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return "", 0, errors.Wrap(err, "failed to parse subject token")
+		}
+		subjectToken, _ = fields[creds.CredentialSource.Format.SubjectTokenFieldName].(string)
+	}
+	if subjectToken == "" {
+		return "", 0, errors.Errorf("no subject token found in %s", creds.CredentialSource.File)
+	}
+
+	form := url.Values{
+		"grant_type":           {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":             {creds.Audience},
+		"scope":                {cloudPlatformScope},
+		"requested_token_type": {"urn:ietf:params:oauth:token-type:access_token"},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {creds.SubjectTokenType},
+	}
+	req, err := http.NewRequest(http.MethodPost, creds.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to create token exchange request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var sts struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.doJSON(ctx, req, &sts); err != nil {
+		return "", 0, errors.Wrap(err, "failed to exchange subject token")
+	}
+	if creds.ServiceAccountImpersonationURL == "" {
+		return sts.AccessToken, time.Duration(sts.ExpiresIn) * time.Second, nil
+	}
+
+	body, _ := json.Marshal(map[string][]string{"scope": {cloudPlatformScope}})
+	req, err = http.NewRequest(http.MethodPost, creds.ServiceAccountImpersonationURL, bytes.NewReader(body))
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to create impersonation request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+sts.AccessToken)
+	var impersonated struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := c.doJSON(ctx, req, &impersonated); err != nil {
+		return "", 0, errors.Wrap(err, "failed to impersonate service account")
+	}
+	return impersonated.AccessToken, time.Until(impersonated.ExpireTime), nil
+}
+
+// metadataToken obtains an access token of the service account of the pod from the
+// metadata server.
+func (c *cloud) metadataToken(ctx context.Context) (string, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf(
+		"http://%s/computeMetadata/v1/instance/service-accounts/default/token", c.opts.MetadataHost), nil)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to create metadata request")
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := c.doJSON(ctx, req, &token); err != nil {
+		return "", 0, errors.Wrap(err, "failed to obtain access token from metadata server")
+	}
+	return token.AccessToken, time.Duration(token.ExpiresIn) * time.Second, nil
+}
+
+// doJSON sends the request and decodes the JSON response into v.
+func (c *cloud) doJSON(ctx context.Context, req *http.Request, v interface{}) error {
+	resp, err := c.opts.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("%s returned status %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(v))
+}
+
+// TagsOf implements the distribution.Cloud interface with the manifest details that
+// Google registries add to the tag list.
+func (c *cloud) TagsOf(ctx context.Context, client *distribution.Client, repo, digest string) ([]string, error) {
+	var list struct {
+		Manifest map[string]struct {
+			Tag []string `json:"tag"`
+		} `json:"manifest"`
+	}
+	if _, err := client.GetJSON(ctx, fmt.Sprintf("/v2/%s/tags/list", repo), fmt.Sprintf("repository:%s:pull", repo), &list); err != nil {
+		return nil, errors.Wrapf(err, "failed to list tags of %s", repo)
+	}
+	if list.Manifest == nil {
+		return distribution.TagsByDigest(ctx, client, repo, digest)
+	}
+	return list.Manifest[digest].Tag, nil
+}
+
+// PushTime implements the distribution.PushTimer interface with the upload time that
+// Google registries add to the tag list.
+func (c *cloud) PushTime(ctx context.Context, client *distribution.Client, repo, digest string) (time.Time, error) {
+	var list struct {
+		Manifest map[string]struct {
+			TimeUploadedMs string `json:"timeUploadedMs"`
+		} `json:"manifest"`
+	}
+	if _, err := client.GetJSON(ctx, fmt.Sprintf("/v2/%s/tags/list", repo), fmt.Sprintf("repository:%s:pull", repo), &list); err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to list tags of %s", repo)
+	}
+	m, ok := list.Manifest[digest]
+	if !ok {
+		return time.Time{}, errors.Errorf("no upload time of manifest %s of %s", digest, repo)
+	}
+	ms, err := strconv.ParseInt(m.TimeUploadedMs, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "invalid upload time of manifest %s of %s", digest, repo)
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC(), nil
+}
+
+// Untag implements the distribution.Cloud interface. Deleting a manifest by tag only
+// removes the tag.
+func (c *cloud) Untag(ctx context.Context, client *distribution.Client, repo, tag string) error {
+	return client.DeleteManifest(ctx, repo, tag)
+}
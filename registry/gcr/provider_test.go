@@ -0,0 +1,169 @@
+package gcr
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wish/kcd/stats"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestCredentials(t *testing.T) {
+	var stsCalls int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sts":
+			r.ParseForm()
+			if r.Form.Get("subject_token") != "k8s-token" || r.Form.Get("audience") != "//iam.googleapis.com/pool" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			stsCalls++
+			fmt.Fprint(w, `{"access_token":"federated-token","expires_in":3600}`)
+		case "/impersonate":
+			if r.Header.Get("Authorization") != "Bearer federated-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"accessToken":"sa-token","expireTime":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"metadata-token","expires_in":3600}`)
+	}))
+	defer metadata.Close()
+
+	dir, err := ioutil.TempDir("", "kcd-gcr")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := `{"type":"service_account","client_email":"kcd@project.iam.gserviceaccount.com"}`
+	subject := writeFile(t, dir, "token", `{"id_token":"k8s-token"}`)
+	external := fmt.Sprintf(`{"type":"external_account","audience":"//iam.googleapis.com/pool",
+		"subject_token_type":"urn:ietf:params:oauth:token-type:jwt","token_url":"%[1]s/sts",
+		"service_account_impersonation_url":"%[1]s/impersonate",
+		"credential_source":{"file":%[2]q,"format":{"type":"json","subject_token_field_name":"id_token"}}}`, srv.URL, subject)
+
+	tests := []struct {
+		name, file, username, password string
+	}{
+		{"service account key", writeFile(t, dir, "key.json", key), "_json_key", key},
+		{"workload identity federation", writeFile(t, dir, "external.json", external), "oauth2accesstoken", "sa-token"},
+		{"metadata server", "", "oauth2accesstoken", "metadata-token"},
+	}
+	for _, test := range tests {
+		c := &cloud{opts: &Options{
+			HTTPClient:      srv.Client(),
+			CredentialsFile: test.file,
+			MetadataHost:    strings.TrimPrefix(metadata.URL, "http://"),
+		}}
+		// tokens are cached until they expire
+		for i := 0; i < 2; i++ {
+			username, password, err := c.Credentials(context.Background(), "gcr.io")
+			if err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if username != test.username || password != test.password {
+				t.Errorf("%s: expected %s:%s, got %s:%s", test.name, test.username, test.password, username, password)
+			}
+		}
+	}
+	if stsCalls != 1 {
+		t.Errorf("expected a single token exchange, got %d", stsCalls)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	const digest = "sha256:0123"
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/token" {
+			if user, pass, _ := r.BasicAuth(); user != "oauth2accesstoken" || pass != "metadata-token" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, `{"token":"registry-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/v2/token",service="gcr.io"`, r.Host))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/project/app/manifests/prod":
+			w.Header().Set("Docker-Content-Digest", digest)
+		case "/v2/project/app/tags/list":
+			fmt.Fprintf(w, `{"tags":["1111111","2222222","prod","old"],"manifest":{
+				%q:{"tag":["2222222","prod"],"timeUploadedMs":"1600000000000"},"sha256:4567":{"tag":["1111111","old"]}}}`, digest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token":"metadata-token","expires_in":3600}`)
+	}))
+	defer metadata.Close()
+
+	os.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(metadata.URL, "http://"))
+	defer os.Unsetenv("GCE_METADATA_HOST")
+	p, err := NewGCR(strings.TrimPrefix(srv.URL, "https://")+"/project/app", `^[0-9a-f]{7}$`, stats.NewFake(),
+		WithHTTPClient(srv.Client()), WithCredentialsFile(""))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	versions, err := p.Versions(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"2222222"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	pushed, err := p.PushTime(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("failed to get push time: %v", err)
+	}
+	if expected := time.Unix(1600000000, 0); !pushed.Equal(expected) {
+		t.Errorf("expected push time %v, got %v", expected, pushed)
+	}
+}
+
+func TestParseRepo(t *testing.T) {
+	for _, repo := range []string{"gcr.io/project/app", "eu.gcr.io/project/app", "europe-west1-docker.pkg.dev/project/images/app"} {
+		if _, _, err := ParseRepo(repo); err != nil {
+			t.Errorf("%s: unexpected error: %v", repo, err)
+		}
+	}
+	for _, repo := range []string{"gcr.io/app", "docker.io/project/app", "gcr.io/project/app:latest"} {
+		if _, _, err := ParseRepo(repo); err == nil {
+			t.Errorf("%s: expected error", repo)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/stats"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+const (
+	// FilePrefix is the prefix of image repositories backed by a YAML or JSON file that
+	// maps tags to versions, e.g. file:///etc/kcd/versions.yaml.
+	FilePrefix = "file://"
+
+	// OCILayoutPrefix is the prefix of image repositories backed by an OCI image layout
+	// directory, e.g. oci-layout:///var/lib/images/app.
+	OCILayoutPrefix = "oci-layout://"
+
+	// refNameAnnotation is the annotation of index manifests of an OCI image layout that
+	// holds the tag of the manifest.
+	refNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// Provider is a registry backed by the local filesystem, for clusters without access
+// to a registry and for tests. The file or layout is read on every lookup, so changes
+// are picked up without restarting kcd. Provider implements registry.Tagger by
+// rewriting the file or the index of the layout.
+type Provider struct {
+	imageRepo string
+	prefix    string
+	path      string
+	root      string
+	vRegex    *regexp.Regexp
+	stats     stats.Stats
+}
+
+// Options contains the options of the local registry provider.
+type Options struct {
+	// Root is the directory that contains the files and layouts of local image
+	// repositories. Local image repositories are disabled if no root is set.
+	Root string
+}
+
+// WithRoot sets the directory that local image repositories must be in.
+func WithRoot(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.Root = dir
+	}
+}
+
+// ParseRepo returns the prefix and the path of a local image repository.
+func ParseRepo(imageRepo string) (prefix, path string, err error) {
+	for _, prefix := range []string{FilePrefix, OCILayoutPrefix} {
+		if !strings.HasPrefix(imageRepo, prefix) {
+			continue
+		}
+		path := strings.TrimPrefix(imageRepo, prefix)
+		if path == "" || !filepath.IsAbs(path) {
+			return "", "", errors.Errorf("repository %s must have an absolute path, e.g. %s/path", imageRepo, prefix)
+		}
+		return prefix, filepath.Clean(path), nil
+	}
+	return "", "", errors.Errorf("repository %s must start with %s or %s", imageRepo, FilePrefix, OCILayoutPrefix)
+}
+
+// NewLocal returns a registry provider of a file:// or oci-layout:// image repository,
+// which must be within the root directory set by WithRoot.
+func NewLocal(imageRepo, versionExp string, stats stats.Stats, options ...func(*Options)) (*Provider, error) {
+	opts := &Options{}
+	for _, opt := range options {
+		opt(opts)
+	}
+
+	vRegex, err := regexp.Compile(versionExp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Value of versionExp %s is not a valid regular expression", versionExp)
+	}
+	p := &Provider{root: opts.Root, vRegex: vRegex, stats: stats}
+	return p.forRepo(imageRepo)
+}
+
+func (p *Provider) forRepo(imageRepo string) (*Provider, error) {
+	prefix, path, err := ParseRepo(imageRepo)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRoot(p.root, path); err != nil {
+		return nil, errors.Wrapf(err, "repository %s is not allowed", imageRepo)
+	}
+	return &Provider{
+		imageRepo: imageRepo,
+		prefix:    prefix,
+		path:      path,
+		root:      p.root,
+		vRegex:    p.vRegex,
+		stats:     p.stats,
+	}, nil
+}
+
+// checkRoot returns an error if the path isn't within the root directory, also after
+// resolving symlinks, since the repositories are defined by users of the cluster.
+func checkRoot(root, path string) error {
+	if root == "" {
+		return errors.New("local repositories are disabled as no root directory is configured")
+	}
+	root = filepath.Clean(root)
+	if !within(root, path) {
+		return errors.Errorf("%s is outside of the root directory %s", path, root)
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve root directory %s", root)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		// the file may be created by a tags command, its directory must be within the root
+		resolved, err = filepath.EvalSymlinks(filepath.Dir(path))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve %s", path)
+	}
+	if !within(resolvedRoot, resolved) {
+		return errors.Errorf("%s resolves to %s outside of the root directory %s", path, resolved, root)
+	}
+	return nil
+}
+
+// within returns whether the path is the directory dir or within it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// RegistryFor implements the registry.Provider interface.
+func (p *Provider) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return p.forRepo(imageRepo)
+}
+
+// Versions implements the registry.Registry interface. The versions of a file are those
+// listed for the tag, in order. The versions of an OCI image layout are the sorted tags
+// of the manifest tagged with tag. Only versions matching the version pattern are
+// returned.
+func (p *Provider) Versions(ctx context.Context, tag string) ([]string, error) {
+	all, err := p.versionsOf(tag)
+	if err != nil {
+		p.stats.IncCount("registry.failure", p.imageRepo)
+		return nil, errors.Wrapf(err, "failed to get versions of %s", tag)
+	}
+
+	var versions []string
+	for _, v := range all {
+		if p.vRegex.MatchString(v) {
+			versions = append(versions, v)
+		}
+	}
+	if len(versions) == 0 {
+		p.stats.Event(fmt.Sprintf("registry.%s.sync.failure", p.imageRepo),
+			fmt.Sprintf("Failed to sync with %s for tag %s", p.imageRepo, tag), "", "error",
+			time.Now().UTC(), tag)
+		p.stats.IncCount("registry.failure", p.imageRepo)
+		return nil, errors.Errorf("No version found for tag %s", tag)
+	}
+
+	glog.V(2).Infof("Got currentVersions=%s from %s", strings.Join(versions, ", "), p.imageRepo)
+
+	return versions, nil
+}
+
+func (p *Provider) versionsOf(tag string) ([]string, error) {
+	if p.prefix == FilePrefix {
+		tags, err := readTagsFile(p.path)
+		if err != nil {
+			return nil, err
+		}
+		return tags[tag], nil
+	}
+
+	index, err := readIndex(p.path)
+	if err != nil {
+		return nil, err
+	}
+	digest, ok := index.digestOf(tag)
+	if !ok {
+		return nil, nil
+	}
+	return index.tagsOf(digest), nil
+}
+
+// Add adds a list of tags to the image identified with version. Tags of a file are
+// mapped to the version, replacing their previous versions.
+func (p *Provider) Add(version string, tags ...string) error {
+	glog.V(2).Infof("Adding tags %s to version %s of repository %s", strings.Join(tags, ", "), version, p.imageRepo)
+
+	if p.prefix == FilePrefix {
+		file, err := readTagsFile(p.path)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			file[tag] = versionList{version}
+		}
+		return writeJSON(p.path, file)
+	}
+
+	index, err := readIndex(p.path)
+	if err != nil {
+		return err
+	}
+	if err := index.tag(version, tags...); err != nil {
+		return err
+	}
+	return writeJSON(filepath.Join(p.path, "index.json"), index)
+}
+
+// Remove removes the list of tags from the repository. Tags that don't exist are ignored.
+func (p *Provider) Remove(tags ...string) error {
+	glog.V(2).Infof("Removing tags %s from repository %s", strings.Join(tags, ", "), p.imageRepo)
+
+	if p.prefix == FilePrefix {
+		file, err := readTagsFile(p.path)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			delete(file, tag)
+		}
+		return writeJSON(p.path, file)
+	}
+
+	index, err := readIndex(p.path)
+	if err != nil {
+		return err
+	}
+	index.untag(tags...)
+	return writeJSON(filepath.Join(p.path, "index.json"), index)
+}
+
+// Get returns the list of tags of the image identified with version. For a file, these
+// are the tags whose versions include version.
+func (p *Provider) Get(version string) ([]string, error) {
+	if p.prefix == FilePrefix {
+		file, err := readTagsFile(p.path)
+		if err != nil {
+			return nil, err
+		}
+		var tags []string
+		for tag, versions := range file {
+			for _, v := range versions {
+				if v == version {
+					tags = append(tags, tag)
+					break
+				}
+			}
+		}
+		sort.Strings(tags)
+		return tags, nil
+	}
+
+	index, err := readIndex(p.path)
+	if err != nil {
+		return nil, err
+	}
+	digest, ok := index.digestOf(version)
+	if !ok {
+		return nil, errors.Errorf("version %s not found in %s", version, p.imageRepo)
+	}
+	return index.tagsOf(digest), nil
+}
+
+// versionList is a list of versions that may be given as a single version. Numeric
+// versions, e.g. build numbers, are allowed without quotes.
+type versionList []string
+
+func (vl *versionList) UnmarshalJSON(data []byte) error {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(data, &raws); err != nil {
+		raws = []json.RawMessage{data}
+	}
+	versions := make(versionList, 0, len(raws))
+	for _, raw := range raws {
+		var version string
+		if err := json.Unmarshal(raw, &version); err != nil {
+			var number json.Number
+			if err := json.Unmarshal(raw, &number); err != nil {
+				return errors.New("versions must be a version or a list of versions")
+			}
+			version = number.String()
+		}
+		versions = append(versions, version)
+	}
+	*vl = versions
+	return nil
+}
+
+// readTagsFile reads a YAML or JSON file that maps tags to a version or a list of
+// versions, e.g.
+//
+//	prod: 1.2.3
+//	staging: [1.3.0, abc1234]
+func readTagsFile(path string) (map[string]versionList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	data, err = yaml.ToJSON(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	tags := map[string]versionList{}
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return tags, nil
+}
+
+// ociIndex is the index.json of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor   `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    json.RawMessage   `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func readIndex(dir string) (*ociIndex, error) {
+	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); err != nil {
+		return nil, errors.Wrapf(err, "%s is not an OCI image layout", dir)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read index of %s", dir)
+	}
+	var index ociIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse index of %s", dir)
+	}
+	return &index, nil
+}
+
+// digestOf returns the digest of the manifest tagged with tag.
+func (idx *ociIndex) digestOf(tag string) (string, bool) {
+	for _, m := range idx.Manifests {
+		if m.Annotations[refNameAnnotation] == tag {
+			return m.Digest, true
+		}
+	}
+	return "", false
+}
+
+// tagsOf returns the sorted tags of the manifest with the digest.
+func (idx *ociIndex) tagsOf(digest string) []string {
+	var tags []string
+	for _, m := range idx.Manifests {
+		if name := m.Annotations[refNameAnnotation]; name != "" && m.Digest == digest {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// tag adds entries for the tags that reference the manifest tagged with version, moving
+// tags that reference other manifests.
+func (idx *ociIndex) tag(version string, tags ...string) error {
+	var desc *ociDescriptor
+	for i := range idx.Manifests {
+		if idx.Manifests[i].Annotations[refNameAnnotation] == version {
+			desc = &idx.Manifests[i]
+			break
+		}
+	}
+	if desc == nil {
+		return errors.Errorf("version %s not found", version)
+	}
+	tagged := *desc
+	idx.untag(tags...)
+
+	for _, tag := range tags {
+		m := tagged
+		m.Annotations = map[string]string{}
+		for k, v := range tagged.Annotations {
+			m.Annotations[k] = v
+		}
+		m.Annotations[refNameAnnotation] = tag
+		idx.Manifests = append(idx.Manifests, m)
+	}
+	return nil
+}
+
+// untag removes the entries of the tags.
+func (idx *ociIndex) untag(tags ...string) {
+	remove := map[string]bool{}
+	for _, tag := range tags {
+		remove[tag] = true
+	}
+	manifests := idx.Manifests[:0]
+	for _, m := range idx.Manifests {
+		if !remove[m.Annotations[refNameAnnotation]] {
+			manifests = append(manifests, m)
+		}
+	}
+	idx.Manifests = manifests
+}
+
+// writeJSON atomically replaces the file with the JSON encoding of v. YAML files are
+// written as JSON, which is valid YAML.
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s", path)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write %s", path)
+	}
+	if info, err := os.Stat(path); err == nil {
+		if err := os.Chmod(tmp.Name(), info.Mode()); err != nil {
+			return errors.Wrapf(err, "failed to write %s", path)
+		}
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), path), "failed to write %s", path)
+}
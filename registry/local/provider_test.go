@@ -0,0 +1,178 @@
+package local
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wish/kcd/stats"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kcd-local")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir := tempDir(t)
+	path := filepath.Join(dir, "versions.yaml")
+	writeFile(t, path, "prod: abc1234\nstaging: [def5678, latest, 1234]\n")
+
+	p, err := NewLocal(FilePrefix+path, `^[0-9a-f]{4,7}$`, stats.NewFake(), WithRoot(dir))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	versions, err := p.Versions(context.Background(), "staging")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"def5678", "1234"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+	if _, err := p.Versions(context.Background(), "dev"); err == nil || !strings.Contains(err.Error(), "No version found") {
+		t.Errorf("expected no version error, got %v", err)
+	}
+
+	if err := p.Add("def5678", "prod", "canary"); err != nil {
+		t.Fatalf("failed to add tags: %v", err)
+	}
+	if err := p.Remove("staging"); err != nil {
+		t.Fatalf("failed to remove tags: %v", err)
+	}
+	tags, err := p.Get("def5678")
+	if err != nil {
+		t.Fatalf("failed to get tags: %v", err)
+	}
+	if expected := []string{"canary", "prod"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("expected tags %v, got %v", expected, tags)
+	}
+
+	// changes to the file are picked up by lookups
+	writeFile(t, path, `{"prod": "fedcba9"}`)
+	if versions, err := p.Versions(context.Background(), "prod"); err != nil || versions[0] != "fedcba9" {
+		t.Errorf("expected updated version, got %v: %v", versions, err)
+	}
+}
+
+func TestOCILayout(t *testing.T) {
+	dir := tempDir(t)
+	writeFile(t, filepath.Join(dir, "oci-layout"), `{"imageLayoutVersion":"1.0.0"}`)
+	writeFile(t, filepath.Join(dir, "index.json"), `{"schemaVersion":2,"manifests":[
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:aaaa","size":10,
+			"annotations":{"org.opencontainers.image.ref.name":"1111111"}},
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:aaaa","size":10,
+			"annotations":{"org.opencontainers.image.ref.name":"prod"}},
+		{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"sha256:bbbb","size":12,
+			"annotations":{"org.opencontainers.image.ref.name":"2222222"}}]}`)
+
+	p, err := NewLocal(OCILayoutPrefix+dir, `^[0-9a-f]{7}$`, stats.NewFake(), WithRoot(dir))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	versions, err := p.Versions(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"1111111"}; !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected versions %v, got %v", expected, versions)
+	}
+
+	// moving the prod tag to another manifest
+	if err := p.Add("2222222", "prod"); err != nil {
+		t.Fatalf("failed to add tags: %v", err)
+	}
+	if versions, err := p.Versions(context.Background(), "prod"); err != nil || !reflect.DeepEqual(versions, []string{"2222222"}) {
+		t.Errorf("expected prod to reference 2222222, got %v: %v", versions, err)
+	}
+	if tags, err := p.Get("2222222"); err != nil || !reflect.DeepEqual(tags, []string{"2222222", "prod"}) {
+		t.Errorf("unexpected tags %v: %v", tags, err)
+	}
+
+	if err := p.Remove("prod", "missing"); err != nil {
+		t.Fatalf("failed to remove tags: %v", err)
+	}
+	if _, err := p.Versions(context.Background(), "prod"); err == nil {
+		t.Errorf("expected error for removed tag")
+	}
+	if err := p.Add("3333333", "prod"); err == nil {
+		t.Errorf("expected error for missing version")
+	}
+
+	missing, err := NewLocal(OCILayoutPrefix+filepath.Join(dir, "nonexistent"), `.*`, stats.NewFake(), WithRoot(dir))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	if _, err := missing.Versions(context.Background(), "prod"); err == nil {
+		t.Errorf("expected error for missing layout")
+	}
+}
+
+func TestRoot(t *testing.T) {
+	root := tempDir(t)
+	outside := tempDir(t)
+	writeFile(t, filepath.Join(root, "versions.yaml"), "prod: abc1234\n")
+	writeFile(t, filepath.Join(outside, "versions.yaml"), "prod: abc1234\n")
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	if _, err := NewLocal(FilePrefix+filepath.Join(root, "versions.yaml"), `.*`, stats.NewFake(), WithRoot(root)); err != nil {
+		t.Errorf("unexpected error for repository within root: %v", err)
+	}
+	for _, path := range []string{
+		filepath.Join(outside, "versions.yaml"),
+		filepath.Join(root, "..", filepath.Base(outside), "versions.yaml"),
+		filepath.Join(root, "link", "versions.yaml"),
+	} {
+		if _, err := NewLocal(FilePrefix+path, `.*`, stats.NewFake(), WithRoot(root)); err == nil {
+			t.Errorf("%s: expected error for repository outside of root", path)
+		}
+	}
+
+	p, err := NewLocal(FilePrefix+filepath.Join(root, "versions.yaml"), `.*`, stats.NewFake())
+	if err == nil {
+		t.Errorf("expected error without root, got provider %v", p)
+	}
+	p, err = NewLocal(FilePrefix+filepath.Join(root, "versions.yaml"), `.*`, stats.NewFake(), WithRoot(root))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	if _, err := p.RegistryFor(FilePrefix + filepath.Join(outside, "versions.yaml")); err == nil {
+		t.Errorf("expected error for registry outside of root")
+	}
+}
+
+func TestParseRepo(t *testing.T) {
+	tests := []struct {
+		imageRepo, prefix, path string
+		valid                   bool
+	}{
+		{"file:///etc/kcd/versions.yaml", FilePrefix, "/etc/kcd/versions.yaml", true},
+		{"oci-layout:///var/lib/images/app/", OCILayoutPrefix, "/var/lib/images/app", true},
+		{"file://versions.yaml", "", "", false},
+		{"oci-layout://", "", "", false},
+		{"gcr.io/project/app", "", "", false},
+	}
+	for _, test := range tests {
+		prefix, path, err := ParseRepo(test.imageRepo)
+		if (err == nil) != test.valid || prefix != test.prefix || path != test.path {
+			t.Errorf("%s: expected %s %s (valid=%t), got %s %s: %v", test.imageRepo, test.prefix, test.path, test.valid, prefix, path, err)
+		}
+	}
+}
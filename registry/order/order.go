@@ -0,0 +1,215 @@
+package order
+
+import (
+	"context"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/registry"
+)
+
+// Kinds of version orders.
+const (
+	// KindSemver orders versions by semantic version precedence, e.g. 1.2.3 or v1.2.3-rc.1.
+	KindSemver = "semver"
+	// KindBuildNumber orders versions by the number captured by the first capture group
+	// of a pattern, e.g. 1234 of build-1234-abcdef0.
+	KindBuildNumber = "buildNumber"
+	// KindPushTime orders versions by the time their images were pushed to the registry.
+	KindPushTime = "pushTime"
+)
+
+// Validate checks that the version order spec is valid.
+func Validate(spec kcdv1.VersionOrderSpec) error {
+	switch spec.Kind {
+	case KindSemver, KindPushTime:
+		return nil
+	case KindBuildNumber:
+		_, err := buildNumberRegex(spec.Pattern)
+		return err
+	}
+	return errors.Errorf("unknown version order kind %q, expected one of %s, %s or %s",
+		spec.Kind, KindSemver, KindBuildNumber, KindPushTime)
+}
+
+// incomparableError is returned when a version can't be compared since it doesn't follow
+// the version order.
+type incomparableError struct {
+	error
+}
+
+// IsIncomparable returns whether the error is caused by a version that doesn't follow the
+// version order, as opposed to a failure to look up the versions, e.g. their push times.
+func IsIncomparable(err error) bool {
+	_, ok := errors.Cause(err).(incomparableError)
+	return ok
+}
+
+// Compare returns -1 if version a is older than version b, 1 if it is newer and 0 if
+// neither is. The registry is used to look up push times, and must implement
+// registry.PushTimer for the pushTime kind. Versions that don't follow the version order
+// return an error for which IsIncomparable is true.
+func Compare(ctx context.Context, spec kcdv1.VersionOrderSpec, reg registry.Registry, a, b string) (int, error) {
+	if a == b {
+		return 0, nil
+	}
+
+	switch spec.Kind {
+	case KindSemver:
+		va, err := parseSemver(a)
+		if err != nil {
+			return 0, incomparableError{err}
+		}
+		vb, err := parseSemver(b)
+		if err != nil {
+			return 0, incomparableError{err}
+		}
+		return va.compare(vb), nil
+
+	case KindBuildNumber:
+		rx, err := buildNumberRegex(spec.Pattern)
+		if err != nil {
+			return 0, err
+		}
+		na, err := buildNumber(rx, a)
+		if err != nil {
+			return 0, incomparableError{err}
+		}
+		nb, err := buildNumber(rx, b)
+		if err != nil {
+			return 0, incomparableError{err}
+		}
+		return na.Cmp(nb), nil
+
+	case KindPushTime:
+		pt, ok := reg.(registry.PushTimer)
+		if !ok {
+			return 0, errors.New("the registry does not record push times")
+		}
+		ta, err := pt.PushTime(ctx, a)
+		if err != nil {
+			return 0, err
+		}
+		tb, err := pt.PushTime(ctx, b)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case ta.Before(tb):
+			return -1, nil
+		case ta.After(tb):
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, Validate(spec)
+}
+
+func buildNumberRegex(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, errors.Errorf("a pattern is required for version order kind %s", KindBuildNumber)
+	}
+	rx, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid build number pattern %s", pattern)
+	}
+	if rx.NumSubexp() < 1 {
+		return nil, errors.Errorf("build number pattern %s has no capture group", pattern)
+	}
+	return rx, nil
+}
+
+// buildNumber returns the number captured by the first capture group of the pattern.
+func buildNumber(rx *regexp.Regexp, version string) (*big.Int, error) {
+	m := rx.FindStringSubmatch(version)
+	if m == nil {
+		return nil, errors.Errorf("version %s does not match build number pattern %s", version, rx)
+	}
+	n, ok := new(big.Int).SetString(m[1], 10)
+	if !ok {
+		return nil, errors.Errorf("build number %q of version %s is not a number", m[1], version)
+	}
+	return n, nil
+}
+
+// semver is a semantic version. Build metadata is ignored, as it doesn't affect precedence.
+type semver struct {
+	numbers    [3]*big.Int
+	prerelease []string
+}
+
+var semverRule = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+	`(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+[0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*)?$`)
+
+func parseSemver(version string) (*semver, error) {
+	m := semverRule.FindStringSubmatch(version)
+	if m == nil {
+		return nil, errors.Errorf("version %s is not a semantic version", version)
+	}
+	v := &semver{}
+	for i := range v.numbers {
+		v.numbers[i], _ = new(big.Int).SetString(m[i+1], 10)
+	}
+	if m[4] != "" {
+		v.prerelease = strings.Split(m[4], ".")
+	}
+	return v, nil
+}
+
+// compare compares semantic versions by precedence, see https://semver.org/#spec-item-11.
+func (v *semver) compare(o *semver) int {
+	for i := range v.numbers {
+		if c := v.numbers[i].Cmp(o.numbers[i]); c != 0 {
+			return c
+		}
+	}
+
+	// a pre-release version has lower precedence than the release
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := compareIdentifiers(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.prerelease) < len(o.prerelease):
+		return -1
+	case len(v.prerelease) > len(o.prerelease):
+		return 1
+	}
+	return 0
+}
+
+// compareIdentifiers compares pre-release identifiers. Numeric identifiers are compared
+// numerically and have lower precedence than alphanumeric ones.
+func compareIdentifiers(a, b string) int {
+	na, errA := strconv.ParseUint(a, 10, 64)
+	nb, errB := strconv.ParseUint(b, 10, 64)
+	switch {
+	case errA == nil && errB == nil:
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
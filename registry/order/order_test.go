@@ -0,0 +1,105 @@
+package order
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+)
+
+type fakeRegistry map[string]time.Time
+
+func (r fakeRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (r fakeRegistry) PushTime(ctx context.Context, version string) (time.Time, error) {
+	t, ok := r[version]
+	if !ok {
+		return time.Time{}, errors.Errorf("version %s not found", version)
+	}
+	return t, nil
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	reg := fakeRegistry{"abcdef0": now.Add(-time.Hour), "1234567": now}
+
+	semver := kcdv1.VersionOrderSpec{Kind: KindSemver}
+	build := kcdv1.VersionOrderSpec{Kind: KindBuildNumber, Pattern: `^build-([0-9]+)-`}
+	pushTime := kcdv1.VersionOrderSpec{Kind: KindPushTime}
+
+	tests := []struct {
+		spec     kcdv1.VersionOrderSpec
+		a, b     string
+		expected int
+	}{
+		{semver, "1.2.3", "1.2.3", 0},
+		{semver, "1.2.3", "1.10.0", -1},
+		{semver, "v2.0.0", "1.99.99", 1},
+		{semver, "1.0.0-rc.1", "1.0.0", -1},
+		{semver, "1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{semver, "1.0.0-alpha.beta", "1.0.0-alpha.1", 1},
+		{semver, "1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{semver, "1.0.0+build.1", "1.0.0+build.2", 0},
+		{build, "build-99-abcdef0", "build-100-1234567", -1},
+		{build, "build-100-abcdef0", "build-100-1234567", 0},
+		{pushTime, "abcdef0", "1234567", -1},
+		{pushTime, "1234567", "abcdef0", 1},
+	}
+	for _, test := range tests {
+		c, err := Compare(context.Background(), test.spec, reg, test.a, test.b)
+		if err != nil {
+			t.Errorf("%s %s %s: unexpected error: %v", test.spec.Kind, test.a, test.b, err)
+			continue
+		}
+		if c != test.expected {
+			t.Errorf("%s: expected %s compared to %s to be %d, got %d", test.spec.Kind, test.a, test.b, test.expected, c)
+		}
+	}
+
+	for _, test := range []struct {
+		spec         kcdv1.VersionOrderSpec
+		a, b         string
+		incomparable bool
+	}{
+		{semver, "1.2", "1.2.3", true},
+		{semver, "abcdef0", "1.2.3", true},
+		{build, "latest", "build-1-abcdef0", true},
+		{pushTime, "missing", "abcdef0", false},
+		{kcdv1.VersionOrderSpec{Kind: "alphabetical"}, "a", "b", false},
+	} {
+		_, err := Compare(context.Background(), test.spec, reg, test.a, test.b)
+		if err == nil {
+			t.Errorf("%s: expected error comparing %s and %s", test.spec.Kind, test.a, test.b)
+			continue
+		}
+		if IsIncomparable(err) != test.incomparable {
+			t.Errorf("%s: expected incomparable %t comparing %s and %s, got %v", test.spec.Kind, test.incomparable, test.a, test.b, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, spec := range []kcdv1.VersionOrderSpec{
+		{Kind: KindSemver},
+		{Kind: KindPushTime},
+		{Kind: KindBuildNumber, Pattern: `^([0-9]+)$`},
+	} {
+		if err := Validate(spec); err != nil {
+			t.Errorf("%v: unexpected error: %v", spec, err)
+		}
+	}
+	for _, spec := range []kcdv1.VersionOrderSpec{
+		{Kind: ""},
+		{Kind: KindBuildNumber},
+		{Kind: KindBuildNumber, Pattern: `^[0-9]+$`},
+		{Kind: KindBuildNumber, Pattern: `^([0-9]+$`},
+	} {
+		if err := Validate(spec); err == nil {
+			t.Errorf("%v: expected error", spec)
+		}
+	}
+}
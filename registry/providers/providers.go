@@ -0,0 +1,112 @@
+// Package providers creates the registry provider of an image repository, so that the
+// syncers, the webhook and the API all resolve versions the same way.
+package providers
+
+import (
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/acr"
+	"github.com/wish/kcd/registry/cache"
+	"github.com/wish/kcd/registry/dockerhub"
+	"github.com/wish/kcd/registry/ecr"
+	"github.com/wish/kcd/registry/gcr"
+	"github.com/wish/kcd/registry/local"
+	"github.com/wish/kcd/stats"
+)
+
+// Options contains the options of the registry providers.
+type Options struct {
+	ECR []func(*ecr.Options)
+
+	// LocalRoot is the directory local registries must be in. Local registries are
+	// disabled if not set.
+	LocalRoot string
+}
+
+// DefaultOptions are applied to all providers before the options given to New and
+// NewProvider. They are configured from flags when the process starts.
+var DefaultOptions []func(*Options)
+
+// WithECROptions sets the options of ECR providers.
+func WithECROptions(options ...func(*ecr.Options)) func(*Options) {
+	return func(opts *Options) {
+		opts.ECR = append(opts.ECR, options...)
+	}
+}
+
+// WithLocalRoot sets the directory local registries must be in.
+func WithLocalRoot(dir string) func(*Options) {
+	return func(opts *Options) {
+		opts.LocalRoot = dir
+	}
+}
+
+// New returns the provider of the registry the image repository belongs to.
+func New(imageRepo, versionExp string, stats stats.Stats, options ...func(*Options)) (registry.Provider, error) {
+	opts := &Options{}
+	for _, opt := range append(append([]func(*Options){}, DefaultOptions...), options...) {
+		opt(opts)
+	}
+
+	switch registry.ProviderByRepo(imageRepo) {
+	case "ecr":
+		return ecr.NewECR(imageRepo, versionExp, stats, opts.ECR...)
+	case "gcr":
+		return gcr.NewGCR(imageRepo, versionExp, stats)
+	case "acr":
+		return acr.NewACR(imageRepo, versionExp, stats)
+	case "local":
+		return local.NewLocal(imageRepo, versionExp, stats, local.WithRoot(opts.LocalRoot))
+	default:
+		return dockerhub.NewDHV2(imageRepo, versionExp, dockerhub.WithStats(stats))
+	}
+}
+
+// NewProvider returns the registry provider used to resolve the versions of the KCD
+// resource, wrapped by the shared version cache. Use Source to get the registry of the
+// KCD resource from the provider.
+func NewProvider(kcd *kcd1.KCD, stats stats.Stats, options ...func(*Options)) (registry.Provider, error) {
+	versionExp := VersionSyntax(kcd)
+	provider, err := New(Source(kcd), versionExp, stats, options...)
+	if err != nil {
+		return nil, err
+	}
+	return cache.Default.Wrap(provider, versionExp), nil
+}
+
+// Source returns the repository the versions of the KCD resource are looked up in,
+// which is the registry source if set and the image repository otherwise.
+func Source(kcd *kcd1.KCD) string {
+	if kcd.Spec.RegistrySource != "" {
+		return kcd.Spec.RegistrySource
+	}
+	return kcd.Spec.ImageRepo
+}
+
+// VersionSyntax returns the version syntax of the KCD resource, which defaults to the
+// syntax of git commit hashes.
+func VersionSyntax(kcd *kcd1.KCD) string {
+	if kcd.Spec.VersionSyntax != "" {
+		return kcd.Spec.VersionSyntax
+	}
+	return ecr.VersionRegex
+}
+
+// ParseRepo checks that the image repository can be parsed by the registry provider it
+// belongs to.
+func ParseRepo(imageRepo string) error {
+	var err error
+	switch registry.ProviderByRepo(imageRepo) {
+	case "ecr":
+		_, _, _, err = ecr.ParseRepo(imageRepo)
+	case "gcr":
+		_, _, err = gcr.ParseRepo(imageRepo)
+	case "acr":
+		_, _, err = acr.ParseRepo(imageRepo)
+	case "local":
+		_, _, err = local.ParseRepo(imageRepo)
+	default:
+		err = dockerhub.ParseRepo(imageRepo)
+	}
+	return err
+}
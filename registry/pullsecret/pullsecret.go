@@ -0,0 +1,178 @@
+package pullsecret
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const dockerHubHost = "docker.io"
+
+// Keyring contains registry credentials keyed by registry host, optionally followed
+// by a repository path prefix, e.g. gcr.io or gcr.io/project.
+type Keyring map[string]registry.Credentials
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// Parse returns the credentials of a docker config secret, of type
+// kubernetes.io/dockerconfigjson or the legacy kubernetes.io/dockercfg.
+func Parse(secret *corev1.Secret) (Keyring, error) {
+	var entries map[string]dockerConfigEntry
+	if data, ok := secret.Data[corev1.DockerConfigJsonKey]; ok {
+		var config struct {
+			Auths map[string]dockerConfigEntry `json:"auths"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s of secret %s", corev1.DockerConfigJsonKey, secret.Name)
+		}
+		entries = config.Auths
+	} else if data, ok := secret.Data[corev1.DockerConfigKey]; ok {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse %s of secret %s", corev1.DockerConfigKey, secret.Name)
+		}
+	} else {
+		return nil, errors.Errorf("secret %s is not a docker config secret", secret.Name)
+	}
+
+	keyring := Keyring{}
+	for server, entry := range entries {
+		creds := registry.Credentials{Username: entry.Username, Password: entry.Password}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid auth of %s in secret %s", server, secret.Name)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid auth of %s in secret %s, expected <username>:<password>", server, secret.Name)
+			}
+			creds = registry.Credentials{Username: parts[0], Password: parts[1]}
+		}
+		keyring[normalizeServer(server)] = creds
+	}
+	return keyring, nil
+}
+
+// Lookup returns the credentials of the image repository. If several entries match,
+// the one with the longest repository path prefix is used.
+func (k Keyring) Lookup(imageRepo string) (registry.Credentials, bool) {
+	repo := normalizeRepo(imageRepo)
+	var match string
+	for key := range k {
+		if (repo == key || strings.HasPrefix(repo, key+"/")) && len(key) > len(match) {
+			match = key
+		}
+	}
+	if match == "" {
+		return registry.Credentials{}, false
+	}
+	return k[match], true
+}
+
+// Credentials returns the credentials of the image repository from the first of the
+// named docker config secrets of the namespace that has credentials of it. Missing
+// secrets are skipped, as they are by the kubelet.
+func Credentials(ctx context.Context, cs kubernetes.Interface, namespace, imageRepo string, secretNames []string) (registry.Credentials, bool, error) {
+	for _, name := range secretNames {
+		secret, err := cs.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if k8serr.IsNotFound(err) {
+			glog.Warningf("Image pull secret %s/%s not found", namespace, name)
+			continue
+		}
+		if err != nil {
+			return registry.Credentials{}, false, errors.Wrapf(err, "failed to get secret %s/%s", namespace, name)
+		}
+		keyring, err := Parse(secret)
+		if err != nil {
+			return registry.Credentials{}, false, err
+		}
+		if creds, ok := keyring.Lookup(imageRepo); ok {
+			glog.V(4).Infof("Using credentials of secret %s/%s for %s", namespace, name, imageRepo)
+			return creds, true, nil
+		}
+	}
+	return registry.Credentials{}, false, nil
+}
+
+// WithCredentials returns a context with the credentials of the image repository used for
+// registry lookups of a KCD resource in the namespace. The credentials are taken from the
+// secret referenced by secretRef if defined, otherwise from the imagePullSecrets of the
+// pod specs of its workloads. The context is returned unchanged if no secret has credentials
+// for the repository, in which case registries use their own credentials.
+func WithCredentials(ctx context.Context, cs kubernetes.Interface, namespace, imageRepo string,
+	secretRef *corev1.LocalObjectReference, podSpecs []corev1.PodSpec) (context.Context, error) {
+
+	var names []string
+	if secretRef != nil {
+		names = []string{secretRef.Name}
+	} else {
+		seen := map[string]bool{}
+		for _, podSpec := range podSpecs {
+			for _, ref := range podSpec.ImagePullSecrets {
+				if ref.Name != "" && !seen[ref.Name] {
+					seen[ref.Name] = true
+					names = append(names, ref.Name)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return ctx, nil
+	}
+
+	creds, ok, err := Credentials(ctx, cs, namespace, imageRepo, names)
+	if err != nil {
+		return ctx, err
+	}
+	if !ok {
+		if secretRef != nil {
+			return ctx, errors.Errorf("registry secret %s does not exist or has no credentials for %s", names[0], imageRepo)
+		}
+		glog.V(4).Infof("No image pull secret in namespace %s has credentials for %s", namespace, imageRepo)
+		return ctx, nil
+	}
+	return registry.WithCredentials(ctx, creds), nil
+}
+
+// normalizeServer returns the host and path of a docker config server, which may be a
+// URL, e.g. https://index.docker.io/v1/.
+func normalizeServer(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server = strings.TrimSuffix(server, "/")
+	host, path := server, ""
+	if i := strings.Index(server, "/"); i >= 0 {
+		host, path = server[:i], server[i:]
+	}
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", dockerHubHost:
+		// the path of docker hub servers is the API version
+		return dockerHubHost
+	}
+	if path == "/v1" || path == "/v2" {
+		path = ""
+	}
+	return host + path
+}
+
+// normalizeRepo returns the image repository with its registry host, which is docker
+// hub for repositories without a host.
+func normalizeRepo(imageRepo string) string {
+	parts := strings.SplitN(imageRepo, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return normalizeServer(imageRepo)
+	}
+	return dockerHubHost + "/" + imageRepo
+}
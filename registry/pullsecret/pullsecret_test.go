@@ -0,0 +1,115 @@
+package pullsecret
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/wish/kcd/registry"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func dockerConfigSecret(name, key, data string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Data:       map[string][]byte{key: []byte(data)},
+	}
+}
+
+func TestLookup(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("hub-user:hub-pass"))
+	keyring, err := Parse(dockerConfigSecret("creds", corev1.DockerConfigJsonKey, `{"auths":{
+		"https://index.docker.io/v1/":{"auth":"`+auth+`"},
+		"gcr.io":{"username":"_json_key","password":"key"},
+		"gcr.io/team":{"username":"_json_key","password":"team-key"},
+		"https://registry.example.com:5000/v2/":{"username":"example","password":"secret"}}}`))
+	if err != nil {
+		t.Fatalf("failed to parse secret: %v", err)
+	}
+
+	tests := []struct {
+		imageRepo string
+		expected  registry.Credentials
+		found     bool
+	}{
+		{"wish/kcd", registry.Credentials{Username: "hub-user", Password: "hub-pass"}, true},
+		{"docker.io/library/nginx", registry.Credentials{Username: "hub-user", Password: "hub-pass"}, true},
+		{"gcr.io/project/app", registry.Credentials{Username: "_json_key", Password: "key"}, true},
+		{"gcr.io/team/app", registry.Credentials{Username: "_json_key", Password: "team-key"}, true},
+		{"gcr.io/teamother/app", registry.Credentials{Username: "_json_key", Password: "key"}, true},
+		{"registry.example.com:5000/app", registry.Credentials{Username: "example", Password: "secret"}, true},
+		{"registry.example.com/app", registry.Credentials{}, false},
+		{"eu.gcr.io/project/app", registry.Credentials{}, false},
+	}
+	for _, test := range tests {
+		creds, ok := keyring.Lookup(test.imageRepo)
+		if ok != test.found || creds != test.expected {
+			t.Errorf("%s: expected %v (%t), got %v (%t)", test.imageRepo, test.expected, test.found, creds, ok)
+		}
+	}
+
+	legacy, err := Parse(dockerConfigSecret("legacy", corev1.DockerConfigKey, `{"quay.io":{"auth":"`+
+		base64.StdEncoding.EncodeToString([]byte("robot:token"))+`"}}`))
+	if err != nil {
+		t.Fatalf("failed to parse legacy secret: %v", err)
+	}
+	if creds, ok := legacy.Lookup("quay.io/team/app"); !ok || creds.Username != "robot" || creds.Password != "token" {
+		t.Errorf("unexpected credentials of legacy secret: %v", creds)
+	}
+
+	if _, err := Parse(dockerConfigSecret("opaque", "password", "secret")); err == nil {
+		t.Errorf("expected error for secret without docker config")
+	}
+	if _, err := Parse(dockerConfigSecret("invalid", corev1.DockerConfigJsonKey, `{"auths":{"gcr.io":{"auth":"invalid"}}}`)); err == nil {
+		t.Errorf("expected error for invalid auth")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	cs := fake.NewSimpleClientset(
+		dockerConfigSecret("hub", corev1.DockerConfigJsonKey, `{"auths":{"docker.io":{"username":"hub","password":"pass"}}}`),
+		dockerConfigSecret("gcr", corev1.DockerConfigJsonKey, `{"auths":{"gcr.io":{"username":"_json_key","password":"key"}}}`),
+	)
+
+	creds, ok, err := Credentials(context.Background(), cs, "default", "gcr.io/project/app", []string{"missing", "hub", "gcr"})
+	if err != nil || !ok {
+		t.Fatalf("expected credentials, got %t: %v", ok, err)
+	}
+	if creds.Password != "key" {
+		t.Errorf("expected credentials of gcr secret, got %v", creds)
+	}
+
+	if _, ok, err := Credentials(context.Background(), cs, "default", "quay.io/team/app", []string{"hub", "gcr"}); ok || err != nil {
+		t.Errorf("expected no credentials, got %t: %v", ok, err)
+	}
+}
+
+func TestWithCredentials(t *testing.T) {
+	cs := fake.NewSimpleClientset(
+		dockerConfigSecret("hub", corev1.DockerConfigJsonKey, `{"auths":{"docker.io":{"username":"hub","password":"pass"}}}`),
+		dockerConfigSecret("gcr", corev1.DockerConfigJsonKey, `{"auths":{"gcr.io":{"username":"_json_key","password":"key"}}}`),
+	)
+	podSpecs := []corev1.PodSpec{
+		{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}}},
+		{ImagePullSecrets: []corev1.LocalObjectReference{{Name: "hub"}, {Name: "gcr"}}},
+	}
+
+	ctx, err := WithCredentials(context.Background(), cs, "default", "gcr.io/project/app", nil, podSpecs)
+	if creds, ok := registry.CredentialsFromContext(ctx); err != nil || !ok || creds.Password != "key" {
+		t.Errorf("expected credentials of image pull secret gcr, got %v: %v", creds, err)
+	}
+
+	// the secret ref takes precedence over image pull secrets
+	ctx, err = WithCredentials(context.Background(), cs, "default", "gcr.io/project/app",
+		&corev1.LocalObjectReference{Name: "hub"}, podSpecs)
+	if err == nil {
+		t.Errorf("expected error for secret ref without credentials of the repository")
+	}
+
+	ctx, err = WithCredentials(context.Background(), cs, "default", "quay.io/team/app", nil, podSpecs)
+	if _, ok := registry.CredentialsFromContext(ctx); ok || err != nil {
+		t.Errorf("expected no credentials, got %t: %v", ok, err)
+	}
+}
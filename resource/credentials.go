@@ -0,0 +1,33 @@
+package resource
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/registry/pullsecret"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// withRegistryCredentials returns a context with the credentials of the image repository
+// source used for registry lookups, as defined by pullsecret.WithCredentials. The pod
+// specs of the workloads are only obtained if the KCD resource has no registrySecretRef.
+func (s *Syncer) withRegistryCredentials(ctx context.Context) (context.Context, error) {
+	var podSpecs []corev1.PodSpec
+	if s.kcd.Spec.RegistrySecretRef == nil {
+		workloads, err := s.workloadProvider.Workloads(s.kcd)
+		if err != nil {
+			return ctx, errors.Wrapf(err, "failed to obtain workloads for kcd=%s", s.kcd.Name)
+		}
+		for _, wl := range workloads {
+			podSpecs = append(podSpecs, wl.PodSpec())
+		}
+	}
+
+	ctx, err := pullsecret.WithCredentials(ctx, s.workloadProvider.Client(), s.kcd.Namespace,
+		providers.Source(s.kcd), s.kcd.Spec.RegistrySecretRef, podSpecs)
+	if err != nil {
+		return ctx, errors.Wrapf(err, "failed to read registry credentials for kcd=%s", s.kcd.Name)
+	}
+	return ctx, nil
+}
@@ -0,0 +1,45 @@
+package resource
+
+import (
+	"context"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/events"
+	"github.com/wish/kcd/registry/order"
+)
+
+// downgradeBlocked returns whether the rollout of the version must be blocked since it
+// is older than the last successful version, according to the version order of the KCD
+// resource. Downgrades are allowed if AllowDowngrade is set and when the version is
+// pinned via the version override or has been approved. Versions that don't follow the
+// version order can't be compared and aren't considered downgrades, which is recorded as
+// an event. Other errors, e.g. failures to look up push times, are returned so that the
+// rollout isn't started.
+func (s *Syncer) downgradeBlocked(ctx context.Context, version string) (bool, string, error) {
+	spec := s.kcd.Spec
+	prevVersion := s.kcd.Status.SuccessVersion
+	if spec.VersionOrder == nil || spec.AllowDowngrade || spec.VersionOverride != "" ||
+		spec.ApprovedVersion == version || prevVersion == "" || prevVersion == version {
+		return false, prevVersion, nil
+	}
+
+	ctx, err := s.withRegistryCredentials(ctx)
+	if err != nil {
+		return false, prevVersion, err
+	}
+	c, err := order.Compare(ctx, *spec.VersionOrder, s.registry, version, prevVersion)
+	if err != nil && !order.IsIncomparable(err) {
+		// the rollout stays blocked while the versions can't be looked up
+		return false, prevVersion, errors.Wrapf(err, "failed to compare version %s with version %s", version, prevVersion)
+	}
+	if err != nil {
+		glog.Warningf("Failed to compare version %s of kcd=%s with version %s, not treating it as a downgrade: %v",
+			version, s.kcd.Name, prevVersion, err)
+		s.options.Stats.IncCount("kcdsync.downgrade.incomparable", s.kcd.Name)
+		s.options.Recorder.Eventf(events.Warning, "KCDVersionsIncomparable",
+			"Version %s can't be compared with version %s, rolling it out: %v", version, prevVersion, err)
+		return false, prevVersion, nil
+	}
+	return c < 0, prevVersion, nil
+}
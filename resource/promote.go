@@ -0,0 +1,89 @@
+package resource
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/events"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/state"
+)
+
+// PromotableVersion returns the version of the source KCD that can be promoted at the
+// given time. A version is promotable once the source KCD has reported it as its
+// SuccessVersion for at least the soak duration.
+// Returns false if no version is ready for promotion.
+func PromotableVersion(src *kcd1.KCD, soak time.Duration, now time.Time) (string, bool) {
+	if src.Status.SuccessVersion == "" {
+		return "", false
+	}
+	if soak > 0 {
+		if src.Status.SuccessTime.IsZero() {
+			return "", false
+		}
+		if now.Sub(src.Status.SuccessTime.Time) < soak {
+			return "", false
+		}
+	}
+	return src.Status.SuccessVersion, true
+}
+
+// promotedVersions returns the versions to roll out for a KCD that promotes versions
+// from another KCD resource. Returns no versions if the source KCD does not have a
+// version that is ready for promotion.
+func (s *Syncer) promotedVersions() ([]string, error) {
+	pf := s.kcd.Spec.PromoteFrom
+
+	namespace := pf.Namespace
+	if namespace == "" {
+		namespace = s.kcd.Namespace
+	}
+	if namespace == s.kcd.Namespace && pf.Name == s.kcd.Name {
+		return nil, state.NewFailed("kcd %s cannot promote versions from itself", s.kcd.Name)
+	}
+
+	src, err := s.resourceProvider.KCD(namespace, pf.Name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain source KCD %s/%s for promotion", namespace, pf.Name)
+	}
+
+	soak := time.Duration(pf.SoakSeconds) * time.Second
+	version, ok := PromotableVersion(src, soak, time.Now().UTC())
+	if !ok {
+		glog.V(2).Infof("No version of kcd=%s/%s ready for promotion to kcd=%s: successVersion=%s, successTime=%v, soak=%v",
+			namespace, pf.Name, s.kcd.Name, src.Status.SuccessVersion, src.Status.SuccessTime, soak)
+		return nil, nil
+	}
+
+	glog.V(4).Infof("Promoting version %s from kcd=%s/%s to kcd=%s", version, namespace, pf.Name, s.kcd.Name)
+	return []string{version}, nil
+}
+
+// updatePromotedTag tags the promoted version with the KCD's tag in the registry, if
+// configured, so that the registry reflects the promotion.
+func (s *Syncer) updatePromotedTag(version string, next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		pf := s.kcd.Spec.PromoteFrom
+		if pf == nil || !pf.UpdateTag || s.kcd.Spec.Tag == "" {
+			return state.Single(next)
+		}
+
+		tagger, ok := s.registry.(registry.Tagger)
+		if !ok {
+			glog.Errorf("Registry for kcd=%s does not support tagging promoted versions", s.kcd.Name)
+			return state.Single(next)
+		}
+
+		glog.V(2).Infof("Tagging promoted version %s with tag %s for kcd=%s", version, s.kcd.Spec.Tag, s.kcd.Name)
+
+		if err := tagger.Add(version, s.kcd.Spec.Tag); err != nil {
+			glog.Errorf("Failed to tag promoted version %s with %s for kcd=%s: %v", version, s.kcd.Spec.Tag, s.kcd.Name, err)
+			s.options.Recorder.Event(events.Warning, "PromotionTagFailed", "Failed to tag promoted version in registry")
+		}
+
+		return state.Single(next)
+	}
+}
@@ -0,0 +1,122 @@
+package resource
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdfake "github.com/wish/kcd/gok8s/client/clientset/versioned/fake"
+	"github.com/wish/kcd/state"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPromotableVersion(t *testing.T) {
+	now := time.Now().UTC()
+	succeeded := func(version string, ago time.Duration) *kcd1.KCD {
+		kcd := &kcd1.KCD{Status: kcd1.KCDStatus{SuccessVersion: version}}
+		if ago >= 0 {
+			kcd.Status.SuccessTime = metav1.NewTime(now.Add(-ago))
+		}
+		return kcd
+	}
+
+	for _, tc := range []struct {
+		name     string
+		src      *kcd1.KCD
+		soak     time.Duration
+		version  string
+		expected bool
+	}{
+		{"no successful version", succeeded("", time.Hour), 0, "", false},
+		{"no soak", succeeded("abc1234", 0), 0, "abc1234", true},
+		{"no soak without success time", succeeded("abc1234", -1), 0, "abc1234", true},
+		{"soaked", succeeded("abc1234", time.Hour), 30 * time.Minute, "abc1234", true},
+		{"soaking", succeeded("abc1234", time.Minute), 30 * time.Minute, "", false},
+		{"soak without success time", succeeded("abc1234", -1), 30 * time.Minute, "", false},
+	} {
+		version, ok := PromotableVersion(tc.src, tc.soak, now)
+		if version != tc.version || ok != tc.expected {
+			t.Errorf("%s: expected (%q, %t), got (%q, %t)", tc.name, tc.version, tc.expected, version, ok)
+		}
+	}
+}
+
+func TestPromotedVersions(t *testing.T) {
+	src := &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-staging", Namespace: "staging"},
+		Status: kcd1.KCDStatus{
+			SuccessVersion: "abc1234",
+			SuccessTime:    metav1.NewTime(time.Now().UTC().Add(-time.Hour)),
+		},
+	}
+	kcdcs := kcdfake.NewSimpleClientset(src)
+
+	for _, tc := range []struct {
+		name      string
+		pf        kcd1.PromoteFromSpec
+		versions  []string
+		err       bool
+		permanent bool
+	}{
+		{name: "soaked", pf: kcd1.PromoteFromSpec{Name: "app-staging", Namespace: "staging", SoakSeconds: 1800}, versions: []string{"abc1234"}},
+		{name: "soaking", pf: kcd1.PromoteFromSpec{Name: "app-staging", Namespace: "staging", SoakSeconds: 7200}},
+		{name: "unknown source", pf: kcd1.PromoteFromSpec{Name: "app-staging"}, err: true},
+		{name: "self", pf: kcd1.PromoteFromSpec{Name: "app"}, err: true, permanent: true},
+	} {
+		kcd := newTestKCD(kcd1.KCDStatus{})
+		kcd.Spec.PromoteFrom = &tc.pf
+		s := &Syncer{kcd: kcd, resourceProvider: NewK8sProvider(testNamespace, kcdcs, nil)}
+
+		versions, err := s.promotedVersions()
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.name)
+			} else if state.IsPermanent(err) != tc.permanent {
+				t.Errorf("%s: expected permanent error %t, got %v", tc.name, tc.permanent, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(versions, tc.versions) {
+			t.Errorf("%s: expected versions %v, got %v", tc.name, tc.versions, versions)
+		}
+	}
+}
+
+func TestUpdateStatusSuccessTime(t *testing.T) {
+	kcdcs := kcdfake.NewSimpleClientset(newTestKCD(kcd1.KCDStatus{}))
+	p := NewK8sProvider(testNamespace, kcdcs, nil)
+	first := time.Now().UTC().Truncate(time.Second)
+
+	kcd, err := p.UpdateStatus(testNamespace, "app", "abc1234", StatusSuccess, first)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !kcd.Status.SuccessTime.Time.Equal(first) {
+		t.Errorf("expected success time %v, got %v", first, kcd.Status.SuccessTime)
+	}
+
+	// succeeding with the same version again doesn't restart the soak time
+	if _, err := p.UpdateStatus(testNamespace, "app", "abc1234", StatusProgressing, first.Add(time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	kcd, err = p.UpdateStatus(testNamespace, "app", "abc1234", StatusSuccess, first.Add(2*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !kcd.Status.SuccessTime.Time.Equal(first) {
+		t.Errorf("expected unchanged success time %v, got %v", first, kcd.Status.SuccessTime)
+	}
+
+	kcd, err = p.UpdateStatus(testNamespace, "app", "def5678", StatusSuccess, first.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if kcd.Status.SuccessVersion != "def5678" || !kcd.Status.SuccessTime.Time.Equal(first.Add(time.Hour)) {
+		t.Errorf("expected success of def5678 at %v, got %+v", first.Add(time.Hour), kcd.Status)
+	}
+}
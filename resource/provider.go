@@ -10,12 +10,18 @@ import (
 	clientset "github.com/wish/kcd/gok8s/client/clientset/versioned"
 	"github.com/wish/kcd/gok8s/workload"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
 )
 
+// Rollout statuses of KCD resources.
 const (
-	StatusFailed      = "Failed"
-	StatusSuccess     = "Success"
-	StatusProgressing = "Progressing"
+	StatusFailed           = kcdv1.StatusFailed
+	StatusSuccess          = kcdv1.StatusSuccess
+	StatusProgressing      = kcdv1.StatusProgressing
+	StatusAwaitingApproval = kcdv1.StatusAwaitingApproval
+	StatusRolledBack       = kcdv1.StatusRolledBack
+	StatusDowngradeBlocked = kcdv1.StatusDowngradeBlocked
+	StatusResync           = kcdv1.StatusResync
 )
 
 // Resource maintains a high level status of deployments managed by
@@ -37,9 +43,12 @@ type Resource struct {
 
 type Provider interface {
 	KCD(namespace, name string) (*kcdv1.KCD, error)
+	KCDs(namespace, labelSelector string) ([]*kcdv1.KCD, error)
 	Resource(kcd *kcdv1.KCD) *Resource
 	AllResources(namespace string) ([]*Resource, error)
 	UpdateStatus(namespace, kcdName, version, status string, tm time.Time) (*kcdv1.KCD, error)
+	UpdatePodsStatus(namespace, kcdName string, pods kcdv1.PodsStatus) (*kcdv1.KCD, error)
+	UpdateSpec(namespace, kcdName string, update func(spec *kcdv1.KCDSpec)) (*kcdv1.KCD, error)
 }
 
 type K8sProvider struct {
@@ -70,6 +79,21 @@ func (p *K8sProvider) KCD(namespace, name string) (*kcdv1.KCD, error) {
 	return kcd, nil
 }
 
+// KCDs returns the KCD resources in the given namespace that match the label selector.
+// If namespace is empty then KCD resources of all namespaces are returned.
+func (p *K8sProvider) KCDs(namespace, labelSelector string) ([]*kcdv1.KCD, error) {
+	list, err := p.kcdcs.CustomV1().KCDs(namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list KCD instances in namespace %s", namespace)
+	}
+
+	kcds := make([]*kcdv1.KCD, 0, len(list.Items))
+	for i := range list.Items {
+		kcds = append(kcds, &list.Items[i])
+	}
+	return kcds, nil
+}
+
 // AllResources returns all resources managed by container versions in the current namespace.
 func (p *K8sProvider) AllResources(namespace string) ([]*Resource, error) {
 	kcds, err := p.kcdcs.CustomV1().KCDs(namespace).List(context.TODO(), metav1.ListOptions{})
@@ -109,7 +133,7 @@ func (p *K8sProvider) UpdateStatus(namespace, kcdName, version, status string, t
 
 	kcd, err := client.Get(context.TODO(), kcdName, metav1.GetOptions{})
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to get KCD instance with name %s", kcd.Name)
+		return nil, errors.Wrapf(err, "failed to get KCD instance with name %s", kcdName)
 	}
 	kcdCopy := kcd.DeepCopy()
 
@@ -122,8 +146,12 @@ func (p *K8sProvider) UpdateStatus(namespace, kcdName, version, status string, t
 	// if !tm.IsZero() {
 	// 	kcdCopy.Status.CurrStatusTime = metav1.NewTime(tm)
 	// }
-	if status == StatusSuccess && version != "" {
+	// the success time is when the version first succeeded, so that repeated
+	// successes of the same version don't restart the soak time of promotions
+	if status == StatusSuccess && version != "" &&
+		(version != kcd.Status.SuccessVersion || kcd.Status.SuccessTime.IsZero()) {
 		kcdCopy.Status.SuccessVersion = version
+		kcdCopy.Status.SuccessTime = metav1.NewTime(tm)
 	}
 
 	result, err := client.UpdateStatus(context.TODO(), kcdCopy, metav1.UpdateOptions{})
@@ -134,3 +162,51 @@ func (p *K8sProvider) UpdateStatus(namespace, kcdName, version, status string, t
 	glog.V(2).Infof("Successfully updated KCD status: %+v", result)
 	return result, nil
 }
+
+// UpdatePodsStatus updates the KCD with the given name to record the pod counts
+// observed during a rollout. Returns the updated KCD.
+func (p *K8sProvider) UpdatePodsStatus(namespace, kcdName string, pods kcdv1.PodsStatus) (*kcdv1.KCD, error) {
+	glog.V(2).Infof("Updating pods status for kcd=%s, pods=%+v", kcdName, pods)
+
+	client := p.kcdcs.CustomV1().KCDs(namespace)
+
+	kcd, err := client.Get(context.TODO(), kcdName, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get KCD instance with name %s", kcdName)
+	}
+	kcdCopy := kcd.DeepCopy()
+	kcdCopy.Status.Pods = pods
+
+	result, err := client.UpdateStatus(context.TODO(), kcdCopy, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to update KCD spec %s", kcdCopy.Name)
+	}
+
+	return result, nil
+}
+
+// UpdateSpec applies the given update function to the spec of the KCD with the given
+// name, retrying on conflicts. Returns the updated KCD.
+func (p *K8sProvider) UpdateSpec(namespace, kcdName string, update func(spec *kcdv1.KCDSpec)) (*kcdv1.KCD, error) {
+	glog.V(2).Infof("Updating spec for kcd=%s", kcdName)
+
+	client := p.kcdcs.CustomV1().KCDs(namespace)
+
+	var result *kcdv1.KCD
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		kcd, err := client.Get(context.TODO(), kcdName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		kcdCopy := kcd.DeepCopy()
+		update(&kcdCopy.Spec)
+
+		result, err = client.Update(context.TODO(), kcdCopy, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to update spec of KCD %s", kcdName)
+	}
+
+	return result, nil
+}
@@ -8,13 +8,17 @@ import (
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
+	"github.com/wish/kcd/audit"
 	"github.com/wish/kcd/config"
 	"github.com/wish/kcd/deploy"
 	"github.com/wish/kcd/events"
 	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/cluster"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/history"
 	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/cache"
+	"github.com/wish/kcd/registry/providers"
 	"github.com/wish/kcd/state"
 	"github.com/wish/kcd/verify"
 	corev1 "k8s.io/api/core/v1"
@@ -31,6 +35,7 @@ type Syncer struct {
 	resourceProvider Provider
 	workloadProvider workload.Provider
 	historyProvider  history.Provider
+	clusterProvider  cluster.Provider // used to obtain workloads of the clusters defined by the kcd resource
 
 	registry         registry.Registry // provides version information for the current kcd resource
 	registryProvider registry.Provider // used to obtain version information for other registry resoures
@@ -40,7 +45,7 @@ type Syncer struct {
 
 // NewSyncer creates a Syncer instance for handling the main sync loop.
 func NewSyncer(resourceProvider Provider, workloadProvider workload.Provider, registryProvider registry.Provider,
-	hp history.Provider, kcd *kcd1.KCD, options ...func(*config.Options)) (*Syncer, error) {
+	hp history.Provider, clusterProvider cluster.Provider, kcd *kcd1.KCD, options ...func(*config.Options)) (*Syncer, error) {
 
 	opts := config.NewOptions()
 	for _, opt := range options {
@@ -50,12 +55,9 @@ func NewSyncer(resourceProvider Provider, workloadProvider workload.Provider, re
 	dur := time.Duration(kcd.Spec.PollIntervalSeconds) * time.Second
 	glog.V(1).Infof("Syncing every %s", dur)
 
-	opTimeout := time.Minute * 15
-	if kcd.Spec.TimeoutSeconds > 0 {
-		opTimeout = time.Second * time.Duration(kcd.Spec.TimeoutSeconds)
-	}
+	opTimeout := deploy.Timeout(kcd)
 
-	registry, err := registryProvider.RegistryFor(kcd.Spec.ImageRepo)
+	registry, err := registryProvider.RegistryFor(providers.Source(kcd))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -67,9 +69,11 @@ func NewSyncer(resourceProvider Provider, workloadProvider workload.Provider, re
 		registryProvider: registryProvider,
 		registry:         registry,
 		historyProvider:  hp,
+		clusterProvider:  clusterProvider,
 		options:          opts,
 	}
-	s.machine = state.NewMachine(s.initialState(), state.WithStartWaitTime(dur), state.WithTimeout(opTimeout))
+	s.machine = state.NewMachine(s.initialState(), state.WithStartWaitTime(dur), state.WithTimeout(opTimeout),
+		state.WithStats(opts.Stats), state.WithRecorder(opts.Recorder), state.WithAudit(opts.Audit))
 	return s, nil
 }
 
@@ -99,11 +103,42 @@ func (s *Syncer) initialState() state.StateFunc {
 		// refresh kcd resource state
 		s.kcd = kcd
 
-		versions, err := s.registry.Versions(ctx, s.kcd.Spec.Tag)
-		if err != nil {
-			glog.Errorf("Syncer failed to get version from registry, kcd=%s, tag=%s: %v", s.kcd.Name, kcd.Spec.Tag, err)
-			s.options.Recorder.Event(events.Warning, "KCDSyncFailed", "Failed to get versions from registry")
-			return state.Error(errors.Wrap(err, "failed to get versions from registry"))
+		if s.kcd.Spec.Paused {
+			glog.V(2).Infof("Rollouts are paused for kcd=%s", s.kcd.Name)
+			return state.None()
+		}
+
+		var versions []string
+		if s.kcd.Spec.VersionOverride != "" {
+			glog.V(2).Infof("Using version override %s for kcd=%s", s.kcd.Spec.VersionOverride, s.kcd.Name)
+			versions = []string{s.kcd.Spec.VersionOverride}
+		} else if s.kcd.Spec.PromoteFrom != nil {
+			versions, err = s.promotedVersions()
+			if err != nil {
+				glog.Errorf("Syncer failed to get promoted version, kcd=%s: %v", s.kcd.Name, err)
+				s.options.Recorder.Event(events.Warning, "KCDSyncFailed", "Failed to get promoted version")
+				return state.Error(errors.Wrap(err, "failed to get promoted version"))
+			}
+			if len(versions) == 0 {
+				return state.None()
+			}
+		} else {
+			regCtx, err := s.withRegistryCredentials(ctx)
+			if err != nil {
+				glog.Errorf("Syncer failed to get registry credentials, kcd=%s: %v", s.kcd.Name, err)
+				s.options.Recorder.Event(events.Warning, "KCDSyncFailed", "Failed to get registry credentials")
+				return state.Error(err)
+			}
+			versions, err = s.registry.Versions(regCtx, s.kcd.Spec.Tag)
+			if cache.IsCircuitOpen(err) {
+				glog.V(1).Infof("Skipping sync of kcd=%s while the registry is backing off: %v", s.kcd.Name, err)
+				return state.None()
+			}
+			if err != nil {
+				glog.Errorf("Syncer failed to get version from registry, kcd=%s, tag=%s: %v", s.kcd.Name, kcd.Spec.Tag, err)
+				s.options.Recorder.Event(events.Warning, "KCDSyncFailed", "Failed to get versions from registry")
+				return state.Error(errors.Wrap(err, "failed to get versions from registry"))
+			}
 		}
 
 		version := versions[0]
@@ -111,7 +146,7 @@ func (s *Syncer) initialState() state.StateFunc {
 			glog.V(4).Infof("Got registry versions for kcd=%s, tag=%s, versions=%v, rolloutVersion=%s", s.kcd.Name, kcd.Spec.Tag, strings.Join(versions, ", "), version)
 		}
 
-		deployer, err := deploy.New(s.workloadProvider, s.registryProvider, s.kcd, versions[0])
+		deployer, err := s.newDeployer(version)
 		if err != nil {
 			glog.Errorf("Failed to create deployer for kcd=%s: %v", s.kcd.Name, err)
 			return state.Error(errors.Wrap(err, "failed to create deployer"))
@@ -125,23 +160,73 @@ func (s *Syncer) initialState() state.StateFunc {
 		}
 		if !process {
 			glog.V(4).Infof("Not attempting %s rollout of version %s: %+v", s.kcd.Name, version, s.kcd.Status)
+			if hk, ok := deployer.(deploy.Housekeeper); ok {
+				if err := hk.Housekeeping(ctx); err != nil {
+					glog.Errorf("Failed housekeeping for kcd=%s: %v", s.kcd.Name, err)
+				}
+			}
 			return state.None()
 		}
+		blocked, prevVersion, err := s.downgradeBlocked(ctx, version)
+		if err != nil {
+			glog.Errorf("Failed to check for a downgrade of kcd=%s to version %s: %v", s.kcd.Name, version, err)
+			s.options.Recorder.Eventf(events.Warning, "KCDSyncFailed",
+				"Failed to compare version %s with version %s to check for a downgrade", version, prevVersion)
+			return state.Error(err)
+		}
+		if blocked {
+			glog.V(1).Infof("Blocking downgrade of kcd=%s from version %s to version %s", s.kcd.Name, prevVersion, version)
+			if s.kcd.Status.CurrVersion == version && s.kcd.Status.CurrStatus == StatusDowngradeBlocked {
+				return state.None()
+			}
+			s.options.Stats.IncCount("kcdsync.downgrade.blocked", s.kcd.Name)
+			s.options.Recorder.Eventf(events.Warning, "KCDDowngradeBlocked",
+				"Version %s is older than version %s, approve it to roll it out", version, prevVersion)
+			return state.Single(s.updateRolloutStatus(version, StatusDowngradeBlocked, nil))
+		}
+		if s.awaitingApproval(version) {
+			glog.V(2).Infof("Version %s of kcd=%s is awaiting approval", version, s.kcd.Name)
+			if s.kcd.Status.CurrVersion == version && s.kcd.Status.CurrStatus == StatusAwaitingApproval {
+				return state.None()
+			}
+			s.options.Recorder.Eventf(events.Normal, "KCDAwaitingApproval", "Version %s is awaiting approval", version)
+			return state.Single(s.updateRolloutStatus(version, StatusAwaitingApproval, nil))
+		}
 
 		glog.V(4).Infof("Creating rollout state for kcd=%s", s.kcd.Name)
 
-		syncState := s.verify(version,
+		syncState := s.verify(deployer, version,
 			s.updateRolloutStatus(version, StatusProgressing,
 				s.deploy(deployer,
-					s.successfulDeploymentStats(
-						s.syncVersionConfig(version,
-							s.addHistory(deployer, version,
-								s.updateRolloutStatus(version, StatusSuccess, nil)))))))
+					s.updatePodsStatus(deployer,
+						s.successfulDeploymentStats(
+							s.syncVersionConfig(deployer, version,
+								s.updatePromotedTag(version,
+									s.addHistory(deployer, version,
+										s.updateRolloutStatus(version, StatusSuccess, nil)))))))))
 
 		return state.Single(state.WithFailure(syncState, s.handleFailure(version, deployer)))
 	}
 }
 
+// newDeployer returns a deployer for the given version. KCD resources that define
+// clusters are rolled out across those clusters.
+func (s *Syncer) newDeployer(version string) (deploy.Deployer, error) {
+	if len(s.kcd.Spec.Clusters) > 0 {
+		return deploy.NewMultiClusterDeployer(s.clusterProvider, s.registryProvider, s.kcd, version)
+	}
+	return deploy.New(s.workloadProvider, s.registryProvider, s.kcd, version)
+}
+
+// clusters returns the clusters that the deployer rolls out to. Deployers that don't roll
+// out across clusters only roll out to the local cluster.
+func (s *Syncer) clusters(deployer deploy.Deployer) []deploy.ClusterRollout {
+	if mc, ok := deployer.(deploy.MultiCluster); ok {
+		return mc.Clusters()
+	}
+	return []deploy.ClusterRollout{{WorkloadProvider: s.workloadProvider, Workloads: deployer.Workloads()}}
+}
+
 // shouldProcess returns whether a rollout should be performed on the workloads defined
 // by the KCD resource.
 func (s *Syncer) shouldProcess(deployer deploy.Deployer, kcd *kcd1.KCD, versions []string) (bool, error) {
@@ -164,8 +249,26 @@ func (s *Syncer) shouldProcess(deployer deploy.Deployer, kcd *kcd1.KCD, versions
 		return true, nil
 	}
 
-	// don't attempt to rollout a failed state (since this may keep looping)
-	if kcd.Status.CurrStatus == StatusFailed {
+	// a resync retries the rollout from the start
+	if kcd.Status.CurrStatus == StatusResync {
+		glog.V(4).Info("KCD status resync")
+		return true, nil
+	}
+
+	// a version awaiting approval is processed once it has been approved
+	if kcd.Status.CurrStatus == StatusAwaitingApproval {
+		glog.V(4).Info("KCD status awaiting approval")
+		return true, nil
+	}
+
+	// a blocked downgrade is processed once it has been approved or allowed
+	if kcd.Status.CurrStatus == StatusDowngradeBlocked {
+		glog.V(4).Info("KCD status downgrade blocked")
+		return true, nil
+	}
+
+	// don't attempt to rollout a failed or rolled back state (since this may keep looping)
+	if kcd.Status.CurrStatus == StatusFailed || kcd.Status.CurrStatus == StatusRolledBack {
 		glog.V(4).Info("KCD status failed")
 		return false, nil
 	}
@@ -186,6 +289,15 @@ func (s *Syncer) shouldProcess(deployer deploy.Deployer, kcd *kcd1.KCD, versions
 	return false, nil
 }
 
+// awaitingApproval returns whether the rollout of the version must wait for approval.
+// Versions pinned via the version override are considered approved.
+func (s *Syncer) awaitingApproval(version string) bool {
+	if !s.kcd.Spec.Strategy.RequireApproval || s.kcd.Spec.VersionOverride != "" {
+		return false
+	}
+	return version != s.kcd.Spec.ApprovedVersion
+}
+
 // handleFailure is a state invoked when a sync permanently fails. It is responsible for updating
 // the rollout status and generating relevant stats and events.
 func (s *Syncer) handleFailure(version string, deployer deploy.Deployer) state.OnFailureFunc {
@@ -197,33 +309,82 @@ func (s *Syncer) handleFailure(version string, deployer deploy.Deployer) state.O
 			time.Now().UTC(), s.kcd.Name)
 		s.options.Recorder.Event(events.Warning, "KCDSyncFailed", "Failed to deploy the target")
 
-		next := s.updateRolloutStatus(version, StatusFailed, nil)
-
 		if s.kcd.Spec.Rollback.Enabled {
-			if rollbacker, ok := deployer.(deploy.SupportsRollback); ok {
-				glog.V(1).Infof("Initiating rollback for kcd=%v, prevVersion=%v", s.kcd.Name, s.kcd.Status.SuccessVersion)
-				return state.NewStates(rollbacker.Rollback(s.kcd.Status.SuccessVersion, next))
-			} else {
+			prevVersion := s.kcd.Status.SuccessVersion
+			rollbacker, ok := deployer.(deploy.SupportsRollback)
+			switch {
+			case !ok:
 				glog.Errorf("Rollback is enabled but deployer does not support rollback: kcd=%v", s.kcd.Name)
+			case prevVersion == "":
+				glog.V(1).Infof("Not rolling back kcd=%v since no version has succeeded yet", s.kcd.Name)
+				s.options.Recorder.Event(events.Warning, "KCDRollbackSkipped", "No previous successful version to roll back to")
+			default:
+				glog.V(1).Infof("Initiating rollback for kcd=%v, prevVersion=%v", s.kcd.Name, prevVersion)
+				s.options.Recorder.Eventf(events.Normal, "KCDRollback", "Rolling back to version %s", prevVersion)
+				return state.NewStates(
+					s.updatePodsStatus(deployer,
+						s.updateRolloutStatus(version, StatusFailed,
+							rollbacker.Rollback(prevVersion,
+								s.rolledBack(deployer, version, prevVersion),
+								s.handleRollbackFailure(version, prevVersion, deployer)))))
 			}
 		} else {
 			glog.V(1).Infof("Not rolling back kcd=%v", s.kcd.Name)
 		}
 
+		next := s.updatePodsStatus(deployer, s.updateRolloutStatus(version, StatusFailed, nil))
 		return state.NewStates(next)
 	}
 }
 
-func (s *Syncer) verify(version string, next state.State) state.StateFunc {
+// rolledBack is the state after a successful rollback. It records the rollback in the
+// history and sets the RolledBack status on the failed version, so that it isn't retried.
+func (s *Syncer) rolledBack(deployer deploy.Deployer, version, prevVersion string) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		glog.V(1).Infof("Rolled back kcd=%v from version=%v to prevVersion=%v", s.kcd.Name, version, prevVersion)
+
+		s.options.Stats.IncCount("kcdsync.rollback.success", s.kcd.Name)
+		s.options.Recorder.Eventf(events.Normal, "KCDRolledBack", "Rolled back from version %s to %s", version, prevVersion)
+
+		return state.Single(
+			s.updatePodsStatus(deployer,
+				s.addHistory(deployer, prevVersion,
+					s.updateRolloutStatus(version, StatusRolledBack, nil))))
+	}
+}
+
+// handleRollbackFailure escalates the failure of a rollback, which leaves the workloads
+// in an unknown state that requires manual intervention.
+func (s *Syncer) handleRollbackFailure(version, prevVersion string, deployer deploy.Deployer) state.OnFailureFunc {
+	return func(ctx context.Context, err error) state.States {
+		glog.Errorf("Failed to roll back kcd=%v from version=%v to prevVersion=%v: %v", s.kcd.Name, version, prevVersion, err)
+
+		s.options.Stats.IncCount("kcdsync.rollback.failure", s.kcd.Name)
+		s.options.Stats.Event("kcdsync.rollback.failure",
+			fmt.Sprintf("Failed to roll back %s from version %s to %s: %v", s.kcd.Name, version, prevVersion, err), "", "error",
+			time.Now().UTC(), s.kcd.Name)
+		s.options.Recorder.Eventf(events.Warning, "KCDRollbackFailed", "Failed to roll back to version %s: %v", prevVersion, err)
+
+		return state.NewStates(s.updatePodsStatus(deployer, nil))
+	}
+}
+
+// verify runs the container verification steps in each of the clusters that the deployer
+// rolls out to, one cluster after another.
+func (s *Syncer) verify(deployer deploy.Deployer, version string, next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
 		if version == s.kcd.Status.CurrVersion && s.kcd.Status.CurrStatus == StatusProgressing {
 			// we've already run the verify step
 			return state.Single(next)
 		}
 
-		return state.Single(
-			verify.NewVerifiers(s.workloadProvider.Client(), s.registryProvider, s.workloadProvider.Namespace(),
-				version, s.kcd.Spec.Container.Verify, next))
+		clusters := s.clusters(deployer)
+		for i := len(clusters) - 1; i >= 0; i-- {
+			wp := clusters[i].WorkloadProvider
+			next = verify.NewVerifiers(wp.Client(), s.registryProvider, wp.Namespace(),
+				version, s.kcd.Spec.Container.Verify, next)
+		}
+		return state.Single(next)
 	}
 }
 
@@ -244,6 +405,11 @@ func (s *Syncer) updateRolloutStatus(version, status string, next state.State) s
 			return state.Error(errors.Wrapf(err, "failed to update Rollout status for kcd=%s, version=%s, status=%s", s.kcd.Name, version, status))
 		}
 
+		entry := audit.ForKCD(s.kcd, audit.SourceSyncer, audit.ActorSyncer, audit.ActionUpdateStatus)
+		entry.Old = statusValue(s.kcd.Status.CurrVersion, s.kcd.Status.CurrStatus)
+		entry.New = statusValue(version, status)
+		audit.FromContext(ctx).Log(entry)
+
 		s.kcd = kcd
 		return state.Single(next)
 	}
@@ -259,6 +425,32 @@ func (s *Syncer) deploy(deployer deploy.Deployer, next state.State) state.StateF
 	}
 }
 
+// updatePodsStatus records the pod counts observed by the deployer in the KCD resource status.
+// Failing to record the counts does not fail the rollout.
+func (s *Syncer) updatePodsStatus(deployer deploy.Deployer, next state.State) state.StateFunc {
+	return func(ctx context.Context) (state.States, error) {
+		reporter, ok := deployer.(deploy.ReportsPods)
+		if !ok {
+			return state.Single(next)
+		}
+
+		pods := reporter.Pods()
+		if pods == s.kcd.Status.Pods {
+			return state.Single(next)
+		}
+
+		kcd, err := s.resourceProvider.UpdatePodsStatus(s.kcd.Namespace, s.kcd.Name, pods)
+		if err != nil {
+			glog.Errorf("Failed to update pods status for kcd=%s: %v", s.kcd.Name, err)
+			events.FromContext(ctx).Event(events.Warning, "FailedUpdatePodsStatus", "Failed to update pods status")
+			return state.Single(next)
+		}
+
+		s.kcd = kcd
+		return state.Single(next)
+	}
+}
+
 // successfulDeploymentStats generates stats for a successful rollout.
 func (s *Syncer) successfulDeploymentStats(next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
@@ -273,8 +465,9 @@ func (s *Syncer) successfulDeploymentStats(next state.State) state.StateFunc {
 // syncVersionConfig syncs the config map referenced by CV resource - creates if absent and updates if required
 // The controller is not responsible for managing the config resource it reference but only for updating
 // and ensuring its present. If the reference to config was removed from CV resource its not the responsibility
-// of controller to remove it .. it assumes the configMap is external resource and not owned by kcd resource
-func (s *Syncer) syncVersionConfig(version string, next state.State) state.StateFunc {
+// of controller to remove it .. it assumes the configMap is external resource and not owned by kcd resource.
+// The config map is synced in each of the clusters that the deployer rolls out to.
+func (s *Syncer) syncVersionConfig(deployer deploy.Deployer, version string, next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
 		kcd := s.kcd
 		glog.V(4).Infof("syncVersionConfig: kcd=%s, version=%s", kcd.Name, version)
@@ -283,45 +476,60 @@ func (s *Syncer) syncVersionConfig(version string, next state.State) state.State
 			return state.Single(next)
 		}
 
-		client := s.workloadProvider.Client()
-		namespace := s.workloadProvider.Namespace()
-
-		cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), kcd.Spec.Config.Name, metav1.GetOptions{})
-		if err != nil {
-			if k8serr.IsNotFound(err) {
-				_, err = client.CoreV1().ConfigMaps(namespace).Create(context.TODO(),
-					newVersionConfig(namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key, version), metav1.CreateOptions{})
-				if err != nil {
-					events.FromContext(ctx).Event(events.Warning, "FailedCreateVersionConfigMap", "Failed to create version configmap")
-					return state.Error(errors.Wrapf(err, "failed to create version configmap from %s/%s:%s",
-						namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key))
-				}
-				return state.Single(next)
+		for _, cl := range s.clusters(deployer) {
+			if err := s.syncConfigMap(ctx, cl.WorkloadProvider, version); err != nil {
+				return state.Error(err)
 			}
-			return state.Error(errors.Wrapf(err, "failed to get version configmap from %s/%s:%s",
-				namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key))
 		}
+		return state.Single(next)
+	}
+}
 
-		if version == cm.Data[kcd.Spec.Config.Key] {
-			return state.Single(next)
+// syncConfigMap creates or updates the version config map in the namespace of the
+// workload provider.
+func (s *Syncer) syncConfigMap(ctx context.Context, wp workload.Provider, version string) error {
+	kcd := s.kcd
+	client := wp.Client()
+	namespace := wp.Namespace()
+
+	cm, err := client.CoreV1().ConfigMaps(namespace).Get(context.TODO(), kcd.Spec.Config.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serr.IsNotFound(err) {
+			_, err = client.CoreV1().ConfigMaps(namespace).Create(context.TODO(),
+				newVersionConfig(namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key, version), metav1.CreateOptions{})
+			if err != nil {
+				events.FromContext(ctx).Event(events.Warning, "FailedCreateVersionConfigMap", "Failed to create version configmap")
+				return errors.Wrapf(err, "failed to create version configmap from %s/%s:%s",
+					namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key)
+			}
+			return nil
 		}
+		return errors.Wrapf(err, "failed to get version configmap from %s/%s:%s",
+			namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key)
+	}
 
-		cm.Data[kcd.Spec.Config.Key] = version
+	if version == cm.Data[kcd.Spec.Config.Key] {
+		return nil
+	}
 
-		// TODO enable this when patchstretegy is supported on config map https://github.com/kubernetes/client-go/blob/7ac1236/pkg/api/v1/types.go#L3979
-		// _, err = s.k8sClient.CoreV1().ConfigMaps(s.namespace).Patch(cm.ObjectMeta.Name, types.StrategicMergePatchType, []byte(fmt.Sprintf(`{
-		// 	"Data": {
-		// 		"%s": "%s",
-		// 	},
-		// }`, s.Config.ConfigMap.Key, version)))
-		_, err = client.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
-		if err != nil {
-			events.FromContext(ctx).Event(events.Warning, "FailedUpdateVersionConfigMap", "Failed to update version configmap")
-			return state.Error(errors.Wrapf(err, "failed to update version configmap from %s/%s:%s",
-				namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key))
-		}
-		return state.Single(next)
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
 	}
+	cm.Data[kcd.Spec.Config.Key] = version
+
+	// TODO enable this when patchstretegy is supported on config map https://github.com/kubernetes/client-go/blob/7ac1236/pkg/api/v1/types.go#L3979
+	// _, err = s.k8sClient.CoreV1().ConfigMaps(s.namespace).Patch(cm.ObjectMeta.Name, types.StrategicMergePatchType, []byte(fmt.Sprintf(`{
+	// 	"Data": {
+	// 		"%s": "%s",
+	// 	},
+	// }`, s.Config.ConfigMap.Key, version)))
+	_, err = client.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	if err != nil {
+		events.FromContext(ctx).Event(events.Warning, "FailedUpdateVersionConfigMap", "Failed to update version configmap")
+		return errors.Wrapf(err, "failed to update version configmap from %s/%s:%s",
+			namespace, kcd.Spec.Config.Name, kcd.Spec.Config.Key)
+	}
+	return nil
 }
 
 // newVersionConfig creates a new configmap for a version if specified in CV resource.
@@ -338,7 +546,7 @@ func newVersionConfig(namespace, name, key, version string) *corev1.ConfigMap {
 }
 
 // addHistory adds the successful rollout of the targets to the given version to the
-// history provider.
+// history provider. The history of each cluster is recorded in that cluster.
 func (s *Syncer) addHistory(deployer deploy.Deployer, version string, next state.State) state.StateFunc {
 	return func(ctx context.Context) (state.States, error) {
 		if !s.kcd.Spec.History.Enabled {
@@ -346,28 +554,46 @@ func (s *Syncer) addHistory(deployer deploy.Deployer, version string, next state
 			return state.Single(next)
 		}
 
-		for _, target := range deployer.Workloads() {
-			// TODO: remove this spec field???
-			//name := s.kcd.Spec.History.Name
-			//if name == "" {
-			//	name = target.Name()
-			//}
-			name := target.Name()
-
-			glog.V(4).Infof("Adding version history for kcd=%s, name=%s, version=%s", s.kcd.Name, name, version)
-
-			err := s.historyProvider.Add(s.workloadProvider.Namespace(), name, &history.Record{
-				Type:    target.Type(),
-				Name:    target.Name(),
-				Version: version,
-				Time:    time.Now().UTC(),
-			})
-			if err != nil {
-				glog.Errorf("Failed to save history: %v", err)
-				s.options.Recorder.Event(events.Warning, "SaveHistoryFailed", "Failed to record update history")
-			}
+		for _, cl := range s.clusters(deployer) {
+			s.addClusterHistory(cl, version)
 		}
 
 		return state.Single(next)
 	}
 }
+
+// addClusterHistory adds the rollout of the cluster's targets to the given version to the
+// history of the cluster.
+func (s *Syncer) addClusterHistory(cl deploy.ClusterRollout, version string) {
+	hp := s.historyProvider
+	if cl.WorkloadProvider.Client() != s.workloadProvider.Client() {
+		hp = history.NewProvider(cl.WorkloadProvider.Client(), s.options.Stats)
+	}
+
+	for _, target := range cl.Workloads {
+		// TODO: remove this spec field???
+		//name := s.kcd.Spec.History.Name
+		//if name == "" {
+		//	name = target.Name()
+		//}
+		name := target.Name()
+
+		glog.V(4).Infof("Adding version history for kcd=%s, name=%s, version=%s", s.kcd.Name, name, version)
+
+		err := hp.Add(cl.WorkloadProvider.Namespace(), name, &history.Record{
+			Type:    target.Type(),
+			Name:    target.Name(),
+			Version: version,
+			Time:    time.Now().UTC(),
+		})
+		if err != nil {
+			glog.Errorf("Failed to save history: %v", err)
+			s.options.Recorder.Event(events.Warning, "SaveHistoryFailed", "Failed to record update history")
+		}
+	}
+}
+
+// statusValue returns the description of a version and status in the audit log.
+func statusValue(version, status string) string {
+	return fmt.Sprintf("version=%s status=%s", version, status)
+}
@@ -0,0 +1,451 @@
+package resource
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wish/kcd/config"
+	"github.com/wish/kcd/events"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdfake "github.com/wish/kcd/gok8s/client/clientset/versioned/fake"
+	"github.com/wish/kcd/gok8s/cluster"
+	"github.com/wish/kcd/gok8s/workload"
+	"github.com/wish/kcd/history"
+	"github.com/wish/kcd/registry/cache"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/state"
+	"github.com/wish/kcd/stats"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	gofake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const (
+	testNamespace = "test-namespace"
+	testImageRepo = "registry.example.com/team/app"
+)
+
+// queuedState is a state with the failure funcs of the operation it belongs to.
+type queuedState struct {
+	state    state.State
+	failures []state.OnFailure
+}
+
+func (qs queuedState) next(st state.State, onFailure state.OnFailure) queuedState {
+	failures := append([]state.OnFailure{}, qs.failures...)
+	if onFailure != nil {
+		failures = append(failures, onFailure)
+	}
+	return queuedState{state: st, failures: failures}
+}
+
+// runStates executes the given state and all subsequent states until completion,
+// ignoring any delays. Like the state machine, the failure funcs are invoked in reverse
+// order on the first failure and the states they return are executed.
+func runStates(t *testing.T, st state.State) {
+	queue := []queuedState{{state: st}}
+	failed := false
+	for i := 0; len(queue) > 0; i++ {
+		if i > 1000 {
+			t.Fatalf("states did not complete")
+		}
+		curr := queue[0]
+		queue = queue[1:]
+
+		states, err := curr.state.Do(context.Background())
+		if err != nil {
+			if failed {
+				continue
+			}
+			failed = true
+			for j := len(curr.failures) - 1; j >= 0; j-- {
+				failureStates := curr.failures[j].Fail(context.Background(), err)
+				for _, fs := range failureStates.States {
+					queue = append(queue, curr.next(fs, failureStates.OnFailure))
+				}
+			}
+			continue
+		}
+		for _, next := range states.States {
+			queue = append(queue, curr.next(next, states.OnFailure))
+		}
+	}
+}
+
+func newTestDeployment(version string) *appsv1.Deployment {
+	replicas := int32(0)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: testNamespace,
+			Labels:    map[string]string{"kcdapp": "app"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "app"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: testImageRepo + ":" + version}},
+				},
+			},
+		},
+	}
+}
+
+func newTestKCD(status kcd1.KCDStatus) *kcd1.KCD {
+	return &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: testNamespace},
+		Spec: kcd1.KCDSpec{
+			ImageRepo:     testImageRepo,
+			Tag:           "prod",
+			VersionSyntax: "^[0-9a-f]{7}$",
+			Selector:      map[string]string{"kcdapp": "app"},
+			Container:     kcd1.ContainerSpec{Name: "app"},
+		},
+		Status: status,
+	}
+}
+
+// testSyncer contains a syncer and the clients of the resources it syncs.
+type testSyncer struct {
+	*Syncer
+
+	cs       *gofake.Clientset
+	kcdcs    *kcdfake.Clientset
+	recorder *events.FakeRecorder
+}
+
+func newTestSyncer(t *testing.T, kcd *kcd1.KCD, registryDir string, deployments ...*appsv1.Deployment) *testSyncer {
+	cs := gofake.NewSimpleClientset()
+	for _, dep := range deployments {
+		if _, err := cs.AppsV1().Deployments(testNamespace).Create(context.Background(), dep, metav1.CreateOptions{}); err != nil {
+			t.Fatalf("failed to create deployment: %v", err)
+		}
+	}
+	kcdcs := kcdfake.NewSimpleClientset(kcd)
+
+	workloadProvider := workload.NewProvider(cs, kcdcs, testNamespace)
+	registryProvider, err := providers.NewProvider(kcd, stats.NewFake(), providers.WithLocalRoot(registryDir))
+	if err != nil {
+		t.Fatalf("failed to create registry provider: %v", err)
+	}
+	recorder := events.NewFakeRecorder(100)
+	s, err := NewSyncer(NewK8sProvider(testNamespace, kcdcs, workloadProvider), workloadProvider, registryProvider,
+		history.NewProvider(cs, stats.NewFake()), cluster.NewFakeProvider(nil), kcd, config.WithRecorder(recorder))
+	if err != nil {
+		t.Fatalf("failed to create syncer: %v", err)
+	}
+	return &testSyncer{Syncer: s, cs: cs, kcdcs: kcdcs, recorder: recorder}
+}
+
+// sync runs a single sync of the syncer.
+func (ts *testSyncer) sync(t *testing.T) {
+	runStates(t, ts.initialState())
+}
+
+func (ts *testSyncer) image(t *testing.T) string {
+	dep, err := ts.cs.AppsV1().Deployments(testNamespace).Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	return dep.Spec.Template.Spec.Containers[0].Image
+}
+
+func (ts *testSyncer) status(t *testing.T) kcd1.KCDStatus {
+	kcd, err := ts.kcdcs.CustomV1().KCDs(testNamespace).Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get kcd: %v", err)
+	}
+	return kcd.Status
+}
+
+// hasEvent returns whether an event with the reason was recorded, discarding the
+// events recorded before it.
+func (ts *testSyncer) hasEvent(reason string) bool {
+	for {
+		select {
+		case event := <-ts.recorder.Events:
+			if strings.Contains(event, " "+reason+" ") {
+				return true
+			}
+		default:
+			return false
+		}
+	}
+}
+
+func writeVersions(t *testing.T, path, content string) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+func TestSyncLocalRegistry(t *testing.T) {
+	dir := newRegistryDir(t, "abc1234")
+	origCache := cache.Default
+	defer func() { cache.Default = origCache }()
+	cache.Default = cache.New(cache.WithTTL(0))
+
+	path := filepath.Join(dir, "versions.yaml")
+	kcd := newTestKCD(kcd1.KCDStatus{CurrVersion: "1111111", CurrStatus: StatusSuccess, SuccessVersion: "1111111"})
+	kcd.Spec.RegistrySource = "file://" + path
+	ts := newTestSyncer(t, kcd, dir, newTestDeployment("1111111"))
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":abc1234" {
+		t.Errorf("expected image of the registry source version, got %s", image)
+	}
+	if status := ts.status(t); status.CurrVersion != "abc1234" || status.CurrStatus != StatusSuccess {
+		t.Errorf("expected successful rollout of abc1234, got %+v", status)
+	}
+
+	// up to date workloads aren't changed
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":abc1234" {
+		t.Errorf("expected unchanged image, got %s", image)
+	}
+
+	writeVersions(t, path, "prod: [def5678, latest]\n")
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":def5678" {
+		t.Errorf("expected image of the new version, got %s", image)
+	}
+}
+
+// newRegistryDir returns a directory with a local registry that tags the version as prod.
+func newRegistryDir(t *testing.T, version string) string {
+	dir, err := ioutil.TempDir("", "kcd-sync")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	writeVersions(t, filepath.Join(dir, "versions.yaml"), "prod: "+version+"\n")
+	return dir
+}
+
+// newRollbackKCD returns a KCD resource with rollbacks enabled whose last successful
+// version is 1111111.
+func newRollbackKCD(registryDir string) *kcd1.KCD {
+	kcd := newTestKCD(kcd1.KCDStatus{CurrVersion: "1111111", CurrStatus: StatusSuccess, SuccessVersion: "1111111"})
+	kcd.Spec.RegistrySource = "file://" + filepath.Join(registryDir, "versions.yaml")
+	kcd.Spec.Rollback.Enabled = true
+	return kcd
+}
+
+// newFailingDeployment returns a deployment whose rollouts exceed their progress deadline.
+func newFailingDeployment(version string) *appsv1.Deployment {
+	dep := newTestDeployment(version)
+	dep.Status.Conditions = []appsv1.DeploymentCondition{{
+		Type:           appsv1.DeploymentProgressing,
+		Status:         corev1.ConditionFalse,
+		Reason:         "ProgressDeadlineExceeded",
+		LastUpdateTime: metav1.NewTime(time.Now().Add(time.Hour)),
+	}}
+	return dep
+}
+
+func TestSyncRolledBack(t *testing.T) {
+	dir := newRegistryDir(t, "abc1234")
+	ts := newTestSyncer(t, newRollbackKCD(dir), dir, newFailingDeployment("1111111"))
+
+	// the rollout fails, but the rollback to the previous version makes progress
+	ts.cs.PrependReactor("patch", "deployments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if !strings.Contains(string(action.(k8stesting.PatchAction).GetPatch()), "1111111") {
+			return false, nil, nil
+		}
+		obj, err := ts.cs.Tracker().Get(action.GetResource(), testNamespace, "app")
+		if err != nil {
+			return true, nil, err
+		}
+		dep := obj.(*appsv1.Deployment).DeepCopy()
+		dep.Status.Conditions = nil
+		if err := ts.cs.Tracker().Update(action.GetResource(), dep, testNamespace); err != nil {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":1111111" {
+		t.Errorf("expected image of the previous version, got %s", image)
+	}
+	status := ts.status(t)
+	if status.CurrVersion != "abc1234" || status.CurrStatus != StatusRolledBack || status.SuccessVersion != "1111111" {
+		t.Errorf("expected abc1234 to be rolled back, got %+v", status)
+	}
+	if !ts.hasEvent("KCDRolledBack") {
+		t.Errorf("expected rolled back event")
+	}
+
+	// rolled back versions aren't retried
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":1111111" {
+		t.Errorf("expected rolled back version not to be retried, got %s", image)
+	}
+}
+
+func TestSyncRollbackFailure(t *testing.T) {
+	dir := newRegistryDir(t, "abc1234")
+	ts := newTestSyncer(t, newRollbackKCD(dir), dir, newFailingDeployment("1111111"))
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":1111111" {
+		t.Errorf("expected rollback to patch the previous version, got %s", image)
+	}
+	if status := ts.status(t); status.CurrVersion != "abc1234" || status.CurrStatus != StatusFailed {
+		t.Errorf("expected abc1234 to have failed, got %+v", status)
+	}
+	if !ts.hasEvent("KCDRollbackFailed") {
+		t.Errorf("expected rollback failed event")
+	}
+}
+
+func TestSyncResync(t *testing.T) {
+	dir := newRegistryDir(t, "abc1234")
+
+	for _, test := range []struct {
+		status   string
+		expected string
+	}{
+		// verification already ran before the rollout became progressing
+		{StatusProgressing, StatusSuccess},
+		// a resync verifies the version again, which fails for an unknown verify kind
+		{StatusResync, StatusFailed},
+	} {
+		kcd := newTestKCD(kcd1.KCDStatus{CurrVersion: "abc1234", CurrStatus: test.status, SuccessVersion: "1111111"})
+		kcd.Spec.RegistrySource = "file://" + filepath.Join(dir, "versions.yaml")
+		kcd.Spec.Container.Verify = []kcd1.VerifySpec{{Kind: "unknown"}}
+		ts := newTestSyncer(t, kcd, dir, newTestDeployment("abc1234"))
+
+		ts.sync(t)
+		if status := ts.status(t); status.CurrVersion != "abc1234" || status.CurrStatus != test.expected {
+			t.Errorf("%s: expected status %s, got %+v", test.status, test.expected, status)
+		}
+	}
+}
+
+// newDowngradeKCD returns a KCD resource with semantic versions whose last successful
+// version is v1.2.0.
+func newDowngradeKCD(registryDir string) *kcd1.KCD {
+	kcd := newTestKCD(kcd1.KCDStatus{CurrVersion: "v1.2.0", CurrStatus: StatusSuccess, SuccessVersion: "v1.2.0"})
+	kcd.Spec.RegistrySource = "file://" + filepath.Join(registryDir, "versions.yaml")
+	kcd.Spec.VersionSyntax = `^v?[0-9]+(\.[0-9]+)*$`
+	kcd.Spec.VersionOrder = &kcd1.VersionOrderSpec{Kind: "semver"}
+	return kcd
+}
+
+func TestSyncDowngradeBlocked(t *testing.T) {
+	dir := newRegistryDir(t, "v1.1.0")
+	ts := newTestSyncer(t, newDowngradeKCD(dir), dir, newTestDeployment("v1.2.0"))
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":v1.2.0" {
+		t.Errorf("expected downgrade not to be rolled out, got %s", image)
+	}
+	if status := ts.status(t); status.CurrVersion != "v1.1.0" || status.CurrStatus != StatusDowngradeBlocked {
+		t.Errorf("expected downgrade to be blocked, got %+v", status)
+	}
+	if !ts.hasEvent("KCDDowngradeBlocked") {
+		t.Errorf("expected downgrade blocked event")
+	}
+
+	// blocked downgrades aren't reported again
+	ts.sync(t)
+	if ts.hasEvent("KCDDowngradeBlocked") {
+		t.Errorf("expected no further downgrade blocked event")
+	}
+
+	kcd, err := ts.kcdcs.CustomV1().KCDs(testNamespace).Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get kcd: %v", err)
+	}
+	kcd.Spec.ApprovedVersion = "v1.1.0"
+	if _, err := ts.kcdcs.CustomV1().KCDs(testNamespace).Update(context.Background(), kcd, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to approve version: %v", err)
+	}
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":v1.1.0" {
+		t.Errorf("expected approved downgrade to be rolled out, got %s", image)
+	}
+	if status := ts.status(t); status.CurrVersion != "v1.1.0" || status.CurrStatus != StatusSuccess {
+		t.Errorf("expected approved downgrade to succeed, got %+v", status)
+	}
+}
+
+func TestSyncVersionsIncomparable(t *testing.T) {
+	// the previous version isn't a semantic version
+	dir := newRegistryDir(t, "v1.3.0")
+	kcd := newDowngradeKCD(dir)
+	kcd.Status.SuccessVersion = "1234567"
+	ts := newTestSyncer(t, kcd, dir, newTestDeployment("1234567"))
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":v1.3.0" {
+		t.Errorf("expected incomparable version to be rolled out, got %s", image)
+	}
+	if !ts.hasEvent("KCDVersionsIncomparable") {
+		t.Errorf("expected versions incomparable event")
+	}
+}
+
+func TestSyncVersionsLookupFailed(t *testing.T) {
+	// the local registry doesn't record push times
+	dir := newRegistryDir(t, "v1.1.0")
+	kcd := newDowngradeKCD(dir)
+	kcd.Spec.VersionOrder = &kcd1.VersionOrderSpec{Kind: "pushTime"}
+	ts := newTestSyncer(t, kcd, dir, newTestDeployment("v1.2.0"))
+
+	ts.sync(t)
+	if image := ts.image(t); image != testImageRepo+":v1.2.0" {
+		t.Errorf("expected version not to be rolled out while push times can't be looked up, got %s", image)
+	}
+	if ts.hasEvent("KCDVersionsIncomparable") {
+		t.Errorf("expected no versions incomparable event for a failed lookup")
+	}
+}
+
+func TestSyncClusters(t *testing.T) {
+	dir := newRegistryDir(t, "abc1234")
+	kcd := newTestKCD(kcd1.KCDStatus{CurrVersion: "1111111", CurrStatus: StatusSuccess, SuccessVersion: "1111111"})
+	kcd.Spec.RegistrySource = "file://" + filepath.Join(dir, "versions.yaml")
+	kcd.Spec.Clusters = []kcd1.ClusterSpec{{Name: "local"}, {Name: "remote"}}
+	kcd.Spec.Config = &kcd1.ConfigSpec{Name: "app-version", Key: "version"}
+	kcd.Spec.History.Enabled = true
+	ts := newTestSyncer(t, kcd, dir, newTestDeployment("1111111"))
+
+	remote := gofake.NewSimpleClientset(newTestDeployment("1111111"))
+	ts.clusterProvider = cluster.NewFakeProvider(map[string]kubernetes.Interface{"local": ts.cs, "remote": remote})
+
+	ts.sync(t)
+	if status := ts.status(t); status.CurrVersion != "abc1234" || status.CurrStatus != StatusSuccess {
+		t.Fatalf("expected successful rollout of abc1234, got %+v", status)
+	}
+
+	// the version config and history are updated in every cluster
+	for name, cs := range map[string]kubernetes.Interface{"local": ts.cs, "remote": remote} {
+		cm, err := cs.CoreV1().ConfigMaps(testNamespace).Get(context.Background(), "app-version", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: failed to get version config: %v", name, err)
+		}
+		if version := cm.Data["version"]; version != "abc1234" {
+			t.Errorf("%s: expected version config abc1234, got %s", name, version)
+		}
+		records, err := history.NewProvider(cs, stats.NewFake()).History(testNamespace, "app")
+		if err != nil {
+			t.Fatalf("%s: failed to get history: %v", name, err)
+		}
+		if !strings.Contains(records, "abc1234") {
+			t.Errorf("%s: expected history of abc1234, got %s", name, records)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package resource
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/wish/kcd/deploy"
+	"github.com/wish/kcd/deploy/traffic"
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/order"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/verify"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// ValidateSpec checks the spec of a KCD resource for errors that would otherwise only
+// cause rollouts to fail later on.
+func ValidateSpec(spec *kcdv1.KCDSpec) field.ErrorList {
+	var errs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if registry.ProviderByRepo(spec.ImageRepo) == "local" {
+		errs = append(errs, field.Invalid(specPath.Child("imageRepo"), spec.ImageRepo,
+			"local repositories can only be used as registrySource, the image repository must be pullable"))
+	} else {
+		errs = append(errs, validateImageRepo(spec.ImageRepo, specPath.Child("imageRepo"))...)
+	}
+	if spec.RegistrySource != "" {
+		errs = append(errs, validateImageRepo(spec.RegistrySource, specPath.Child("registrySource"))...)
+	}
+
+	if spec.VersionSyntax != "" {
+		if _, err := regexp.Compile(spec.VersionSyntax); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("versionSyntax"), spec.VersionSyntax,
+				fmt.Sprintf("must be a valid regular expression: %v", err)))
+		}
+	}
+
+	if spec.VersionOrder != nil {
+		if err := order.Validate(*spec.VersionOrder); err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("versionOrder"), *spec.VersionOrder, err.Error()))
+		}
+	}
+
+	if len(spec.Selector) == 0 {
+		errs = append(errs, field.Required(specPath.Child("selector"), "a selector is required to find the workloads"))
+	}
+	if spec.Container.Name == "" {
+		errs = append(errs, field.Required(specPath.Child("container", "name"), "the name of the container to update is required"))
+	}
+	errs = append(errs, validateVerifySpecs(spec.Container.Verify, specPath.Child("container", "verify"))...)
+
+	errs = append(errs, validateStrategy(&spec.Strategy, specPath.Child("strategy"))...)
+	if bg := spec.Strategy.BlueGreen; bg != nil && bg.Traffic != nil {
+		if timeout := deploy.Timeout(&kcdv1.KCD{Spec: *spec}); timeout > deploy.MaxTimeout {
+			errs = append(errs, field.Invalid(specPath.Child("strategy", "blueGreen", "traffic"), *bg.Traffic,
+				fmt.Sprintf("a rollout including soak and traffic steps would take %s, more than the maximum of %s",
+					timeout, deploy.MaxTimeout)))
+		}
+	}
+
+	if spec.PromoteFrom != nil && spec.PromoteFrom.Name == "" {
+		errs = append(errs, field.Required(specPath.Child("promoteFrom", "name"), "the name of the source KCD is required"))
+	}
+
+	return errs
+}
+
+// validateImageRepo checks that the image repository can be parsed by the registry
+// provider it belongs to.
+func validateImageRepo(imageRepo string, path *field.Path) field.ErrorList {
+	if imageRepo == "" {
+		return field.ErrorList{field.Required(path, "an image repository is required")}
+	}
+
+	if err := providers.ParseRepo(imageRepo); err != nil {
+		return field.ErrorList{field.Invalid(path, imageRepo, err.Error())}
+	}
+	return nil
+}
+
+// validateStrategy checks that the strategy kind is known and that the spec required by
+// the kind is present.
+func validateStrategy(strategy *kcdv1.StrategySpec, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	switch strategy.Kind {
+	case "":
+	case deploy.KindServieBlueGreen:
+		bgPath := path.Child("blueGreen")
+		bg := strategy.BlueGreen
+		if bg == nil {
+			errs = append(errs, field.Required(bgPath, fmt.Sprintf("required for strategy kind %s", strategy.Kind)))
+			break
+		}
+		if len(deploy.LiveServices(bg)) == 0 {
+			errs = append(errs, field.Required(bgPath.Child("serviceName"), "the name of the live service is required"))
+		}
+		for i, name := range bg.ServiceNames {
+			if name == "" {
+				errs = append(errs, field.Required(bgPath.Child("serviceNames").Index(i), "must not be empty"))
+			}
+		}
+		for i, name := range bg.VerificationServiceNames {
+			if name == "" {
+				errs = append(errs, field.Required(bgPath.Child("verificationServiceNames").Index(i), "must not be empty"))
+			}
+		}
+		if len(bg.LabelNames) == 0 {
+			errs = append(errs, field.Required(bgPath.Child("labelNames"), "at least one label name is required"))
+		}
+		if bg.Traffic != nil {
+			if err := traffic.Validate(*bg.Traffic); err != nil {
+				errs = append(errs, field.Invalid(bgPath.Child("traffic"), *bg.Traffic, err.Error()))
+			}
+			if len(deploy.VerificationServices(bg)) == 0 {
+				errs = append(errs, field.Required(bgPath.Child("verificationServiceName"),
+					"a verification service is required to shift traffic to"))
+			}
+		}
+		if kp := bg.KeepPrevious; kp != nil {
+			if kp.Seconds < 0 {
+				errs = append(errs, field.Invalid(bgPath.Child("keepPrevious", "seconds"), kp.Seconds, "must not be negative"))
+			}
+			if kp.ReplicasPercent < 0 || kp.ReplicasPercent > 100 {
+				errs = append(errs, field.Invalid(bgPath.Child("keepPrevious", "replicasPercent"), kp.ReplicasPercent,
+					"must be between 0 and 100"))
+			}
+		}
+	default:
+		errs = append(errs, field.NotSupported(path.Child("kind"), strategy.Kind, []string{deploy.KindServieBlueGreen}))
+	}
+
+	errs = append(errs, validateVerifySpecs(strategy.Verify, path.Child("verify"))...)
+
+	if r := strategy.Readiness; r != nil && (r.MinReadyPercent < 0 || r.MinReadyPercent > 100) {
+		errs = append(errs, field.Invalid(path.Child("readiness", "minReadyPercent"), r.MinReadyPercent,
+			"must be between 0 and 100"))
+	}
+
+	return errs
+}
+
+// validateVerifySpecs checks that the verify kinds are known.
+func validateVerifySpecs(specs []kcdv1.VerifySpec, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, spec := range specs {
+		switch spec.Kind {
+		case verify.KindImage:
+			if spec.Image == "" {
+				errs = append(errs, field.Required(path.Index(i).Child("image"), "an image is required for image verification"))
+			}
+		default:
+			errs = append(errs, field.NotSupported(path.Index(i).Child("kind"), spec.Kind, []string{verify.KindImage}))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,104 @@
+package resource
+
+import (
+	"strings"
+	"testing"
+
+	kcdv1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+)
+
+func validSpec() kcdv1.KCDSpec {
+	return kcdv1.KCDSpec{
+		ImageRepo:     "123456789.dkr.ecr.us-east-1.amazonaws.com/app",
+		VersionSyntax: "^v[0-9]+$",
+		Selector:      map[string]string{"kcdapp": "app"},
+		Container:     kcdv1.ContainerSpec{Name: "app"},
+		Strategy: kcdv1.StrategySpec{
+			Kind: "ServiceBlueGreen",
+			BlueGreen: &kcdv1.BlueGreenSpec{
+				ServiceName: "app",
+				LabelNames:  []string{"color"},
+			},
+			Verify: []kcdv1.VerifySpec{{Kind: "Image", Image: "verify"}},
+		},
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	testCases := []struct {
+		name     string
+		modify   func(spec *kcdv1.KCDSpec)
+		expected []string
+	}{
+		{"valid", func(spec *kcdv1.KCDSpec) {}, nil},
+		{"dockerhub repo", func(spec *kcdv1.KCDSpec) { spec.ImageRepo = "nearmap/kcd" }, nil},
+		{"dockerhub repo with tag", func(spec *kcdv1.KCDSpec) { spec.ImageRepo = "nearmap/kcd:latest" },
+			[]string{"spec.imageRepo"}},
+		{"bad ecr repo", func(spec *kcdv1.KCDSpec) { spec.ImageRepo = "dkr.ecr.us-east-1.amazonaws.com/app" },
+			[]string{"spec.imageRepo"}},
+		{"local registry source", func(spec *kcdv1.KCDSpec) { spec.RegistrySource = "file:///etc/kcd/versions.yaml" }, nil},
+		{"local image repo", func(spec *kcdv1.KCDSpec) { spec.ImageRepo = "file:///etc/kcd/versions.yaml" },
+			[]string{"spec.imageRepo"}},
+		{"bad registry source", func(spec *kcdv1.KCDSpec) { spec.RegistrySource = "oci-layout://images/app" },
+			[]string{"spec.registrySource"}},
+		{"bad regex", func(spec *kcdv1.KCDSpec) { spec.VersionSyntax = "^v[0-9" }, []string{"spec.versionSyntax"}},
+		{"build number without capture group", func(spec *kcdv1.KCDSpec) {
+			spec.VersionOrder = &kcdv1.VersionOrderSpec{Kind: "buildNumber", Pattern: "^build-[0-9]+$"}
+		}, []string{"spec.versionOrder"}},
+		{"semver order", func(spec *kcdv1.KCDSpec) { spec.VersionOrder = &kcdv1.VersionOrderSpec{Kind: "semver"} }, nil},
+		{"empty selector", func(spec *kcdv1.KCDSpec) { spec.Selector = nil }, []string{"spec.selector"}},
+		{"unknown strategy", func(spec *kcdv1.KCDSpec) { spec.Strategy.Kind = "Canary" }, []string{"spec.strategy.kind"}},
+		{"missing blue-green", func(spec *kcdv1.KCDSpec) { spec.Strategy.BlueGreen = nil },
+			[]string{"spec.strategy.blueGreen"}},
+		{"incomplete blue-green", func(spec *kcdv1.KCDSpec) { spec.Strategy.BlueGreen = &kcdv1.BlueGreenSpec{} },
+			[]string{"spec.strategy.blueGreen.serviceName", "spec.strategy.blueGreen.labelNames"}},
+		{"live services", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.ServiceName = ""
+			spec.Strategy.BlueGreen.ServiceNames = []string{"app-public", "app-internal"}
+		}, nil},
+		{"empty service names", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.ServiceNames = []string{""}
+			spec.Strategy.BlueGreen.VerificationServiceNames = []string{"app-verify", ""}
+		}, []string{"spec.strategy.blueGreen.serviceNames[0]", "spec.strategy.blueGreen.verificationServiceNames[1]"}},
+		{"traffic", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.VerificationServiceName = "app-verify"
+			spec.Strategy.BlueGreen.Traffic = &kcdv1.TrafficSpec{Kind: "HTTPRoute", Name: "app", Steps: []int{5, 25}}
+		}, nil},
+		{"invalid traffic", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.VerificationServiceName = ""
+			spec.Strategy.BlueGreen.Traffic = &kcdv1.TrafficSpec{Kind: "HTTPRoute", Name: "app", Steps: []int{25, 5}}
+		}, []string{"spec.strategy.blueGreen.traffic", "spec.strategy.blueGreen.verificationServiceName"}},
+		{"traffic exceeding timeout", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.VerificationServiceName = "app-verify"
+			spec.Strategy.BlueGreen.Traffic = &kcdv1.TrafficSpec{Kind: "HTTPRoute", Name: "app", Steps: []int{5, 25}, StepSeconds: 43200}
+		}, []string{"spec.strategy.blueGreen.traffic"}},
+		{"invalid keep previous", func(spec *kcdv1.KCDSpec) {
+			spec.Strategy.BlueGreen.KeepPrevious = &kcdv1.KeepPreviousSpec{Seconds: -1, ReplicasPercent: 150}
+		}, []string{"spec.strategy.blueGreen.keepPrevious.seconds", "spec.strategy.blueGreen.keepPrevious.replicasPercent"}},
+		{"unknown verify kind", func(spec *kcdv1.KCDSpec) { spec.Strategy.Verify[0].Kind = "Smoke" },
+			[]string{"spec.strategy.verify[0].kind"}},
+		{"multiple errors", func(spec *kcdv1.KCDSpec) {
+			spec.ImageRepo = ""
+			spec.Container.Name = ""
+		}, []string{"spec.imageRepo", "spec.container.name"}},
+	}
+
+	for _, tc := range testCases {
+		spec := validSpec()
+		tc.modify(&spec)
+
+		errs := ValidateSpec(&spec)
+		if len(errs) != len(tc.expected) {
+			t.Errorf("%s: expected %d errors, got %v", tc.name, len(tc.expected), errs)
+			continue
+		}
+		for i, field := range tc.expected {
+			if errs[i].Field != field {
+				t.Errorf("%s: expected error for %s, got %v", tc.name, field, errs[i])
+			}
+			if !strings.Contains(errs[i].Error(), field) {
+				t.Errorf("%s: expected error message to name %s, got %s", tc.name, field, errs[i].Error())
+			}
+		}
+	}
+}
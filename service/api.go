@@ -0,0 +1,611 @@
+package kcd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/wish/kcd/audit"
+	"github.com/wish/kcd/deploy"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/workload"
+	"github.com/wish/kcd/history"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/resource"
+	"github.com/wish/kcd/stats"
+	goji "goji.io"
+	"goji.io/pat"
+	"goji.io/pattern"
+	corev1 "k8s.io/api/core/v1"
+	k8serr "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// AccessChecker determines whether the user of a request may perform the verb on the
+// KCD resource that the request refers to.
+type AccessChecker interface {
+	Allowed(r *http.Request, verb string) bool
+}
+
+// API serves the versioned JSON REST API for KCD resources.
+type API struct {
+	resourceProvider resource.Provider
+	workloadProvider *workload.K8sProvider
+	historyProvider  history.Provider
+
+	// accessChecker is used to decide which actions are offered on HTML pages.
+	accessChecker AccessChecker
+
+	// auditLogger records the changes made through the API.
+	auditLogger audit.Logger
+
+	// stats is used by the registries queried for diffs.
+	stats stats.Stats
+}
+
+// NewAPI returns an API instance. The workload provider is used to obtain the workloads
+// of KCD resources in any namespace.
+func NewAPI(resourceProvider resource.Provider, workloadProvider *workload.K8sProvider,
+	historyProvider history.Provider) *API {
+
+	return &API{
+		resourceProvider: resourceProvider,
+		workloadProvider: workloadProvider,
+		historyProvider:  historyProvider,
+		auditLogger:      audit.Nop(),
+		stats:            stats.NewFake(),
+	}
+}
+
+// WithAccessChecker sets the access checker used to decide which actions are offered to
+// the user. All actions are offered if no access checker is set.
+func (a *API) WithAccessChecker(ac AccessChecker) *API {
+	a.accessChecker = ac
+	return a
+}
+
+// WithAuditLogger sets the logger that records the changes made through the API.
+func (a *API) WithAuditLogger(logger audit.Logger) *API {
+	a.auditLogger = logger
+	return a
+}
+
+// WithStats sets the stats client used by the registries queried for diffs.
+func (a *API) WithStats(stats stats.Stats) *API {
+	a.stats = stats
+	return a
+}
+
+// Register adds the API routes to the given mux, relative to the mux's root.
+func (a *API) Register(mux *goji.Mux) {
+	const kcdPath = "/v1/namespaces/:namespace/kcds/:name"
+
+	mux.Handle(pat.Get("/v1/kcds"), http.HandlerFunc(a.list))
+	mux.Handle(pat.Get("/v1/namespaces/:namespace/kcds"), http.HandlerFunc(a.list))
+	mux.Handle(pat.Get(kcdPath), http.HandlerFunc(a.get))
+	mux.Handle(pat.Get(kcdPath+"/history"), http.HandlerFunc(a.history))
+	mux.Handle(pat.Post(kcdPath+"/resync"), http.HandlerFunc(a.resync))
+	mux.Handle(pat.Post(kcdPath+"/rollback"), http.HandlerFunc(a.rollback))
+	mux.Handle(pat.Post(kcdPath+"/approve"), http.HandlerFunc(a.approve))
+	mux.Handle(pat.Post(kcdPath+"/pause"), a.setPaused(true))
+	mux.Handle(pat.Post(kcdPath+"/resume"), a.setPaused(false))
+	mux.Handle(pat.Put(kcdPath+"/version"), http.HandlerFunc(a.setVersion))
+	mux.Handle(pat.Delete(kcdPath+"/version"), http.HandlerFunc(a.clearVersion))
+	mux.Handle(pat.Get(kcdPath+"/diff"), http.HandlerFunc(a.diff))
+	mux.Handle(pat.Get("/v1/namespaces/:namespace/resources/:name/diff"), http.HandlerFunc(a.diff))
+}
+
+const (
+	// ServiceRoleLive is the role of the service that receives production traffic.
+	ServiceRoleLive = "live"
+
+	// ServiceRoleVerification is the role of the service used to verify new versions.
+	ServiceRoleVerification = "verification"
+
+	// maxHistoryEntries is the number of history records shown on the detail page.
+	maxHistoryEntries = 20
+)
+
+// KCDList is the response of the list endpoints.
+type KCDList struct {
+	Items []*kcd1.KCD `json:"items"`
+}
+
+// KCDDetail is a KCD resource along with the workloads it selects.
+type KCDDetail struct {
+	KCD       *kcd1.KCD        `json:"kcd"`
+	Workloads []WorkloadDetail `json:"workloads"`
+	Services  []ServiceDetail  `json:"services,omitempty"`
+}
+
+// WorkloadDetail describes a workload selected by a KCD resource, including the version
+// of its pod template and the versions its pods are running. For blue-green rollouts
+// the color is given by the values of the blue-green labels of the pod template, and
+// the workload is live if it is selected by the service.
+type WorkloadDetail struct {
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Type      string      `json:"type"`
+	Image     string      `json:"image"`
+	Version   string      `json:"version"`
+	Color     string      `json:"color,omitempty"`
+	Live      bool        `json:"live,omitempty"`
+	Pods      []PodDetail `json:"pods"`
+}
+
+// ServiceDetail describes a service that is switched between workloads by blue-green
+// rollouts.
+type ServiceDetail struct {
+	Name     string            `json:"name"`
+	Role     string            `json:"role"`
+	Selector map[string]string `json:"selector"`
+}
+
+// PodDetail describes the live version and readiness of a pod.
+type PodDetail struct {
+	Name    string `json:"name"`
+	Image   string `json:"image"`
+	Version string `json:"version"`
+	Phase   string `json:"phase"`
+	Ready   bool   `json:"ready"`
+}
+
+// History is the rollout history of the workloads of a KCD resource, most recent first.
+type History struct {
+	Name    string   `json:"name"`
+	Entries []string `json:"entries"`
+}
+
+// VersionRequest is the request body of the version override and rollback endpoints.
+type VersionRequest struct {
+	Version string `json:"version"`
+}
+
+// list returns the KCD resources, optionally filtered by namespace, label selector and status.
+func (a *API) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	namespace := pathParam(r, "namespace")
+	if namespace == "" {
+		namespace = q.Get("namespace")
+	}
+
+	kcds, err := a.resourceProvider.KCDs(namespace, q.Get("labelSelector"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := q.Get("status")
+	result := KCDList{Items: make([]*kcd1.KCD, 0, len(kcds))}
+	for _, kcd := range kcds {
+		if status != "" && kcd.Status.CurrStatus != status {
+			continue
+		}
+		result.Items = append(result.Items, kcd)
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// get returns a KCD resource along with its workloads and their live pod versions.
+func (a *API) get(w http.ResponseWriter, r *http.Request) {
+	kcd, err := a.resourceProvider.KCD(pat.Param(r, "namespace"), pat.Param(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	detail, err := a.detail(kcd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "html" {
+		a.detailHTML(w, r, detail)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// detail returns the details of the workloads selected by the KCD resource.
+func (a *API) detail(kcd *kcd1.KCD) (*KCDDetail, error) {
+	wp := a.workloadProvider.ForNamespace(kcd.Namespace)
+
+	workloads, err := wp.Workloads(kcd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain workloads for kcd %s", kcd.Name)
+	}
+
+	result := &KCDDetail{
+		KCD:       kcd,
+		Workloads: make([]WorkloadDetail, 0, len(workloads)),
+	}
+	if bg := kcd.Spec.Strategy.BlueGreen; bg != nil {
+		result.Services, err = blueGreenServices(wp, bg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to obtain blue-green services for kcd %s", kcd.Name)
+		}
+	}
+	for _, wl := range workloads {
+		wd := WorkloadDetail{
+			Name:      wl.Name(),
+			Namespace: wl.Namespace(),
+			Type:      wl.Type(),
+		}
+		wd.Image, wd.Version = containerVersion(kcd, wl.PodSpec().Containers)
+		if tw, ok := wl.(workload.TemplateWorkload); ok && kcd.Spec.Strategy.BlueGreen != nil {
+			wd.Color = blueGreenColor(kcd.Spec.Strategy.BlueGreen.LabelNames, tw.PodTemplateSpec().Labels)
+			for _, service := range result.Services {
+				if service.Role == ServiceRoleLive && len(service.Selector) > 0 &&
+					labels.SelectorFromSet(service.Selector).Matches(labels.Set(tw.PodTemplateSpec().Labels)) {
+					wd.Live = true
+				}
+			}
+		}
+
+		pods, err := deploy.ActivePodsForTarget(wp.Client(), kcd.Namespace, wl)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to obtain pods for workload %s", wl.Name())
+		}
+		for _, pod := range pods {
+			pd := PodDetail{
+				Name:  pod.Name,
+				Phase: string(pod.Status.Phase),
+				Ready: deploy.CheckPodRunningState(pod),
+			}
+			pd.Image, pd.Version = containerVersion(kcd, pod.Spec.Containers)
+			wd.Pods = append(wd.Pods, pd)
+		}
+
+		result.Workloads = append(result.Workloads, wd)
+	}
+
+	return result, nil
+}
+
+// detailHTML writes the detail page of a KCD resource, including its rollout history.
+// Actions are only offered if the user may update the KCD resource.
+func (a *API) detailHTML(w http.ResponseWriter, r *http.Request, detail *KCDDetail) {
+	entries, err := a.historyEntries(detail.KCD)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(entries) > maxHistoryEntries {
+		entries = entries[:maxHistoryEntries]
+	}
+
+	canUpdate := a.accessChecker == nil || a.accessChecker.Allowed(r, "update")
+
+	if err := genKCDDetailHTML(w, detail, entries, canUpdate); err != nil {
+		glog.Errorf("Failed to generate kcd detail page: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// history returns the rollout history of the workloads of a KCD resource.
+func (a *API) history(w http.ResponseWriter, r *http.Request) {
+	kcd, err := a.resourceProvider.KCD(pat.Param(r, "namespace"), pat.Param(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entries, err := a.historyEntries(kcd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, History{Name: kcd.Name, Entries: entries})
+}
+
+// historyEntries returns the history records of all workloads selected by the KCD
+// resource, most recent first. History is recorded per workload by the syncer.
+func (a *API) historyEntries(kcd *kcd1.KCD) ([]string, error) {
+	workloads, err := a.workloadProvider.ForNamespace(kcd.Namespace).Workloads(kcd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain workloads for kcd %s", kcd.Name)
+	}
+
+	entries := []string{}
+	for _, wl := range workloads {
+		msg, err := a.historyProvider.History(kcd.Namespace, wl.Name())
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to obtain history for workload %s", wl.Name())
+		}
+		for _, entry := range strings.Split(msg, "\n\n") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+
+	// records start with their UTC timestamp, so they sort chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(entries)))
+	return entries, nil
+}
+
+// resync marks the current rollout of the KCD resource for resync, causing the syncer to
+// attempt it again including its verification, e.g. after a failure.
+func (a *API) resync(w http.ResponseWriter, r *http.Request) {
+	namespace, name := pat.Param(r, "namespace"), pat.Param(r, "name")
+	prev, err := a.resourceProvider.KCD(namespace, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	kcd, err := a.resourceProvider.UpdateStatus(namespace, name, "", resource.StatusResync, time.Now().UTC())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	auditStatusUpdate(a.auditLogger, r, prev, kcd, "resync")
+
+	writeJSON(w, http.StatusOK, kcd)
+}
+
+// rollback pins the KCD resource to the version given in the request body or, if none
+// is given, to the last successfully deployed version. The pin remains until the version
+// override is removed, since the tag may still reference the version rolled back from.
+func (a *API) rollback(w http.ResponseWriter, r *http.Request) {
+	namespace, name := pat.Param(r, "namespace"), pat.Param(r, "name")
+
+	var req VersionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	kcd, err := a.resourceProvider.KCD(namespace, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Version != "" {
+		if err := checkVersionSyntax(kcd, req.Version); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+			return
+		}
+	}
+
+	version := req.Version
+	if version == "" {
+		version = kcd.Status.SuccessVersion
+	}
+	if version == "" || (version == kcd.Status.CurrVersion && kcd.Status.CurrStatus == resource.StatusSuccess) {
+		writeJSON(w, http.StatusConflict, apiError{Error: "no previous version to roll back to"})
+		return
+	}
+
+	glog.V(1).Infof("Rolling back kcd=%s/%s to version %s", namespace, name, version)
+	a.updateSpec(w, r, "rollback", func(spec *kcd1.KCDSpec) {
+		spec.VersionOverride = version
+	})
+}
+
+// approve approves the version given in the request body or, if none is given, the
+// version that is awaiting approval or whose downgrade is blocked.
+func (a *API) approve(w http.ResponseWriter, r *http.Request) {
+	namespace, name := pat.Param(r, "namespace"), pat.Param(r, "name")
+
+	var req VersionRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body: " + err.Error()})
+			return
+		}
+	}
+
+	kcd, err := a.resourceProvider.KCD(namespace, name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	version := req.Version
+	if version == "" && (kcd.Status.CurrStatus == resource.StatusAwaitingApproval ||
+		kcd.Status.CurrStatus == resource.StatusDowngradeBlocked) {
+		version = kcd.Status.CurrVersion
+	}
+	if version == "" {
+		writeJSON(w, http.StatusConflict, apiError{Error: "no version is awaiting approval"})
+		return
+	}
+
+	glog.V(1).Infof("Approving version %s of kcd=%s/%s", version, namespace, name)
+	a.updateSpec(w, r, "approve", func(spec *kcd1.KCDSpec) {
+		spec.ApprovedVersion = version
+	})
+}
+
+// setPaused returns a handler that pauses or resumes rollouts of a KCD resource.
+func (a *API) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := "resume"
+		if paused {
+			action = "pause"
+		}
+		a.updateSpec(w, r, action, func(spec *kcd1.KCDSpec) {
+			spec.Paused = paused
+		})
+	}
+}
+
+// setVersion pins the KCD resource to the version given in the request body, which must
+// match the version syntax of the KCD resource.
+func (a *API) setVersion(w http.ResponseWriter, r *http.Request) {
+	var req VersionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "invalid request body: " + err.Error()})
+		return
+	}
+	if req.Version == "" {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "version is required"})
+		return
+	}
+
+	kcd, err := a.resourceProvider.KCD(pat.Param(r, "namespace"), pat.Param(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkVersionSyntax(kcd, req.Version); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	a.updateSpec(w, r, "set version", func(spec *kcd1.KCDSpec) {
+		spec.VersionOverride = req.Version
+	})
+}
+
+// checkVersionSyntax returns an error if the version doesn't match the version syntax of
+// the KCD resource, since the syncer would never roll it out.
+func checkVersionSyntax(kcd *kcd1.KCD, version string) error {
+	syntax := providers.VersionSyntax(kcd)
+	versionRegex, err := regexp.Compile(syntax)
+	if err != nil {
+		return errors.Wrapf(err, "invalid version syntax %s of kcd %s", syntax, kcd.Name)
+	}
+	if !versionRegex.MatchString(version) {
+		return errors.Errorf("version %s doesn't match the version syntax %s of kcd %s", version, syntax, kcd.Name)
+	}
+	return nil
+}
+
+// clearVersion removes the version override of a KCD resource.
+func (a *API) clearVersion(w http.ResponseWriter, r *http.Request) {
+	a.updateSpec(w, r, "clear version", func(spec *kcd1.KCDSpec) {
+		spec.VersionOverride = ""
+	})
+}
+
+// updateSpec updates the spec of the KCD resource of the request and writes the updated
+// resource. The change is recorded in the audit log with the given action as reason.
+func (a *API) updateSpec(w http.ResponseWriter, r *http.Request, action string, update func(spec *kcd1.KCDSpec)) {
+	var old, new string
+	kcd, err := a.resourceProvider.UpdateSpec(pat.Param(r, "namespace"), pat.Param(r, "name"), func(spec *kcd1.KCDSpec) {
+		old = specValue(spec)
+		update(spec)
+		new = specValue(spec)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	entry := audit.ForKCD(kcd, audit.SourceAPI, requestActor(r), audit.ActionUpdateSpec)
+	entry.Old = old
+	entry.New = new
+	entry.Reason = auditReason(r, action)
+	a.auditLogger.Log(entry)
+
+	writeJSON(w, http.StatusOK, kcd)
+}
+
+// containerVersion returns the image and version of the kcd managed container.
+func containerVersion(kcd *kcd1.KCD, containers []corev1.Container) (image, version string) {
+	for _, c := range containers {
+		if c.Name == kcd.Spec.Container.Name {
+			idx := strings.LastIndex(c.Image, ":")
+			if idx < 0 || idx < strings.LastIndex(c.Image, "/") {
+				return c.Image, ""
+			}
+			return c.Image, c.Image[idx+1:]
+		}
+	}
+	return "", ""
+}
+
+// blueGreenServices returns the live and verification services of a blue-green rollout.
+func blueGreenServices(wp *workload.K8sProvider, bg *kcd1.BlueGreenSpec) ([]ServiceDetail, error) {
+	var result []ServiceDetail
+	for role, serviceNames := range map[string][]string{
+		ServiceRoleLive:         deploy.LiveServices(bg),
+		ServiceRoleVerification: deploy.VerificationServices(bg),
+	} {
+		for _, serviceName := range serviceNames {
+			service, err := wp.Client().CoreV1().Services(wp.Namespace()).Get(context.TODO(), serviceName, metav1.GetOptions{})
+			if err != nil {
+				if k8serr.IsNotFound(err) {
+					continue
+				}
+				return nil, errors.Wrapf(err, "failed to get service %s", serviceName)
+			}
+			result = append(result, ServiceDetail{
+				Name:     service.Name,
+				Role:     role,
+				Selector: service.Spec.Selector,
+			})
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Role < result[j].Role
+	})
+	return result, nil
+}
+
+// blueGreenColor returns the color of a workload, given by the values of its blue-green labels.
+func blueGreenColor(labelNames []string, podLabels map[string]string) string {
+	var values []string
+	for _, labelName := range labelNames {
+		if v, ok := podLabels[labelName]; ok {
+			values = append(values, v)
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// apiError is the response body of failed API requests.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeError writes the error as a JSON response with a status code matching the error.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch {
+	case k8serr.IsNotFound(errors.Cause(err)):
+		code = http.StatusNotFound
+	case k8serr.IsBadRequest(errors.Cause(err)):
+		code = http.StatusBadRequest
+	}
+	if code == http.StatusInternalServerError {
+		glog.Errorf("API request failed: %+v", err)
+	}
+
+	writeJSON(w, code, apiError{Error: err.Error()})
+}
+
+// writeJSON writes the value as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("Failed to encode API response: %v", err)
+	}
+}
+
+// pathParam returns the value of the path parameter with the given name, or an empty
+// string if the matched route has no such parameter.
+func pathParam(r *http.Request, name string) string {
+	if v, ok := r.Context().Value(pattern.Variable(name)).(string); ok {
+		return v
+	}
+	return ""
+}
@@ -0,0 +1,370 @@
+package kcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wish/kcd/audit"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	kcdfake "github.com/wish/kcd/gok8s/client/clientset/versioned/fake"
+	"github.com/wish/kcd/gok8s/workload"
+	"github.com/wish/kcd/history"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/resource"
+	"github.com/wish/kcd/stats"
+	goji "goji.io"
+	"goji.io/pat"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gofake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestKCD(name, status string) *kcd1.KCD {
+	return &kcd1.KCD{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "ns",
+			Labels:    map[string]string{"team": "a"},
+		},
+		Spec: kcd1.KCDSpec{
+			ImageRepo:     "repo/app",
+			VersionSyntax: "^v[0-9]+$",
+			Selector:      map[string]string{"kcdapp": name},
+			Container:     kcd1.ContainerSpec{Name: "app"},
+		},
+		Status: kcd1.KCDStatus{
+			CurrVersion:    "v2",
+			CurrStatus:     status,
+			SuccessVersion: "v1",
+		},
+	}
+}
+
+func newTestAPI() http.Handler {
+	return newTestAPIWithAccess(nil, audit.Nop())
+}
+
+func newTestAPIWithAccess(ac AccessChecker, auditLogger audit.Logger) http.Handler {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "ns",
+			Labels:    map[string]string{"kcdapp": "app"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"pod": "app"}},
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "repo/app:v2"}},
+				},
+			},
+		},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-1",
+			Namespace: "ns",
+			Labels:    map[string]string{"pod": "app"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "repo/app:v1"}},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+
+	historyConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app.history",
+			Namespace: "ns",
+		},
+		Data: map[string]string{
+			"Info": "Update occurred at:2020-01-02 00:00:00 +0000 UTC:\nWorkload:app to version:v2\n\n" +
+				"Update occurred at:2020-01-01 00:00:00 +0000 UTC:\nWorkload:app to version:v1\n",
+		},
+	}
+
+	cs := gofake.NewSimpleClientset(deployment, pod, historyConfig)
+	kcdcs := kcdfake.NewSimpleClientset(newTestKCD("app", resource.StatusFailed), newTestKCD("other", resource.StatusSuccess))
+
+	workloadProvider := workload.NewProvider(cs, kcdcs, "")
+	resourceProvider := resource.NewK8sProvider("", kcdcs, workloadProvider)
+
+	mux := goji.NewMux()
+	kcdmux := goji.SubMux()
+	mux.Handle(pat.New("/kcd/*"), kcdmux)
+	api := NewAPI(resourceProvider, workloadProvider, history.NewProvider(cs, stats.NewFake())).WithAuditLogger(auditLogger)
+	if ac != nil {
+		api.WithAccessChecker(ac)
+	}
+	api.Register(kcdmux)
+	return mux
+}
+
+func doRequest(t *testing.T, h http.Handler, method, url string, body interface{}, result interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatalf("failed to encode request body: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, url, &buf))
+
+	if result != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), result); err != nil {
+			t.Fatalf("failed to decode response of %s %s: %v", method, url, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAPIList(t *testing.T) {
+	api := newTestAPI()
+
+	testCases := []struct {
+		url      string
+		expected int
+	}{
+		{"/kcd/v1/kcds", 2},
+		{"/kcd/v1/kcds?namespace=other", 0},
+		{"/kcd/v1/namespaces/ns/kcds?status=Failed", 1},
+		{"/kcd/v1/namespaces/ns/kcds?labelSelector=team%3Da", 2},
+		{"/kcd/v1/namespaces/ns/kcds?labelSelector=team%3Db", 0},
+	}
+
+	for _, tc := range testCases {
+		var list KCDList
+		if code := doRequest(t, api, http.MethodGet, tc.url, nil, &list); code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", tc.url, code)
+			continue
+		}
+		if len(list.Items) != tc.expected {
+			t.Errorf("%s: expected %d items, got %d", tc.url, tc.expected, len(list.Items))
+		}
+	}
+}
+
+func TestAPIGet(t *testing.T) {
+	api := newTestAPI()
+
+	var detail KCDDetail
+	if code := doRequest(t, api, http.MethodGet, "/kcd/v1/namespaces/ns/kcds/app", nil, &detail); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(detail.Workloads) != 1 {
+		t.Fatalf("expected 1 workload, got %d", len(detail.Workloads))
+	}
+	wl := detail.Workloads[0]
+	if wl.Version != "v2" || len(wl.Pods) != 1 || wl.Pods[0].Version != "v1" {
+		t.Errorf("unexpected workload detail: %+v", wl)
+	}
+
+	if code := doRequest(t, api, http.MethodGet, "/kcd/v1/namespaces/ns/kcds/missing", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing kcd, got %d", code)
+	}
+}
+
+func TestAPIActions(t *testing.T) {
+	api := newTestAPI()
+	base := "/kcd/v1/namespaces/ns/kcds/"
+
+	var kcd kcd1.KCD
+	if code := doRequest(t, api, http.MethodPost, base+"app/pause", nil, &kcd); code != http.StatusOK || !kcd.Spec.Paused {
+		t.Errorf("expected kcd to be paused, got status %d, paused=%v", code, kcd.Spec.Paused)
+	}
+	kcd = kcd1.KCD{}
+	if code := doRequest(t, api, http.MethodPost, base+"app/resume", nil, &kcd); code != http.StatusOK || kcd.Spec.Paused {
+		t.Errorf("expected kcd to be resumed, got status %d, paused=%v", code, kcd.Spec.Paused)
+	}
+
+	if code := doRequest(t, api, http.MethodPut, base+"app/version", VersionRequest{}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an empty version, got %d", code)
+	}
+	if code := doRequest(t, api, http.MethodPut, base+"app/version", VersionRequest{Version: "latest"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a version not matching the version syntax, got %d", code)
+	}
+	if code := doRequest(t, api, http.MethodPost, base+"app/rollback", VersionRequest{Version: "latest"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a rollback version not matching the version syntax, got %d", code)
+	}
+	if code := doRequest(t, api, http.MethodPut, base+"app/version", VersionRequest{Version: "v3"}, &kcd); code != http.StatusOK ||
+		kcd.Spec.VersionOverride != "v3" {
+		t.Errorf("expected version override v3, got status %d, override=%s", code, kcd.Spec.VersionOverride)
+	}
+	kcd = kcd1.KCD{}
+	if code := doRequest(t, api, http.MethodDelete, base+"app/version", nil, &kcd); code != http.StatusOK || kcd.Spec.VersionOverride != "" {
+		t.Errorf("expected version override to be removed, got status %d, override=%s", code, kcd.Spec.VersionOverride)
+	}
+
+	if code := doRequest(t, api, http.MethodPost, base+"app/rollback", nil, &kcd); code != http.StatusOK || kcd.Spec.VersionOverride != "v1" {
+		t.Errorf("expected rollback to v1, got status %d, override=%s", code, kcd.Spec.VersionOverride)
+	}
+
+	if code := doRequest(t, api, http.MethodPost, base+"app/approve", nil, nil); code != http.StatusConflict {
+		t.Errorf("expected status 409 when no version is awaiting approval, got %d", code)
+	}
+	if code := doRequest(t, api, http.MethodPost, base+"app/approve", VersionRequest{Version: "v2"}, &kcd); code != http.StatusOK ||
+		kcd.Spec.ApprovedVersion != "v2" {
+		t.Errorf("expected approved version v2, got status %d, approved=%s", code, kcd.Spec.ApprovedVersion)
+	}
+
+	if code := doRequest(t, api, http.MethodPost, base+"app/resync", nil, &kcd); code != http.StatusOK ||
+		kcd.Status.CurrStatus != resource.StatusResync {
+		t.Errorf("expected resync to mark kcd for resync, got status %d, currStatus=%s", code, kcd.Status.CurrStatus)
+	}
+}
+
+func TestAPIAudit(t *testing.T) {
+	var auditLog bytes.Buffer
+	api := newTestAPIWithAccess(nil, audit.NewJSONLogger(&auditLog))
+	base := "/kcd/v1/namespaces/ns/kcds/"
+
+	if code := doRequest(t, api, http.MethodPut, base+"app/version?reason=incident", VersionRequest{Version: "v3"}, nil); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if code := doRequest(t, api, http.MethodPost, base+"app/resync", nil, nil); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	var entries []audit.Entry
+	for _, line := range strings.Split(strings.TrimSpace(auditLog.String()), "\n") {
+		var entry audit.Entry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to decode audit log entry %s: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit log entries, got %d", len(entries))
+	}
+
+	spec := entries[0]
+	if spec.Action != audit.ActionUpdateSpec || spec.Source != audit.SourceAPI || spec.Actor != anonymousActor ||
+		spec.KCD != "app" || spec.Reason != "set version: incident" ||
+		!strings.Contains(spec.Old, "versionOverride= ") || !strings.Contains(spec.New, "versionOverride=v3") {
+		t.Errorf("unexpected spec audit log entry %+v", spec)
+	}
+
+	status := entries[1]
+	if status.Action != audit.ActionUpdateStatus || status.Old != "version=v2 status=Failed" ||
+		status.New != "version=v2 status=Resync" || status.Reason != "resync" {
+		t.Errorf("unexpected status audit log entry %+v", status)
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	api := newTestAPI()
+
+	var h History
+	if code := doRequest(t, api, http.MethodGet, "/kcd/v1/namespaces/ns/kcds/app/history", nil, &h); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	if len(h.Entries) != 2 || !strings.HasSuffix(h.Entries[0], "version:v2") {
+		t.Errorf("expected 2 history entries, most recent first, got %q", h.Entries)
+	}
+}
+
+type denyAll struct{}
+
+func (denyAll) Allowed(r *http.Request, verb string) bool {
+	return false
+}
+
+func TestAPIDetailHTML(t *testing.T) {
+	testCases := []struct {
+		api         http.Handler
+		withActions bool
+	}{
+		{newTestAPI(), true},
+		{newTestAPIWithAccess(denyAll{}, audit.Nop()), false},
+	}
+
+	for i, tc := range testCases {
+		rec := httptest.NewRecorder()
+		tc.api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/kcd/v1/namespaces/ns/kcds/app?format=html", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%d: expected status 200, got %d", i, rec.Code)
+		}
+
+		page := rec.Body.String()
+		for _, expected := range []string{"ns/app", "repo/app:v2", "app-1", "Workload:app to version:v1"} {
+			if !strings.Contains(page, expected) {
+				t.Errorf("%d: expected detail page to contain %q", i, expected)
+			}
+		}
+		if hasActions := strings.Contains(page, "Roll back to v1"); hasActions != tc.withActions {
+			t.Errorf("%d: expected actions=%v, got %v", i, tc.withActions, hasActions)
+		}
+	}
+}
+
+// fakeRegistry returns the versions of tags from a map.
+type fakeRegistry map[string][]string
+
+func (f fakeRegistry) RegistryFor(imageRepo string) (registry.Registry, error) {
+	return f, nil
+}
+
+func (f fakeRegistry) Versions(ctx context.Context, tag string) ([]string, error) {
+	return f[tag], nil
+}
+
+func TestAPIDiff(t *testing.T) {
+	origProvider := newRegistryProvider
+	defer func() { newRegistryProvider = origProvider }()
+	newRegistryProvider = func(kcd *kcd1.KCD, stats stats.Stats) (registry.Provider, error) {
+		return fakeRegistry{"": {"v3"}}, nil
+	}
+
+	api := newTestAPI()
+
+	for _, url := range []string{"/kcd/v1/namespaces/ns/kcds/app/diff", "/kcd/v1/namespaces/ns/resources/app/diff"} {
+		var diff Diff
+		if code := doRequest(t, api, http.MethodGet, url, nil, &diff); code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", url, code)
+		}
+		if diff.TargetVersion != "v3" || len(diff.Workloads) != 1 || len(diff.Workloads[0].Containers) != 1 {
+			t.Fatalf("%s: unexpected diff %+v", url, diff)
+		}
+		expected := ContainerDiff{Name: "app", CurrentImage: "repo/app:v2", TargetImage: "repo/app:v3", Reason: DiffPending}
+		if c := diff.Workloads[0].Containers[0]; c != expected {
+			t.Errorf("%s: expected container diff %+v, got %+v", url, expected, c)
+		}
+	}
+
+	if code := doRequest(t, api, http.MethodGet, "/kcd/v1/namespaces/ns/kcds/missing/diff", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a missing kcd, got %d", code)
+	}
+}
+
+func TestContainerDiff(t *testing.T) {
+	testCases := []struct {
+		name     string
+		image    string
+		status   string
+		versions []string
+		expected string
+	}{
+		{"up to date", "repo/app:v2", resource.StatusSuccess, []string{"v1", "v2"}, DiffUpToDate},
+		{"new version", "repo/app:v2", resource.StatusSuccess, []string{"v3"}, DiffPending},
+		{"progressing", "repo/app:v1", resource.StatusProgressing, []string{"v2"}, DiffPending},
+		{"drifted", "repo/app:v1", resource.StatusSuccess, []string{"v2"}, DiffDrifted},
+		{"failed", "repo/app:v1", resource.StatusFailed, []string{"v2"}, DiffFailedNotRetried},
+		{"other repository", "other/app:v1", resource.StatusSuccess, []string{"v2"}, DiffError},
+		{"no versions", "repo/app:v1", resource.StatusSuccess, nil, DiffUpToDate},
+	}
+
+	for _, tc := range testCases {
+		kcd := newTestKCD("app", tc.status)
+		cd := containerDiff(kcd, corev1.Container{Name: "app", Image: tc.image}, tc.versions)
+		if cd.Reason != tc.expected {
+			t.Errorf("%s: expected reason %s, got %+v", tc.name, tc.expected, cd)
+		}
+	}
+}
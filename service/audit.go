@@ -0,0 +1,52 @@
+package kcd
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/wish/kcd/audit"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+// anonymousActor is the actor recorded for requests without an authenticated user.
+const anonymousActor = "anonymous"
+
+// requestActor returns the name of the authenticated user of the request.
+func requestActor(r *http.Request) string {
+	if u, ok := request.UserFrom(r.Context()); ok && u.GetName() != "" {
+		return u.GetName()
+	}
+	return anonymousActor
+}
+
+// auditReason returns the reason recorded in the audit log for the action, including the
+// reason given in the reason query parameter of the request.
+func auditReason(r *http.Request, action string) string {
+	if reason := r.URL.Query().Get("reason"); reason != "" {
+		return fmt.Sprintf("%s: %s", action, reason)
+	}
+	return action
+}
+
+// specValue returns the description of the spec fields changed by the API in the audit log.
+func specValue(spec *kcd1.KCDSpec) string {
+	return fmt.Sprintf("paused=%t versionOverride=%s approvedVersion=%s",
+		spec.Paused, spec.VersionOverride, spec.ApprovedVersion)
+}
+
+// statusValue returns the description of the status of a KCD resource in the audit log.
+func statusValue(kcd *kcd1.KCD) string {
+	return fmt.Sprintf("version=%s status=%s", kcd.Status.CurrVersion, kcd.Status.CurrStatus)
+}
+
+// auditStatusUpdate records the status update of a KCD resource made by the request.
+func auditStatusUpdate(logger audit.Logger, r *http.Request, prev, kcd *kcd1.KCD, action string) {
+	entry := audit.ForKCD(kcd, audit.SourceAPI, requestActor(r), audit.ActionUpdateStatus)
+	if prev != nil {
+		entry.Old = statusValue(prev)
+	}
+	entry.New = statusValue(kcd)
+	entry.Reason = auditReason(r, action)
+	logger.Log(entry)
+}
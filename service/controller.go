@@ -421,7 +421,7 @@ func (c *CVController) newKCDSyncDeployment(kcd *kcd1.KCD, version string) *apps
 							Name:            fmt.Sprintf("%s-container", dName),
 							Image:           fmt.Sprintf("%s:%s", c.kcdImgRepo, version),
 							ImagePullPolicy: "Always",
-							Args: []string{
+							Args: append([]string{
 								"registry",
 								"sync",
 								fmt.Sprintf("--namespace=%s", kcd.Namespace),
@@ -430,7 +430,7 @@ func (c *CVController) newKCDSyncDeployment(kcd *kcd1.KCD, version string) *apps
 								fmt.Sprintf("--logtostderr=true"),
 								fmt.Sprintf("--v=%d", glogVerbosity),
 								fmt.Sprintf("--vmodule=%s", glogVmodule),
-							},
+							}, syncerArgs()...),
 							Env: []corev1.EnvVar{
 								{
 									Name: "NAME",
@@ -474,10 +474,25 @@ func (c *CVController) newKCDSyncDeployment(kcd *kcd1.KCD, version string) *apps
 	}
 }
 
-// propagate glog flags
+// propagate glog and generic workload flags
 var (
 	glogVerbosity int
 	glogVmodule   string
+
+	genericWorkloads []string
+
+	auditLog    string
+	auditEvents bool
+
+	ecrTimeout     time.Duration
+	ecrMaxRetries  int
+	ecrAssumeRoles []string
+
+	registryCacheTTL  time.Duration
+	registryRateLimit float64
+	registryRateBurst int
+
+	localRegistryRoot string
 )
 
 func init() {
@@ -485,12 +500,90 @@ func init() {
 	glogFlags.ParseErrorsWhitelist.UnknownFlags = true
 	glogFlags.IntVar(&glogVerbosity, "v", 1, "log level for V logs")
 	glogFlags.StringVar(&glogVmodule, "vmodule", "", "comma-separated list of pattern=N settings for file-filtered logging")
+	glogFlags.StringArrayVar(&genericWorkloads, "generic-workload", nil, "custom workload kinds managed by syncers")
+	glogFlags.StringVar(&auditLog, "audit-log", "", "destination of the audit log of syncers")
+	glogFlags.BoolVar(&auditEvents, "audit-events", false, "whether syncers record the audit log as events")
+	glogFlags.DurationVar(&ecrTimeout, "ecr-timeout", 0, "timeout of ECR operations of syncers")
+	glogFlags.IntVar(&ecrMaxRetries, "ecr-max-retries", -1, "maximum number of retries of ECR requests of syncers")
+	glogFlags.StringArrayVar(&ecrAssumeRoles, "ecr-assume-role", nil, "IAM roles assumed by syncers to access ECR repositories")
+	glogFlags.DurationVar(&registryCacheTTL, "registry-cache-ttl", -1, "time syncers cache registry versions")
+	glogFlags.Float64Var(&registryRateLimit, "registry-rate-limit", -1, "requests per second of syncers to a registry host")
+	glogFlags.IntVar(&registryRateBurst, "registry-rate-burst", -1, "burst of requests of syncers to a registry host")
+	glogFlags.StringVar(&localRegistryRoot, "local-registry-root", "", "directory of the local registries of syncers")
 	err := glogFlags.Parse(os.Args)
 	if err != nil {
 		fmt.Printf("Error parsing glog propagation flags: %v\n", err)
 	}
 }
 
+// syncerArgs returns the arguments of the controller that are passed on to syncers.
+func syncerArgs() []string {
+	var args []string
+	args = append(args, genericWorkloadArgs()...)
+	args = append(args, auditArgs()...)
+	args = append(args, ecrArgs()...)
+	args = append(args, registryCacheArgs()...)
+	if localRegistryRoot != "" {
+		args = append(args, fmt.Sprintf("--local-registry-root=%s", localRegistryRoot))
+	}
+	return args
+}
+
+// genericWorkloadArgs returns the syncer arguments for the custom workload kinds
+// that the controller was started with.
+func genericWorkloadArgs() []string {
+	var args []string
+	for _, def := range genericWorkloads {
+		args = append(args, fmt.Sprintf("--generic-workload=%s", def))
+	}
+	return args
+}
+
+// auditArgs returns the syncer arguments for the audit log that the controller was
+// started with.
+func auditArgs() []string {
+	var args []string
+	if auditLog != "" {
+		args = append(args, fmt.Sprintf("--audit-log=%s", auditLog))
+	}
+	if auditEvents {
+		args = append(args, "--audit-events=true")
+	}
+	return args
+}
+
+// ecrArgs returns the syncer arguments for the ECR registry that the controller was
+// started with.
+func ecrArgs() []string {
+	var args []string
+	if ecrTimeout != 0 {
+		args = append(args, fmt.Sprintf("--ecr-timeout=%s", ecrTimeout))
+	}
+	if ecrMaxRetries >= 0 {
+		args = append(args, fmt.Sprintf("--ecr-max-retries=%d", ecrMaxRetries))
+	}
+	for _, assumeRole := range ecrAssumeRoles {
+		args = append(args, fmt.Sprintf("--ecr-assume-role=%s", assumeRole))
+	}
+	return args
+}
+
+// registryCacheArgs returns the syncer arguments for the registry cache that the
+// controller was started with.
+func registryCacheArgs() []string {
+	var args []string
+	if registryCacheTTL >= 0 {
+		args = append(args, fmt.Sprintf("--registry-cache-ttl=%s", registryCacheTTL))
+	}
+	if registryRateLimit >= 0 {
+		args = append(args, fmt.Sprintf("--registry-rate-limit=%g", registryRateLimit))
+	}
+	if registryRateBurst >= 0 {
+		args = append(args, fmt.Sprintf("--registry-rate-burst=%d", registryRateBurst))
+	}
+	return args
+}
+
 func syncDeployName(kcdName string) string {
 	return fmt.Sprintf("kcdsync-%s", kcdName)
 }
@@ -0,0 +1,241 @@
+package kcd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	"github.com/wish/kcd/gok8s/workload"
+	"github.com/wish/kcd/registry"
+	"github.com/wish/kcd/registry/providers"
+	"github.com/wish/kcd/registry/pullsecret"
+	"github.com/wish/kcd/resource"
+	"github.com/wish/kcd/stats"
+	"goji.io/pat"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Reasons of container diffs.
+const (
+	// DiffUpToDate means the container runs one of the target versions.
+	DiffUpToDate = "UpToDate"
+
+	// DiffPending means kcd will roll out the target version to the container.
+	DiffPending = "Pending"
+
+	// DiffDrifted means the version of the container was changed outside of kcd after
+	// the target version was rolled out successfully. kcd will roll it out again.
+	DiffDrifted = "Drifted"
+
+	// DiffFailedNotRetried means the rollout of the target version failed, or was rolled
+	// back, and kcd won't retry it until a new version is available.
+	DiffFailedNotRetried = "FailedNotRetried"
+
+	// DiffError means the container can't be compared with the target version, e.g.
+	// because it uses an image from another repository.
+	DiffError = "Error"
+)
+
+// Diff describes the changes kcd would make to the workloads of a KCD resource if it
+// synced now.
+type Diff struct {
+	Name           string         `json:"name"`
+	Namespace      string         `json:"namespace"`
+	TargetVersion  string         `json:"targetVersion"`
+	TargetVersions []string       `json:"targetVersions"`
+	CurrVersion    string         `json:"currVersion"`
+	CurrStatus     string         `json:"currStatus"`
+	Message        string         `json:"message,omitempty"`
+	Workloads      []WorkloadDiff `json:"workloads"`
+}
+
+// WorkloadDiff describes the changes kcd would make to the containers of a workload.
+type WorkloadDiff struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"`
+	Containers []ContainerDiff `json:"containers"`
+}
+
+// ContainerDiff describes the current and target image of a container managed by kcd.
+type ContainerDiff struct {
+	Name         string `json:"name"`
+	CurrentImage string `json:"currentImage"`
+	TargetImage  string `json:"targetImage,omitempty"`
+	Reason       string `json:"reason"`
+	Error        string `json:"error,omitempty"`
+}
+
+// newRegistryProvider returns the registry provider used to resolve the versions of
+// the KCD resource. Replaced in tests.
+var newRegistryProvider = func(kcd *kcd1.KCD, stats stats.Stats) (registry.Provider, error) {
+	return providers.NewProvider(kcd, stats)
+}
+
+// diff returns the changes kcd would make to the workloads of a KCD resource right now.
+func (a *API) diff(w http.ResponseWriter, r *http.Request) {
+	kcd, err := a.resourceProvider.KCD(pat.Param(r, "namespace"), pat.Param(r, "name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	result, err := a.diffFor(r.Context(), kcd)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// diffFor compares the versions of the workloads selected by the KCD resource with the
+// versions the syncer would roll out, following the same decisions as the syncer.
+func (a *API) diffFor(ctx context.Context, kcd *kcd1.KCD) (*Diff, error) {
+	workloads, err := a.workloadProvider.ForNamespace(kcd.Namespace).Workloads(kcd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to obtain workloads for kcd %s", kcd.Name)
+	}
+	versions, message, err := a.targetVersions(ctx, kcd, workloads)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Diff{
+		Name:           kcd.Name,
+		Namespace:      kcd.Namespace,
+		TargetVersions: versions,
+		CurrVersion:    kcd.Status.CurrVersion,
+		CurrStatus:     kcd.Status.CurrStatus,
+		Message:        message,
+		Workloads:      []WorkloadDiff{},
+	}
+	if len(versions) > 0 {
+		result.TargetVersion = versions[0]
+	}
+	if result.Message == "" && kcd.Spec.Paused {
+		result.Message = "rollouts are paused"
+	}
+	if result.Message == "" && kcd.Status.CurrStatus == resource.StatusDowngradeBlocked &&
+		result.TargetVersion == kcd.Status.CurrVersion && result.TargetVersion != kcd.Spec.ApprovedVersion &&
+		!kcd.Spec.AllowDowngrade && kcd.Spec.VersionOverride == "" {
+		result.Message = fmt.Sprintf("downgrade to version %s is blocked until it is approved", result.TargetVersion)
+	}
+	if result.Message == "" && kcd.Spec.Strategy.RequireApproval && kcd.Spec.VersionOverride == "" &&
+		result.TargetVersion != "" && result.TargetVersion != kcd.Spec.ApprovedVersion {
+		result.Message = fmt.Sprintf("version %s is awaiting approval", result.TargetVersion)
+	}
+
+	for _, wl := range workloads {
+		wd := WorkloadDiff{
+			Name:       wl.Name(),
+			Type:       wl.Type(),
+			Containers: []ContainerDiff{},
+		}
+		for _, c := range wl.PodSpec().Containers {
+			if c.Name != kcd.Spec.Container.Name {
+				continue
+			}
+			wd.Containers = append(wd.Containers, containerDiff(kcd, c, versions))
+		}
+		result.Workloads = append(result.Workloads, wd)
+	}
+
+	return result, nil
+}
+
+// targetVersions returns the versions the syncer would accept for the KCD resource,
+// the first of which is rolled out, along with a message if no version is available.
+// Like the syncer, the registry is queried with the credentials of the registrySecretRef
+// of the KCD resource or of the image pull secrets of its workloads.
+func (a *API) targetVersions(ctx context.Context, kcd *kcd1.KCD, workloads []workload.Workload) ([]string, string, error) {
+	if kcd.Spec.VersionOverride != "" {
+		return []string{kcd.Spec.VersionOverride}, "", nil
+	}
+
+	if pf := kcd.Spec.PromoteFrom; pf != nil {
+		namespace := pf.Namespace
+		if namespace == "" {
+			namespace = kcd.Namespace
+		}
+		src, err := a.resourceProvider.KCD(namespace, pf.Name)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to obtain source KCD %s/%s for promotion", namespace, pf.Name)
+		}
+		version, ok := resource.PromotableVersion(src, time.Duration(pf.SoakSeconds)*time.Second, time.Now().UTC())
+		if !ok {
+			return nil, fmt.Sprintf("no version of kcd %s/%s is ready for promotion", namespace, pf.Name), nil
+		}
+		return []string{version}, "", nil
+	}
+
+	provider, err := newRegistryProvider(kcd, a.stats)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to create registry provider for %s", providers.Source(kcd))
+	}
+	reg, err := provider.RegistryFor(providers.Source(kcd))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to build registry for %s", providers.Source(kcd))
+	}
+	var podSpecs []corev1.PodSpec
+	for _, wl := range workloads {
+		podSpecs = append(podSpecs, wl.PodSpec())
+	}
+	regCtx, err := pullsecret.WithCredentials(ctx, a.workloadProvider.Client(), kcd.Namespace, providers.Source(kcd),
+		kcd.Spec.RegistrySecretRef, podSpecs)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to read registry credentials for kcd %s", kcd.Name)
+	}
+	versions, err := reg.Versions(regCtx, kcd.Spec.Tag)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to get versions of tag %s from registry", kcd.Spec.Tag)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Sprintf("no versions found for tag %s", kcd.Spec.Tag), nil
+	}
+	return versions, "", nil
+}
+
+// containerDiff returns the diff of a container managed by the KCD resource against the
+// target versions.
+func containerDiff(kcd *kcd1.KCD, c corev1.Container, versions []string) ContainerDiff {
+	cd := ContainerDiff{
+		Name:         c.Name,
+		CurrentImage: c.Image,
+		Reason:       DiffUpToDate,
+	}
+	if len(versions) == 0 {
+		return cd
+	}
+	cd.TargetImage = kcd.Spec.ImageRepo + ":" + versions[0]
+
+	ok, err := workload.CheckPodSpecVersion(corev1.PodSpec{Containers: []corev1.Container{c}}, kcd, versions...)
+	switch {
+	case err != nil:
+		cd.Reason = DiffError
+		cd.Error = err.Error()
+	case ok:
+		cd.TargetImage = c.Image
+	case !containsVersion(versions, kcd.Status.CurrVersion):
+		cd.Reason = DiffPending
+	case kcd.Status.CurrStatus == resource.StatusFailed || kcd.Status.CurrStatus == resource.StatusRolledBack:
+		cd.Reason = DiffFailedNotRetried
+	case kcd.Status.CurrStatus == resource.StatusSuccess:
+		cd.Reason = DiffDrifted
+	default:
+		cd.Reason = DiffPending
+	}
+	return cd
+}
+
+// containsVersion returns whether version is one of versions.
+func containsVersion(versions []string, version string) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
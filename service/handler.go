@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/wish/kcd/audit"
 	"github.com/wish/kcd/resource"
 	"github.com/pkg/errors"
 	"goji.io/pat"
@@ -16,7 +17,9 @@ import (
 
 var statusWeight = map[string]int{
 	resource.StatusProgressing: 1,
+	resource.StatusResync:      1,
 	resource.StatusFailed:      2,
+	resource.StatusRolledBack:  2,
 	resource.StatusSuccess:     3,
 }
 
@@ -47,6 +50,30 @@ func genCVHTML(w io.Writer, resources []*resource.Resource, namespace string, re
 	return nil
 }
 
+func genKCDDetailHTML(w io.Writer, detail *KCDDetail, history []string, canUpdate bool) error {
+	t := template.Must(template.New("kcdDetail").Parse(kcdDetailHTML))
+	kcd := detail.KCD
+	data := struct {
+		*KCDDetail
+		DesiredImage     string
+		History          []string
+		CanUpdate        bool
+		AwaitingApproval bool
+	}{
+		KCDDetail:        detail,
+		DesiredImage:     kcd.Spec.ImageRepo + ":" + kcd.Status.CurrVersion,
+		History:          history,
+		CanUpdate:        canUpdate,
+		AwaitingApproval: kcd.Status.CurrStatus == resource.StatusAwaitingApproval ||
+			kcd.Status.CurrStatus == resource.StatusDowngradeBlocked,
+	}
+	err := t.Execute(w, data)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate template of kcd detail")
+	}
+	return nil
+}
+
 func genCV(w io.Writer, resources []*resource.Resource) error {
 	bytes, err := json.Marshal(resources)
 	if err != nil {
@@ -123,8 +150,8 @@ func NewResourceHandler(resourceProvider resource.Provider) http.HandlerFunc {
 }
 
 // NewResourceUpdateHandler is a web handler that performs status updates of KCD
-// managed resources.
-func NewResourceUpdateHandler(resourceProvider resource.Provider) http.HandlerFunc {
+// managed resources. Updates are recorded in the audit log.
+func NewResourceUpdateHandler(resourceProvider resource.Provider, auditLogger audit.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		name := pat.Param(r, "name")
 		namespace := pat.Param(r, "namespace")
@@ -132,10 +159,17 @@ func NewResourceUpdateHandler(resourceProvider resource.Provider) http.HandlerFu
 		q := r.URL.Query()
 		status := q.Get("status")
 
-		_, err := resourceProvider.UpdateStatus(namespace, name, "", status, time.Now().UTC())
+		prev, err := resourceProvider.KCD(namespace, name)
+		if err != nil {
+			glog.V(2).Infof("failed to get resource for name=%s before update, error=%+v", name, err)
+		}
+
+		kcd, err := resourceProvider.UpdateStatus(namespace, name, "", status, time.Now().UTC())
 		if err != nil {
 			glog.Errorf("failed to update resource for name=%s, error=%+v", name, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
+		auditStatusUpdate(auditLogger, r, prev, kcd, "update status")
 	}
 }
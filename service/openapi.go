@@ -0,0 +1,463 @@
+package kcd
+
+import (
+	"net/http"
+)
+
+// NewOpenAPIHandler is a web handler that serves the OpenAPI document of the kcd REST API.
+func NewOpenAPIHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write([]byte(openAPIDocument)); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	}
+}
+
+// openAPIDocument describes the kcd REST API served under /kcd/v1.
+const openAPIDocument = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "kcd",
+    "description": "REST API for KCD resources managed by the kcd controller.",
+    "version": "v1"
+  },
+  "servers": [{"url": "/kcd"}],
+  "security": [{"bearerAuth": []}],
+  "paths": {
+    "/v1/kcds": {
+      "get": {
+        "summary": "List KCD resources of all namespaces",
+        "operationId": "listKCDs",
+        "parameters": [
+          {"$ref": "#/components/parameters/namespaceQuery"},
+          {"$ref": "#/components/parameters/labelSelector"},
+          {"$ref": "#/components/parameters/status"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCDList"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds": {
+      "parameters": [{"$ref": "#/components/parameters/namespace"}],
+      "get": {
+        "summary": "List KCD resources of a namespace",
+        "operationId": "listNamespacedKCDs",
+        "parameters": [
+          {"$ref": "#/components/parameters/labelSelector"},
+          {"$ref": "#/components/parameters/status"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCDList"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "get": {
+        "summary": "Get a KCD resource with its workloads and the versions of their pods",
+        "operationId": "getKCD",
+        "parameters": [
+          {"name": "format", "in": "query", "schema": {"type": "string", "enum": ["json", "html"]}}
+        ],
+        "responses": {
+          "200": {
+            "description": "The KCD resource and its workloads, or an HTML page if the html format is requested.",
+            "content": {
+              "application/json": {"schema": {"$ref": "#/components/schemas/KCDDetail"}},
+              "text/html": {"schema": {"type": "string"}}
+            }
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/history": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "get": {
+        "summary": "Get the rollout history of a KCD resource",
+        "operationId": "getKCDHistory",
+        "responses": {
+          "200": {
+            "description": "The rollout history.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/History"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/diff": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "get": {
+        "summary": "Get the changes kcd would make to the workloads of a KCD resource right now",
+        "operationId": "getKCDDiff",
+        "responses": {
+          "200": {
+            "description": "The current and target images of the containers managed by the KCD resource.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Diff"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/resources/{name}/diff": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "get": {
+        "summary": "Get the changes kcd would make to the workloads of a KCD resource right now (alias of getKCDDiff)",
+        "operationId": "getResourceDiff",
+        "responses": {
+          "200": {
+            "description": "The current and target images of the containers managed by the KCD resource.",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Diff"}}}
+          },
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/resync": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "post": {
+        "summary": "Retry the current rollout of a KCD resource",
+        "operationId": "resyncKCD",
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/rollback": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "post": {
+        "summary": "Roll back to the given version, or to the last successful version if none is given",
+        "operationId": "rollbackKCD",
+        "requestBody": {
+          "required": false,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionRequest"}}}
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/approve": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "post": {
+        "summary": "Approve the given version, or the version awaiting approval or blocked as a downgrade if none is given",
+        "operationId": "approveKCD",
+        "requestBody": {
+          "required": false,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionRequest"}}}
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/pause": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "post": {
+        "summary": "Pause rollouts of a KCD resource",
+        "operationId": "pauseKCD",
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/resume": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "post": {
+        "summary": "Resume rollouts of a KCD resource",
+        "operationId": "resumeKCD",
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/kcds/{name}/version": {
+      "parameters": [
+        {"$ref": "#/components/parameters/namespace"},
+        {"$ref": "#/components/parameters/name"}
+      ],
+      "put": {
+        "summary": "Pin a KCD resource to a version",
+        "operationId": "setKCDVersion",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/VersionRequest"}}}
+        },
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove the version override of a KCD resource",
+        "operationId": "clearKCDVersion",
+        "responses": {
+          "200": {"$ref": "#/components/responses/KCD"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/events": {
+      "get": {
+        "summary": "Stream status changes of KCD resources of all namespaces",
+        "operationId": "streamEvents",
+        "parameters": [
+          {"$ref": "#/components/parameters/namespaceQuery"},
+          {"$ref": "#/components/parameters/nameQuery"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/StatusEvents"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/v1/namespaces/{namespace}/events": {
+      "parameters": [{"$ref": "#/components/parameters/namespace"}],
+      "get": {
+        "summary": "Stream status changes of KCD resources of a namespace",
+        "operationId": "streamNamespacedEvents",
+        "parameters": [
+          {"$ref": "#/components/parameters/nameQuery"}
+        ],
+        "responses": {
+          "200": {"$ref": "#/components/responses/StatusEvents"},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer"}
+    },
+    "parameters": {
+      "namespace": {"name": "namespace", "in": "path", "required": true, "schema": {"type": "string"}},
+      "name": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "namespaceQuery": {"name": "namespace", "in": "query", "schema": {"type": "string"}},
+      "nameQuery": {"name": "name", "in": "query", "schema": {"type": "string"}},
+      "labelSelector": {"name": "labelSelector", "in": "query", "schema": {"type": "string"}},
+      "status": {
+        "name": "status", "in": "query",
+        "schema": {"type": "string", "enum": ["Progressing", "Success", "Failed", "AwaitingApproval", "RolledBack", "DowngradeBlocked", "Resync"]}
+      }
+    },
+    "responses": {
+      "KCD": {
+        "description": "The KCD resource.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/KCD"}}}
+      },
+      "KCDList": {
+        "description": "A list of KCD resources.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/KCDList"}}}
+      },
+      "StatusEvents": {
+        "description": "Server-Sent Events named after the event type, whose data is a StatusEvent and whose id is the resource version of the KCD resource. The stream starts with an Added event for each existing KCD resource.",
+        "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/StatusEvent"}}}
+      },
+      "Error": {
+        "description": "The request failed.",
+        "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+      }
+    },
+    "schemas": {
+      "KCD": {
+        "type": "object",
+        "properties": {
+          "apiVersion": {"type": "string"},
+          "kind": {"type": "string"},
+          "metadata": {"type": "object"},
+          "spec": {
+            "type": "object",
+            "properties": {
+              "imageRepo": {"type": "string"},
+              "tag": {"type": "string"},
+              "versionSyntax": {"type": "string"},
+              "selector": {"type": "object", "additionalProperties": {"type": "string"}},
+              "container": {"type": "object"},
+              "strategy": {"type": "object"},
+              "paused": {"type": "boolean"},
+              "versionOverride": {"type": "string"},
+              "approvedVersion": {"type": "string"}
+            }
+          },
+          "status": {
+            "type": "object",
+            "properties": {
+              "currVersion": {"type": "string"},
+              "currStatus": {"type": "string"},
+              "currStatusTime": {"type": "string", "format": "date-time"},
+              "successVersion": {"type": "string"},
+              "successTime": {"type": "string", "format": "date-time"},
+              "pods": {
+                "type": "object",
+                "properties": {
+                  "total": {"type": "integer"},
+                  "updated": {"type": "integer"},
+                  "ready": {"type": "integer"}
+                }
+              }
+            }
+          }
+        }
+      },
+      "KCDList": {
+        "type": "object",
+        "properties": {
+          "items": {"type": "array", "items": {"$ref": "#/components/schemas/KCD"}}
+        }
+      },
+      "KCDDetail": {
+        "type": "object",
+        "properties": {
+          "kcd": {"$ref": "#/components/schemas/KCD"},
+          "workloads": {"type": "array", "items": {"$ref": "#/components/schemas/Workload"}},
+          "services": {"type": "array", "items": {"$ref": "#/components/schemas/Service"}}
+        }
+      },
+      "Workload": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "namespace": {"type": "string"},
+          "type": {"type": "string"},
+          "image": {"type": "string"},
+          "version": {"type": "string"},
+          "color": {"type": "string"},
+          "live": {"type": "boolean"},
+          "pods": {"type": "array", "items": {"$ref": "#/components/schemas/Pod"}}
+        }
+      },
+      "Service": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "role": {"type": "string", "enum": ["live", "verification"]},
+          "selector": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "Pod": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "image": {"type": "string"},
+          "version": {"type": "string"},
+          "phase": {"type": "string"},
+          "ready": {"type": "boolean"}
+        }
+      },
+      "History": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "entries": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "Diff": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "namespace": {"type": "string"},
+          "targetVersion": {"type": "string"},
+          "targetVersions": {"type": "array", "items": {"type": "string"}},
+          "currVersion": {"type": "string"},
+          "currStatus": {"type": "string"},
+          "message": {"type": "string"},
+          "workloads": {
+            "type": "array",
+            "items": {
+              "type": "object",
+              "properties": {
+                "name": {"type": "string"},
+                "type": {"type": "string"},
+                "containers": {"type": "array", "items": {"$ref": "#/components/schemas/ContainerDiff"}}
+              }
+            }
+          }
+        }
+      },
+      "ContainerDiff": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "currentImage": {"type": "string"},
+          "targetImage": {"type": "string"},
+          "reason": {"type": "string", "enum": ["UpToDate", "Pending", "Drifted", "FailedNotRetried", "Error"]},
+          "error": {"type": "string"}
+        }
+      },
+      "StatusEvent": {
+        "type": "object",
+        "properties": {
+          "type": {"type": "string", "enum": ["Added", "Updated", "Deleted"]},
+          "namespace": {"type": "string"},
+          "name": {"type": "string"},
+          "version": {"type": "string"},
+          "status": {"type": "string"},
+          "prevStatus": {"type": "string"},
+          "statusTime": {"type": "string", "format": "date-time"},
+          "successVersion": {"type": "string"},
+          "pods": {
+            "type": "object",
+            "properties": {
+              "total": {"type": "integer"},
+              "updated": {"type": "integer"},
+              "ready": {"type": "integer"}
+            }
+          },
+          "paused": {"type": "boolean"}
+        }
+      },
+      "VersionRequest": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,279 @@
+package kcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
+	informer "github.com/wish/kcd/gok8s/client/informers/externalversions/custom/v1"
+	listers "github.com/wish/kcd/gok8s/client/listers/custom/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// StatusEventAdded is sent for KCD resources that exist when a stream is opened
+	// and for KCD resources that are created while the stream is open.
+	StatusEventAdded = "Added"
+
+	// StatusEventUpdated is sent when the status of a KCD resource changes, e.g. when
+	// a rollout moves to the next phase or more pods become ready.
+	StatusEventUpdated = "Updated"
+
+	// StatusEventDeleted is sent when a KCD resource is deleted.
+	StatusEventDeleted = "Deleted"
+
+	// subscriberBuffer is the number of events buffered for each stream before events
+	// are dropped for slow clients.
+	subscriberBuffer = 64
+
+	// heartbeatInterval is the interval of comments sent to keep idle streams open.
+	heartbeatInterval = 15 * time.Second
+
+	// reconnectDelay is the delay after which clients should reconnect to a stream.
+	reconnectDelay = 2 * time.Second
+)
+
+// StatusEvent describes a status change of a KCD resource.
+type StatusEvent struct {
+	Type       string          `json:"type"`
+	Namespace  string          `json:"namespace"`
+	Name       string          `json:"name"`
+	Version    string          `json:"version"`
+	Status     string          `json:"status"`
+	PrevStatus string          `json:"prevStatus,omitempty"`
+	StatusTime time.Time       `json:"statusTime"`
+	Success    string          `json:"successVersion"`
+	Pods       kcd1.PodsStatus `json:"pods"`
+	Paused     bool            `json:"paused,omitempty"`
+
+	resourceVersion string
+}
+
+// newStatusEvent returns a status event of the given type for the KCD resource.
+func newStatusEvent(typ string, kcd *kcd1.KCD) StatusEvent {
+	return StatusEvent{
+		Type:            typ,
+		Namespace:       kcd.Namespace,
+		Name:            kcd.Name,
+		Version:         kcd.Status.CurrVersion,
+		Status:          kcd.Status.CurrStatus,
+		StatusTime:      kcd.Status.CurrStatusTime.Time,
+		Success:         kcd.Status.SuccessVersion,
+		Pods:            kcd.Status.Pods,
+		Paused:          kcd.Spec.Paused,
+		resourceVersion: kcd.ResourceVersion,
+	}
+}
+
+// EventStream streams status changes of KCD resources to HTTP clients as Server-Sent
+// Events. It is fed by the KCD informer.
+type EventStream struct {
+	lister listers.KCDLister
+
+	// maxDuration is the duration after which streams are closed so that they are not
+	// cut off by the write timeout of the server. Clients are expected to reconnect.
+	maxDuration time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan StatusEvent]struct{}
+}
+
+// NewEventStream returns an EventStream instance fed by the given KCD informer. Streams
+// are closed after maxDuration, or never if maxDuration is zero.
+func NewEventStream(kcdInformer informer.KCDInformer, maxDuration time.Duration) *EventStream {
+	es := &EventStream{
+		lister:      kcdInformer.Lister(),
+		maxDuration: maxDuration,
+		subscribers: make(map[chan StatusEvent]struct{}),
+	}
+
+	kcdInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if kcd, ok := obj.(*kcd1.KCD); ok {
+				es.publish(newStatusEvent(StatusEventAdded, kcd))
+			}
+		},
+		UpdateFunc: func(old, new interface{}) {
+			oldKCD, ok := old.(*kcd1.KCD)
+			if !ok {
+				return
+			}
+			newKCD, ok := new.(*kcd1.KCD)
+			if !ok || !statusChanged(oldKCD, newKCD) {
+				return
+			}
+			event := newStatusEvent(StatusEventUpdated, newKCD)
+			if oldKCD.Status.CurrStatus != newKCD.Status.CurrStatus || oldKCD.Status.CurrVersion != newKCD.Status.CurrVersion {
+				event.PrevStatus = oldKCD.Status.CurrStatus
+			}
+			es.publish(event)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if kcd, ok := obj.(*kcd1.KCD); ok {
+				es.publish(newStatusEvent(StatusEventDeleted, kcd))
+			}
+		},
+	})
+
+	return es
+}
+
+// statusChanged returns whether an update of a KCD resource is relevant to its rollout
+// status. Resyncs of the informer and other spec changes are ignored.
+func statusChanged(old, new *kcd1.KCD) bool {
+	return old.Status.CurrVersion != new.Status.CurrVersion ||
+		old.Status.CurrStatus != new.Status.CurrStatus ||
+		!old.Status.CurrStatusTime.Equal(&new.Status.CurrStatusTime) ||
+		old.Status.SuccessVersion != new.Status.SuccessVersion ||
+		old.Status.Pods != new.Status.Pods ||
+		old.Spec.Paused != new.Spec.Paused
+}
+
+// subscribe returns a channel that receives all published events.
+func (es *EventStream) subscribe() chan StatusEvent {
+	ch := make(chan StatusEvent, subscriberBuffer)
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe stops publishing events to the channel.
+func (es *EventStream) unsubscribe(ch chan StatusEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	delete(es.subscribers, ch)
+}
+
+// publish sends the event to all subscribers. Events are dropped for subscribers that
+// don't keep up rather than blocking the informer.
+func (es *EventStream) publish(event StatusEvent) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	for ch := range es.subscribers {
+		select {
+		case ch <- event:
+		default:
+			glog.V(2).Infof("Dropping status event for kcd=%s/%s for slow subscriber", event.Namespace, event.Name)
+		}
+	}
+}
+
+// ServeHTTP implements the http.Handler interface. It sends an Added event for each
+// existing KCD resource followed by status changes as they happen. Events can be
+// filtered with the namespace and name query parameters, and the namespace path
+// parameter.
+func (es *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	namespace := pathParam(r, "namespace")
+	if namespace == "" {
+		namespace = q.Get("namespace")
+	}
+	name := q.Get("name")
+
+	matches := func(event StatusEvent) bool {
+		return (namespace == "" || event.Namespace == namespace) && (name == "" || event.Name == name)
+	}
+
+	// Subscribe before listing so that no changes are missed in between.
+	ch := es.subscribe()
+	defer es.unsubscribe(ch)
+
+	var kcds []*kcd1.KCD
+	var err error
+	if namespace == "" {
+		kcds, err = es.lister.List(labels.Everything())
+	} else {
+		kcds, err = es.lister.KCDs(namespace).List(labels.Everything())
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", reconnectDelay/time.Millisecond); err != nil {
+		return
+	}
+	for _, kcd := range kcds {
+		event := newStatusEvent(StatusEventAdded, kcd)
+		if !matches(event) {
+			continue
+		}
+		if err := writeEvent(w, event); err != nil {
+			glog.V(2).Infof("Failed to write status event: %v", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	var deadline <-chan time.Time
+	if es.maxDuration > 0 {
+		timer := time.NewTimer(es.maxDuration)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		select {
+		case event := <-ch:
+			if !matches(event) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				glog.V(2).Infof("Failed to write status event: %v", err)
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-deadline:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes the event in the Server-Sent Events format. The event name is the
+// event type, and the resource version of the KCD resource is used as event id.
+func writeEvent(w http.ResponseWriter, event StatusEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode status event")
+	}
+	if event.resourceVersion != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", event.resourceVersion); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -0,0 +1,105 @@
+package kcd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kcdfake "github.com/wish/kcd/gok8s/client/clientset/versioned/fake"
+	informer "github.com/wish/kcd/gok8s/client/informers/externalversions"
+	"github.com/wish/kcd/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// readEvent reads the next event from a Server-Sent Events stream, skipping comments
+// and fields other than event and data.
+func readEvent(t *testing.T, scanner *bufio.Scanner) (string, StatusEvent) {
+	var typ string
+	var event StatusEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("failed to decode event data: %v", err)
+			}
+		case line == "" && typ != "":
+			return typ, event
+		}
+	}
+	t.Fatalf("stream ended unexpectedly: %v", scanner.Err())
+	return "", event
+}
+
+func TestEventStream(t *testing.T) {
+	kcdcs := kcdfake.NewSimpleClientset(newTestKCD("app", resource.StatusSuccess), newTestKCD("other", resource.StatusSuccess))
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	factory := informer.NewSharedInformerFactory(kcdcs, 0)
+	kcdInformer := factory.Custom().V1().KCDs()
+	es := NewEventStream(kcdInformer, 0)
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, kcdInformer.Informer().HasSynced) {
+		t.Fatalf("failed to sync informer")
+	}
+
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?name=app")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected event stream content type, got %s", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	typ, event := readEvent(t, scanner)
+	if typ != StatusEventAdded || event.Name != "app" || event.Status != resource.StatusSuccess {
+		t.Fatalf("expected Added event for app, got %s %+v", typ, event)
+	}
+
+	/////
+
+	// Only the status change of app is streamed, since the stream is filtered by name.
+	for _, name := range []string{"other", "app"} {
+		kcd, err := kcdcs.CustomV1().KCDs("ns").Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("failed to get kcd: %v", err)
+		}
+		kcd.Status.CurrVersion = "v3"
+		kcd.Status.CurrStatus = resource.StatusProgressing
+		if _, err := kcdcs.CustomV1().KCDs("ns").Update(context.TODO(), kcd, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("failed to update kcd: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		typ, event = readEvent(t, scanner)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for status event")
+	}
+
+	if typ != StatusEventUpdated || event.Name != "app" || event.Version != "v3" ||
+		event.Status != resource.StatusProgressing || event.PrevStatus != resource.StatusSuccess {
+		t.Errorf("unexpected status event %s %+v", typ, event)
+	}
+}
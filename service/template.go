@@ -22,9 +22,31 @@ const kcdListHTML = `
     {{if .Reload}}
     <script>
         window.onload = function() {
-            setTimeout(function () {
-                location.reload(true);
-            }, 60000);
+            if (!window.EventSource) {
+                setTimeout(function () {
+                    location.reload(true);
+                }, 60000);
+                return;
+            }
+            var params = new URLSearchParams(window.location.search);
+            var query = new URLSearchParams();
+            if ({{.Namespace}}) {
+                query.set("namespace", {{.Namespace}});
+            }
+            if (params.get("access_token")) {
+                query.set("access_token", params.get("access_token"));
+            }
+            var pending = null;
+            var reload = function() {
+                if (pending === null) {
+                    pending = setTimeout(function () {
+                        location.reload(true);
+                    }, 1000);
+                }
+            };
+            var source = new EventSource("/kcd/v1/events?" + query.toString());
+            source.addEventListener("Updated", reload);
+            source.addEventListener("Deleted", reload);
         };
     </script>
     {{end}}
@@ -47,11 +69,11 @@ const kcdListHTML = `
                 </thead>
                 <tbody>
                 {{range .Resources}}
-                <tr {{if eq .Status "Failed"}}class="failed"{{else if eq .Status "Progressing"}}class="progress"{{else if and (eq .Status "Success") .Recent}}class="success"{{end}} >
+                <tr {{if or (eq .Status "Failed") (eq .Status "RolledBack")}}class="failed"{{else if eq .Status "Progressing"}}class="progress"{{else if and (eq .Status "Success") .Recent}}class="success"{{end}} >
                     {{if eq $.Namespace ""}}<td>{{.Namespace}}</td>{{end}}
-                    <td>{{.Name}}</td>
+                    <td><a class="kcd-detail" href="/kcd/v1/namespaces/{{.Namespace}}/kcds/{{.Name}}?format=html">{{.Name}}</a></td>
                     <td>{{.Container}}</td>
-                    <td><p {{if eq .Status "Failed"}}class="failed"{{else if eq .Status "Progressing"}}class="progress"{{else if and (eq .Status "Success") .Recent}}class="success"{{end}}>{{.Status}}</td>
+                    <td><p {{if or (eq .Status "Failed") (eq .Status "RolledBack")}}class="failed"{{else if eq .Status "Progressing"}}class="progress"{{else if and (eq .Status "Success") .Recent}}class="success"{{end}}>{{.Status}}</td>
                     <td>{{.CurrVersion}}</td>
                     <td>{{if ne .LiveVersion .CurrVersion}}{{.LiveVersion}}{{end}}</td>
                 </tr>
@@ -61,6 +83,148 @@ const kcdListHTML = `
         </div>
     </section>
 </main>
+<script>
+    (function () {
+        var token = new URLSearchParams(window.location.search).get("access_token");
+        if (!token) {
+            return;
+        }
+        var links = document.querySelectorAll("a.kcd-detail");
+        for (var i = 0; i < links.length; i++) {
+            links[i].href += "&access_token=" + encodeURIComponent(token);
+        }
+    })();
+</script>
+</body>
+</html>
+`
+
+const kcdDetailHTML = `
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>kcd: {{.KCD.Namespace}}/{{.KCD.Name}}</title>
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <style type="text/css">
+    body,h1{margin:0}body{padding:0}h1,h2,p,pre,table{font-size:14px;font-family:OpenSans,Lucida Grande,Lucida Sans Unicode,sans-serif;font-weight:100;color:#555;padding:0px;border-collapse:collapse;margin:1px;}h1{font-size:18px;width:100%;border-bottom:solid 1px #eee;color:#7d7d7d;padding:3px}h2{font-size:16px;color:#7d7d7d;margin:15px 15px 0 15px}td,th{text-align:left;padding:0 15px 3px 0;vertical-align:top}table,pre,div.actions{margin:15px}
+    </style>
+    <style type="text/css">
+    span.progress{background-color:#668cff;color:#000000;font-weight:bold}span.failed{background-color:#ff3333;color:#000000;font-weight:bold}span.success{background-color:#66ff66;color:#000000;font-weight:bold}span.awaiting{background-color:#ffcc00;color:#000000;font-weight:bold}td.mismatch{color:#ff3333;font-weight:bold}
+    </style>
+    {{if .CanUpdate}}
+    <script>
+        function kcdAction(action, method) {
+            var params = new URLSearchParams(window.location.search);
+            var headers = {};
+            if (params.get("access_token")) {
+                headers["Authorization"] = "Bearer " + params.get("access_token");
+            }
+            var url = window.location.pathname + "/" + action;
+            fetch(url, {method: method || "POST", headers: headers, credentials: "same-origin"})
+                .then(function (resp) {
+                    if (!resp.ok) {
+                        return resp.json().then(function (body) { throw new Error(body.error || resp.statusText); });
+                    }
+                    location.reload(true);
+                })
+                .catch(function (err) {
+                    alert(action + " failed: " + err.message);
+                });
+        }
+    </script>
+    {{end}}
+</head>
+<body>
+<main>
+    <h1>{{.KCD.Namespace}}/{{.KCD.Name}}</h1>
+    <section>
+        <table>
+            <tr><th scope="row">Status</th><td><span {{if or (eq .KCD.Status.CurrStatus "Failed") (eq .KCD.Status.CurrStatus "RolledBack")}}class="failed"{{else if or (eq .KCD.Status.CurrStatus "Progressing") (eq .KCD.Status.CurrStatus "Resync")}}class="progress"{{else if eq .KCD.Status.CurrStatus "Success"}}class="success"{{else if .AwaitingApproval}}class="awaiting"{{end}}>{{.KCD.Status.CurrStatus}}</span>{{if .KCD.Spec.Paused}} (paused){{end}}</td></tr>
+            <tr><th scope="row">Current Version</th><td>{{.KCD.Status.CurrVersion}}</td></tr>
+            <tr><th scope="row">Last Successful Version</th><td>{{.KCD.Status.SuccessVersion}}</td></tr>
+            {{if .KCD.Spec.VersionOverride}}<tr><th scope="row">Version Override</th><td>{{.KCD.Spec.VersionOverride}}</td></tr>{{end}}
+            <tr><th scope="row">Pods</th><td>{{.KCD.Status.Pods.Ready}} ready, {{.KCD.Status.Pods.Updated}} updated, {{.KCD.Status.Pods.Total}} total</td></tr>
+            <tr><th scope="row">Image Repo</th><td>{{.KCD.Spec.ImageRepo}}</td></tr>
+            <tr><th scope="row">Tag</th><td>{{.KCD.Spec.Tag}}</td></tr>
+            <tr><th scope="row">Container</th><td>{{.KCD.Spec.Container.Name}}</td></tr>
+            <tr><th scope="row">Strategy</th><td>{{if .KCD.Spec.Strategy.Kind}}{{.KCD.Spec.Strategy.Kind}}{{else}}Simple{{end}}{{if .KCD.Spec.Strategy.RequireApproval}}, requires approval{{end}}{{if .KCD.Spec.Strategy.SoakSeconds}}, soak {{.KCD.Spec.Strategy.SoakSeconds}}s{{end}}</td></tr>
+            {{with .KCD.Spec.Strategy.BlueGreen}}<tr><th scope="row">Blue-Green</th><td>service {{.ServiceName}}{{range .ServiceNames}} {{.}}{{end}}{{if or .VerificationServiceName .VerificationServiceNames}}, verification service {{.VerificationServiceName}}{{range .VerificationServiceNames}} {{.}}{{end}}{{end}}, labels {{range $i, $l := .LabelNames}}{{if $i}}, {{end}}{{$l}}{{end}}{{if .ScaleDown}}, scale down{{end}}{{with .Traffic}}, traffic via {{.Kind}} {{.Name}}{{end}}</td></tr>{{end}}
+            <tr><th scope="row">Verify</th><td>{{range .KCD.Spec.Strategy.Verify}}{{.Kind}}: {{.Image}}{{if .Tag}} ({{.Tag}}){{end}}<br>{{else}}none{{end}}</td></tr>
+            <tr><th scope="row">Rollback</th><td>{{if .KCD.Spec.Rollback.Enabled}}enabled{{else}}disabled{{end}}</td></tr>
+        </table>
+    </section>
+    {{if .CanUpdate}}
+    <section>
+        <div class="actions">
+            {{if .AwaitingApproval}}<button onclick="kcdAction('approve')">Approve {{.KCD.Status.CurrVersion}}</button>{{end}}
+            {{if .KCD.Status.SuccessVersion}}<button onclick="if (confirm('Roll back to {{.KCD.Status.SuccessVersion}}?')) { kcdAction('rollback'); }">Roll back to {{.KCD.Status.SuccessVersion}}</button>{{end}}
+            {{if .KCD.Spec.Paused}}<button onclick="kcdAction('resume')">Resume</button>{{else}}<button onclick="kcdAction('pause')">Pause</button>{{end}}
+            {{if .KCD.Spec.VersionOverride}}<button onclick="kcdAction('version', 'DELETE')">Remove version override</button>{{end}}
+        </div>
+    </section>
+    {{end}}
+    {{if .Services}}
+    <section>
+        <h2>Services</h2>
+        <table>
+            <thead>
+            <tr><th scope="col">Name</th><th scope="col">Role</th><th scope="col">Selector</th></tr>
+            </thead>
+            <tbody>
+            {{range .Services}}
+            <tr><td>{{.Name}}</td><td>{{.Role}}</td><td>{{range $k, $v := .Selector}}{{$k}}={{$v}} {{end}}</td></tr>
+            {{end}}
+            </tbody>
+        </table>
+    </section>
+    {{end}}
+    <section>
+        <h2>Workloads</h2>
+        <table>
+            <thead>
+            <tr>
+                <th scope="col">Workload</th>
+                <th scope="col">Type</th>
+                {{if .Services}}<th scope="col">Color</th>{{end}}
+                <th scope="col">Desired Image</th>
+                <th scope="col">Template Image</th>
+                <th scope="col">Pod</th>
+                <th scope="col">Running Version</th>
+                <th scope="col">Phase</th>
+                <th scope="col">Ready</th>
+            </tr>
+            </thead>
+            <tbody>
+            {{range $wl := .Workloads}}
+            <tr>
+                <td>{{$wl.Name}}</td>
+                <td>{{$wl.Type}}</td>
+                {{if $.Services}}<td>{{$wl.Color}}{{if $wl.Live}} (live){{end}}</td>{{end}}
+                <td>{{$.DesiredImage}}</td>
+                <td {{if ne $wl.Version $.KCD.Status.CurrVersion}}class="mismatch"{{end}}>{{$wl.Image}}</td>
+                <td colspan="4">{{if not $wl.Pods}}no pods{{end}}</td>
+            </tr>
+            {{range $wl.Pods}}
+            <tr>
+                <td colspan="{{if $.Services}}5{{else}}4{{end}}"></td>
+                <td>{{.Name}}</td>
+                <td {{if ne .Version $wl.Version}}class="mismatch"{{end}}>{{.Version}}</td>
+                <td>{{.Phase}}</td>
+                <td>{{if .Ready}}yes{{else}}no{{end}}</td>
+            </tr>
+            {{end}}
+            {{end}}
+            </tbody>
+        </table>
+    </section>
+    <section>
+        <h2>History</h2>
+        <pre>{{range .History}}{{.}}
+
+{{else}}No history recorded.{{end}}</pre>
+    </section>
+</main>
 </body>
 </html>
 `
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/wish/kcd/audit"
 	"github.com/wish/kcd/events"
 	"github.com/wish/kcd/stats"
 	"github.com/pkg/errors"
@@ -27,6 +28,7 @@ type Options struct {
 
 	Stats    stats.Stats
 	Recorder events.Recorder
+	Audit    audit.Logger
 }
 
 // WithStartWaitTime sets a StartWaitTime duration as options.
@@ -57,6 +59,13 @@ func WithRecorder(rec events.Recorder) func(*Options) {
 	}
 }
 
+// WithAudit sets an audit logger instance for options.
+func WithAudit(logger audit.Logger) func(*Options) {
+	return func(op *Options) {
+		op.Audit = logger
+	}
+}
+
 // group tracks a collection of related ops, which is typically all the
 // steps in a complete workflow including failure states.
 // This allows the machine to determine when a related set of operations
@@ -102,11 +111,17 @@ func (g *group) complete() bool {
 // new returns a new operation instance for the given state and failure functions
 // but retaining the context of the receiver operation.
 func (o *op) new(state State, failureFunc OnFailure) *op {
+	return o.newWithContext(o.ctx, o.cancel, state, failureFunc)
+}
+
+// newWithContext returns a new operation instance of the receiver's group for the
+// given state and failure functions that runs with the given context.
+func (o *op) newWithContext(ctx context.Context, cancel context.CancelFunc, state State, failureFunc OnFailure) *op {
 	newOp := &op{
 		group:        o.group,
 		state:        state,
-		ctx:          o.ctx,
-		cancel:       o.cancel,
+		ctx:          ctx,
+		cancel:       cancel,
 		retries:      0,
 		failureFuncs: o.failureFuncs,
 	}
@@ -142,6 +157,7 @@ func NewMachine(start State, options ...func(*Options)) *Machine {
 		MaxRetries:       5,
 		Stats:            stats.NewFake(),
 		Recorder:         events.NewFakeRecorder(100),
+		Audit:            audit.Nop(),
 	}
 	for _, opt := range options {
 		opt(opts)
@@ -151,6 +167,7 @@ func NewMachine(start State, options ...func(*Options)) *Machine {
 
 	ctx := stats.NewContext(context.Background(), opts.Stats)
 	ctx = events.NewContext(ctx, opts.Recorder)
+	ctx = audit.NewContext(ctx, opts.Audit)
 
 	return &Machine{
 		start:   start,
@@ -295,6 +312,15 @@ func (m *Machine) permanentFailure(o *op, err error) {
 
 	glog.V(1).Infof("Operation %s failed with permanent error: %+v", ID(o.ctx), err)
 
+	// the states returned by the failure steps, such as rollbacks, run with a new context
+	// and timeout, since the context of the failed operation may have expired.
+	ctx, cancel := context.WithTimeout(context.WithValue(m.ctx, ctxID, ID(o.ctx)), m.options.OperationTimeout)
+	groupCancel := o.cancel
+	failureCancel := func() {
+		cancel()
+		groupCancel()
+	}
+
 	// run the failure steps one by one and then schedule any returned states.
 	var ops []*op
 	for i := len(o.failureFuncs) - 1; i >= 0; i-- {
@@ -302,10 +328,14 @@ func (m *Machine) permanentFailure(o *op, err error) {
 		for _, st := range states.States {
 			if st != nil {
 				// run as after state, to mitigate potential to continuously cycle through error conditions
-				ops = append(ops, o.new(NewAfterState(time.Now().Add(time.Second*15), st), states.OnFailure))
+				ops = append(ops, o.newWithContext(ctx, failureCancel,
+					NewAfterState(time.Now().Add(time.Second*15), st), states.OnFailure))
 			}
 		}
 	}
+	if len(ops) == 0 {
+		cancel()
+	}
 
 	m.scheduleOps(ops...)
 	m.completeOp(o)
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestPermanentFailureContext(t *testing.T) {
+	m := NewMachine(nil, WithTimeout(time.Minute))
+
+	// an operation that timed out
+	ctx, cancel := context.WithTimeout(context.WithValue(m.ctx, ctxID, "op-id"), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+
+	var failCtx context.Context
+	rollback := newStateImpl("rollback")
+	o := &op{
+		group:  &group{},
+		state:  newStateImpl("rollout"),
+		ctx:    ctx,
+		cancel: cancel,
+		failureFuncs: []OnFailure{OnFailureFunc(func(ctx context.Context, err error) States {
+			failCtx = ctx
+			return NewStates(rollback)
+		})},
+	}
+
+	m.permanentFailure(o, errors.New("timed out"))
+
+	if failCtx != ctx {
+		t.Errorf("expected the failure func to receive the context of the failed operation")
+	}
+	if !o.complete || o.group.permError == nil {
+		t.Errorf("expected the failed operation to be complete with a permanent error")
+	}
+
+	select {
+	case failureOp := <-m.ops:
+		if err := failureOp.ctx.Err(); err != nil {
+			t.Errorf("expected the failure state to run in a new context, got error %v", err)
+		}
+		if deadline, ok := failureOp.ctx.Deadline(); !ok || time.Until(deadline) < 50*time.Second {
+			t.Errorf("expected the failure state to have the operation timeout, got deadline %v", deadline)
+		}
+		if id := ID(failureOp.ctx); id != "op-id" {
+			t.Errorf("expected the failure state to keep the operation id, got %s", id)
+		}
+		if as, ok := failureOp.state.(*AfterState); !ok || as.state != rollback {
+			t.Errorf("expected the failure state to be delayed, got %T", failureOp.state)
+		}
+
+		m.completeOp(failureOp)
+		if failureOp.ctx.Err() == nil {
+			t.Errorf("expected the context of the failure state to be cancelled when the group completes")
+		}
+	default:
+		t.Fatalf("expected the failure state to be scheduled")
+	}
+}
@@ -2,6 +2,7 @@ package state
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 )
 
@@ -141,3 +142,28 @@ func WithFailure(state State, onFailure OnFailure) StateFunc {
 		return sts, nil
 	}
 }
+
+// Join returns a state that executes the given branches independently and invokes
+// next only once every branch has completed. Each branch receives the state it must
+// invoke on completion. If a branch fails then next is never invoked.
+func Join(next State, branches ...func(done State) State) StateFunc {
+	return func(ctx context.Context) (States, error) {
+		if len(branches) == 0 {
+			return Single(next)
+		}
+
+		remaining := int32(len(branches))
+		done := StateFunc(func(ctx context.Context) (States, error) {
+			if atomic.AddInt32(&remaining, -1) > 0 {
+				return None()
+			}
+			return Single(next)
+		})
+
+		var states []State
+		for _, branch := range branches {
+			states = append(states, branch(done))
+		}
+		return Many(states...)
+	}
+}
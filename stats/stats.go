@@ -13,6 +13,10 @@ type Stats interface {
 	// and delivers it to statsd backend
 	IncCount(name string, tags ...string)
 
+	// Gauge captures the current value of a measurement (identified by name)
+	// and delivers it to statsd backend
+	Gauge(name string, value int64, tags ...string)
+
 	// ServiceCheck captures the status of a service when a change in the
 	// service status was notified
 	ServiceCheck(name, mesg string, status int, timestamp time.Time, tags ...string)
@@ -38,6 +42,11 @@ func (fs *FakeStats) IncCount(name string, tags ...string) {
 	glog.V(4).Infof("Stats: %s is notified, tags are %s", name, tags)
 }
 
+// Gauge is used to capture the current value of a measurement
+func (fs *FakeStats) Gauge(name string, value int64, tags ...string) {
+	glog.V(4).Infof("Stats: %s is %d, tags are %s", name, value, tags)
+}
+
 // ServiceCheck logs the status of service
 func (fs *FakeStats) ServiceCheck(name, mesg string, status int, timestamp time.Time, tags ...string) {
 	glog.V(4).Infof("Stats: Service Check %s with status %d is received with message %s @ time %s, tags are %s",
@@ -5,19 +5,25 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/user"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+	"github.com/wish/kcd/audit"
 	conf "github.com/wish/kcd/config"
 	"github.com/wish/kcd/events"
+	kcd1 "github.com/wish/kcd/gok8s/apis/custom/v1"
 	clientset "github.com/wish/kcd/gok8s/client/clientset/versioned"
+	"github.com/wish/kcd/gok8s/cluster"
 	"github.com/wish/kcd/gok8s/workload"
 	"github.com/wish/kcd/history"
 	"github.com/wish/kcd/registry"
-	dh "github.com/wish/kcd/registry/dockerhub"
+	"github.com/wish/kcd/registry/cache"
 	"github.com/wish/kcd/registry/ecr"
+	"github.com/wish/kcd/registry/providers"
 	"github.com/wish/kcd/resource"
 	svc "github.com/wish/kcd/service"
 	"github.com/wish/kcd/signals"
@@ -45,6 +51,10 @@ type crParams struct {
 	providerUnused string
 
 	stats statsParams
+	audit auditParams
+	ecr   ecrParams
+	cache registryCacheParams
+	local localRegistryParams
 }
 
 func newCRCommands() *cobra.Command {
@@ -70,6 +80,10 @@ func newCRRootCommand() *regRoot {
 	root.PersistentFlags().StringVar(&params.providerUnused, "provider", "ecr", "unused")
 
 	(&params.stats).addFlags(root.Command)
+	(&params.audit).addFlags(root.Command)
+	(&params.ecr).addFlags(root.Command)
+	(&params.cache).addFlags(root.Command)
+	(&params.local).addFlags(root.Command)
 
 	root.PersistentPreRunE = func(cmd *cobra.Command, args []string) (err error) {
 		// prevent glog complaining about flags not being parsed
@@ -80,6 +94,9 @@ func newCRRootCommand() *regRoot {
 			return errors.Wrap(err, "failed to initialize stats")
 		}
 
+		root.params.cache.setDefault(root.stats)
+		root.params.local.setDefault()
+
 		root.stopChan = signals.SetupTwoWaySignalHandler()
 
 		return nil
@@ -94,6 +111,8 @@ type crSyncParams struct {
 	namespace string
 	kcdName   string
 	version   string
+
+	genericWorkloads []string
 }
 
 func newKCDSyncCommand(root *regRoot) *cobra.Command {
@@ -108,6 +127,7 @@ func newKCDSyncCommand(root *regRoot) *cobra.Command {
 	cmd.Flags().StringVar(&params.namespace, "namespace", "", "namespace of container version resource that the syncer is based on.")
 	cmd.Flags().StringVar(&params.kcdName, "kcd", "", "name of container version resource that the syncer is based on")
 	cmd.Flags().StringVar(&params.version, "version", "", "Indicates version of kcd resources to use in CR Syncer")
+	addGenericWorkloadFlag(cmd, &params.genericWorkloads)
 
 	cmd.PreRunE = func(cmd *cobra.Command, args []string) (err error) {
 		if params.kcdName == "" || params.namespace == "" {
@@ -160,8 +180,18 @@ func newKCDSyncCommand(root *regRoot) *cobra.Command {
 
 		recorder := events.PodEventRecorder(k8sClient, params.namespace)
 
+		auditLogger, err := root.params.audit.logger(k8sClient)
+		if err != nil {
+			scStatus = 2
+			return errors.Wrap(err, "failed to configure audit log")
+		}
+
 		workloadProvider := workload.NewProvider(k8sClient, customCS, params.namespace,
 			conf.WithRecorder(recorder), conf.WithStats(stats))
+		if err = addGenericWorkloads(cfg, workloadProvider, params.genericWorkloads); err != nil {
+			scStatus = 2
+			return errors.Wrap(err, "failed to configure generic workloads")
+		}
 
 		resourceProvider := resource.NewK8sProvider(params.namespace, customCS, workloadProvider)
 
@@ -178,13 +208,19 @@ func newKCDSyncCommand(root *regRoot) *cobra.Command {
 		if kcd.Spec.VersionSyntax == "" {
 			kcd.Spec.VersionSyntax = ecr.VersionRegex
 		}
-		var registryProvider registry.Provider
-		switch registry.ProviderByRepo(kcd.Spec.ImageRepo) {
-		case "ecr":
-			registryProvider, err = ecr.NewECR(kcd.Spec.ImageRepo, kcd.Spec.VersionSyntax, stats)
-		case "dockerhub":
-			registryProvider, err = dh.NewDHV2(kcd.Spec.ImageRepo, kcd.Spec.VersionSyntax, dh.WithStats(stats))
+		syncers, err := registrySyncers(customCS, kcd)
+		if err != nil {
+			glog.Warningf("Failed to count the syncers of the registry of kcd name=%s, not sharing its rate limit: %v",
+				params.kcdName, err)
 		}
+		root.params.cache.setSharedDefault(stats, syncers)
+
+		ecrOptions, err := root.params.ecr.options()
+		if err != nil {
+			scStatus = 2
+			return errors.Wrap(err, "failed to configure ECR")
+		}
+		registryProvider, err := providers.NewProvider(kcd, stats, providers.WithECROptions(ecrOptions...))
 		if err != nil {
 			glog.Errorf("Failed to create registry provider in namespace=%s for kcd name=%s, error=%v",
 				params.namespace, params.kcdName, err)
@@ -193,8 +229,11 @@ func newKCDSyncCommand(root *regRoot) *cobra.Command {
 
 		historyProvider := history.NewProvider(k8sClient, stats)
 
-		crSyncer, err := resource.NewSyncer(resourceProvider, workloadProvider, registryProvider, historyProvider, kcd,
+		clusterProvider := cluster.NewSecretProvider(k8sClient, customCS, workloadProvider,
 			conf.WithRecorder(recorder), conf.WithStats(stats))
+
+		crSyncer, err := resource.NewSyncer(resourceProvider, workloadProvider, registryProvider, historyProvider, clusterProvider, kcd,
+			conf.WithRecorder(recorder), conf.WithStats(stats), conf.WithAudit(auditLogger))
 		if err != nil {
 			glog.Errorf("Failed to create syncer in namespace=%s for kcd name=%s, error=%v",
 				params.namespace, params.kcdName, err)
@@ -243,6 +282,27 @@ func newKCDSyncCommand(root *regRoot) *cobra.Command {
 	return cmd
 }
 
+// registrySyncers returns the number of KCD resources whose versions are looked up in
+// the registry host of the given resource, i.e. the number of syncers that share the
+// rate limit of the host. Resources created later aren't counted until the syncer restarts.
+func registrySyncers(cs clientset.Interface, kcd *kcd1.KCD) (int, error) {
+	kcds, err := cs.CustomV1().KCDs("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return 1, errors.Wrap(err, "failed to list KCD resources")
+	}
+	host := cache.HostOf(providers.Source(kcd))
+	syncers := 0
+	for i := range kcds.Items {
+		if cache.HostOf(providers.Source(&kcds.Items[i])) == host {
+			syncers++
+		}
+	}
+	if syncers == 0 {
+		syncers = 1
+	}
+	return syncers, nil
+}
+
 type regTagParams struct {
 	tags    []string
 	version string
@@ -261,6 +321,7 @@ func newTagsCommand(root *regRoot) *cobra.Command {
 	}
 
 	var crProvider registry.Tagger
+	var auditLogger audit.Logger
 	var params regTagParams
 	cmd.PersistentFlags().StringSliceVar(&params.tags, "tags", nil, "list of tags that needs to be added or removed")
 	cmd.PersistentFlags().StringVar(&params.verPat, "version-pattern", ecr.VersionRegex, "Regex pattern for container version")
@@ -273,15 +334,23 @@ func newTagsCommand(root *regRoot) *cobra.Command {
 			return errors.Wrap(err, "failed to initialize stats")
 		}
 
-		switch registry.ProviderByRepo(root.params.registry) {
-		case "ecr":
-			crProvider, err = ecr.NewECR(root.params.registry, params.verPat, root.stats)
-		case "dockerhub":
-			crProvider, err = dh.NewDHV2(root.params.registry, params.verPat, dh.WithStats(root.stats))
+		ecrOptions, err := root.params.ecr.options()
+		if err != nil {
+			return errors.Wrap(err, "failed to configure ECR")
 		}
+		provider, err := providers.New(root.params.registry, params.verPat, root.stats, providers.WithECROptions(ecrOptions...))
 		if err != nil {
 			return err
 		}
+		var ok bool
+		if crProvider, ok = provider.(registry.Tagger); !ok {
+			return errors.Errorf("registry of %s does not support tags", root.params.registry)
+		}
+
+		auditLogger, err = root.params.audit.logger(nil)
+		if err != nil {
+			return errors.Wrap(err, "failed to configure audit log")
+		}
 
 		return nil
 	}
@@ -299,7 +368,11 @@ func newTagsCommand(root *regRoot) *cobra.Command {
 		return nil
 	}
 	addTagCmd.RunE = func(cmd *cobra.Command, args []string) error {
-		return crProvider.Add(params.version, params.tags...)
+		if err := crProvider.Add(params.version, params.tags...); err != nil {
+			return err
+		}
+		auditTags(auditLogger, audit.ActionAddTags, root.params.registry+":"+params.version, nil, params.tags)
+		return nil
 	}
 
 	rmTagCmd := &cobra.Command{
@@ -315,7 +388,11 @@ func newTagsCommand(root *regRoot) *cobra.Command {
 		return nil
 	}
 	rmTagCmd.RunE = func(cmd *cobra.Command, args []string) error {
-		return crProvider.Remove(params.tags...)
+		if err := crProvider.Remove(params.tags...); err != nil {
+			return err
+		}
+		auditTags(auditLogger, audit.ActionRemoveTags, root.params.registry, params.tags, nil)
+		return nil
 	}
 
 	getTagCmd := &cobra.Command{
@@ -346,6 +423,23 @@ func newTagsCommand(root *regRoot) *cobra.Command {
 	return cmd
 }
 
+// auditTags records a change of registry tags made with the CLI in the audit log.
+func auditTags(logger audit.Logger, action, target string, old, new []string) {
+	actor := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		actor = u.Username
+	}
+	logger.Log(audit.Entry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		Source: audit.SourceCLI,
+		Action: action,
+		Target: target,
+		Old:    strings.Join(old, ","),
+		New:    strings.Join(new, ","),
+	})
+}
+
 // newCVListCommand is CLI interface to list the current status of KCD resource definitions
 func newCVCommand() *cobra.Command {
 	var k8sConfig string